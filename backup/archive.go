@@ -0,0 +1,303 @@
+// Package backup reads and writes Whalio backup archives.
+//
+// An archive is a gzip-compressed tar file holding a SQLite snapshot of the
+// database, the media directories and, as the last entry, a manifest listing
+// the size and SHA-256 of every other entry:
+//
+//	database.db
+//	files/...
+//	images/...
+//	manifest.json
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+	"whalio/storage"
+)
+
+const (
+	Format  = "whalio-backup"
+	Version = 1
+
+	ManifestName = "manifest.json"
+	DatabaseName = "database.db"
+)
+
+var ErrInvalidArchive = errors.New("invalid backup archive")
+
+type Manifest struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	Files     []File    `json:"files"`
+}
+
+// File is an archive entry, Path uses forward slashes
+type File struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Dir is a store whose blobs are kept in the archive below Name
+type Dir struct {
+	Name    string
+	Storage storage.Storage
+}
+
+// Write writes an archive with the database snapshot at dbPath and every
+// blob in dirs to w. Blobs are hashed while they are written, so each is
+// read exactly once.
+func Write(ctx context.Context, w io.Writer, dbPath string, dirs []Dir) (*Manifest, error) {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	manifest := &Manifest{
+		Format:    Format,
+		Version:   Version,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	db, err := os.Open(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	stat, err := db.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := addFile(tw, manifest, DatabaseName, db, stat.Size(), stat.ModTime()); err != nil {
+		return nil, err
+	}
+
+	for _, dir := range dirs {
+		blobs, err := dir.Storage.List(ctx, "")
+		if err != nil {
+			return nil, fmt.Errorf("failed list %s: %w", dir.Name, err)
+		}
+
+		for _, blob := range blobs {
+			// A blob deleted since it was listed, say by the trash purger,
+			// is left out, its row is gone from the snapshot or soon will be
+			err := addBlob(ctx, tw, manifest, dir, blob)
+			if errors.Is(err, errVanished) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	hdr := &tar.Header{
+		Name:    ManifestName,
+		Mode:    0o644,
+		Size:    int64(len(data)),
+		ModTime: manifest.CreatedAt,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// errVanished is returned by addBlob for a blob that no longer exists,
+// before anything of it is written
+var errVanished = errors.New("blob vanished")
+
+func addBlob(ctx context.Context, tw *tar.Writer, manifest *Manifest, dir Dir, blob storage.Info) error {
+	source, err := dir.Storage.Open(ctx, blob.Key, 0, blob.Size)
+	if errors.Is(err, storage.ErrNotExist) {
+		return errVanished
+	}
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	return addFile(tw, manifest, path.Join(dir.Name, blob.Key), source, blob.Size, blob.ModTime)
+}
+
+func addFile(tw *tar.Writer, manifest *Manifest, name string, source io.Reader, size int64, modTime time.Time) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0o644,
+		Size:    size,
+		ModTime: modTime,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	// Copy exactly the size in the header, the file may grow while we read
+	hash := sha256.New()
+	if _, err := io.CopyN(io.MultiWriter(tw, hash), source, size); err != nil {
+		return fmt.Errorf("failed archive %s: %w", name, err)
+	}
+
+	manifest.Files = append(manifest.Files, File{
+		Path:   name,
+		Size:   size,
+		SHA256: hex.EncodeToString(hash.Sum(nil)),
+	})
+
+	return nil
+}
+
+// Extract unpacks an archive into dir and verifies it against its manifest.
+// Nothing outside dir is touched, so a failed or tampered archive can be
+// discarded by removing dir.
+func Extract(r io.Reader, dir string) (*Manifest, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	extracted := make(map[string]File)
+	var manifest *Manifest
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+		}
+
+		switch {
+		case hdr.Typeflag == tar.TypeDir:
+			continue
+		case hdr.Typeflag != tar.TypeReg:
+			return nil, fmt.Errorf("%w: unexpected entry type for %s", ErrInvalidArchive, hdr.Name)
+		case !filepath.IsLocal(hdr.Name):
+			return nil, fmt.Errorf("%w: unsafe path %s", ErrInvalidArchive, hdr.Name)
+		case hdr.Name == ManifestName:
+			manifest = &Manifest{}
+			if err := json.NewDecoder(io.LimitReader(tr, 64<<20)).Decode(manifest); err != nil {
+				return nil, fmt.Errorf("%w: bad manifest: %v", ErrInvalidArchive, err)
+			}
+			continue
+		}
+
+		file, err := extractFile(tr, filepath.Join(dir, filepath.FromSlash(hdr.Name)))
+		if err != nil {
+			return nil, err
+		}
+		file.Path = hdr.Name
+		extracted[hdr.Name] = file
+	}
+
+	if err := verify(manifest, extracted); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// Stage extracts and verifies an archive into a new directory below parent.
+// The caller owns the returned directory.
+func Stage(r io.Reader, parent string) (string, *Manifest, error) {
+	if err := os.MkdirAll(parent, 0o755); err != nil {
+		return "", nil, err
+	}
+
+	dir, err := os.MkdirTemp(parent, ".whalio-restore-")
+	if err != nil {
+		return "", nil, err
+	}
+
+	manifest, err := Extract(r, dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+
+	return dir, manifest, nil
+}
+
+func extractFile(r io.Reader, dest string) (File, error) {
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return File{}, err
+	}
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return File{}, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+	defer out.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(out, hash), r)
+	if err != nil {
+		return File{}, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+
+	return File{Size: size, SHA256: hex.EncodeToString(hash.Sum(nil))}, out.Close()
+}
+
+func verify(manifest *Manifest, extracted map[string]File) error {
+	switch {
+	case manifest == nil:
+		return fmt.Errorf("%w: missing %s", ErrInvalidArchive, ManifestName)
+	case manifest.Format != Format:
+		return fmt.Errorf("%w: unknown format %q", ErrInvalidArchive, manifest.Format)
+	case manifest.Version < 1 || manifest.Version > Version:
+		return fmt.Errorf("%w: unsupported version %d", ErrInvalidArchive, manifest.Version)
+	}
+
+	listed := make(map[string]bool, len(manifest.Files))
+	for _, want := range manifest.Files {
+		got, ok := extracted[want.Path]
+		if !ok {
+			return fmt.Errorf("%w: missing %s", ErrInvalidArchive, want.Path)
+		}
+		if got.Size != want.Size || got.SHA256 != want.SHA256 {
+			return fmt.Errorf("%w: checksum mismatch for %s", ErrInvalidArchive, want.Path)
+		}
+		listed[want.Path] = true
+	}
+
+	for name := range extracted {
+		if !listed[name] {
+			return fmt.Errorf("%w: %s is not in the manifest", ErrInvalidArchive, name)
+		}
+	}
+
+	if !listed[DatabaseName] {
+		return fmt.Errorf("%w: missing %s", ErrInvalidArchive, DatabaseName)
+	}
+
+	return nil
+}
@@ -0,0 +1,195 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"whalio/storage"
+)
+
+// vanishing lists a blob that is gone by the time it is opened
+type vanishing struct {
+	storage.Storage
+	key string
+}
+
+func (v *vanishing) List(ctx context.Context, prefix string) ([]storage.Info, error) {
+	infos, err := v.Storage.List(ctx, prefix)
+	return append(infos, storage.Info{Key: v.key, Size: 10, ModTime: time.Now()}), err
+}
+
+func newStore(t *testing.T, blobs map[string]string) storage.Storage {
+	t.Helper()
+
+	store := storage.NewMemory()
+	for key, content := range blobs {
+		if err := store.Put(t.Context(), key, strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+func TestWriteAndExtract(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "source.db")
+	if err := os.WriteFile(dbPath, []byte("sqlite"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	media := newStore(t, map[string]string{"songs/ab/abc.mp3": "song"})
+	images := newStore(t, map[string]string{"albums/1.png": "cover"})
+
+	var archive bytes.Buffer
+	written, err := Write(t.Context(), &archive, dbPath, []Dir{
+		{Name: "files", Storage: &vanishing{Storage: media, key: "songs/cd/purged.mp3"}},
+		{Name: "images", Storage: images},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	manifest, err := Extract(&archive, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The purged blob is neither in the manifest nor in the archive
+	var paths []string
+	for _, file := range manifest.Files {
+		paths = append(paths, file.Path)
+	}
+	if want := []string{DatabaseName, "files/songs/ab/abc.mp3", "images/albums/1.png"}; strings.Join(paths, " ") != strings.Join(want, " ") {
+		t.Errorf("manifest lists %v, want %v", paths, want)
+	}
+	if len(written.Files) != len(manifest.Files) {
+		t.Errorf("Write returned %d files, the archive has %d", len(written.Files), len(manifest.Files))
+	}
+	for name, want := range map[string]string{
+		DatabaseName:             "sqlite",
+		"files/songs/ab/abc.mp3": "song",
+		"images/albums/1.png":    "cover",
+	} {
+		got, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil || string(got) != want {
+			t.Errorf("%s = %q, %v, want %q", name, got, err, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "files", "songs", "cd")); err == nil {
+		t.Error("the purged blob was extracted")
+	}
+}
+
+type entry struct {
+	name, content string
+}
+
+// archiveOf returns an archive of entries with a manifest of listed, nil
+// for none
+func archiveOf(t *testing.T, entries []entry, listed []entry) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	add := func(name string, content []byte) {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, e := range entries {
+		add(e.name, []byte(e.content))
+	}
+	if listed != nil {
+		manifest := Manifest{Format: Format, Version: Version, CreatedAt: time.Now()}
+		for _, e := range listed {
+			sum := sha256.Sum256([]byte(e.content))
+			manifest.Files = append(manifest.Files, File{Path: e.name, Size: int64(len(e.content)), SHA256: hex.EncodeToString(sum[:])})
+		}
+		data, err := json.Marshal(manifest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		add(ManifestName, data)
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractRejects(t *testing.T) {
+	db := entry{DatabaseName, "sqlite"}
+	song := entry{"files/songs/ab/abc.mp3", "song"}
+
+	tests := []struct {
+		name    string
+		entries []entry
+		listed  []entry
+	}{
+		{"tampered entry", []entry{db, {song.name, "gnos"}}, []entry{db, song}},
+		{"truncated entry", []entry{db, {song.name, "son"}}, []entry{db, song}},
+		{"unlisted entry", []entry{db, song}, []entry{db}},
+		{"listed entry missing", []entry{db}, []entry{db, song}},
+		{"missing manifest", []entry{db, song}, nil},
+		{"missing database", []entry{song}, []entry{song}},
+		{"unsafe path", []entry{db, {"../escape.mp3", "song"}}, []entry{db, {"../escape.mp3", "song"}}},
+		{"absolute path", []entry{db, {"/tmp/escape.mp3", "song"}}, []entry{db, {"/tmp/escape.mp3", "song"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := t.TempDir()
+			dir, manifest, err := Stage(bytes.NewReader(archiveOf(t, tt.entries, tt.listed)), parent)
+			if !errors.Is(err, ErrInvalidArchive) {
+				t.Fatalf("Stage = %s, %+v, %v, want %v", dir, manifest, err, ErrInvalidArchive)
+			}
+
+			// Nothing is left behind, and nothing written outside
+			if left, _ := os.ReadDir(parent); len(left) != 0 {
+				t.Errorf("left %d entries in %s", len(left), parent)
+			}
+			if _, err := os.Stat(filepath.Join(filepath.Dir(parent), "escape.mp3")); err == nil {
+				t.Error("wrote outside the staging directory")
+			}
+		})
+	}
+
+	if _, err := Extract(strings.NewReader("not gzip"), t.TempDir()); !errors.Is(err, ErrInvalidArchive) {
+		t.Errorf("Extract of garbage = %v, want %v", err, ErrInvalidArchive)
+	}
+}
+
+func TestExtractRejectsUnknownManifest(t *testing.T) {
+	for name, manifest := range map[string]Manifest{
+		"format":  {Format: "other", Version: Version},
+		"version": {Format: Format, Version: Version + 1},
+	} {
+		t.Run(name, func(t *testing.T) {
+			data, err := json.Marshal(manifest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			archive := archiveOf(t, []entry{{ManifestName, string(data)}}, nil)
+			if _, err := Extract(bytes.NewReader(archive), t.TempDir()); !errors.Is(err, ErrInvalidArchive) {
+				t.Errorf("Extract = %v, want %v", err, ErrInvalidArchive)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"whalio/storage"
+)
+
+// Install replaces the database at dbPath and the blobs in dirs with an
+// archive extracted into dir by Extract. The previous database and the
+// directories of local stores are not deleted but renamed by appending
+// suffix; the renamed paths are returned. Other stores get every archived
+// blob written over, blobs missing from the archive are left alone. The
+// database must not be open while installing.
+func Install(ctx context.Context, dir, dbPath string, dirs []Dir, suffix string) ([]string, error) {
+	var setAside []string
+
+	replace := func(src, dest string) error {
+		// Nothing worth keeping in an empty directory, Remove fails for
+		// anything else
+		if info, err := os.Stat(dest); err == nil && info.IsDir() {
+			os.Remove(dest)
+		}
+
+		if _, err := os.Stat(dest); err == nil {
+			if err := os.Rename(dest, dest+suffix); err != nil {
+				return fmt.Errorf("failed move aside %s: %w", dest, err)
+			}
+			setAside = append(setAside, dest+suffix)
+		}
+
+		if err := move(src, dest); err != nil {
+			return fmt.Errorf("failed install %s: %w", dest, err)
+		}
+		return nil
+	}
+
+	if err := replace(filepath.Join(dir, DatabaseName), dbPath); err != nil {
+		return setAside, err
+	}
+
+	for _, d := range dirs {
+		src := filepath.Join(dir, d.Name)
+		if err := os.MkdirAll(src, 0o755); err != nil {
+			return setAside, err
+		}
+
+		var err error
+		if local, ok := d.Storage.(interface{ Root() string }); ok {
+			err = replace(src, local.Root())
+		} else {
+			err = upload(ctx, src, d.Storage)
+		}
+		if err != nil {
+			return setAside, err
+		}
+	}
+
+	return setAside, nil
+}
+
+// upload writes every file below dir to store, keyed by relative path
+func upload(ctx context.Context, dir string, store storage.Storage) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		file, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		return store.Put(ctx, filepath.ToSlash(rel), file)
+	})
+}
+
+// move renames src to dest, copying when they are on different devices
+func move(src, dest string) error {
+	err := os.Rename(src, dest)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		err = os.CopyFS(dest, os.DirFS(src))
+	} else {
+		err = copyFile(src, dest)
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(src)
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dest)
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+	"whalio/config"
+	"whalio/core"
+	"whalio/jobs"
+	"whalio/repository"
+	"whalio/signing"
+	"whalio/storage"
+	"whalio/transcode"
+
+	"github.com/rs/zerolog"
+)
+
+// app holds the services shared by the server and maintenance commands
+type app struct {
+	repo   *repository.Repository
+	queue  *jobs.Queue
+	core   *core.Core
+	signer *signing.Signer // nil without signing key
+}
+
+// newApp opens and migrates the database, sets up the storage backends and
+// wires up the core. Job workers are not started.
+func newApp(cfg *config.Config, logger *zerolog.Logger) (*app, error) {
+	if err := os.MkdirAll(cfg.StaticDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create dir %s: %w", cfg.StaticDir, err)
+	}
+
+	media, images, err := newStorages(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	if media, images, err = encryptStorages(cfg, logger, media, images); err != nil {
+		return nil, err
+	}
+
+	repo, err := repository.Open(logger, cfg.DatabasePath)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info().Msgf("Successfully connected to db: %s", cfg.DatabasePath)
+
+	queue := jobs.NewQueue(logger, repo, jobs.Options{
+		Workers:      cfg.JobWorkers,
+		Timeout:      cfg.JobTimeout,
+		MaxAttempts:  cfg.JobMaxAttempts,
+		PollInterval: 5 * time.Second,
+		RetryBackoff: 10 * time.Second,
+	})
+
+	// Without ffmpeg songs are still played, just not transcoded
+	var transcoder transcode.Transcoder
+	if len(cfg.TranscodeFormats) > 0 {
+		ffmpeg, err := transcode.NewFFmpeg(logger, cfg.FFmpegPath)
+		if err != nil {
+			logger.Warn().Err(err).Msg("Transcoding disabled")
+		} else {
+			transcoder = ffmpeg
+		}
+	}
+
+	signer, err := newSigner(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &app{
+		repo:   repo,
+		queue:  queue,
+		core:   core.NewCore(logger, repo, media, images, queue, transcoder, cfg, 30*time.Second),
+		signer: signer,
+	}, nil
+}
+
+// newStorages returns the stores for song files and for images
+func newStorages(cfg *config.Config, logger *zerolog.Logger) (media, images storage.Storage, err error) {
+	if cfg.StorageBackend == "s3" {
+		s3 := storage.S3Config{
+			Endpoint:  cfg.S3Endpoint,
+			Region:    cfg.S3Region,
+			Bucket:    cfg.S3Bucket,
+			AccessKey: cfg.S3AccessKey,
+			SecretKey: cfg.S3SecretKey,
+			UseSSL:    cfg.S3UseSSL,
+		}
+
+		s3.Prefix = "files/"
+		if media, err = storage.NewS3(logger, s3); err != nil {
+			return nil, nil, err
+		}
+		s3.Prefix = "images/"
+		if images, err = storage.NewS3(logger, s3); err != nil {
+			return nil, nil, err
+		}
+
+		logger.Info().Msgf("Storing media in s3 bucket %s at %s", cfg.S3Bucket, cfg.S3Endpoint)
+		return media, images, nil
+	}
+
+	if media, err = storage.NewLocal(logger, cfg.UploadDir); err != nil {
+		return nil, nil, fmt.Errorf("failed to create dir %s: %w", cfg.UploadDir, err)
+	}
+	if images, err = storage.NewLocal(logger, cfg.ImageDir); err != nil {
+		return nil, nil, fmt.Errorf("failed to create dir %s: %w", cfg.ImageDir, err)
+	}
+
+	return media, images, nil
+}
+
+// encryptStorages wraps both stores to encrypt at rest if a key is
+// configured
+func encryptStorages(cfg *config.Config, logger *zerolog.Logger, media, images storage.Storage) (storage.Storage, storage.Storage, error) {
+	if !cfg.Encrypted() {
+		return media, images, nil
+	}
+
+	keys, err := readKeys(cfg.EncryptionKey, cfg.EncryptionKeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	encMedia, err := storage.NewEncrypted(logger, media, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	encImages, err := storage.NewEncrypted(logger, images, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logger.Info().Int("keys", len(keys)).Msg("Encrypting media at rest")
+	return encMedia, encImages, nil
+}
+
+func (a *app) Close() error {
+	return a.repo.Close()
+}
+
+// newSigner returns the signer of stream and download URLs, nil if no
+// signing key is configured
+func newSigner(cfg *config.Config) (*signing.Signer, error) {
+	if !cfg.Signing() {
+		return nil, nil
+	}
+
+	keys, err := readKeys(cfg.SigningKey, cfg.SigningKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("signing key: %w", err)
+	}
+	return signing.NewSigner(keys)
+}
+
+// readKeys parses the keys given directly or, if file is set, in file
+func readKeys(text, file string) ([][]byte, error) {
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %w", err)
+		}
+		text = string(data)
+	}
+	return storage.ParseKeys(text)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+	"whalio/backup"
+	"whalio/config"
+	"whalio/core"
+	"whalio/repository"
+
+	"github.com/rs/zerolog"
+)
+
+func runBackup(cfg *config.Config, logger *zerolog.Logger, args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return errors.New("usage: whalio backup <archive.tar.gz | ->")
+	}
+
+	a, err := newApp(cfg, logger)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	if positional[0] == "-" {
+		_, err := a.core.Backup(os.Stdout)
+		return err
+	}
+
+	// Write next to the destination and rename, so an interrupted backup
+	// never leaves a truncated archive under the final name
+	dest := positional[0]
+	out, err := os.Create(dest + ".partial")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+
+	manifest, err := a.core.Backup(out)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(out.Name(), dest); err != nil {
+		return err
+	}
+
+	var size int64
+	for _, f := range manifest.Files {
+		size += f.Size
+	}
+	fmt.Printf("Wrote %s: %d files, %d bytes before compression\n", dest, len(manifest.Files), size)
+
+	return nil
+}
+
+func runRestore(cfg *config.Config, logger *zerolog.Logger, args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	merge := fs.Bool("merge", false, "Merge into the existing library instead of replacing it")
+	force := fs.Bool("force", false, "Replace an existing library, it is kept with a .before-restore suffix")
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return errors.New("usage: whalio restore <archive.tar.gz | -> [--merge | --force]")
+	}
+
+	var in io.Reader = os.Stdin
+	if positional[0] != "-" {
+		file, err := os.Open(positional[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+
+	if *merge {
+		return mergeBackup(cfg, logger, in)
+	}
+
+	if err := checkReplace(cfg, logger, *force); err != nil {
+		return err
+	}
+
+	dir, manifest, err := backup.Stage(in, filepath.Dir(cfg.DatabasePath))
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	logger.Info().Time("created_at", manifest.CreatedAt).Int("files", len(manifest.Files)).Msg("Archive verified")
+
+	media, images, err := newStorages(cfg, logger)
+	if err != nil {
+		return err
+	}
+
+	suffix := ".before-restore-" + time.Now().Format("20060102-150405")
+	setAside, err := backup.Install(context.Background(), dir, cfg.DatabasePath, core.BackupDirs(media, images), suffix)
+	for _, path := range setAside {
+		fmt.Printf("Previous data kept at %s\n", path)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Restored backup from %s\n", manifest.CreatedAt.Local().Format(time.RFC1123))
+	return nil
+}
+
+// checkReplace refuses to replace a library that has songs unless forced
+func checkReplace(cfg *config.Config, logger *zerolog.Logger, force bool) error {
+	if _, err := os.Stat(cfg.DatabasePath); errors.Is(err, os.ErrNotExist) || force {
+		return nil
+	}
+
+	repo, err := repository.Open(logger, cfg.DatabasePath)
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+
+	songs, err := repo.CountSongs(context.Background())
+	if err != nil {
+		return err
+	}
+	if songs > 0 {
+		return fmt.Errorf("library already has %d songs, use --merge to combine or --force to replace it", songs)
+	}
+
+	return nil
+}
+
+func mergeBackup(cfg *config.Config, logger *zerolog.Logger, in io.Reader) error {
+	a, err := newApp(cfg, logger)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	dir, manifest, err := a.core.StageBackup(in)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	logger.Info().Time("created_at", manifest.CreatedAt).Int("files", len(manifest.Files)).Msg("Archive verified")
+
+	report, err := a.core.MergeBackup(context.Background(), dir, func(done, total int) {
+		if done%100 == 0 || done == total {
+			logger.Info().Msgf("Merged %d/%d songs", done, total)
+		}
+	})
+	if report != nil {
+		fmt.Printf("Songs:           %d\n", report.Songs)
+		fmt.Printf("Matched:         %d\n", report.Matched)
+		fmt.Printf("Imported:        %d\n", report.Imported)
+		fmt.Printf("Failed:          %d\n", report.Failed)
+		fmt.Printf("Artists created: %d\n", report.ArtistsCreated)
+		fmt.Printf("Albums created:  %d\n", report.AlbumsCreated)
+		fmt.Printf("Playlists:       %d\n", report.Playlists)
+	}
+	if err != nil {
+		return err
+	}
+
+	if report.Imported > 0 {
+		fmt.Println("\nMerged songs are scanned in the background the next time the server runs.")
+	}
+
+	return nil
+}
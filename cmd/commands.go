@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"whalio/config"
+
+	"github.com/rs/zerolog"
+)
+
+// command is a maintenance task run instead of the server, e.g.
+// `whalio import itunes Library.xml --music-root /music`
+type command struct {
+	name  string
+	usage string
+	run   func(cfg *config.Config, logger *zerolog.Logger, args []string) error
+}
+
+var commands = []command{
+	{"import itunes", "<Library.xml> --music-root <dir>", runImportITunes},
+	{"backup", "<archive.tar.gz | ->", runBackup},
+	{"restore", "<archive.tar.gz | -> [--merge | --force]", runRestore},
+	{"migrate media", "", runMigrateMedia},
+	{"fsck", "[--hashes] [--repair[=orphans,missing]]", runFsck},
+	{"rotate-key", "[--dry-run]", runRotateKey},
+}
+
+func runCommand(cfg *config.Config, logger *zerolog.Logger, args []string) error {
+	joined := strings.Join(args, " ")
+	for _, cmd := range commands {
+		if joined == cmd.name || strings.HasPrefix(joined, cmd.name+" ") {
+			return cmd.run(cfg, logger, args[len(strings.Fields(cmd.name)):])
+		}
+	}
+
+	printUsage()
+	return fmt.Errorf("unknown command %q", joined)
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: whalio [flags] [command]")
+	fmt.Fprintln(os.Stderr, "\nWithout a command the web server is started. Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %s %s\n", cmd.name, cmd.usage)
+	}
+	fmt.Fprintln(os.Stderr, "\nFlags:")
+	flag.PrintDefaults()
+}
+
+// parseArgs parses flags that may be mixed with positional arguments and
+// returns the positional ones.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"whalio/config"
+	"whalio/core"
+
+	"github.com/rs/zerolog"
+)
+
+// repairFlag is a bool flag that also takes a list of modes, so both
+// --repair and --repair=orphans work
+type repairFlag struct {
+	repair core.FsckRepair
+}
+
+func (f *repairFlag) String() string   { return "" }
+func (f *repairFlag) IsBoolFlag() bool { return true }
+
+func (f *repairFlag) Set(s string) (err error) {
+	f.repair, err = core.ParseFsckRepair(s)
+	return err
+}
+
+func runFsck(cfg *config.Config, logger *zerolog.Logger, args []string) error {
+	fs := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	hashes := fs.Bool("hashes", false, "Read every song file and compare its hash")
+	var repair repairFlag
+	fs.Var(&repair, "repair", "Fix what can be fixed: orphans, missing or all (the default)")
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return errors.New("usage: whalio fsck [--hashes] [--repair[=orphans,missing]]")
+	}
+
+	a, err := newApp(cfg, logger)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	opts := core.FsckOptions{Hashes: *hashes, Repair: repair.repair}
+	report, err := a.core.Fsck(context.Background(), opts, func(done, total int) {
+		if done%100 == 0 || done == total {
+			logger.Info().Msgf("Checked %d/%d songs", done, total)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, s := range report.MissingSongs {
+		fmt.Printf("missing song     %d %q: %s\n", s.ID, s.Name, s.Key)
+	}
+	for _, s := range report.SizeMismatches {
+		fmt.Printf("size mismatch    %d %q: %s is %s bytes, expected %s\n", s.ID, s.Name, s.Key, s.Actual, s.Expected)
+	}
+	for _, s := range report.HashMismatches {
+		fmt.Printf("hash mismatch    %d %q: %s\n", s.ID, s.Name, s.Key)
+	}
+	for _, i := range report.MissingImages {
+		fmt.Printf("missing image    %s %d %q: %s\n", i.Kind, i.ID, i.Name, i.Key)
+	}
+	for _, b := range report.Orphans {
+		fmt.Printf("orphan           %s %s (%d bytes)\n", b.Store, b.Key, b.Size)
+	}
+	for _, b := range report.Stranded {
+		fmt.Printf("stranded         %s %s (%d bytes)\n", b.Store, b.Key, b.Size)
+	}
+
+	fmt.Printf("Checked %d songs and %d files\n", report.Songs, report.Blobs)
+	if repair.repair != 0 {
+		fmt.Printf("Quarantined:        %d\n", report.Quarantined)
+		fmt.Printf("Restored:           %d\n", report.Restored)
+		fmt.Printf("Marked unavailable: %d\n", report.MarkedUnavailable)
+		fmt.Printf("Marked available:   %d\n", report.MarkedAvailable)
+	}
+	if report.Failed > 0 {
+		return fmt.Errorf("%d checks or repairs failed", report.Failed)
+	}
+	if !report.Clean() && repair.repair == 0 {
+		fmt.Println("Run with --repair to quarantine orphans and mark missing songs unavailable")
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"whalio/config"
+	"whalio/itunes"
+
+	"github.com/rs/zerolog"
+)
+
+func runImportITunes(cfg *config.Config, logger *zerolog.Logger, args []string) error {
+	fs := flag.NewFlagSet("import itunes", flag.ContinueOnError)
+	musicRoot := fs.String("music-root", "", "Directory that replaces the library's iTunes Media folder")
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return errors.New("usage: whalio import itunes <Library.xml> --music-root <dir>")
+	}
+
+	file, err := os.Open(positional[0])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	lib, err := itunes.Parse(file)
+	if err != nil {
+		return err
+	}
+
+	if *musicRoot == "" {
+		logger.Warn().Str("music_folder", lib.MusicFolder).Msg("No --music-root given, using track locations as exported")
+	}
+
+	a, err := newApp(cfg, logger)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	report, err := a.core.ImportITunes(lib, *musicRoot, func(done, total int) {
+		if done%100 == 0 || done == total {
+			logger.Info().Msgf("Processed %d/%d tracks", done, total)
+		}
+	})
+	if report != nil {
+		fmt.Printf("Tracks:          %d\n", report.Tracks)
+		fmt.Printf("Matched:         %d\n", report.Matched)
+		fmt.Printf("Imported:        %d\n", report.Imported)
+		fmt.Printf("Missing files:   %d\n", report.Missing)
+		fmt.Printf("Skipped:         %d\n", report.Skipped)
+		fmt.Printf("Failed:          %d\n", report.Failed)
+		fmt.Printf("Artists created: %d\n", report.ArtistsCreated)
+		fmt.Printf("Albums created:  %d\n", report.AlbumsCreated)
+		fmt.Printf("Playlists:       %d\n", report.Playlists)
+	}
+	if err != nil {
+		return err
+	}
+
+	if report.Imported > 0 {
+		fmt.Println("\nImported songs are scanned in the background the next time the server runs.")
+	}
+
+	return nil
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
@@ -9,19 +11,14 @@ import (
 	"syscall"
 	"time"
 	"whalio/config"
-	"whalio/core"
 	"whalio/handlers"
-	"whalio/models"
-	"whalio/repository"
-	"whalio/storage"
+	"whalio/transcode"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
 	"github.com/go-chi/httplog/v2"
 	"github.com/rs/zerolog"
-	"gorm.io/driver/sqlite"
-	"gorm.io/gorm"
 )
 
 func main() {
@@ -30,37 +27,41 @@ func main() {
 	if err := cfg.Validate(); err != nil {
 		log.Fatalf("Invalid configuration: %v", err)
 	}
+	if err := transcode.CheckFormats(cfg.TranscodeFormats); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
 
 	// Setup logger
 	logger := setupLogger(cfg)
 
-	db, err := gorm.Open(sqlite.Open(cfg.DatabasePath))
-	if err != nil {
-		logger.Error().Msgf("Failed open database: %v", err)
-
+	// Anything left after the flags is a maintenance command
+	if args := flag.Args(); len(args) > 0 {
+		if err := runCommand(cfg, &logger, args); err != nil {
+			fmt.Fprintf(os.Stderr, "whalio %s: %v\n", args[0], err)
+			os.Exit(1)
+		}
 		return
 	}
 
-	if err = db.AutoMigrate(&models.Song{}, &models.Artist{}, &models.Album{}); err != nil {
-		logger.Error().Msgf("Failed make migration: %v", err)
-
-		return
+	app, err := newApp(cfg, &logger)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to initialize application")
 	}
 
-	logger.Info().Msgf("Successfully connected to db: %s", cfg.DatabasePath)
-
-	// Ensure required directories exist
-	if err := os.MkdirAll(cfg.UploadDir, 0o755); err != nil {
-		logger.Fatal().Err(err).Msgf("Failed to create upload dir: %s", cfg.UploadDir)
+	if pending, err := app.core.PendingMediaMigration(); err == nil && pending > 0 {
+		logger.Warn().Int64("songs", pending).Msg("Songs use the old file layout and can't be played, run `whalio migrate media`")
 	}
-	if err := os.MkdirAll(cfg.ImageDir, 0o755); err != nil {
-		logger.Fatal().Err(err).Msgf("Failed to create image dir: %s", cfg.ImageDir)
+
+	// Start background job workers
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	if err := app.queue.Start(jobsCtx); err != nil {
+		logger.Fatal().Err(err).Msg("Failed to start job queue")
 	}
-	if err := os.MkdirAll(cfg.StaticDir, 0o755); err != nil {
-		logger.Fatal().Err(err).Msgf("Failed to create static dir: %s", cfg.StaticDir)
+	go app.core.RunTrashPurger(jobsCtx)
+	if _, err := app.core.BackfillArtwork(); err != nil {
+		logger.Error().Err(err).Msg("Failed to queue artwork processing")
 	}
 
-	core := core.NewCore(repository.NewRepository(&logger, db), storage.NewStorage(&logger), cfg, 30*time.Second)
 	// Create router
 	r := chi.NewRouter()
 
@@ -68,7 +69,7 @@ func main() {
 	setupMiddleware(r, cfg)
 
 	// Initialize handlers
-	h := handlers.New(core)
+	h := handlers.New(app.core, cfg, app.signer)
 
 	// Register routes
 	h.RegisterRoutes(r)
@@ -109,6 +110,10 @@ func main() {
 		logger.Fatal().Err(err).Msg("Server forced to shutdown")
 	}
 
+	// Stop job workers, interrupted jobs are resumed on next start
+	stopJobs()
+	app.queue.Wait()
+
 	logger.Info().Msg("✅ Server exited")
 }
 
@@ -146,8 +151,9 @@ func setupMiddleware(r *chi.Mux, cfg *config.Config) {
 	// Request ID middleware
 	r.Use(middleware.RequestID)
 
-	// Real IP middleware
-	r.Use(middleware.RealIP)
+	// Real IP middleware, for requests through trusted proxies
+	proxies, _ := cfg.Proxies()
+	r.Use(handlers.RealIP(proxies))
 
 	// Logging middleware
 	r.Use(httplog.RequestLogger(httplog.NewLogger("whalio", httplog.Options{
@@ -164,8 +170,8 @@ func setupMiddleware(r *chi.Mux, cfg *config.Config) {
 	// Recoverer middleware
 	r.Use(middleware.Recoverer)
 
-	// Timeout middleware
-	r.Use(middleware.Timeout(30 * time.Second))
+	// Timeout middleware, streams and uploads take as long as they take
+	r.Use(handlers.ExceptLongLived(middleware.Timeout(30 * time.Second)))
 
 	// Compress middleware
 	r.Use(middleware.Compress(5))
@@ -195,9 +201,10 @@ func setupMiddleware(r *chi.Mux, cfg *config.Config) {
 		})
 	})
 
-	// Rate limiting (if enabled)
+	// Rate limiting (if enabled). Streams and uploads are long lived, streams
+	// have limits of their own, they'd soon take up every slot.
 	if cfg.RateLimitEnabled {
-		r.Use(middleware.Throttle(cfg.RateLimit))
+		r.Use(handlers.ExceptLongLived(middleware.Throttle(cfg.RateLimit)))
 	}
 
 	// Development middleware
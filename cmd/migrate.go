@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"whalio/config"
+
+	"github.com/rs/zerolog"
+)
+
+func runMigrateMedia(cfg *config.Config, logger *zerolog.Logger, args []string) error {
+	fs := flag.NewFlagSet("migrate media", flag.ContinueOnError)
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return errors.New("usage: whalio migrate media")
+	}
+
+	a, err := newApp(cfg, logger)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	report, err := a.core.MigrateMediaLayout(context.Background(), func(done, total int) {
+		if done%100 == 0 || done == total {
+			logger.Info().Msgf("Checked %d/%d rows", done, total)
+		}
+	})
+	if report != nil {
+		fmt.Printf("Songs moved:         %d\n", report.Songs)
+		fmt.Printf("Covers moved:        %d\n", report.Covers)
+		fmt.Printf("Artist images moved: %d\n", report.ArtistImages)
+		fmt.Printf("Missing files:       %d\n", report.Missing)
+		fmt.Printf("Failed:              %d\n", report.Failed)
+	}
+
+	return err
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"whalio/config"
+
+	"github.com/rs/zerolog"
+)
+
+func runRotateKey(cfg *config.Config, logger *zerolog.Logger, args []string) error {
+	fs := flag.NewFlagSet("rotate-key", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "Only count the files that would be re-encrypted")
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return errors.New("usage: whalio rotate-key [--dry-run]")
+	}
+
+	a, err := newApp(cfg, logger)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	report, err := a.core.RotateKeys(context.Background(), *dryRun, func(done, total int) {
+		if done%100 == 0 || done == total {
+			logger.Info().Msgf("Checked %d/%d files", done, total)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		fmt.Printf("To re-encrypt: %d of %d files\n", report.Rotated, report.Blobs)
+	} else {
+		fmt.Printf("Re-encrypted: %d of %d files\n", report.Rotated, report.Blobs)
+	}
+	fmt.Printf("Up to date:   %d\n", report.UpToDate)
+	if report.Failed > 0 {
+		return fmt.Errorf("%d files failed, run again once fixed", report.Failed)
+	}
+
+	return nil
+}
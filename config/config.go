@@ -3,9 +3,11 @@ package config
 import (
 	"flag"
 	"fmt"
+	"net/netip"
 	"os"
 	"slices"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -31,15 +33,89 @@ type Config struct {
 	// Static files
 	StaticDir string `json:"static_dir"`
 
+	// Where songs and images are stored: "local" keeps them in UploadDir and
+	// ImageDir, "s3" in a bucket of an S3 compatible object store
+	StorageBackend string `json:"storage_backend"`
+	S3Endpoint     string `json:"s3_endpoint"`
+	S3Region       string `json:"s3_region"`
+	S3Bucket       string `json:"s3_bucket"`
+	S3AccessKey    string `json:"-"`
+	S3SecretKey    string `json:"-"`
+	S3UseSSL       bool   `json:"s3_use_ssl"`
+
+	// Encrypts songs and images at rest when set. Either holds base64
+	// encoded 256 bit keys, the first encrypts new files and the others
+	// are kept for reading files not yet rotated to it.
+	EncryptionKey     string `json:"-"`
+	EncryptionKeyFile string `json:"encryption_key_file"`
+
+	// Signs stream and download URLs when set, in the same format as the
+	// encryption keys: the first signs, the others are still accepted.
+	// With RequireSignedURLs unsigned requests are refused. Links signed
+	// for the player last SignedURLTTL.
+	SigningKey        string        `json:"-"`
+	SigningKeyFile    string        `json:"signing_key_file"`
+	RequireSignedURLs bool          `json:"require_signed_urls"`
+	SignedURLTTL      time.Duration `json:"signed_url_ttl"`
+
+	// Bearer token of administration requests: issuing signed links,
+	// backups, restores and fsck. Without one they are refused.
+	AdminToken string `json:"-"`
+
+	// Upload limits, in bytes per request
+	MaxUploadSize      int64 `json:"max_upload_size"`
+	MaxImageUploadSize int64 `json:"max_image_upload_size"`
+
 	// CORS settings
 	AllowedOrigins []string `json:"allowed_origins"`
 	AllowedMethods []string `json:"allowed_methods"`
 	AllowedHeaders []string `json:"allowed_headers"`
 
-	// Rate limiting
+	// Background jobs
+	JobWorkers     int           `json:"job_workers"`
+	JobTimeout     time.Duration `json:"job_timeout"`
+	JobMaxAttempts int           `json:"job_max_attempts"`
+
+	// Storage quotas in bytes, 0 means unlimited. Uploads that would take
+	// the library, an artist or an album over its quota are refused.
+	StorageQuota int64 `json:"storage_quota"`
+	ArtistQuota  int64 `json:"artist_quota"`
+	AlbumQuota   int64 `json:"album_quota"`
+
+	// Transcoding with ffmpeg for /stream/{id}?format=&bitrate=. Formats
+	// and bitrates (in kbit/s) not listed are refused, no formats turns
+	// transcoding off, formats are checked with transcode.CheckFormats.
+	// Transcodes are cached up to TranscodeCacheSize bytes, the least
+	// recently played are evicted first.
+	FFmpegPath         string   `json:"ffmpeg_path"`
+	TranscodeFormats   []string `json:"transcode_formats"`
+	TranscodeBitrates  []int    `json:"transcode_bitrates"`
+	TranscodeCacheSize int64    `json:"transcode_cache_size"`
+
+	// HLS at /stream/{id}/hls/index.m3u8, one AAC variant per bitrate, no
+	// bitrates turns it off. Segments are transcoded when first asked for
+	// and cached with the other transcodes.
+	HLSBitrates        []int         `json:"hls_bitrates"`
+	HLSSegmentDuration time.Duration `json:"hls_segment_duration"`
+
+	// Deleted items stay in the trash this long, 0 keeps them forever
+	TrashRetention time.Duration `json:"trash_retention"`
+
+	// Rate limiting, RateLimit caps requests in flight except streams
 	RateLimitEnabled bool `json:"rate_limit_enabled"`
 	RateLimit        int  `json:"rate_limit"`
 
+	// Stream limits, 0 for none: concurrent streams per client, and bytes
+	// per second of each stream and of all of them together
+	MaxStreamsPerClient int   `json:"max_streams_per_client"`
+	StreamRateLimit     int64 `json:"stream_rate_limit"`
+	EgressRateLimit     int64 `json:"egress_rate_limit"`
+
+	// Proxies, as addresses or CIDR prefixes, whose X-Forwarded-For and
+	// X-Real-IP headers are believed. Other requests are told apart by
+	// the address they come from.
+	TrustedProxies []string `json:"trusted_proxies"`
+
 	// Logging
 	LogLevel  string `json:"log_level"`
 	LogFormat string `json:"log_format"` // "json" or "console"
@@ -60,6 +136,32 @@ const (
 	DefaultLogFormat    = "console"
 	DefaultRateLimit    = 100
 	DefaultDatabasePath = "database.db"
+
+	DefaultStorageBackend = "local"
+
+	DefaultMaxUploadSize      = 512 << 20
+	DefaultMaxImageUploadSize = 10 << 20
+
+	DefaultJobWorkers     = 2
+	DefaultJobTimeout     = 10 * time.Minute
+	DefaultJobMaxAttempts = 3
+
+	DefaultTrashRetention = 30 * 24 * time.Hour
+
+	DefaultFFmpegPath         = "ffmpeg"
+	DefaultTranscodeCacheSize = 2 << 30
+
+	DefaultHLSSegmentDuration = 6 * time.Second
+
+	DefaultMaxStreamsPerClient = 4
+
+	DefaultSignedURLTTL = 24 * time.Hour
+)
+
+var (
+	DefaultTranscodeFormats  = []string{"opus", "mp3"}
+	DefaultTranscodeBitrates = []int{64, 96, 128, 192, 256, 320}
+	DefaultHLSBitrates       = []int{64, 128, 256}
 )
 
 // Load loads configuration from environment variables and command line flags
@@ -76,10 +178,52 @@ func Load() *Config {
 		DatabasePath:     getEnv("DATABASE_PATH", DefaultDatabasePath),
 		StaticDir:        getEnv("STATIC_DIR", DefaultStaticDir),
 		ImageDir:         getEnv("IMAGE_DIR", DefaultImageDir),
+		MaxUploadSize:    getInt64Env("MAX_UPLOAD_SIZE", DefaultMaxUploadSize),
 		LogLevel:         getEnv("LOG_LEVEL", DefaultLogLevel),
 		LogFormat:        getEnv("LOG_FORMAT", DefaultLogFormat),
 		RateLimitEnabled: getBoolEnv("RATE_LIMIT_ENABLED", true),
 		RateLimit:        getIntEnv("RATE_LIMIT", DefaultRateLimit),
+
+		MaxStreamsPerClient: getIntEnv("MAX_STREAMS_PER_CLIENT", DefaultMaxStreamsPerClient),
+		StreamRateLimit:     getInt64Env("STREAM_RATE_LIMIT", 0),
+		EgressRateLimit:     getInt64Env("EGRESS_RATE_LIMIT", 0),
+		TrustedProxies:      getSliceEnv("TRUSTED_PROXIES", nil),
+
+		MaxImageUploadSize: getInt64Env("MAX_IMAGE_UPLOAD_SIZE", DefaultMaxImageUploadSize),
+
+		JobWorkers: getIntEnv("JOB_WORKERS", DefaultJobWorkers),
+		JobTimeout: getDurationEnv("JOB_TIMEOUT", DefaultJobTimeout),
+
+		TrashRetention: getDurationEnv("TRASH_RETENTION", DefaultTrashRetention),
+		StorageQuota:   getInt64Env("STORAGE_QUOTA", 0),
+		ArtistQuota:    getInt64Env("ARTIST_QUOTA", 0),
+		AlbumQuota:     getInt64Env("ALBUM_QUOTA", 0),
+		JobMaxAttempts: getIntEnv("JOB_MAX_ATTEMPTS", DefaultJobMaxAttempts),
+
+		StorageBackend: getEnv("STORAGE_BACKEND", DefaultStorageBackend),
+		S3Endpoint:     getEnv("S3_ENDPOINT", ""),
+		S3Region:       getEnv("S3_REGION", ""),
+		S3Bucket:       getEnv("S3_BUCKET", ""),
+		S3AccessKey:    getEnv("S3_ACCESS_KEY", ""),
+		S3SecretKey:    getEnv("S3_SECRET_KEY", ""),
+		S3UseSSL:       getBoolEnv("S3_USE_SSL", true),
+
+		EncryptionKey:     getEnv("ENCRYPTION_KEY", ""),
+		EncryptionKeyFile: getEnv("ENCRYPTION_KEY_FILE", ""),
+
+		SigningKey:        getEnv("SIGNING_KEY", ""),
+		SigningKeyFile:    getEnv("SIGNING_KEY_FILE", ""),
+		RequireSignedURLs: getBoolEnv("REQUIRE_SIGNED_URLS", false),
+		SignedURLTTL:      getDurationEnv("SIGNED_URL_TTL", DefaultSignedURLTTL),
+
+		AdminToken: getEnv("ADMIN_TOKEN", ""),
+
+		FFmpegPath:         getEnv("FFMPEG_PATH", DefaultFFmpegPath),
+		TranscodeFormats:   getSliceEnv("TRANSCODE_FORMATS", DefaultTranscodeFormats),
+		TranscodeBitrates:  getIntSliceEnv("TRANSCODE_BITRATES", DefaultTranscodeBitrates),
+		TranscodeCacheSize: getInt64Env("TRANSCODE_CACHE_SIZE", DefaultTranscodeCacheSize),
+		HLSBitrates:        getIntSliceEnv("HLS_BITRATES", DefaultHLSBitrates),
+		HLSSegmentDuration: getDurationEnv("HLS_SEGMENT_DURATION", DefaultHLSSegmentDuration),
 	}
 
 	// Set default CORS settings
@@ -116,6 +260,35 @@ func (c *Config) IsDevelopment() bool {
 	return c.Environment == "development"
 }
 
+// Encrypted returns true if media is encrypted at rest
+func (c *Config) Encrypted() bool {
+	return c.EncryptionKey != "" || c.EncryptionKeyFile != ""
+}
+
+// Signing reports whether a URL signing key is configured
+func (c *Config) Signing() bool {
+	return c.SigningKey != "" || c.SigningKeyFile != ""
+}
+
+// Proxies parses TrustedProxies, single addresses become prefixes of just
+// them
+func (c *Config) Proxies() ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(c.TrustedProxies))
+	for _, value := range c.TrustedProxies {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			ip, ipErr := netip.ParseAddr(value)
+			if ipErr != nil {
+				return nil, err
+			}
+			ip = ip.Unmap()
+			prefix = netip.PrefixFrom(ip, ip.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
 // IsProduction returns true if running in production mode
 func (c *Config) IsProduction() bool {
 	return c.Environment == "production"
@@ -141,6 +314,69 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("invalid log level: %s (valid: %v)", c.LogLevel, validLogLevels)
 	}
 
+	if c.MaxUploadSize <= 0 || c.MaxImageUploadSize <= 0 {
+		return fmt.Errorf("upload size limits must be positive")
+	}
+
+	if c.StorageQuota < 0 || c.ArtistQuota < 0 || c.AlbumQuota < 0 {
+		return fmt.Errorf("storage quotas must not be negative")
+	}
+
+	if c.TrashRetention < 0 {
+		return fmt.Errorf("trash retention must not be negative")
+	}
+
+	if c.JobWorkers < 1 || c.JobMaxAttempts < 1 || c.JobTimeout <= 0 {
+		return fmt.Errorf("job workers, attempts and timeout must be positive")
+	}
+
+	switch c.StorageBackend {
+	case "local":
+	case "s3":
+		if c.S3Endpoint == "" || c.S3Bucket == "" {
+			return fmt.Errorf("s3 storage needs S3_ENDPOINT and S3_BUCKET")
+		}
+	default:
+		return fmt.Errorf("invalid storage backend: %s (valid: local, s3)", c.StorageBackend)
+	}
+
+	for _, bitrate := range slices.Concat(c.TranscodeBitrates, c.HLSBitrates) {
+		if bitrate < 8 || bitrate > 512 {
+			return fmt.Errorf("invalid transcode bitrate: %d (valid: 8 to 512 kbit/s)", bitrate)
+		}
+	}
+	if c.HLSSegmentDuration < time.Second || c.HLSSegmentDuration > time.Minute {
+		return fmt.Errorf("invalid HLS segment duration: %s (valid: 1s to 1m)", c.HLSSegmentDuration)
+	}
+	if len(c.TranscodeFormats) > 0 && len(c.TranscodeBitrates) == 0 {
+		return fmt.Errorf("transcoding needs at least one bitrate")
+	}
+	if c.MaxStreamsPerClient < 0 || c.StreamRateLimit < 0 || c.EgressRateLimit < 0 {
+		return fmt.Errorf("stream limits must not be negative")
+	}
+
+	if _, err := c.Proxies(); err != nil {
+		return fmt.Errorf("invalid trusted proxy: %w", err)
+	}
+
+	if c.TranscodeCacheSize < 0 {
+		return fmt.Errorf("transcode cache size must not be negative")
+	}
+
+	if c.SigningKey != "" && c.SigningKeyFile != "" {
+		return fmt.Errorf("set either SIGNING_KEY or SIGNING_KEY_FILE, not both")
+	}
+	if c.RequireSignedURLs && !c.Signing() {
+		return fmt.Errorf("REQUIRE_SIGNED_URLS needs SIGNING_KEY or SIGNING_KEY_FILE")
+	}
+	if c.SignedURLTTL <= 0 {
+		return fmt.Errorf("signed URL TTL must be positive")
+	}
+
+	if c.EncryptionKey != "" && c.EncryptionKeyFile != "" {
+		return fmt.Errorf("set either ENCRYPTION_KEY or ENCRYPTION_KEY_FILE, not both")
+	}
+
 	// Validate log format
 	if c.LogFormat != "json" && c.LogFormat != "console" {
 		return fmt.Errorf("invalid log format: %s (valid: json, console)", c.LogFormat)
@@ -176,6 +412,15 @@ func getIntEnv(key string, defaultValue int) int {
 	return defaultValue
 }
 
+func getInt64Env(key string, defaultValue int64) int64 {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return parsed
+		}
+	}
+	return defaultValue
+}
+
 func getDurationEnv(key string, defaultValue time.Duration) time.Duration {
 	if value := os.Getenv(key); value != "" {
 		if parsed, err := time.ParseDuration(value); err == nil {
@@ -185,14 +430,40 @@ func getDurationEnv(key string, defaultValue time.Duration) time.Duration {
 	return defaultValue
 }
 
+// getSliceEnv splits a comma separated list, "none" is the empty list
 func getSliceEnv(key string, defaultValue []string) []string {
-	if value := os.Getenv(key); value != "" {
-		// Simple split by comma - in production you might want more sophisticated parsing
-		result := []string{}
-		for _, v := range []string{value} { // Simplified for now
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	result := []string{}
+	if value == "none" {
+		return result
+	}
+	for v := range strings.SplitSeq(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
 			result = append(result, v)
 		}
-		return result
 	}
-	return defaultValue
+	return result
+}
+
+// getIntSliceEnv splits a comma separated list of integers, the default is
+// kept if any is invalid
+func getIntSliceEnv(key string, defaultValue []int) []int {
+	values := getSliceEnv(key, nil)
+	if values == nil {
+		return defaultValue
+	}
+
+	result := make([]int, 0, len(values))
+	for _, v := range values {
+		parsed, err := strconv.Atoi(v)
+		if err != nil {
+			return defaultValue
+		}
+		result = append(result, parsed)
+	}
+	return result
 }
@@ -0,0 +1,286 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"path"
+	"strings"
+	"sync"
+	"time"
+	"whalio/imaging"
+	"whalio/models"
+	"whalio/storage"
+)
+
+var ErrInvalidArtworkKind = errors.New("invalid artwork kind")
+
+// generatedSize is the size of generated artwork and the placeholder
+// when full size is asked for
+const generatedSize = 512
+
+// placeholders caches encoded placeholders by size and format
+var placeholders sync.Map
+
+// Artwork is album or artist artwork ready to be served
+type Artwork struct {
+	io.ReadSeekCloser
+	Format  string
+	ETag    string    // Strong, the same bytes always have the same one
+	Version string    // The ArtworkVersion of the album or artist, empty if it has none
+	ModTime time.Time // Zero for generated artwork
+}
+
+// Artwork returns the image of an album or artist scaled to fit size
+// pixels, one of models.ArtworkSizes or 0 for full size, in format, JPEG,
+// PNG or WebP. An empty format keeps the one of the image's thumbnails.
+// Renderings are cached in image storage as artifacts of the album or
+// artist. Albums without image get their initials, artists a mosaic of
+// their covers. If the image can't be read a placeholder is returned.
+func (c *Core) Artwork(ctx context.Context, kind string, id uint, size int, format string) (*Artwork, error) {
+	size = models.ArtworkSize(size)
+
+	var key, thumbExt string
+	switch kind {
+	case models.OwnerAlbum:
+		album, err := c.repository.GetAlbumByID(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if album.ImagePath == "" {
+			return generatedArtwork(imaging.Initials(album.Name, orGenerated(size)), "initials:"+album.Name, album.ArtworkVersion(), format, imaging.PNG)
+		}
+		key, thumbExt = album.ImagePath, album.ThumbExt
+	case models.OwnerArtist:
+		artist, err := c.repository.GetArtistByID(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if artist.ImagePath == "" {
+			return c.artistArtwork(ctx, artist, size, format)
+		}
+		key, thumbExt = artist.ImagePath, artist.ThumbExt
+	default:
+		return nil, ErrInvalidArtworkKind
+	}
+
+	art, err := c.artwork(ctx, kind, id, key, thumbExt, size, format)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		c.logger.Warn().Err(err).Str("key", key).Msg("failed render artwork, serving placeholder")
+		return placeholderArtwork(size, format)
+	}
+
+	return art, nil
+}
+
+// artistArtwork renders a mosaic of the first covers of an artist without
+// image, just the first cover if there aren't enough for a mosaic, and its
+// initials if there is none
+func (c *Core) artistArtwork(ctx context.Context, artist *models.Artist, size int, format string) (*Artwork, error) {
+	var covers []models.Album
+	for _, album := range artist.Albums {
+		if album.ImagePath != "" {
+			covers = append(covers, album)
+		}
+	}
+	if len(covers) < imaging.MosaicTiles {
+		covers = covers[:min(len(covers), 1)]
+	} else {
+		covers = covers[:imaging.MosaicTiles]
+	}
+
+	tileSize := models.ArtworkSize(orGenerated(size) / 2)
+	if len(covers) == 1 {
+		tileSize = size
+	}
+
+	tiles := make([]image.Image, 0, len(covers))
+	keys := make([]string, 0, len(covers))
+	for _, cover := range covers {
+		tile, err := c.artwork(ctx, models.OwnerAlbum, cover.ID, cover.ImagePath, cover.ThumbExt, tileSize, "")
+		if err != nil {
+			c.logger.Warn().Err(err).Str("key", cover.ImagePath).Msg("failed render mosaic tile")
+			break
+		}
+		img, err := imaging.Decode(tile, c.cfg.MaxImageUploadSize)
+		tile.Close()
+		if err != nil {
+			c.logger.Warn().Err(err).Str("key", cover.ImagePath).Msg("failed decode mosaic tile")
+			break
+		}
+		tiles = append(tiles, img)
+		keys = append(keys, cover.ImagePath)
+	}
+
+	if len(tiles) == 0 || len(tiles) < len(covers) {
+		return generatedArtwork(imaging.Initials(artist.Name, orGenerated(size)), "initials:"+artist.Name, artist.ArtworkVersion(), format, imaging.PNG)
+	}
+	return generatedArtwork(imaging.Mosaic(tiles, orGenerated(size)), "mosaic:"+strings.Join(keys, ","), artist.ArtworkVersion(), format, imaging.JPEG)
+}
+
+// generatedArtwork encodes artwork generated from source, in format or
+// fallback if none is asked for
+func generatedArtwork(img image.Image, source, version, format, fallback string) (*Artwork, error) {
+	if format == "" {
+		format = fallback
+	}
+
+	var buf bytes.Buffer
+	if err := imaging.Encode(&buf, img, format); err != nil {
+		return nil, err
+	}
+
+	return &Artwork{
+		ReadSeekCloser: nopCloser{bytes.NewReader(buf.Bytes())},
+		Format:         format,
+		ETag:           `"` + models.ArtworkVersion(fmt.Sprintf("%s:%d:%s", source, img.Bounds().Dx(), format)) + `"`,
+		Version:        version,
+	}, nil
+}
+
+// orGenerated returns size, or generatedSize for full size
+func orGenerated(size int) int {
+	if size == 0 {
+		return generatedSize
+	}
+	return size
+}
+
+func (c *Core) artwork(ctx context.Context, kind string, id uint, key, thumbExt string, size int, format string) (*Artwork, error) {
+	original := imaging.Format(path.Ext(key))
+	if format == "" {
+		switch {
+		case size == 0:
+			format = original
+		case thumbExt != "":
+			format = imaging.Format(thumbExt)
+		case original == imaging.JPEG:
+			format = imaging.JPEG
+		default:
+			format = imaging.PNG
+		}
+	}
+
+	cacheKey := key
+	if size > 0 || format != original {
+		cacheKey = models.ArtworkKey(key, size, imaging.Ext(format))
+	}
+
+	art := &Artwork{
+		Format:  format,
+		ETag:    `"` + models.ArtworkVersion(cacheKey) + `"`,
+		Version: models.ArtworkVersion(key),
+	}
+
+	cached, info, err := c.OpenImage(ctx, cacheKey)
+	if err == nil {
+		art.ReadSeekCloser = cached
+		art.ModTime = info.ModTime
+		return art, nil
+	}
+	if !errors.Is(err, storage.ErrNotExist) {
+		return nil, err
+	}
+
+	data, err := c.renderArtwork(ctx, key, thumbExt, size, format)
+	if err != nil {
+		return nil, err
+	}
+
+	// A failure to cache only costs rendering it again next time
+	work := c.newUnitOfWork()
+	if err := work.Put(ctx, c.images, cacheKey, bytes.NewReader(data)); err != nil {
+		c.logger.Warn().Err(err).Str("key", cacheKey).Msg("failed cache artwork")
+	} else {
+		err = work.Commit(ctx, func(ctx context.Context) error {
+			return c.repository.SaveArtifacts(ctx, []models.Artifact{{
+				OwnerType:  kind,
+				OwnerID:    id,
+				Kind:       models.ArtifactArtwork,
+				Store:      models.StoreImages,
+				StorageKey: cacheKey,
+				Size:       int64(len(data)),
+			}})
+		}, nil)
+		if err != nil {
+			c.logger.Warn().Err(err).Str("key", cacheKey).Msg("failed cache artwork")
+		}
+	}
+
+	art.ReadSeekCloser = nopCloser{bytes.NewReader(data)}
+	art.ModTime = time.Now()
+	return art, nil
+}
+
+// renderArtwork scales the image at key, starting from the smallest
+// thumbnail large enough
+func (c *Core) renderArtwork(ctx context.Context, key, thumbExt string, size int, format string) ([]byte, error) {
+	source := key
+	if thumbExt != "" && size > 0 {
+		for _, s := range models.ThumbnailSizes {
+			if s >= size {
+				source = models.ThumbnailKey(key, s, thumbExt)
+				break
+			}
+		}
+	}
+
+	reader, err := c.images.Open(ctx, source, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	img, err := imaging.Decode(reader, c.cfg.MaxImageUploadSize)
+	if err != nil {
+		return nil, err
+	}
+
+	scaled := img.Image
+	if size > 0 {
+		scaled = imaging.Thumbnail(img, size)
+	}
+
+	var buf bytes.Buffer
+	if err := imaging.Encode(&buf, scaled, format); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// placeholderArtwork returns the placeholder at size, PNG unless another
+// format is asked for
+func placeholderArtwork(size int, format string) (*Artwork, error) {
+	size = orGenerated(size)
+	if format == "" {
+		format = imaging.PNG
+	}
+
+	name := fmt.Sprintf("placeholder_%d%s", size, imaging.Ext(format))
+	data, ok := placeholders.Load(name)
+	if !ok {
+		var buf bytes.Buffer
+		if err := imaging.Encode(&buf, imaging.Placeholder(size), format); err != nil {
+			return nil, err
+		}
+		data, _ = placeholders.LoadOrStore(name, buf.Bytes())
+	}
+
+	return &Artwork{
+		ReadSeekCloser: nopCloser{bytes.NewReader(data.([]byte))},
+		Format:         format,
+		ETag:           `"` + name + `"`,
+	}, nil
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error { return nil }
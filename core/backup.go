@@ -0,0 +1,382 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"whalio/backup"
+	"whalio/jobs"
+	"whalio/models"
+	"whalio/repository"
+	"whalio/storage"
+
+	"github.com/rs/zerolog"
+)
+
+const JobMergeBackup = "merge_backup"
+
+type mergeBackupPayload struct {
+	Dir string `json:"dir"`
+}
+
+// BackupMergeReport summarises what MergeBackup did.
+type BackupMergeReport struct {
+	Songs          int
+	Matched        int // Already in this library, history merged in
+	Imported       int // Copied from the archive
+	Failed         int
+	ArtistsCreated int
+	AlbumsCreated  int
+	Playlists      int // Created, playlists that already exist are kept
+}
+
+// BackupDirs returns the stores kept in backups, keyed by their directory
+// in the archive.
+func BackupDirs(media, images storage.Storage) []backup.Dir {
+	return []backup.Dir{
+		{Name: "files", Storage: media},
+		{Name: "images", Storage: images},
+	}
+}
+
+// Backup writes a backup archive of the database and all media to w. The
+// database is snapshotted first, so the server can keep running meanwhile.
+func (c *Core) Backup(w io.Writer) (*backup.Manifest, error) {
+	tmp, err := os.MkdirTemp("", "whalio-backup-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	dbPath := filepath.Join(tmp, backup.DatabaseName)
+
+	ctx, cancel := c.context()
+	err = c.repository.Snapshot(ctx, dbPath)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+
+	return backup.Write(context.Background(), w, dbPath, BackupDirs(c.media, c.images))
+}
+
+// StageBackup extracts and verifies an archive into a new directory next to
+// the database. The caller owns the returned directory.
+func (c *Core) StageBackup(r io.Reader) (string, *backup.Manifest, error) {
+	return backup.Stage(r, filepath.Dir(c.cfg.DatabasePath))
+}
+
+// EnqueueMergeBackup merges a staged archive in the background. The staging
+// directory is removed once the merge succeeds, or right away if the job
+// can't be queued.
+func (c *Core) EnqueueMergeBackup(dir string) (*models.Job, error) {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	job, err := c.queue.Enqueue(ctx, JobMergeBackup, mergeBackupPayload{Dir: dir})
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	return job, nil
+}
+
+// MergeBackup adds the songs, artists, albums and playlists of a staged
+// archive to this library. Songs are matched by content hash, then by
+// artist, album and title; matched songs get their listening history merged
+// like ImportITunes does. Merging the same archive twice is safe.
+func (c *Core) MergeBackup(ctx context.Context, dir string, progress func(done, total int)) (*BackupMergeReport, error) {
+	snapshot, err := repository.Open(c.logger, filepath.Join(dir, backup.DatabaseName))
+	if err != nil {
+		return nil, err
+	}
+	defer snapshot.Close()
+
+	// Keys come from the archived database, reading them through stores
+	// keeps a crafted archive from pointing outside the staging dir
+	staged, err := openStagedBackup(c.logger, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	songs, err := snapshot.ListSongs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	playlists, err := snapshot.ListPlaylists(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &BackupMergeReport{Songs: len(songs)}
+	songIDs := make(map[uint]uint, len(songs))
+
+	for i := range songs {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if progress != nil {
+			progress(i, len(songs))
+		}
+
+		src := &songs[i]
+		song, imported, err := c.mergeBackupSong(staged, src, report)
+		if err != nil {
+			report.Failed++
+			c.logger.Warn().Err(err).Uint("song_id", src.ID).Str("name", src.Name).Msg("failed merge backup song")
+			continue
+		}
+
+		if imported {
+			report.Imported++
+		} else {
+			report.Matched++
+		}
+		songIDs[src.ID] = song.ID
+	}
+
+	for _, p := range playlists {
+		created, err := c.mergeBackupPlaylist(&p, songIDs)
+		if err != nil {
+			return report, fmt.Errorf("failed merge playlist %q: %w", p.Name, err)
+		}
+		if created {
+			report.Playlists++
+		}
+	}
+
+	if progress != nil {
+		progress(len(songs), len(songs))
+	}
+
+	return report, nil
+}
+
+func (c *Core) mergeBackupSong(staged *stagedBackup, src *models.Song, report *BackupMergeReport) (*models.Song, bool, error) {
+	song, err := c.findSong(src.Hash, src.Album.Artist.Name, src.Album.Name, src.Name)
+	imported := false
+
+	if errors.Is(err, repository.ErrSongNotFound) {
+		song, err = c.importBackupFile(staged, src, report)
+		imported = true
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	mergeSongHistory(song, src)
+
+	ctx, cancel := c.context()
+	defer cancel()
+
+	if err := c.repository.UpdateSong(ctx, song); err != nil {
+		return nil, false, err
+	}
+
+	return song, imported, nil
+}
+
+func (c *Core) importBackupFile(staged *stagedBackup, src *models.Song, report *BackupMergeReport) (*models.Song, error) {
+	// Archives from before storage keys use the name based layout
+	key := src.StorageKey
+	if key == "" {
+		key = src.LegacyKey()
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+
+	file, err := staged.files.Open(ctx, key, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	artist, created, err := c.ensureArtist(src.Album.Artist.Name)
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		report.ArtistsCreated++
+		if err := c.restoreArtistDetails(staged, artist, &src.Album.Artist); err != nil {
+			return nil, err
+		}
+	}
+
+	album, created, err := c.ensureAlbum(artist, src.Album.Name, src.Album.Year)
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		report.AlbumsCreated++
+		if err := c.restoreAlbumDetails(staged, album, &src.Album); err != nil {
+			return nil, err
+		}
+	}
+
+	song, _, err := c.AddSong(src.Name, src.Filename, src.MimeType, album.ID, file)
+	if err != nil {
+		return nil, err
+	}
+	song.Album = *album
+
+	return song, nil
+}
+
+// restoreArtistDetails copies description and image of an artist created
+// during a merge from its archived counterpart.
+func (c *Core) restoreArtistDetails(staged *stagedBackup, artist, src *models.Artist) error {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	artist.Desc = src.Desc
+
+	work := c.newUnitOfWork()
+	image := &stagedImage{}
+	if src.ImagePath != "" {
+		if archived := c.stageArchivedImage(ctx, work, staged, models.ArtistsKeyDir, src.ImagePath); archived != nil {
+			image = archived
+			artist.Image = image.Image
+		}
+	}
+
+	return work.Commit(ctx,
+		func(ctx context.Context) error { return c.repository.UpdateArtist(ctx, artist, image.thumbs...) },
+		func(ctx context.Context) error {
+			artist.Image = models.Image{}
+			return c.repository.UpdateArtist(ctx, artist)
+		},
+	)
+}
+
+// restoreAlbumDetails copies description and cover of an album created
+// during a merge from its archived counterpart.
+func (c *Core) restoreAlbumDetails(staged *stagedBackup, album, src *models.Album) error {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	album.Description = src.Description
+
+	work := c.newUnitOfWork()
+	image := &stagedImage{}
+	if src.ImagePath != "" {
+		if archived := c.stageArchivedImage(ctx, work, staged, models.CoversKeyDir, src.ImagePath); archived != nil {
+			image = archived
+			album.Image = image.Image
+		}
+	}
+
+	return work.Commit(ctx,
+		func(ctx context.Context) error { return c.repository.UpdateAlbum(ctx, album, image.thumbs...) },
+		func(ctx context.Context) error {
+			album.Image = models.Image{}
+			return c.repository.UpdateAlbum(ctx, album)
+		},
+	)
+}
+
+// stageArchivedImage runs an archived image through the same pipeline as
+// uploads as part of work. A missing or invalid image is logged and
+// skipped, it should not fail the whole merge.
+func (c *Core) stageArchivedImage(ctx context.Context, work *unitOfWork, staged *stagedBackup, dir, src string) *stagedImage {
+	file, err := staged.images.Open(ctx, src, 0, -1)
+	if err != nil {
+		c.logger.Warn().Err(err).Str("key", src).Msg("archived image missing")
+		return nil
+	}
+	defer file.Close()
+
+	image, err := c.stageUploadedImage(ctx, work, dir, file)
+	if err != nil {
+		c.logger.Warn().Err(err).Str("key", src).Msg("failed stage archived image")
+		return nil
+	}
+	return image
+}
+
+// stagedBackup gives access to the blobs of an archive staged by StageBackup
+type stagedBackup struct {
+	files, images storage.Storage
+}
+
+func openStagedBackup(logger *zerolog.Logger, dir string) (*stagedBackup, error) {
+	files, err := storage.NewLocal(logger, filepath.Join(dir, "files"))
+	if err != nil {
+		return nil, err
+	}
+	images, err := storage.NewLocal(logger, filepath.Join(dir, "images"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &stagedBackup{files: files, images: images}, nil
+}
+
+func (c *Core) mergeBackupPlaylist(src *models.Playlist, songIDs map[uint]uint) (bool, error) {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	_, err := c.repository.GetPlaylistByName(ctx, src.Name)
+	if err == nil {
+		return false, nil
+	}
+	if !errors.Is(err, repository.ErrPlaylistNotFound) {
+		return false, err
+	}
+
+	entries := make([]uint, 0, len(src.Entries))
+	for _, e := range src.Entries {
+		if id, ok := songIDs[e.SongID]; ok {
+			entries = append(entries, id)
+		}
+	}
+
+	return true, c.repository.SavePlaylist(ctx, models.NewPlaylist(src.Name), entries)
+}
+
+// mergeSongHistory copies listening history from an archived song without
+// losing anything already recorded here.
+func mergeSongHistory(song, src *models.Song) {
+	song.PlayCount = max(song.PlayCount, src.PlayCount)
+
+	if song.Rating == 0 {
+		song.Rating = src.Rating
+	}
+	if src.LastPlayed != nil && (song.LastPlayed == nil || src.LastPlayed.After(*song.LastPlayed)) {
+		played := *src.LastPlayed
+		song.LastPlayed = &played
+	}
+	if !src.CreatedAt.IsZero() && src.CreatedAt.Before(song.CreatedAt) {
+		song.CreatedAt = src.CreatedAt
+	}
+	if song.TrackNumber == 0 {
+		song.TrackNumber = src.TrackNumber
+	}
+}
+
+// mergeBackup runs MergeBackup for a staged archive uploaded through the API
+func (c *Core) mergeBackup(ctx context.Context, job *models.Job, progress jobs.ProgressFunc) error {
+	var payload mergeBackupPayload
+	if err := jobs.DecodePayload(job, &payload); err != nil {
+		return err
+	}
+
+	report, err := c.MergeBackup(ctx, payload.Dir, func(done, total int) {
+		progress(done*100/max(total, 1), fmt.Sprintf("Merged %d of %d songs", done, total))
+	})
+	if err != nil {
+		return err
+	}
+
+	progress(100, fmt.Sprintf("Imported %d and matched %d songs, %d failed", report.Imported, report.Matched, report.Failed))
+
+	if err := os.RemoveAll(payload.Dir); err != nil {
+		c.logger.Warn().Err(err).Str("dir", payload.Dir).Msg("failed remove staged backup")
+	}
+
+	return nil
+}
@@ -2,30 +2,60 @@ package core
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
-	"os"
-	"path/filepath"
+	"path"
+	"strings"
+	"sync"
 	"time"
 	"whalio/config"
+	"whalio/jobs"
+	"whalio/metadata"
 	"whalio/models"
 	"whalio/repository"
 	"whalio/storage"
+	"whalio/transcode"
+
+	"github.com/rs/zerolog"
 )
 
 type Core struct {
+	logger     *zerolog.Logger
 	repository *repository.Repository
-	storage    *storage.Storage
+	media      storage.Storage // Song files
+	images     storage.Storage // Artist and album images
+	queue      *jobs.Queue
+	transcoder transcode.Transcoder // nil if transcoding is disabled
 	cfg        *config.Config
 	timeout    time.Duration
+
+	flightsMu sync.Mutex
+	flights   map[string]*flight // Running transcodes by key
+
+	quotaMu sync.Mutex // Held while an upload is checked against the quotas and saved
 }
 
-func NewCore(repository *repository.Repository, storage *storage.Storage, cfg *config.Config, timeout time.Duration) *Core {
-	return &Core{
+func NewCore(logger *zerolog.Logger, repository *repository.Repository, media, images storage.Storage, queue *jobs.Queue, transcoder transcode.Transcoder, cfg *config.Config, timeout time.Duration) *Core {
+	c := &Core{
+		logger:     logger,
 		repository: repository,
-		storage:    storage,
+		media:      media,
+		images:     images,
+		queue:      queue,
+		transcoder: transcoder,
 		cfg:        cfg,
 		timeout:    timeout,
+		flights:    make(map[string]*flight),
 	}
+
+	queue.Register(JobScanSong, c.scanSong)
+	queue.Register(JobMergeBackup, c.mergeBackup)
+	queue.Register(JobProcessArtwork, c.processArtwork)
+
+	return c
 }
 
 func (c *Core) context() (context.Context, context.CancelFunc) {
@@ -38,79 +68,201 @@ func (c *Core) CreateArtist(name, desc string, imagesource io.Reader) error {
 
 	artist := models.NewArtist(name, desc)
 
-	artist.ImagePath = artist.GetImageFilepath(c.cfg.ImageDir)
-
-	if err := c.repository.CreateArtist(ctx, artist); err != nil {
-		return err
+	// Without image artwork is generated when asked for
+	work := c.newUnitOfWork()
+	image := &stagedImage{}
+	if imagesource != nil {
+		var err error
+		if image, err = c.stageUploadedImage(ctx, work, models.ArtistsKeyDir, imagesource); err != nil {
+			return err
+		}
+		artist.Image = image.Image
 	}
 
-	return c.storage.SaveFile(imagesource, artist.ImagePath)
+	return work.Commit(ctx,
+		func(ctx context.Context) error { return c.repository.CreateArtist(ctx, artist, image.thumbs...) },
+		func(ctx context.Context) error { return c.repository.PurgeRows(ctx, nil, nil, []uint{artist.ID}) },
+	)
 }
 
-func (c *Core) PlaySong(id uint) (io.ReadSeeker, os.FileInfo, error) {
-	ctx, cancel := c.context()
+// Stream is a song file, or a transcode of one, ready to be served
+type Stream struct {
+	io.ReadSeekCloser
+	Name        string // File name, its extension types the stream
+	ContentType string // Empty to go by Name
+	ETag        string // Strong, empty if the content isn't known
+	ModTime     time.Time
+}
+
+// PlaySong opens the song file for streaming. Reads are served lazily from
+// the storage backend, so seeking to a range only fetches that range. The
+// returned reader is bound to ctx. Its ETag is the content hash.
+func (c *Core) PlaySong(ctx context.Context, id uint) (*Stream, error) {
+	dbCtx, cancel := c.context()
 	defer cancel()
 
-	song, err := c.repository.GetSongByID(ctx, id)
+	song, err := c.repository.GetSongByID(dbCtx, id)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	file, info, err := c.storage.OpenFile(song.Filepath(c.cfg.UploadDir))
+	info, err := c.media.Stat(ctx, song.StorageKey)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	return file, info, nil
+	stream := &Stream{
+		ReadSeekCloser: storage.NewReadSeeker(ctx, c.media, info),
+		Name:           song.Filename,
+		ContentType:    song.MimeType,
+		ModTime:        info.ModTime,
+	}
+	if stream.Name == "" {
+		stream.Name = path.Base(info.Key)
+	}
+	if song.Hash != "" {
+		stream.ETag = `"` + song.Hash + `"`
+	}
+	return stream, nil
 }
 
-func (c *Core) AddSong(name, filename, mimeType string, fileSize int64, albumID uint, source io.Reader) error {
-	ctx, cancel := c.context()
-	defer cancel()
+// OpenImage opens an artist or album image by its storage key
+func (c *Core) OpenImage(ctx context.Context, key string) (io.ReadSeekCloser, storage.Info, error) {
+	info, err := c.images.Stat(ctx, key)
+	if err != nil {
+		return nil, storage.Info{}, err
+	}
 
-	song := models.NewSong(name, filename, mimeType, fileSize, albumID)
+	return storage.NewReadSeeker(ctx, c.images, info), info, nil
+}
 
-	// Get album info for filepath generation
-	album, err := c.repository.GetAlbumByID(ctx, albumID)
+// AddSong streams source into its final location exactly once. The content
+// hash and audio metadata are computed from the same pass via a tee, so the
+// upload never has to be re-read from disk. Slower analysis such as tag
+// parsing runs afterwards in the returned scan job. Uploads that would go
+// over a storage quota fail with ErrQuotaExceeded.
+func (c *Core) AddSong(name, filename, mimeType string, albumID uint, source io.Reader) (*models.Song, *models.Job, error) {
+	song := models.NewSong(name, filename, mimeType, albumID)
+
+	// Make sure the album exists before storing anything. The upload may outlast
+	// c.timeout, so each database call gets its own context.
+	album, err := c.GetAlbum(albumID)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 	song.Album = *album
 
+	quotaCtx, cancel := c.context()
+	left, err := c.quotaLeft(quotaCtx, album)
+	cancel()
+	if err != nil {
+		return nil, nil, err
+	}
+	if left == 0 {
+		return nil, nil, ErrQuotaExceeded
+	}
+	if left > 0 {
+		source = &quotaReader{source: source, left: left}
+	}
+
+	hash := sha256.New()
+	probe := metadata.NewProbe()
+
 	// Save file to storage
-	filePath := song.Filepath(c.cfg.UploadDir)
-	if err := c.storage.SaveFile(source, filePath); err != nil {
-		return err
+	work := c.newUnitOfWork()
+	if err := work.Put(context.Background(), c.media, song.StorageKey, io.TeeReader(source, io.MultiWriter(hash, probe))); err != nil {
+		return nil, nil, err
 	}
 
-	// Create song in database
-	if err := c.repository.CreateSong(ctx, song); err != nil {
-		return err
+	info := probe.Result()
+	song.FileSize = info.Size
+	song.Duration = int(info.Duration.Round(time.Second) / time.Second)
+	song.Hash = hex.EncodeToString(hash.Sum(nil))
+	if info.MimeType != "" {
+		song.MimeType = info.MimeType
 	}
 
-	return nil
+	ctx, cancel := c.context()
+	defer cancel()
+
+	// Create song in database. Other uploads may have been saved while this
+	// one was streaming, so the quota is checked again with its final size.
+	err = work.Commit(ctx,
+		func(ctx context.Context) error {
+			c.quotaMu.Lock()
+			defer c.quotaMu.Unlock()
+			if err := c.checkQuota(ctx, album, song.FileSize); err != nil {
+				return err
+			}
+			return c.repository.CreateSong(ctx, song)
+		},
+		func(ctx context.Context) error { return c.repository.PurgeRows(ctx, []uint{song.ID}, nil, nil) },
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	job, err := c.queue.Enqueue(ctx, JobScanSong, scanSongPayload{SongID: song.ID})
+	if err != nil {
+		c.logger.Error().Err(err).Uint("song_id", song.ID).Msg("failed enqueue song scan")
+		return song, nil, nil
+	}
+
+	return song, job, nil
 }
 
-func (c *Core) ChangeAlbum(songID uint, albumID uint) error {
+// SongUpdate lists the changes to make to a song, nil fields are kept
+type SongUpdate struct {
+	AlbumID     *uint
+	Name        *string
+	TrackNumber *int
+}
+
+var ErrInvalidSongUpdate = errors.New("invalid song update")
+
+// UpdateSong moves a song to another album, renames it or changes its track
+// number. The file is stored under its storage key whatever the song is
+// called or where it belongs, so only the row changes and the update is
+// atomic: it is either saved completely or not at all.
+func (c *Core) UpdateSong(id uint, update SongUpdate) (*models.Song, error) {
 	ctx, cancel := c.context()
 	defer cancel()
 
-	song, err := c.repository.GetSongByID(ctx, songID)
+	song, err := c.repository.GetSongByID(ctx, id)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	path := song.Filepath(c.cfg.UploadDir)
+	if update.Name != nil {
+		name := strings.TrimSpace(*update.Name)
+		if name == "" {
+			return nil, fmt.Errorf("%w: name must not be empty", ErrInvalidSongUpdate)
+		}
+		song.Name = name
+	}
 
-	song.AlbumID = albumID
+	if update.TrackNumber != nil {
+		if *update.TrackNumber < 0 {
+			return nil, fmt.Errorf("%w: track number must not be negative", ErrInvalidSongUpdate)
+		}
+		song.TrackNumber = *update.TrackNumber
+	}
 
-	if err = c.repository.UpdateSong(ctx, song); err != nil {
-		return err
+	if update.AlbumID != nil && *update.AlbumID != song.AlbumID {
+		album, err := c.repository.GetAlbumByID(ctx, *update.AlbumID)
+		if err != nil {
+			return nil, err
+		}
+		album.Songs = nil
+		song.AlbumID = album.ID
+		song.Album = *album
 	}
 
-	newpath := song.Filepath(c.cfg.UploadDir)
+	if err := c.repository.UpdateSong(ctx, song); err != nil {
+		return nil, err
+	}
 
-	return c.storage.RenameFile(newpath, path)
+	return song, nil
 }
 
 func (c *Core) GetSomeAlbums() ([]models.Album, error) {
@@ -159,55 +311,18 @@ func (c *Core) CreateAlbum(name, desc, artistName string, year int, imageSource
 
 	album := models.NewAlbum(name, desc, year, artist.ID)
 
-	album.ImagePath = album.ImageFilepath()
-
-	if err = c.repository.CreateAlbum(ctx, album); err != nil {
-		return err
-	}
-
-	if err = c.storage.SaveFile(imageSource, filepath.Join(c.cfg.ImageDir, album.ImagePath)); err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func (c *Core) DeleteAlbum(id uint) error {
-	ctx, cancel := c.context()
-	defer cancel()
-
-	album, err := c.repository.GetAlbumByID(ctx, id)
-	if err != nil {
-		return err
-	}
-
-	if err = c.repository.DeleteAlbum(ctx, id); err != nil {
-		return err
-	}
-
-	if err = c.storage.DeleteFile(filepath.Join(c.cfg.ImageDir, album.ImagePath)); err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func (c *Core) DeleteArtist(id uint) error {
-	ctx, cancel := c.context()
-	defer cancel()
-
-	artist, err := c.repository.GetArtistByID(ctx, id)
-	if err != nil {
-		return err
-	}
-
-	if err = c.repository.DeleteArtist(ctx, id); err != nil {
-		return err
-	}
-
-	if err = c.storage.DeleteFile(filepath.Join(c.cfg.ImageDir, artist.ImagePath)); err != nil {
-		return err
+	// Without image artwork is generated when asked for
+	work := c.newUnitOfWork()
+	image := &stagedImage{}
+	if imageSource != nil {
+		if image, err = c.stageUploadedImage(ctx, work, models.CoversKeyDir, imageSource); err != nil {
+			return err
+		}
+		album.Image = image.Image
 	}
 
-	return nil
+	return work.Commit(ctx,
+		func(ctx context.Context) error { return c.repository.CreateAlbum(ctx, album, image.thumbs...) },
+		func(ctx context.Context) error { return c.repository.PurgeRows(ctx, nil, []uint{album.ID}, nil) },
+	)
 }
@@ -0,0 +1,67 @@
+package core
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+	"whalio/config"
+	"whalio/jobs"
+	"whalio/repository"
+	"whalio/storage"
+
+	"github.com/rs/zerolog"
+)
+
+// newTestCore returns a core backed by a SQLite database and local storage
+// in a temporary directory. wrap, if given, wraps the image store, to inject
+// faults.
+func newTestCore(t *testing.T, wrap func(storage.Storage) storage.Storage) *Core {
+	t.Helper()
+
+	dir := t.TempDir()
+	cfg := &config.Config{
+		DatabasePath:       filepath.Join(dir, "database.db"),
+		UploadDir:          filepath.Join(dir, "files"),
+		ImageDir:           filepath.Join(dir, "images"),
+		MaxUploadSize:      config.DefaultMaxUploadSize,
+		MaxImageUploadSize: config.DefaultMaxImageUploadSize,
+		TrashRetention:     config.DefaultTrashRetention,
+	}
+
+	logger := zerolog.Nop()
+	media, err := storage.NewLocal(&logger, cfg.UploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var images storage.Storage
+	if images, err = storage.NewLocal(&logger, cfg.ImageDir); err != nil {
+		t.Fatal(err)
+	}
+	if wrap != nil {
+		images = wrap(images)
+	}
+
+	repo, err := repository.Open(&logger, cfg.DatabasePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { repo.Close() })
+
+	queue := jobs.NewQueue(&logger, repo, jobs.Options{Workers: 1, Timeout: time.Minute, MaxAttempts: 1})
+	return NewCore(&logger, repo, media, images, queue, nil, cfg, 10*time.Second)
+}
+
+// listKeys returns the keys of all blobs in store
+func listKeys(t *testing.T, store storage.Storage) []string {
+	t.Helper()
+
+	infos, err := store.List(t.Context(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, info := range infos {
+		keys = append(keys, info.Key)
+	}
+	return keys
+}
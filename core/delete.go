@@ -0,0 +1,115 @@
+package core
+
+import (
+	"context"
+	"whalio/models"
+	"whalio/storage"
+)
+
+// DeletionPlan lists what deleting an album or an artist moves to the trash.
+// Files and Bytes count the files that exist, they are deleted and their
+// space freed when the trash is purged.
+type DeletionPlan struct {
+	Artists int   `json:"artists"`
+	Albums  int   `json:"albums"`
+	Songs   int   `json:"songs"`
+	Files   int   `json:"files"`
+	Bytes   int64 `json:"bytes"`
+}
+
+func (p *DeletionPlan) addBlob(ctx context.Context, store storage.Storage, key string) {
+	if key == "" {
+		return
+	}
+	info, err := store.Stat(ctx, key)
+	if err != nil {
+		return
+	}
+
+	p.Files++
+	p.Bytes += info.Size
+}
+
+func (c *Core) planAlbum(ctx context.Context, plan *DeletionPlan, album *models.Album) {
+	plan.Albums++
+	plan.addBlob(ctx, c.images, album.ImagePath)
+
+	for _, song := range album.Songs {
+		plan.Songs++
+		plan.addBlob(ctx, c.media, song.StorageKey)
+	}
+}
+
+// PlanAlbumDeletion returns what DeleteAlbum would remove
+func (c *Core) PlanAlbumDeletion(id uint) (*DeletionPlan, error) {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	album, err := c.repository.GetAlbumByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &DeletionPlan{}
+	c.planAlbum(ctx, plan, album)
+
+	return plan, nil
+}
+
+// PlanArtistDeletion returns what DeleteArtist would remove
+func (c *Core) PlanArtistDeletion(id uint) (*DeletionPlan, error) {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	artist, err := c.repository.GetArtistByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &DeletionPlan{Artists: 1}
+	plan.addBlob(ctx, c.images, artist.ImagePath)
+	for i := range artist.Albums {
+		c.planAlbum(ctx, plan, &artist.Albums[i])
+	}
+
+	return plan, nil
+}
+
+// DeleteAlbum moves an album with its songs to the trash
+func (c *Core) DeleteAlbum(id uint) (*DeletionPlan, error) {
+	plan, err := c.PlanAlbumDeletion(id)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+
+	return plan, c.repository.DeleteAlbum(ctx, id)
+}
+
+// DeleteArtist moves an artist with all of its albums and their songs to the
+// trash
+func (c *Core) DeleteArtist(id uint) (*DeletionPlan, error) {
+	plan, err := c.PlanArtistDeletion(id)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+
+	return plan, c.repository.DeleteArtist(ctx, id)
+}
+
+// DeleteSong moves a song to the trash
+func (c *Core) DeleteSong(id uint) error {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	if _, err := c.repository.GetSongByID(ctx, id); err != nil {
+		return err
+	}
+
+	return c.repository.DeleteSong(ctx, id)
+}
@@ -0,0 +1,156 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"whalio/models"
+	"whalio/repository"
+	"whalio/storage"
+)
+
+// trashedRows counts the rows in the trash and sums the size of their files
+func trashedRows(t *testing.T, c *Core) DeletionPlan {
+	t.Helper()
+
+	artists, albums, songs, err := c.repository.ListTrash(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := DeletionPlan{Artists: len(artists), Albums: len(albums), Songs: len(songs)}
+	add := func(store storage.Storage, key string) {
+		if key == "" {
+			return
+		}
+		info, err := store.Stat(t.Context(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got.Files++
+		got.Bytes += info.Size
+	}
+	for _, artist := range artists {
+		add(c.images, artist.ImagePath)
+	}
+	for _, album := range albums {
+		add(c.images, album.ImagePath)
+	}
+	for _, song := range songs {
+		add(c.media, song.StorageKey)
+	}
+	return got
+}
+
+func TestDeleteArtist(t *testing.T) {
+	c := newTestCore(t, nil)
+	if err := c.CreateArtist("Artist", "", bytes.NewReader(testPNG(t))); err != nil {
+		t.Fatal(err)
+	}
+	first := createAlbum(t, c, "Artist", "First", bytes.NewReader(testPNG(t)))
+	second := createAlbum(t, c, "Artist", "Second", nil)
+	other := createAlbum(t, c, "Other", "Other", nil)
+	addSong(t, c, first, 100)
+	addSong(t, c, first, 200)
+	addSong(t, c, second, 300)
+	untouched := addSong(t, c, other, 400)
+
+	// A song already in the trash isn't counted again
+	if err := c.DeleteSong(addSong(t, c, second, 500).ID); err != nil {
+		t.Fatal(err)
+	}
+	before := trashedRows(t, c)
+
+	plan, err := c.PlanArtistDeletion(first.ArtistID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Artists != 1 || plan.Albums != 2 || plan.Songs != 3 || plan.Files != 5 {
+		t.Errorf("plan = %+v, want 1 artist, 2 albums, 3 songs and 5 files", *plan)
+	}
+	if got := trashedRows(t, c); got != before {
+		t.Fatalf("planning trashed %+v", got)
+	}
+
+	deleted, err := c.DeleteArtist(first.ArtistID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *deleted != *plan {
+		t.Errorf("deleted %+v, planned %+v", *deleted, *plan)
+	}
+
+	// The plan matches what went to the trash, files stay until it's purged
+	got := trashedRows(t, c)
+	got.Artists -= before.Artists
+	got.Albums -= before.Albums
+	got.Songs -= before.Songs
+	got.Files -= before.Files
+	got.Bytes -= before.Bytes
+	if got != *plan {
+		t.Errorf("trashed %+v, planned %+v", got, *plan)
+	}
+
+	if _, err := c.GetArtist(first.ArtistID); !errors.Is(err, repository.ErrArtistNotFound) {
+		t.Errorf("GetArtist after delete = %v, want %v", err, repository.ErrArtistNotFound)
+	}
+	if _, err := c.GetAlbum(second.ID); !errors.Is(err, repository.ErrAlbumNotFound) {
+		t.Errorf("GetAlbum after delete = %v, want %v", err, repository.ErrAlbumNotFound)
+	}
+	if _, err := c.repository.GetSongByID(t.Context(), untouched.ID); err != nil {
+		t.Errorf("song of another artist: %v", err)
+	}
+
+	if _, err := c.DeleteArtist(first.ArtistID); !errors.Is(err, repository.ErrArtistNotFound) {
+		t.Errorf("deleting again = %v, want %v", err, repository.ErrArtistNotFound)
+	}
+}
+
+func TestDeleteAlbum(t *testing.T) {
+	c := newTestCore(t, nil)
+	album := createAlbum(t, c, "Artist", "Album", bytes.NewReader(testPNG(t)))
+	kept := createAlbum(t, c, "Artist", "Kept", nil)
+	addSong(t, c, album, 100)
+	addSong(t, c, album, 200)
+	addSong(t, c, kept, 300)
+
+	plan, err := c.PlanAlbumDeletion(album.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Artists != 0 || plan.Albums != 1 || plan.Songs != 2 || plan.Files != 3 {
+		t.Errorf("plan = %+v, want 1 album, 2 songs and 3 files", *plan)
+	}
+
+	deleted, err := c.DeleteAlbum(album.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *deleted != *plan {
+		t.Errorf("deleted %+v, planned %+v", *deleted, *plan)
+	}
+	if got := trashedRows(t, c); got != *plan {
+		t.Errorf("trashed %+v, planned %+v", got, *plan)
+	}
+
+	// The artist and its other album are left alone
+	artist, err := c.GetArtist(album.ArtistID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(artist.Albums) != 1 || artist.Albums[0].ID != kept.ID {
+		t.Errorf("artist has albums %v, want only %s", albumNames(artist.Albums), kept.Name)
+	}
+
+	if _, err := c.PlanAlbumDeletion(album.ID); !errors.Is(err, repository.ErrAlbumNotFound) {
+		t.Errorf("planning a trashed album = %v, want %v", err, repository.ErrAlbumNotFound)
+	}
+}
+
+func albumNames(albums []models.Album) []string {
+	names := make([]string, len(albums))
+	for i, album := range albums {
+		names[i] = album.Name
+	}
+	return names
+}
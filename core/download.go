@@ -0,0 +1,222 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"whalio/models"
+	"whalio/storage"
+	"whalio/zipstream"
+)
+
+// ErrEmptyDownload is returned for an album or artist without songs
+var ErrEmptyDownload = errors.New("nothing to download")
+
+// Download is a ZIP archive of an album or an artist's discography, laid
+// out and sized but not read yet
+type Download struct {
+	Name    string // File name of the archive
+	Size    int64
+	ModTime time.Time // Of the newest file
+	entries []zipstream.Entry
+}
+
+// WriteTo streams the archive to w, reading the files as it goes. It fails
+// if a file changed since the download was prepared.
+func (d *Download) WriteTo(ctx context.Context, w io.Writer) error {
+	return zipstream.Write(ctx, w, d.entries)
+}
+
+// AlbumDownload prepares an archive of an album:
+//
+//	01 - Title.flac
+//	02 - Title.mp3
+//	cover.jpg
+//	Album.m3u8
+func (c *Core) AlbumDownload(ctx context.Context, id uint) (*Download, error) {
+	album, err := c.GetAlbum(id)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := c.albumEntries(ctx, album, album.Artist.Name, "")
+	if err != nil {
+		return nil, err
+	}
+	return newDownload(album.Artist.Name+" - "+album.Name, entries)
+}
+
+// ArtistDownload prepares an archive of all albums of an artist, each in
+// its own "Year - Album" folder laid out like AlbumDownload
+func (c *Core) ArtistDownload(ctx context.Context, id uint) (*Download, error) {
+	artist, err := c.GetArtist(id)
+	if err != nil {
+		return nil, err
+	}
+
+	albums := artist.Albums
+	sort.SliceStable(albums, func(i, j int) bool {
+		if albums[i].Year != albums[j].Year {
+			return albums[i].Year < albums[j].Year
+		}
+		return albums[i].ID < albums[j].ID
+	})
+
+	var entries []zipstream.Entry
+	folders := make(map[string]bool)
+	for i := range albums {
+		folder := cleanFileName(albums[i].Name)
+		if albums[i].Year > 0 {
+			folder = fmt.Sprintf("%d - %s", albums[i].Year, folder)
+		}
+		folder = uniqueName(folders, folder, "")
+
+		albumEntries, err := c.albumEntries(ctx, &albums[i], artist.Name, folder+"/")
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, albumEntries...)
+	}
+	return newDownload(artist.Name, entries)
+}
+
+// albumEntries lists the songs of album in track order, its cover and a
+// playlist of the songs, with names starting with prefix. Every file is
+// looked up here, before anything is sent: songs whose file is missing are
+// left out and logged, any other error fails the download while it can
+// still be answered with an error.
+func (c *Core) albumEntries(ctx context.Context, album *models.Album, artistName, prefix string) ([]zipstream.Entry, error) {
+	songs := album.Songs
+	sort.SliceStable(songs, func(i, j int) bool {
+		// Songs without a track number go last
+		a, b := songs[i].TrackNumber, songs[j].TrackNumber
+		if (a > 0) != (b > 0) {
+			return a > 0
+		}
+		if a != b {
+			return a < b
+		}
+		return songs[i].ID < songs[j].ID
+	})
+
+	var entries []zipstream.Entry
+	names := make(map[string]bool)
+	playlist := bytes.NewBufferString("#EXTM3U\n")
+	for i, song := range songs {
+		info, err := c.media.Stat(ctx, song.StorageKey)
+		if errors.Is(err, storage.ErrNotExist) {
+			c.logger.Warn().Uint("song", song.ID).Str("key", song.StorageKey).Msg("Leaving missing song out of download")
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("song %d: %w", song.ID, err)
+		}
+
+		track := song.TrackNumber
+		if track <= 0 {
+			track = i + 1
+		}
+		ext := path.Ext(song.Filename)
+		if ext == "" {
+			ext = path.Ext(song.StorageKey)
+		}
+		name := uniqueName(names, fmt.Sprintf("%02d - %s", track, cleanFileName(song.Name)), strings.ToLower(ext))
+
+		entries = append(entries, blobEntry(c.media, prefix+name, info))
+
+		duration := song.Duration
+		if duration <= 0 {
+			duration = -1 // Unknown
+		}
+		fmt.Fprintf(playlist, "#EXTINF:%d,%s - %s\n%s\n", duration, artistName, song.Name, name)
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	// Missing covers are left out, the songs are what matters
+	if album.ImagePath != "" {
+		if info, err := c.images.Stat(ctx, album.ImagePath); err == nil {
+			entries = append(entries, blobEntry(c.images, prefix+"cover"+path.Ext(album.ImagePath), info))
+		} else {
+			c.logger.Warn().Err(err).Uint("album", album.ID).Msg("Leaving cover out of download")
+		}
+	}
+
+	content := playlist.Bytes()
+	entries = append(entries, zipstream.Entry{
+		Name:     prefix + cleanFileName(album.Name) + ".m3u8",
+		Size:     int64(len(content)),
+		Modified: album.UpdatedAt,
+		Open: func(context.Context) (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(content)), nil
+		},
+	})
+	return entries, nil
+}
+
+// blobEntry is an archive entry named name read from a blob of store
+func blobEntry(store storage.Storage, name string, info storage.Info) zipstream.Entry {
+	return zipstream.Entry{
+		Name:     name,
+		Size:     info.Size,
+		Modified: info.ModTime,
+		Open: func(ctx context.Context) (io.ReadCloser, error) {
+			return store.Open(ctx, info.Key, 0, -1)
+		},
+	}
+}
+
+func newDownload(name string, entries []zipstream.Entry) (*Download, error) {
+	if len(entries) == 0 {
+		return nil, ErrEmptyDownload
+	}
+
+	size, err := zipstream.Size(entries)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Download{Name: cleanFileName(name) + ".zip", Size: size, entries: entries}
+	for _, entry := range entries {
+		if entry.Modified.After(d.ModTime) {
+			d.ModTime = entry.Modified
+		}
+	}
+	return d, nil
+}
+
+// cleanFileName makes name safe as a file name on any system, replacing
+// path separators and characters Windows doesn't allow
+func cleanFileName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < ' ' || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+
+	// Windows also drops trailing dots and spaces
+	name = strings.TrimRight(strings.TrimSpace(name), ". ")
+	if name == "" {
+		return "Untitled"
+	}
+	return name
+}
+
+// uniqueName returns base+ext, numbered if names already has it, and adds
+// it to names
+func uniqueName(names map[string]bool, base, ext string) string {
+	name := base + ext
+	for n := 2; names[strings.ToLower(name)]; n++ {
+		name = fmt.Sprintf("%s (%d)%s", base, n, ext)
+	}
+	names[strings.ToLower(name)] = true
+	return name
+}
@@ -0,0 +1,107 @@
+package core
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"whalio/storage"
+)
+
+// failingStat fails Stat of key with err
+type failingStat struct {
+	storage.Storage
+	key string
+	err error
+}
+
+func (s *failingStat) Stat(ctx context.Context, key string) (storage.Info, error) {
+	if key == s.key {
+		return storage.Info{}, s.err
+	}
+	return s.Storage.Stat(ctx, key)
+}
+
+// writeDownload writes d and returns the names and contents of the files in
+// it, failing if it isn't d.Size bytes
+func writeDownload(t *testing.T, d *Download) map[string]string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := d.WriteTo(t.Context(), &buf); err != nil {
+		t.Fatal(err)
+	}
+	if int64(buf.Len()) != d.Size {
+		t.Fatalf("archive is %d bytes, announced %d", buf.Len(), d.Size)
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, file := range archive.File {
+		r, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[file.Name] = string(content)
+	}
+	return files
+}
+
+func TestAlbumDownloadSkipsMissingSongs(t *testing.T) {
+	c := newTestCore(t, nil)
+	album := createAlbum(t, c, "Artist", "Album", nil)
+	kept := addSong(t, c, album, 100)
+	missing := addSong(t, c, album, 200)
+	if err := c.media.Delete(t.Context(), missing.StorageKey); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := c.AlbumDownload(t.Context(), album.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := writeDownload(t, d)
+
+	if len(files) != 2 || len(files["01 - Song.mp3"]) != 100 {
+		names := make([]string, 0, len(files))
+		for name := range files {
+			names = append(names, name)
+		}
+		t.Fatalf("archive holds %v, want the song left and the playlist", names)
+	}
+	if playlist := files["Album.m3u8"]; strings.Count(playlist, "#EXTINF") != 1 {
+		t.Errorf("playlist lists the missing song:\n%s", playlist)
+	}
+
+	// Without any song left there is nothing to download
+	if err := c.media.Delete(t.Context(), kept.StorageKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.AlbumDownload(t.Context(), album.ID); !errors.Is(err, ErrEmptyDownload) {
+		t.Errorf("AlbumDownload without files = %v, want %v", err, ErrEmptyDownload)
+	}
+}
+
+func TestAlbumDownloadFailsBeforeWriting(t *testing.T) {
+	c := newTestCore(t, nil)
+	album := createAlbum(t, c, "Artist", "Album", nil)
+	addSong(t, c, album, 100)
+	song := addSong(t, c, album, 200)
+
+	// A store that can't be read fails the download while it is prepared
+	c.media = &failingStat{Storage: c.media, key: song.StorageKey, err: errFault}
+	if d, err := c.AlbumDownload(t.Context(), album.ID); !errors.Is(err, errFault) {
+		t.Errorf("AlbumDownload = %v, %v, want %v", d, err, errFault)
+	}
+}
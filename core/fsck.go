@@ -0,0 +1,313 @@
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"whalio/models"
+	"whalio/storage"
+)
+
+// quarantineKeyDir holds blobs fsck moved out of the way, below a dir named
+// after the time of the run
+const quarantineKeyDir = "quarantine"
+
+// fsckGracePeriod protects blobs of uploads that are still in progress,
+// newer blobs are never reported as orphans
+const fsckGracePeriod = time.Hour
+
+// FsckRepair selects what Fsck fixes, the zero value only reports
+type FsckRepair int
+
+const (
+	// RepairOrphans quarantines blobs that no row refers to and moves
+	// stranded staged blobs into place
+	RepairOrphans FsckRepair = 1 << iota
+	// RepairMissing marks songs whose file is missing unavailable, and
+	// available again once the file is back
+	RepairMissing
+
+	RepairAll = RepairOrphans | RepairMissing
+)
+
+// ParseFsckRepair parses a comma separated list of "orphans" and "missing".
+// "all" and "true" select both, "" and "false" neither.
+func ParseFsckRepair(s string) (FsckRepair, error) {
+	var repair FsckRepair
+	for mode := range strings.SplitSeq(s, ",") {
+		switch strings.TrimSpace(mode) {
+		case "", "false":
+		case "all", "true":
+			repair |= RepairAll
+		case "orphans":
+			repair |= RepairOrphans
+		case "missing":
+			repair |= RepairMissing
+		default:
+			return 0, fmt.Errorf("unknown repair mode %q, want orphans, missing or all", mode)
+		}
+	}
+	return repair, nil
+}
+
+type FsckOptions struct {
+	// Hashes reads every song file to compare it with Song.Hash
+	Hashes bool
+	Repair FsckRepair
+}
+
+type FsckSong struct {
+	ID       uint   `json:"id"`
+	Name     string `json:"name"`
+	Key      string `json:"key"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+}
+
+type FsckImage struct {
+	Kind string `json:"kind"` // "album" or "artist"
+	ID   uint   `json:"id"`
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+type FsckBlob struct {
+	Store string `json:"store"` // "media" or "images"
+	Key   string `json:"key"`
+	Size  int64  `json:"size"`
+}
+
+// FsckReport lists every inconsistency between rows and stored blobs
+type FsckReport struct {
+	Songs          int         `json:"songs"`
+	Blobs          int         `json:"blobs"`
+	MissingSongs   []FsckSong  `json:"missingSongs"`
+	SizeMismatches []FsckSong  `json:"sizeMismatches"`
+	HashMismatches []FsckSong  `json:"hashMismatches"`
+	MissingImages  []FsckImage `json:"missingImages"`
+	Orphans        []FsckBlob  `json:"orphans"`
+	// Staged blobs left behind by a crash, see unitOfWork
+	Stranded []FsckBlob `json:"stranded"`
+
+	Quarantined       int `json:"quarantined"`
+	Restored          int `json:"restored"`
+	MarkedUnavailable int `json:"markedUnavailable"`
+	MarkedAvailable   int `json:"markedAvailable"`
+	Failed            int `json:"failed"`
+}
+
+// Clean reports whether nothing is out of order
+func (r *FsckReport) Clean() bool {
+	return len(r.MissingSongs) == 0 && len(r.SizeMismatches) == 0 && len(r.HashMismatches) == 0 &&
+		len(r.MissingImages) == 0 && len(r.Orphans) == 0 && len(r.Stranded) == 0
+}
+
+// Fsck compares the database with the media and image stores. It lists
+// songs whose file is missing or differs in size or hash, albums and
+// artists whose image is missing, blobs no row refers to and staged blobs a
+// crash left behind. With opts.Repair some of those are fixed, orphans are
+// never deleted but moved below quarantine/ in their store. Repairs are
+// refused with ErrMediaMigrationPending until MigrateMediaLayout has run.
+func (c *Core) Fsck(ctx context.Context, opts FsckOptions, progress func(done, total int)) (*FsckReport, error) {
+	report := &FsckReport{
+		MissingSongs:   []FsckSong{},
+		SizeMismatches: []FsckSong{},
+		HashMismatches: []FsckSong{},
+		MissingImages:  []FsckImage{},
+		Orphans:        []FsckBlob{},
+		Stranded:       []FsckBlob{},
+	}
+
+	// Blobs are listed before rows: a blob committed in between then has
+	// its row, and one staged in between is too new to be reported
+	mediaBlobs, err := c.media.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	imageBlobs, err := c.images.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	mediaKeys, imageKeys, err := c.repository.ListStorageKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	songs, err := c.repository.ListSongs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	albums, err := c.repository.ListAlbums(ctx)
+	if err != nil {
+		return nil, err
+	}
+	artists, err := c.repository.ListArtists(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Until the migration has run, files of the old layout look like orphans
+	// and their songs like they are missing
+	if opts.Repair != 0 && migrationPending(songs, albums, artists, blobKeys(mediaBlobs), blobKeys(imageBlobs)) {
+		return nil, ErrMediaMigrationPending
+	}
+
+	report.Songs = len(songs)
+	report.Blobs = len(mediaBlobs) + len(imageBlobs)
+	quarantine := quarantineKeyDir + "/" + time.Now().UTC().Format("20060102-150405")
+
+	c.checkOrphans(ctx, report, "media", c.media, mediaBlobs, mediaKeys, quarantine, opts.Repair)
+	c.checkOrphans(ctx, report, "images", c.images, imageBlobs, imageKeys, quarantine, opts.Repair)
+
+	for i := range songs {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if progress != nil {
+			progress(i, len(songs))
+		}
+		c.checkSong(ctx, report, &songs[i], opts)
+	}
+
+	for _, album := range albums {
+		if album.ImagePath != "" && !c.imageExists(ctx, album.ImagePath) {
+			report.MissingImages = append(report.MissingImages, FsckImage{"album", album.ID, album.Name, album.ImagePath})
+		}
+	}
+	for _, artist := range artists {
+		if artist.ImagePath != "" && !c.imageExists(ctx, artist.ImagePath) {
+			report.MissingImages = append(report.MissingImages, FsckImage{"artist", artist.ID, artist.Name, artist.ImagePath})
+		}
+	}
+
+	if progress != nil {
+		progress(len(songs), len(songs))
+	}
+
+	return report, nil
+}
+
+func blobKeys(blobs []storage.Info) map[string]bool {
+	keys := make(map[string]bool, len(blobs))
+	for _, blob := range blobs {
+		keys[blob.Key] = true
+	}
+	return keys
+}
+
+func (c *Core) imageExists(ctx context.Context, key string) bool {
+	_, err := c.images.Stat(ctx, key)
+	return err == nil
+}
+
+// checkOrphans reports blobs that no key in owned refers to
+func (c *Core) checkOrphans(ctx context.Context, report *FsckReport, name string, store storage.Storage, blobs []storage.Info, owned []string, quarantine string, repair FsckRepair) {
+	keys := make(map[string]bool, len(owned))
+	for _, key := range owned {
+		keys[key] = true
+	}
+	present := blobKeys(blobs)
+
+	cutoff := time.Now().Add(-fsckGracePeriod)
+	for _, blob := range blobs {
+		if keys[blob.Key] || blob.ModTime.After(cutoff) || strings.HasPrefix(blob.Key, quarantineKeyDir+"/") {
+			continue
+		}
+
+		entry := FsckBlob{Store: name, Key: blob.Key, Size: blob.Size}
+
+		if key, ok := strings.CutPrefix(blob.Key, stagingKeyDir+"/"); ok {
+			report.Stranded = append(report.Stranded, entry)
+			if repair&RepairOrphans == 0 {
+				continue
+			}
+			// The row was committed but the move never happened
+			if keys[key] && !present[key] {
+				c.repairBlob(ctx, report, store, blob.Key, key, &report.Restored)
+				present[key] = true
+				continue
+			}
+		} else {
+			report.Orphans = append(report.Orphans, entry)
+			if repair&RepairOrphans == 0 {
+				continue
+			}
+		}
+
+		c.repairBlob(ctx, report, store, blob.Key, quarantine+"/"+blob.Key, &report.Quarantined)
+	}
+}
+
+func (c *Core) repairBlob(ctx context.Context, report *FsckReport, store storage.Storage, src, dest string, counter *int) {
+	if err := store.Move(ctx, src, dest); err != nil {
+		c.logger.Error().Err(err).Str("from", src).Str("to", dest).Msg("failed repair blob")
+		report.Failed++
+		return
+	}
+	*counter++
+}
+
+func (c *Core) checkSong(ctx context.Context, report *FsckReport, song *models.Song, opts FsckOptions) {
+	entry := FsckSong{ID: song.ID, Name: song.Name, Key: song.StorageKey}
+
+	info, err := c.media.Stat(ctx, song.StorageKey)
+	missing := err != nil
+	if missing {
+		report.MissingSongs = append(report.MissingSongs, entry)
+	}
+
+	if opts.Repair&RepairMissing != 0 && missing != song.Unavailable {
+		if err := c.repository.SetSongUnavailable(ctx, song.ID, missing); err != nil {
+			report.Failed++
+		} else if missing {
+			report.MarkedUnavailable++
+		} else {
+			report.MarkedAvailable++
+		}
+	}
+	if missing {
+		return
+	}
+
+	if song.FileSize != 0 && info.Size != song.FileSize {
+		entry.Expected = fmt.Sprint(song.FileSize)
+		entry.Actual = fmt.Sprint(info.Size)
+		report.SizeMismatches = append(report.SizeMismatches, entry)
+		return
+	}
+
+	if !opts.Hashes || song.Hash == "" {
+		return
+	}
+
+	hash, err := c.hashBlob(ctx, song.StorageKey)
+	if err != nil {
+		c.logger.Error().Err(err).Uint("song_id", song.ID).Msg("failed hash song file")
+		report.Failed++
+		return
+	}
+	if hash != song.Hash {
+		entry.Expected = song.Hash
+		entry.Actual = hash
+		report.HashMismatches = append(report.HashMismatches, entry)
+	}
+}
+
+func (c *Core) hashBlob(ctx context.Context, key string) (string, error) {
+	source, err := c.media.Open(ctx, key, 0, -1)
+	if err != nil {
+		return "", err
+	}
+	defer source.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, source); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,155 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"time"
+	"whalio/models"
+	"whalio/storage"
+	"whalio/transcode"
+)
+
+var (
+	ErrHLSDisabled     = errors.New("HLS is disabled")
+	ErrDurationUnknown = errors.New("song duration is unknown")
+	ErrHLSNotFound     = errors.New("no such HLS variant or segment")
+)
+
+// HLSEnabled reports whether songs can be streamed over HLS
+func (c *Core) HLSEnabled() bool {
+	return c.transcoder != nil && len(c.cfg.HLSBitrates) > 0
+}
+
+// HLSMasterPlaylist returns the HLS master playlist of a song, listing a
+// variant for each of the configured HLS bitrates. Query, if not empty, is
+// appended to the URI of every variant.
+func (c *Core) HLSMasterPlaylist(id uint, query string) ([]byte, error) {
+	if _, err := c.hlsSong(id); err != nil {
+		return nil, err
+	}
+	return transcode.MasterPlaylist(c.cfg.HLSBitrates, query), nil
+}
+
+// HLSMediaPlaylist returns the playlist of the segments of a song at
+// bitrate, query is appended to the URI of every segment. Nothing is
+// transcoded until a segment is asked for.
+func (c *Core) HLSMediaPlaylist(id uint, bitrate int, query string) ([]byte, error) {
+	song, err := c.hlsSong(id)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(c.cfg.HLSBitrates, bitrate) {
+		return nil, ErrHLSNotFound
+	}
+	return transcode.MediaPlaylist(songDuration(song), c.cfg.HLSSegmentDuration, query), nil
+}
+
+// HLSSegment opens segment n of a song at bitrate. The first request for
+// a segment of a variant transcodes the whole song in one pass, storing
+// each segment as soon as it is done, so it is served once it is reached.
+// Segments are cached like other transcodes, LRU eviction included, and an
+// evicted one brings the whole variant back.
+func (c *Core) HLSSegment(ctx context.Context, id uint, bitrate, n int) (*Stream, error) {
+	song, err := c.hlsSong(id)
+	if err != nil {
+		return nil, err
+	}
+
+	count := transcode.HLSSegments(songDuration(song), c.cfg.HLSSegmentDuration)
+	if !slices.Contains(c.cfg.HLSBitrates, bitrate) || n < 0 || n >= count {
+		return nil, ErrHLSNotFound
+	}
+
+	key := models.HLSSegmentKey(song.StorageKey, bitrate, transcode.HLSSegmentName(n))
+	variant := models.HLSSegmentKey(song.StorageKey, bitrate, "")
+	stream, err := c.cachedTranscode(ctx, key, transcode.HLSSegmentFormat, variant, func(f *flight) error {
+		return c.segmentHLS(song, bitrate, f)
+	})
+	if errors.Is(err, storage.ErrNotExist) {
+		// The transcode came out shorter than the playlist
+		return nil, ErrHLSNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	stream.ContentType = transcode.HLSSegmentType
+	return stream, nil
+}
+
+// segmentHLS transcodes song into the HLS segments of bitrate. The playlist
+// goes by the duration in whole seconds, whatever the transcoder cuts past
+// its last segment is added to that one.
+func (c *Core) segmentHLS(song *models.Song, bitrate int, f *flight) error {
+	ctx, cancel := context.WithTimeout(context.Background(), transcodeTimeout)
+	defer cancel()
+
+	log := c.logger.With().Uint("song", song.ID).Int("bitrate", bitrate).Logger()
+	log.Info().Msg("segmenting song for HLS")
+	start := time.Now()
+
+	source, err := c.media.Open(ctx, song.StorageKey, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	segment := c.cfg.HLSSegmentDuration
+	last := transcode.HLSSegments(songDuration(song), segment) - 1
+	store := func(n int, r io.Reader) error {
+		key := models.HLSSegmentKey(song.StorageKey, bitrate, transcode.HLSSegmentName(n))
+		if _, err := c.storeTranscode(ctx, song, key, r); err != nil {
+			return err
+		}
+		f.progress()
+		return nil
+	}
+
+	var tail bytes.Buffer
+	opts := transcode.Options{Format: transcode.HLSSegmentFormat, Bitrate: bitrate}
+	err = c.transcoder.Segment(ctx, source, opts, segment, func(n int, r io.Reader) error {
+		if n < last {
+			return store(n, r)
+		}
+		// MPEG-TS segments can simply be concatenated
+		_, err := io.Copy(&tail, r)
+		return err
+	})
+	if err == nil && tail.Len() > 0 {
+		err = store(last, &tail)
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("failed segment song")
+		return err
+	}
+
+	log.Info().Dur("took", time.Since(start)).Msg("segmented song")
+	c.evictTranscodes(ctx)
+	return nil
+}
+
+// hlsSong returns a song that can be streamed over HLS, one whose duration
+// is known
+func (c *Core) hlsSong(id uint) (*models.Song, error) {
+	if !c.HLSEnabled() {
+		return nil, ErrHLSDisabled
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+
+	song, err := c.repository.GetSongByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if song.Duration <= 0 {
+		return nil, ErrDurationUnknown
+	}
+	return song, nil
+}
+
+func songDuration(song *models.Song) time.Duration {
+	return time.Duration(song.Duration) * time.Second
+}
@@ -0,0 +1,132 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"whalio/transcode"
+)
+
+// newHLSCore returns a core segmenting with fake, and a song of content
+// lasting duration
+func newHLSCore(t *testing.T, fake *transcode.Fake, content []byte, duration time.Duration) (*Core, uint) {
+	t.Helper()
+
+	c := newTestCore(t, nil)
+	c.transcoder = fake
+	c.cfg.HLSBitrates = []int{64, 128}
+	c.cfg.HLSSegmentDuration = 6 * time.Second
+
+	if err := c.CreateArtist("Artist", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CreateAlbum("Album", "", "Artist", 2020, nil); err != nil {
+		t.Fatal(err)
+	}
+	song, _, err := c.AddSong("Song", "song.mp3", "audio/mpeg", 1, bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	song.Duration = int(duration.Seconds())
+	if err := c.repository.UpdateSong(t.Context(), song); err != nil {
+		t.Fatal(err)
+	}
+	return c, song.ID
+}
+
+func readSegment(t *testing.T, c *Core, id uint, bitrate, n int) string {
+	t.Helper()
+
+	stream, err := c.HLSSegment(t.Context(), id, bitrate, n)
+	if err != nil {
+		t.Fatalf("segment %d: %v", n, err)
+	}
+	defer stream.Close()
+	if stream.ContentType != transcode.HLSSegmentType {
+		t.Errorf("segment %d is %s", n, stream.ContentType)
+	}
+	data, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestHLSSegmentsInOnePass(t *testing.T) {
+	content := make([]byte, 5000)
+	for i := range content {
+		content[i] = 'a' + byte(i%26)
+	}
+	// 20s make 4 segments of 6s, the fake cuts 5 of 1000 bytes
+	fake := &transcode.Fake{SegmentSize: 1000}
+	c, id := newHLSCore(t, fake, content, 20*time.Second)
+
+	// Players ask for several segments at once
+	segments := make([]string, 4)
+	var wg sync.WaitGroup
+	for n := range segments {
+		wg.Go(func() { segments[n] = readSegment(t, c, id, 128, n) })
+	}
+	wg.Wait()
+
+	if calls := fake.Calls(); len(calls) != 1 {
+		t.Fatalf("segmented %d times, want once: %v", len(calls), calls)
+	}
+
+	// Played back to back the segments are the whole song, the part past
+	// the playlist is in the last segment
+	header := regexp.MustCompile("FAKE aac 128 6s [0-9]+\n")
+	var played strings.Builder
+	for n, segment := range segments {
+		if !header.MatchString(segment) || header.FindStringIndex(segment)[0] != 0 {
+			t.Fatalf("segment %d doesn't start with a header: %.40q", n, segment)
+		}
+		for _, data := range header.Split(segment, -1) {
+			played.WriteString(data)
+		}
+	}
+	if played.String() != string(content) {
+		t.Errorf("segments hold %d bytes of the song, want %d", played.Len(), len(content))
+	}
+	if !strings.Contains(segments[3], "FAKE aac 128 6s 4\n") {
+		t.Errorf("last segment doesn't end the song: %.40q", segments[3])
+	}
+
+	// Cached from now on
+	if got := readSegment(t, c, id, 128, 1); got != segments[1] {
+		t.Errorf("cached segment differs")
+	}
+	readSegment(t, c, id, 64, 0)
+	if calls := fake.Calls(); len(calls) != 2 || calls[1].Bitrate != 64 {
+		t.Errorf("calls = %v, want another for 64 kbit/s", calls)
+	}
+}
+
+func TestHLSSegmentNotFound(t *testing.T) {
+	// The fake makes 2 segments of a song said to last 4
+	c, id := newHLSCore(t, &transcode.Fake{SegmentSize: 3000}, make([]byte, 5000), 20*time.Second)
+
+	tests := []struct {
+		bitrate, n int
+	}{
+		{128, -1},
+		{128, 4},
+		{96, 0}, // Not configured
+		{128, 2},
+		{128, 3},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d/%d", tt.bitrate, tt.n), func(t *testing.T) {
+			if _, err := c.HLSSegment(t.Context(), id, tt.bitrate, tt.n); !errors.Is(err, ErrHLSNotFound) {
+				t.Errorf("err = %v, want %v", err, ErrHLSNotFound)
+			}
+		})
+	}
+	readSegment(t, c, id, 128, 1)
+}
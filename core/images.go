@@ -0,0 +1,186 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"whalio/imaging"
+	"whalio/jobs"
+	"whalio/models"
+)
+
+const JobProcessArtwork = "process_artwork"
+
+// stagedImage is an image staged in a unit of work together with its
+// thumbnails and what was derived from it
+type stagedImage struct {
+	models.Image
+	thumbs []models.Artifact
+}
+
+// stageUploadedImage decodes an image, anything but a valid JPEG, PNG, GIF
+// or WebP image is refused, and stages it below dir in the format it came
+// in, along with a thumbnail for each of models.ThumbnailSizes. Its palette
+// and BlurHash are computed on the way.
+func (c *Core) stageUploadedImage(ctx context.Context, work *unitOfWork, dir string, source io.Reader) (*stagedImage, error) {
+	img, err := imaging.Decode(source, c.cfg.MaxImageUploadSize)
+	if err != nil {
+		return nil, err
+	}
+
+	staged := &stagedImage{Image: models.Image{
+		ImagePath: models.NewStorageKey(dir, imaging.Ext(img.Format)),
+		ImageSize: int64(len(img.Data)),
+		Palette:   strings.Join(imaging.Palette(img), ","),
+		BlurHash:  imaging.BlurHash(img),
+	}}
+	if err := work.Put(ctx, c.images, staged.ImagePath, bytes.NewReader(img.Data)); err != nil {
+		return nil, err
+	}
+
+	if err := c.stageThumbnails(ctx, work, staged, img); err != nil {
+		return nil, err
+	}
+
+	return staged, nil
+}
+
+// stageThumbnails renders and stages the thumbnails of the image at
+// staged.ImagePath
+func (c *Core) stageThumbnails(ctx context.Context, work *unitOfWork, staged *stagedImage, img *imaging.Image) error {
+	format := imaging.ThumbnailFormat(img.Image)
+	staged.ThumbExt = imaging.Ext(format)
+
+	var buf bytes.Buffer
+	for _, size := range models.ThumbnailSizes {
+		buf.Reset()
+		if err := imaging.Encode(&buf, imaging.Thumbnail(img, size), format); err != nil {
+			work.Rollback()
+			return err
+		}
+
+		key := models.ThumbnailKey(staged.ImagePath, size, staged.ThumbExt)
+		thumbSize := int64(buf.Len())
+		if err := work.Put(ctx, c.images, key, &buf); err != nil {
+			return err
+		}
+
+		staged.thumbs = append(staged.thumbs, models.Artifact{
+			Kind:       models.ArtifactThumbnail,
+			Store:      models.StoreImages,
+			StorageKey: key,
+			Size:       thumbSize,
+		})
+	}
+
+	return nil
+}
+
+// own sets the owner of the thumbnails once it is saved
+func (s *stagedImage) own(ownerType string, ownerID uint) {
+	for i := range s.thumbs {
+		s.thumbs[i].OwnerType = ownerType
+		s.thumbs[i].OwnerID = ownerID
+	}
+}
+
+// BackfillArtwork queues a job generating what is missing for images
+// uploaded before thumbnails, palettes or BlurHashes existed. It does nothing if there are none or
+// such a job is already waiting.
+func (c *Core) BackfillArtwork() (*models.Job, error) {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	albums, artists, err := c.repository.ListPendingArtwork(ctx)
+	if err != nil || len(albums)+len(artists) == 0 {
+		return nil, err
+	}
+
+	active, err := c.queue.List(ctx, 100, models.JobQueued, models.JobRunning)
+	if err != nil {
+		return nil, err
+	}
+	for _, job := range active {
+		if job.Kind == JobProcessArtwork {
+			return nil, nil
+		}
+	}
+
+	return c.queue.Enqueue(ctx, JobProcessArtwork, struct{}{})
+}
+
+// processArtwork generates thumbnails, palettes and BlurHashes for every
+// album and artist image missing them. Images that can't be decoded are logged and
+// left alone, they keep being shown full size.
+func (c *Core) processArtwork(ctx context.Context, job *models.Job, progress jobs.ProgressFunc) error {
+	albums, artists, err := c.repository.ListPendingArtwork(ctx)
+	if err != nil {
+		return err
+	}
+
+	total := max(len(albums)+len(artists), 1)
+	done := 0
+	step := func(name string) {
+		progress(done*100/total, "Processing artwork of "+name)
+		done++
+	}
+
+	for _, album := range albums {
+		step(album.Name)
+		c.processImage(ctx, models.OwnerAlbum, album.ID, album.ImagePath, album.ThumbExt)
+	}
+	for _, artist := range artists {
+		step(artist.Name)
+		c.processImage(ctx, models.OwnerArtist, artist.ID, artist.ImagePath, artist.ThumbExt)
+	}
+
+	return ctx.Err()
+}
+
+// processImage derives the palette and BlurHash of an image, and its
+// thumbnails unless it has some already
+func (c *Core) processImage(ctx context.Context, ownerType string, id uint, key, thumbExt string) {
+	log := c.logger.With().Str("owner", ownerType).Uint("id", id).Str("key", key).Logger()
+
+	source, err := c.images.Open(ctx, key, 0, -1)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed open image")
+		return
+	}
+	defer source.Close()
+
+	img, err := imaging.Decode(source, c.cfg.MaxImageUploadSize)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed decode image")
+		return
+	}
+
+	updates := map[string]any{
+		"image_size": int64(len(img.Data)),
+		"palette":    strings.Join(imaging.Palette(img), ","),
+		"blur_hash":  imaging.BlurHash(img),
+	}
+	staged := &stagedImage{Image: models.Image{ImagePath: key}}
+	work := c.newUnitOfWork()
+	if thumbExt == "" {
+		if err := c.stageThumbnails(ctx, work, staged, img); err != nil {
+			log.Error().Err(err).Msg("failed stage thumbnails")
+			return
+		}
+		updates["thumb_ext"] = staged.ThumbExt
+	}
+
+	err = work.Commit(ctx,
+		func(ctx context.Context) error {
+			staged.own(ownerType, id)
+			return c.repository.UpdateImage(ctx, ownerType, id, updates, staged.thumbs...)
+		},
+		func(ctx context.Context) error {
+			return c.repository.UpdateImage(ctx, ownerType, id, map[string]any{"thumb_ext": thumbExt})
+		},
+	)
+	if err != nil {
+		log.Error().Err(err).Msg("failed save artwork")
+	}
+}
@@ -0,0 +1,336 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"whalio/itunes"
+	"whalio/models"
+	"whalio/repository"
+)
+
+const (
+	unknownArtist = "Unknown Artist"
+	unknownAlbum  = "Unknown Album"
+)
+
+// ITunesImportReport summarises what ImportITunes did.
+type ITunesImportReport struct {
+	Tracks         int
+	Matched        int // Already in Whalio, history merged in
+	Imported       int // Copied into Whalio from the music root
+	Missing        int // Neither in Whalio nor found on disk
+	Skipped        int // Podcasts, videos and unsupported formats
+	Failed         int
+	ArtistsCreated int
+	AlbumsCreated  int
+	Playlists      int
+}
+
+// ImportITunes maps the tracks of an iTunes library export onto Whalio songs
+// and carries over play counts, ratings, play dates and date added. Tracks
+// are matched first by artist, album and title, then by file content. Tracks
+// that don't match are imported from musicRoot, creating missing artists and
+// albums. Playlists are created or replaced by name. Running an import twice
+// is safe: play counts are merged by taking the larger value.
+func (c *Core) ImportITunes(lib *itunes.Library, musicRoot string, progress func(done, total int)) (*ITunesImportReport, error) {
+	report := &ITunesImportReport{Tracks: len(lib.Tracks)}
+
+	ids := make([]int64, 0, len(lib.Tracks))
+	for id := range lib.Tracks {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	songIDs := make(map[int64]uint, len(ids))
+
+	for i, id := range ids {
+		if progress != nil {
+			progress(i, len(ids))
+		}
+
+		track := lib.Tracks[id]
+		path := lib.Resolve(track.Location, musicRoot)
+
+		if track.Podcast || track.Video || models.MimeTypeFromExtension(filepath.Ext(path)) == "" {
+			report.Skipped++
+			continue
+		}
+
+		song, imported, err := c.importITunesTrack(track, path, report)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				report.Missing++
+			} else {
+				report.Failed++
+			}
+			c.logger.Warn().Err(err).Int64("track_id", id).Str("path", path).Msg("failed import itunes track")
+			continue
+		}
+
+		if imported {
+			report.Imported++
+		} else {
+			report.Matched++
+		}
+		songIDs[id] = song.ID
+	}
+
+	for _, p := range lib.Playlists {
+		entries := make([]uint, 0, len(p.TrackIDs))
+		for _, id := range p.TrackIDs {
+			if songID, ok := songIDs[id]; ok {
+				entries = append(entries, songID)
+			}
+		}
+
+		if err := c.savePlaylist(p.Name, entries); err != nil {
+			return report, fmt.Errorf("failed import playlist %q: %w", p.Name, err)
+		}
+		report.Playlists++
+	}
+
+	if progress != nil {
+		progress(len(ids), len(ids))
+	}
+
+	return report, nil
+}
+
+// importITunesTrack finds or imports the song for track and merges the
+// iTunes history into it. It reports whether the file had to be imported.
+func (c *Core) importITunesTrack(track *itunes.Track, path string, report *ITunesImportReport) (*models.Song, bool, error) {
+	song, err := c.matchITunesTrack(track, path)
+	imported := false
+
+	if errors.Is(err, repository.ErrSongNotFound) {
+		song, err = c.importITunesFile(track, path, report)
+		imported = true
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	mergeITunesHistory(song, track)
+
+	ctx, cancel := c.context()
+	defer cancel()
+
+	if err := c.repository.UpdateSong(ctx, song); err != nil {
+		return nil, false, err
+	}
+
+	return song, imported, nil
+}
+
+// matchITunesTrack looks track up by artist, album and title. Only a track
+// that matches nothing that way has its file read, to find a song renamed
+// in Whalio by its content.
+func (c *Core) matchITunesTrack(track *itunes.Track, path string) (*models.Song, error) {
+	song, err := c.findSongByTags(itunesArtistName(track), itunesAlbumName(track), itunesTrackName(track, path))
+	if !errors.Is(err, repository.ErrSongNotFound) {
+		return song, err
+	}
+
+	hash, err := hashFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return c.findSongByHash(hash)
+}
+
+// findSong looks a song up by content hash, then by artist, album and title
+func (c *Core) findSong(hash, artistName, albumName, name string) (*models.Song, error) {
+	if hash != "" {
+		song, err := c.findSongByHash(hash)
+		if !errors.Is(err, repository.ErrSongNotFound) {
+			return song, err
+		}
+	}
+
+	return c.findSongByTags(artistName, albumName, name)
+}
+
+func (c *Core) findSongByHash(hash string) (*models.Song, error) {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	return c.repository.FindSongByHash(ctx, hash)
+}
+
+func (c *Core) findSongByTags(artistName, albumName, name string) (*models.Song, error) {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	artist, err := c.repository.GetArtistByName(ctx, artistName)
+	if errors.Is(err, repository.ErrArtistNotFound) {
+		return nil, repository.ErrSongNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	album, err := c.repository.GetAlbumByName(ctx, artist.ID, albumName)
+	if errors.Is(err, repository.ErrAlbumNotFound) {
+		return nil, repository.ErrSongNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return c.repository.FindSongInAlbum(ctx, album.ID, name)
+}
+
+func (c *Core) importITunesFile(track *itunes.Track, path string, report *ITunesImportReport) (*models.Song, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	artist, created, err := c.ensureArtist(itunesArtistName(track))
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		report.ArtistsCreated++
+	}
+
+	album, created, err := c.ensureAlbum(artist, itunesAlbumName(track), track.Year)
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		report.AlbumsCreated++
+	}
+
+	filename := filepath.Base(path)
+	mimeType := models.MimeTypeFromExtension(filepath.Ext(filename))
+
+	song, _, err := c.AddSong(itunesTrackName(track, path), filename, mimeType, album.ID, file)
+	if err != nil {
+		return nil, err
+	}
+	song.Album = *album
+
+	return song, nil
+}
+
+// ensureArtist returns the named artist, creating it without an image if
+// needed. It reports whether the artist was created.
+func (c *Core) ensureArtist(name string) (*models.Artist, bool, error) {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	artist, err := c.repository.GetArtistByName(ctx, name)
+	if !errors.Is(err, repository.ErrArtistNotFound) {
+		return artist, false, err
+	}
+
+	artist = models.NewArtist(name, "")
+	if err := c.repository.CreateArtist(ctx, artist); err != nil {
+		return nil, false, err
+	}
+
+	return artist, true, nil
+}
+
+// ensureAlbum returns the named album of artist, creating it without a
+// cover if needed. It reports whether the album was created.
+func (c *Core) ensureAlbum(artist *models.Artist, name string, year int) (*models.Album, bool, error) {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	album, err := c.repository.GetAlbumByName(ctx, artist.ID, name)
+	created := false
+	if errors.Is(err, repository.ErrAlbumNotFound) {
+		album = models.NewAlbum(name, "", year, artist.ID)
+		err = c.repository.CreateAlbum(ctx, album)
+		created = true
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	album.Artist = *artist
+
+	return album, created, nil
+}
+
+func (c *Core) savePlaylist(name string, songIDs []uint) error {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	playlist, err := c.repository.GetPlaylistByName(ctx, name)
+	if errors.Is(err, repository.ErrPlaylistNotFound) {
+		playlist = models.NewPlaylist(name)
+	} else if err != nil {
+		return err
+	}
+
+	return c.repository.SavePlaylist(ctx, playlist, songIDs)
+}
+
+// mergeITunesHistory copies listening history onto song without losing
+// anything already recorded in Whalio.
+func mergeITunesHistory(song *models.Song, track *itunes.Track) {
+	song.PlayCount = max(song.PlayCount, track.PlayCount)
+
+	if stars := track.Stars(); stars > 0 {
+		song.Rating = stars
+	}
+	if !track.PlayDate.IsZero() && (song.LastPlayed == nil || track.PlayDate.After(*song.LastPlayed)) {
+		played := track.PlayDate
+		song.LastPlayed = &played
+	}
+	if !track.DateAdded.IsZero() && track.DateAdded.Before(song.CreatedAt) {
+		song.CreatedAt = track.DateAdded
+	}
+	if song.TrackNumber == 0 {
+		song.TrackNumber = track.TrackNumber
+	}
+}
+
+func itunesArtistName(track *itunes.Track) string {
+	switch {
+	case track.AlbumArtist != "":
+		return track.AlbumArtist
+	case track.Artist != "":
+		return track.Artist
+	}
+	return unknownArtist
+}
+
+func itunesAlbumName(track *itunes.Track) string {
+	if track.Album != "" {
+		return track.Album
+	}
+	return unknownAlbum
+}
+
+func itunesTrackName(track *itunes.Track, path string) string {
+	if track.Name != "" {
+		return track.Name
+	}
+	base := filepath.Base(path)
+	return base[:len(base)-len(filepath.Ext(base))]
+}
+
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,183 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"whalio/itunes"
+	"whalio/models"
+)
+
+func TestImportITunes(t *testing.T) {
+	c := newTestCore(t, nil)
+	root := t.TempDir()
+	for name, content := range map[string]string{
+		"Music/Artist/Album/01 One.mp3": "first song",
+		"Music/Artist/Album/02 Two.mp3": "second song",
+	} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	added := time.Date(2010, 5, 4, 10, 0, 0, 0, time.UTC)
+	played := time.Date(2024, 2, 29, 22, 15, 0, 0, time.UTC)
+	location := func(name string) string {
+		return filepath.FromSlash("/Users/me/Music/Media/Music/Artist/Album/" + name)
+	}
+	newLibrary := func() *itunes.Library {
+		return &itunes.Library{
+			MusicFolder: filepath.FromSlash("/Users/me/Music/Media"),
+			Tracks: map[int64]*itunes.Track{
+				1: {ID: 1, Name: "One", Artist: "Artist", Album: "Album", TrackNumber: 1, PlayCount: 5, Rating: 80,
+					DateAdded: added, PlayDate: played, Location: location("01 One.mp3")},
+				2: {ID: 2, Name: "Two", Artist: "Artist", Album: "Album", TrackNumber: 2, Location: location("02 Two.mp3")},
+				3: {ID: 3, Name: "Episode", Podcast: true, Location: location("episode.mp3")},
+				4: {ID: 4, Name: "Gone", Artist: "Artist", Album: "Album", Location: location("04 Gone.mp3")},
+			},
+			Playlists: []itunes.Playlist{{ID: 10, Name: "Mix", TrackIDs: []int64{2, 1, 4}}},
+		}
+	}
+
+	songs := func() map[string]models.Song {
+		t.Helper()
+		list, err := c.repository.ListSongs(t.Context())
+		if err != nil {
+			t.Fatal(err)
+		}
+		byName := make(map[string]models.Song)
+		for _, song := range list {
+			if _, ok := byName[song.Name]; ok {
+				t.Errorf("%s imported twice", song.Name)
+			}
+			byName[song.Name] = song
+		}
+		return byName
+	}
+	importLibrary := func(lib *itunes.Library, want ITunesImportReport) {
+		t.Helper()
+		report, err := c.ImportITunes(lib, root, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *report != want {
+			t.Errorf("report = %+v, want %+v", *report, want)
+		}
+	}
+
+	importLibrary(newLibrary(), ITunesImportReport{
+		Tracks: 4, Imported: 2, Missing: 1, Skipped: 1, ArtistsCreated: 1, AlbumsCreated: 1, Playlists: 1,
+	})
+
+	got := songs()
+	one, two := got["One"], got["Two"]
+	if len(got) != 2 || one.ID == 0 || two.ID == 0 {
+		t.Fatalf("imported %v, want One and Two", got)
+	}
+	if one.PlayCount != 5 || one.Rating != 4 || one.TrackNumber != 1 ||
+		one.LastPlayed == nil || !one.LastPlayed.Equal(played) || !one.CreatedAt.Equal(added) {
+		t.Errorf("history not carried over: %+v", one)
+	}
+
+	playlist, err := c.repository.GetPlaylistByName(t.Context(), "Mix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(playlist.Entries) != 2 || playlist.Entries[0].SongID != two.ID || playlist.Entries[1].SongID != one.ID {
+		t.Errorf("playlist entries = %+v, want Two then One", playlist.Entries)
+	}
+
+	// A second export with fewer plays but a later one is merged into the
+	// same songs
+	lib := newLibrary()
+	later := played.Add(24 * time.Hour)
+	lib.Tracks[1].PlayCount = 3
+	lib.Tracks[1].PlayDate = later
+	lib.Tracks[1].Rating = 0
+	importLibrary(lib, ITunesImportReport{Tracks: 4, Matched: 2, Missing: 1, Skipped: 1, Playlists: 1})
+
+	got = songs()
+	if len(got) != 2 || got["One"].ID != one.ID || got["Two"].ID != two.ID {
+		t.Fatalf("second import gave %v, want the same two songs", got)
+	}
+	if one := got["One"]; one.PlayCount != 5 || one.Rating != 4 || one.LastPlayed == nil || !one.LastPlayed.Equal(later) {
+		t.Errorf("history not merged: play count %d, rating %d, last played %v", one.PlayCount, one.Rating, one.LastPlayed)
+	}
+
+	// A song renamed in Whalio is found by its content
+	renamed := "Renamed"
+	if _, err := c.UpdateSong(two.ID, SongUpdate{Name: &renamed}); err != nil {
+		t.Fatal(err)
+	}
+	importLibrary(newLibrary(), ITunesImportReport{Tracks: 4, Matched: 2, Missing: 1, Skipped: 1, Playlists: 1})
+	if got = songs(); len(got) != 2 || got["Renamed"].ID != two.ID {
+		t.Errorf("renamed song imported again: %v", got)
+	}
+
+	// Matching by tags doesn't need the file
+	if err := os.Remove(filepath.Join(root, "Music", "Artist", "Album", "01 One.mp3")); err != nil {
+		t.Fatal(err)
+	}
+	importLibrary(newLibrary(), ITunesImportReport{Tracks: 4, Matched: 2, Missing: 1, Skipped: 1, Playlists: 1})
+}
+
+func TestMergeITunesHistory(t *testing.T) {
+	early := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	late := early.Add(time.Hour)
+
+	tests := []struct {
+		name  string
+		song  models.Song
+		track itunes.Track
+		want  models.Song
+	}{
+		{
+			"fills an empty song",
+			models.Song{},
+			itunes.Track{PlayCount: 3, Rating: 100, PlayDate: early, TrackNumber: 4},
+			models.Song{PlayCount: 3, Rating: 5, LastPlayed: &early, TrackNumber: 4},
+		},
+		{
+			"keeps higher counts and later plays",
+			models.Song{PlayCount: 10, Rating: 2, LastPlayed: &late, TrackNumber: 1},
+			itunes.Track{PlayCount: 3, Rating: 0, PlayDate: early, TrackNumber: 4},
+			models.Song{PlayCount: 10, Rating: 2, LastPlayed: &late, TrackNumber: 1},
+		},
+		{
+			"takes higher counts and later plays",
+			models.Song{PlayCount: 1, Rating: 2, LastPlayed: &early},
+			itunes.Track{PlayCount: 3, Rating: 60, PlayDate: late},
+			models.Song{PlayCount: 3, Rating: 3, LastPlayed: &late},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			song := tt.song
+			mergeITunesHistory(&song, &tt.track)
+			if song.PlayCount != tt.want.PlayCount || song.Rating != tt.want.Rating || song.TrackNumber != tt.want.TrackNumber {
+				t.Errorf("got %d plays, %d stars, track %d, want %d, %d and %d",
+					song.PlayCount, song.Rating, song.TrackNumber, tt.want.PlayCount, tt.want.Rating, tt.want.TrackNumber)
+			}
+			if (song.LastPlayed == nil) != (tt.want.LastPlayed == nil) || song.LastPlayed != nil && !song.LastPlayed.Equal(*tt.want.LastPlayed) {
+				t.Errorf("last played %v, want %v", song.LastPlayed, tt.want.LastPlayed)
+			}
+		})
+	}
+
+	// Date added only moves back
+	song := models.Song{}
+	song.CreatedAt = late
+	mergeITunesHistory(&song, &itunes.Track{DateAdded: early})
+	if !song.CreatedAt.Equal(early) {
+		t.Errorf("created %v, want the earlier %v", song.CreatedAt, early)
+	}
+	mergeITunesHistory(&song, &itunes.Track{DateAdded: late})
+	if !song.CreatedAt.Equal(early) {
+		t.Errorf("created %v, want it kept at %v", song.CreatedAt, early)
+	}
+}
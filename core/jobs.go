@@ -0,0 +1,81 @@
+package core
+
+import (
+	"context"
+	"whalio/jobs"
+	"whalio/metadata"
+	"whalio/models"
+)
+
+const JobScanSong = "scan_song"
+
+type scanSongPayload struct {
+	SongID uint `json:"song_id"`
+}
+
+// GetJob returns the current state of a background job
+func (c *Core) GetJob(id uint) (*models.Job, error) {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	return c.queue.Get(ctx, id)
+}
+
+// ListJobs returns recent jobs in any of the given statuses
+func (c *Core) ListJobs(limit int, statuses ...models.JobStatus) ([]models.Job, error) {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	return c.queue.List(ctx, limit, statuses...)
+}
+
+// SubscribeJob streams progress events for a job until the returned func is called
+func (c *Core) SubscribeJob(id uint) (<-chan jobs.Event, func()) {
+	return c.queue.Subscribe(id)
+}
+
+// scanSong reads the whole audio file to parse its tags and measure its
+// exact duration, then updates the song's duration and, if it has none, its
+// track number.
+func (c *Core) scanSong(ctx context.Context, job *models.Job, progress jobs.ProgressFunc) error {
+	var payload scanSongPayload
+	if err := jobs.DecodePayload(job, &payload); err != nil {
+		return err
+	}
+
+	song, err := c.repository.GetSongByID(ctx, payload.SongID)
+	if err != nil {
+		return err
+	}
+
+	info, err := c.media.Stat(ctx, song.StorageKey)
+	if err != nil {
+		return err
+	}
+
+	file, err := c.media.Open(ctx, song.StorageKey, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	progress(0, "Scanning "+song.Name)
+
+	size := max(info.Size, 1)
+	lastPercent := 0
+	result, tags, err := metadata.Scan(file, func(read int64) {
+		if percent := int(read * 95 / size); percent > lastPercent {
+			lastPercent = percent
+			progress(percent, "Scanning "+song.Name)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	progress(98, "Saving "+song.Name)
+
+	// The song may have been edited meanwhile, only the scanned columns are
+	// saved and a track number set by hand wins over the tag
+	return c.repository.UpdateSongScan(ctx, song.ID, int(result.Duration.Seconds()+0.5), tags.Track)
+}
@@ -0,0 +1,198 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"strings"
+	"whalio/models"
+	"whalio/storage"
+)
+
+// MediaMigrationReport summarises what MigrateMediaLayout did.
+type MediaMigrationReport struct {
+	Songs        int // Song files moved
+	Covers       int // Album covers moved
+	ArtistImages int // Artist images moved
+	Missing      int // Rows whose file wasn't found under any known name
+	Failed       int
+}
+
+// PendingMediaMigration returns the number of songs that are still stored
+// under the name based layout.
+func (c *Core) PendingMediaMigration() (int64, error) {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	return c.repository.CountSongsWithoutStorageKey(ctx)
+}
+
+// ErrMediaMigrationPending is returned by Fsck when asked to repair a
+// library some of whose files MigrateMediaLayout hasn't moved yet. No row
+// refers to them by their name, so they would be quarantined as orphans.
+var ErrMediaMigrationPending = errors.New("media files use the old layout, run `whalio migrate media` first")
+
+// Where files were stored before storage keys, in the order relocate tries
+// them
+func songLegacyKeys(song *models.Song) []string { return []string{song.LegacyKey()} }
+
+func albumLegacyKeys(album *models.Album) []string {
+	return []string{album.ImagePath, album.LegacyImageKey()}
+}
+
+func artistLegacyKeys(artist *models.Artist) []string {
+	// Before storage keys the image dir was part of the stored path
+	return []string{artist.ImagePath, filepath.Base(artist.ImagePath), artist.LegacyImageKey()}
+}
+
+// migrationPending reports whether MigrateMediaLayout would move any file,
+// going by the listed keys of each store rather than asking it per row. An
+// interrupted run leaves rows with a key whose file is still at a legacy
+// key, those count as well.
+func migrationPending(songs []models.Song, albums []models.Album, artists []models.Artist, media, images map[string]bool) bool {
+	for i := range songs {
+		if awaitsMigration(media, songs[i].StorageKey, models.SongsKeyDir, songLegacyKeys(&songs[i])) {
+			return true
+		}
+	}
+	for i := range albums {
+		if awaitsMigration(images, albums[i].ImagePath, models.CoversKeyDir, albumLegacyKeys(&albums[i])) {
+			return true
+		}
+	}
+	for i := range artists {
+		if awaitsMigration(images, artists[i].ImagePath, models.ArtistsKeyDir, artistLegacyKeys(&artists[i])) {
+			return true
+		}
+	}
+	return false
+}
+
+// awaitsMigration is the check relocate makes before moving a file
+func awaitsMigration(present map[string]bool, key, dir string, legacy []string) bool {
+	if strings.HasPrefix(key, dir+"/") && present[key] {
+		return false
+	}
+	if dir != models.SongsKeyDir && key == "" {
+		return false
+	}
+	return slices.ContainsFunc(legacy, func(candidate string) bool {
+		return candidate != "" && !strings.HasPrefix(candidate, dir+"/") && present[candidate]
+	})
+}
+
+// MigrateMediaLayout moves files stored under the old name based layout to
+// storage keys. The new key is saved on the row before the file is moved, so
+// an interrupted run can simply be repeated.
+func (c *Core) MigrateMediaLayout(ctx context.Context, progress func(done, total int)) (*MediaMigrationReport, error) {
+	report := &MediaMigrationReport{}
+
+	songs, err := c.repository.ListSongs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	albums, err := c.repository.ListAlbums(ctx)
+	if err != nil {
+		return nil, err
+	}
+	artists, err := c.repository.ListArtists(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	total := len(songs) + len(albums) + len(artists)
+	done := 0
+	step := func() {
+		done++
+		if progress != nil {
+			progress(done, total)
+		}
+	}
+
+	for i := range songs {
+		song := &songs[i]
+		moved, err := c.relocate(ctx, c.media, &song.StorageKey, models.SongsKeyDir, filepath.Ext(song.Filename),
+			func() error { return c.repository.UpdateSong(ctx, song) },
+			songLegacyKeys(song)...)
+		report.count(&report.Songs, moved, err)
+		step()
+	}
+
+	for i := range albums {
+		album := &albums[i]
+		album.Songs = nil
+		moved, err := c.relocate(ctx, c.images, &album.ImagePath, models.CoversKeyDir, ".png",
+			func() error { return c.repository.UpdateAlbum(ctx, album) },
+			albumLegacyKeys(album)...)
+		report.count(&report.Covers, moved, err)
+		step()
+	}
+
+	for i := range artists {
+		artist := &artists[i]
+		moved, err := c.relocate(ctx, c.images, &artist.ImagePath, models.ArtistsKeyDir, ".png",
+			func() error { return c.repository.UpdateArtist(ctx, artist) },
+			artistLegacyKeys(artist)...)
+		report.count(&report.ArtistImages, moved, err)
+		step()
+	}
+
+	return report, ctx.Err()
+}
+
+var errMediaMissing = errors.New("media file not found")
+
+func (r *MediaMigrationReport) count(moved *int, ok bool, err error) {
+	switch {
+	case errors.Is(err, errMediaMissing):
+		r.Missing++
+	case err != nil:
+		r.Failed++
+	case ok:
+		*moved++
+	}
+}
+
+// relocate moves the first of the legacy keys that exists to a new storage
+// key below dir, saving the key first. Rows that already have a key below
+// dir with an existing file are left alone, as are rows with no image.
+func (c *Core) relocate(ctx context.Context, store storage.Storage, key *string, dir, ext string, save func() error, legacy ...string) (bool, error) {
+	hasKey := strings.HasPrefix(*key, dir+"/")
+	if hasKey {
+		if _, err := store.Stat(ctx, *key); err == nil {
+			return false, nil
+		}
+	} else if dir != models.SongsKeyDir && *key == "" {
+		return false, nil
+	}
+
+	var from string
+	for _, candidate := range legacy {
+		if candidate == "" || strings.HasPrefix(candidate, dir+"/") {
+			continue
+		}
+		if _, err := store.Stat(ctx, candidate); err == nil {
+			from = candidate
+			break
+		}
+	}
+	if from == "" {
+		c.logger.Warn().Str("key", *key).Strs("legacy", legacy).Msg("media file not found for migration")
+		return false, errMediaMissing
+	}
+
+	if !hasKey {
+		*key = models.NewStorageKey(dir, ext)
+		if err := save(); err != nil {
+			return false, err
+		}
+	}
+
+	if err := store.Move(ctx, from, *key); err != nil {
+		c.logger.Error().Err(err).Str("from", from).Str("to", *key).Msg("failed move media file")
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,262 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"whalio/models"
+	"whalio/storage"
+)
+
+// legacyLibrary is a library whose files were stored before storage keys
+type legacyLibrary struct {
+	song   *models.Song
+	album  *models.Album
+	artist *models.Artist
+}
+
+// Contents of the legacy files
+const (
+	legacySong   = "song"
+	legacyCover  = "cover"
+	legacyArtist = "artist"
+)
+
+// newLegacyLibrary adds a song, cover and artist image named the way they
+// were before storage keys. The artist image path still has the image dir
+// in it, as it had then.
+func newLegacyLibrary(t *testing.T, c *Core) *legacyLibrary {
+	t.Helper()
+	ctx := t.Context()
+
+	album := createAlbum(t, c, "Artist", "Album", nil)
+	song := &models.Song{Name: "Song", Filename: "song.mp3", MimeType: "audio/mpeg", AlbumID: album.ID}
+	if err := c.repository.CreateSong(ctx, song); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.repository.UpdateImage(ctx, models.OwnerAlbum, album.ID, map[string]any{"image_path": album.LegacyImageKey()}); err != nil {
+		t.Fatal(err)
+	}
+	artist, err := c.GetArtist(album.ArtistID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.repository.UpdateImage(ctx, models.OwnerArtist, artist.ID, map[string]any{"image_path": "images/" + artist.LegacyImageKey()}); err != nil {
+		t.Fatal(err)
+	}
+
+	song.Album = *album
+	song.Album.Artist = *artist
+	for store, blobs := range map[storage.Storage]map[string]string{
+		c.media:  {song.LegacyKey(): legacySong},
+		c.images: {album.LegacyImageKey(): legacyCover, artist.LegacyImageKey(): legacyArtist},
+	} {
+		for key, content := range blobs {
+			if err := store.Put(ctx, key, strings.NewReader(content)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	return &legacyLibrary{song: song, album: album, artist: artist}
+}
+
+// ageBlobs backdates every file below the store dirs past the fsck grace
+// period, so fsck looks at all of them
+func ageBlobs(t *testing.T, c *Core) {
+	t.Helper()
+
+	old := time.Now().Add(-2 * fsckGracePeriod)
+	for _, dir := range []string{c.cfg.UploadDir, c.cfg.ImageDir} {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			return os.Chtimes(path, old, old)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// checkMigrated checks that every row has a storage key with the legacy
+// file's content behind it and that no legacy file is left
+func checkMigrated(t *testing.T, c *Core, lib *legacyLibrary) {
+	t.Helper()
+
+	song, err := c.GetSongByID(lib.song.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	album, err := c.GetAlbum(lib.album.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	artist, err := c.GetArtist(lib.artist.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range []struct {
+		store    storage.Storage
+		key, dir string
+		content  string
+	}{
+		{c.media, song.StorageKey, models.SongsKeyDir, legacySong},
+		{c.images, album.ImagePath, models.CoversKeyDir, legacyCover},
+		{c.images, artist.ImagePath, models.ArtistsKeyDir, legacyArtist},
+	} {
+		if !strings.HasPrefix(file.key, file.dir+"/") {
+			t.Errorf("%s has key %q, want one below %s/", file.content, file.key, file.dir)
+			continue
+		}
+		var buf bytes.Buffer
+		if err := file.store.Get(t.Context(), file.key, &buf); err != nil {
+			t.Errorf("%s isn't at %s: %v", file.content, file.key, err)
+		} else if buf.String() != file.content {
+			t.Errorf("%s holds %q, want %q", file.key, buf.String(), file.content)
+		}
+	}
+
+	for _, key := range append(listKeys(t, c.media), listKeys(t, c.images)...) {
+		if !slices.ContainsFunc([]string{models.SongsKeyDir, models.CoversKeyDir, models.ArtistsKeyDir}, func(dir string) bool {
+			return strings.HasPrefix(key, dir+"/")
+		}) {
+			t.Errorf("%s is left outside the storage key layout", key)
+		}
+	}
+
+	if pending, err := c.PendingMediaMigration(); err != nil || pending != 0 {
+		t.Errorf("PendingMediaMigration = %d, %v, want 0", pending, err)
+	}
+}
+
+func TestMigrateMediaLayout(t *testing.T) {
+	c := newTestCore(t, nil)
+	lib := newLegacyLibrary(t, c)
+
+	if pending, err := c.PendingMediaMigration(); err != nil || pending != 1 {
+		t.Fatalf("PendingMediaMigration = %d, %v, want 1", pending, err)
+	}
+
+	report, err := c.MigrateMediaLayout(t.Context(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := MediaMigrationReport{Songs: 1, Covers: 1, ArtistImages: 1}
+	if *report != want {
+		t.Errorf("report = %+v, want %+v", *report, want)
+	}
+	checkMigrated(t, c, lib)
+
+	// Running it again finds nothing left to do
+	if report, err = c.MigrateMediaLayout(t.Context(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if *report != (MediaMigrationReport{}) {
+		t.Errorf("second run = %+v, want nothing done", *report)
+	}
+	checkMigrated(t, c, lib)
+}
+
+func TestMigrateMediaLayoutMissing(t *testing.T) {
+	c := newTestCore(t, nil)
+	lib := newLegacyLibrary(t, c)
+	if err := c.media.Delete(t.Context(), lib.song.LegacyKey()); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := c.MigrateMediaLayout(t.Context(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := MediaMigrationReport{Covers: 1, ArtistImages: 1, Missing: 1}
+	if *report != want {
+		t.Errorf("report = %+v, want %+v", *report, want)
+	}
+}
+
+func TestMigrateMediaLayoutInterrupted(t *testing.T) {
+	// The cover's new key is saved, then moving the file there fails
+	var store *faultyStorage
+	c := newTestCore(t, func(s storage.Storage) storage.Storage {
+		store = &faultyStorage{Storage: s, failMove: models.CoversKeyDir + "/"}
+		return store
+	})
+	lib := newLegacyLibrary(t, c)
+
+	report, err := c.MigrateMediaLayout(t.Context(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := MediaMigrationReport{Songs: 1, ArtistImages: 1, Failed: 1}
+	if *report != want {
+		t.Errorf("report = %+v, want %+v", *report, want)
+	}
+
+	album, err := c.GetAlbum(lib.album.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(album.ImagePath, models.CoversKeyDir+"/") {
+		t.Fatalf("cover key %q wasn't saved before the move", album.ImagePath)
+	}
+
+	// The cover is still at its legacy key, which no row refers to anymore
+	ageBlobs(t, c)
+	if _, err := c.Fsck(t.Context(), FsckOptions{Repair: RepairAll}, nil); !errors.Is(err, ErrMediaMigrationPending) {
+		t.Errorf("Fsck repair of an interrupted migration = %v, want %v", err, ErrMediaMigrationPending)
+	}
+
+	store.failMove = ""
+	if report, err = c.MigrateMediaLayout(t.Context(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if want := (MediaMigrationReport{Covers: 1}); *report != want {
+		t.Errorf("second run = %+v, want %+v", *report, want)
+	}
+	checkMigrated(t, c, lib)
+}
+
+func TestFsckRepairWaitsForMigration(t *testing.T) {
+	c := newTestCore(t, nil)
+	lib := newLegacyLibrary(t, c)
+	ageBlobs(t, c)
+	before := append(listKeys(t, c.media), listKeys(t, c.images)...)
+
+	for _, repair := range []FsckRepair{RepairOrphans, RepairMissing, RepairAll} {
+		if _, err := c.Fsck(t.Context(), FsckOptions{Repair: repair}, nil); !errors.Is(err, ErrMediaMigrationPending) {
+			t.Errorf("Fsck with repair %d = %v, want %v", repair, err, ErrMediaMigrationPending)
+		}
+	}
+	if after := append(listKeys(t, c.media), listKeys(t, c.images)...); !slices.Equal(after, before) {
+		t.Errorf("refused repair moved files: %v, was %v", after, before)
+	}
+
+	// Only reporting is fine, the legacy files show up as orphans
+	report, err := c.Fsck(t.Context(), FsckOptions{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Orphans) == 0 {
+		t.Error("legacy files aren't reported as orphans")
+	}
+
+	if _, err := c.MigrateMediaLayout(t.Context(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if report, err = c.Fsck(t.Context(), FsckOptions{Repair: RepairAll}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !report.Clean() || report.Quarantined != 0 {
+		t.Errorf("Fsck after migration = %+v, want a clean library", report)
+	}
+	checkMigrated(t, c, lib)
+}
@@ -0,0 +1,114 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"whalio/storage"
+)
+
+var ErrNotEncrypted = errors.New("media is not encrypted, set ENCRYPTION_KEY or ENCRYPTION_KEY_FILE")
+
+// KeyRotationReport counts blobs per outcome over both stores
+type KeyRotationReport struct {
+	Blobs    int `json:"blobs"`
+	Rotated  int `json:"rotated"`
+	UpToDate int `json:"upToDate"`
+	Failed   int `json:"failed"`
+}
+
+// RotateKeys re-encrypts every blob that isn't encrypted with the current
+// key, plaintext ones included. A blob is rewritten to its staging key and
+// then moved over the original, so it is readable throughout and an
+// interrupted rotation can simply be run again. With dryRun nothing is
+// written.
+func (c *Core) RotateKeys(ctx context.Context, dryRun bool, progress func(done, total int)) (*KeyRotationReport, error) {
+	media, ok := c.media.(*storage.Encrypted)
+	if !ok {
+		return nil, ErrNotEncrypted
+	}
+	images, ok := c.images.(*storage.Encrypted)
+	if !ok {
+		return nil, ErrNotEncrypted
+	}
+
+	mediaBlobs, err := media.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	imageBlobs, err := images.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	report := &KeyRotationReport{Blobs: len(mediaBlobs) + len(imageBlobs)}
+	done := 0
+	rotate := func(store *storage.Encrypted, blobs []storage.Info) error {
+		for _, blob := range blobs {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if progress != nil {
+				progress(done, report.Blobs)
+			}
+			done++
+
+			current, err := store.Current(ctx, blob.Key)
+			if errors.Is(err, storage.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				c.logger.Error().Err(err).Str("key", blob.Key).Msg("failed read blob header")
+				report.Failed++
+				continue
+			}
+			if current {
+				report.UpToDate++
+				continue
+			}
+
+			if !dryRun {
+				if err := c.rotateBlob(ctx, store, blob.Key); err != nil {
+					c.logger.Error().Err(err).Str("key", blob.Key).Msg("failed re-encrypt blob")
+					report.Failed++
+					continue
+				}
+			}
+			report.Rotated++
+		}
+		return nil
+	}
+
+	if err := rotate(media, mediaBlobs); err != nil {
+		return report, err
+	}
+	if err := rotate(images, imageBlobs); err != nil {
+		return report, err
+	}
+
+	if progress != nil {
+		progress(report.Blobs, report.Blobs)
+	}
+
+	return report, nil
+}
+
+func (c *Core) rotateBlob(ctx context.Context, store *storage.Encrypted, key string) error {
+	source, err := store.Open(ctx, key, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	if err := store.Put(ctx, stagingKey(key), source); err != nil {
+		return err
+	}
+
+	if err := store.Move(ctx, stagingKey(key), key); err != nil {
+		if err := store.Delete(ctx, stagingKey(key)); err != nil {
+			c.logger.Warn().Err(err).Str("key", stagingKey(key)).Msg("failed delete staged blob, leaving it behind")
+		}
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,117 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"maps"
+	"testing"
+	"whalio/storage"
+
+	"github.com/rs/zerolog"
+)
+
+// encryptStores wraps the stores of c, as they were before any encryption,
+// in encrypted stores with keys
+func encryptStores(t *testing.T, c *Core, media, images storage.Storage, keys ...[]byte) {
+	t.Helper()
+
+	logger := zerolog.Nop()
+	var err error
+	if c.media, err = storage.NewEncrypted(&logger, media, keys); err != nil {
+		t.Fatal(err)
+	}
+	if c.images, err = storage.NewEncrypted(&logger, images, keys); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readAll returns the content of every blob in store
+func readAll(t *testing.T, store storage.Storage) map[string]string {
+	t.Helper()
+
+	blobs := make(map[string]string)
+	for _, key := range listKeys(t, store) {
+		var buf bytes.Buffer
+		if err := store.Get(t.Context(), key, &buf); err != nil {
+			t.Fatalf("Get %s: %v", key, err)
+		}
+		blobs[key] = buf.String()
+	}
+	return blobs
+}
+
+func TestRotateKeys(t *testing.T) {
+	c := newTestCore(t, nil)
+	media, images := c.media, c.images
+	oldKey, newKey := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+
+	if _, err := c.RotateKeys(t.Context(), false, nil); !errors.Is(err, ErrNotEncrypted) {
+		t.Fatalf("RotateKeys without encryption = %v, want %v", err, ErrNotEncrypted)
+	}
+
+	// A song from before encryption, then a cover and a song with the old key
+	album := createAlbum(t, c, "Artist", "Plain", nil)
+	addSong(t, c, album, 1000)
+	encryptStores(t, c, media, images, oldKey)
+	album = createAlbum(t, c, "Artist", "Album", bytes.NewReader(testPNG(t)))
+	addSong(t, c, album, 200<<10)
+
+	// Old blobs stay readable once the new key is added in front
+	encryptStores(t, c, media, images, newKey, oldKey)
+	wantMedia, wantImages := readAll(t, c.media), readAll(t, c.images)
+	total := len(wantMedia) + len(wantImages)
+
+	report, err := c.RotateKeys(t.Context(), true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (KeyRotationReport{Blobs: total, Rotated: total}); *report != want {
+		t.Errorf("dry run = %+v, want %+v", *report, want)
+	}
+	if current, _ := c.media.(*storage.Encrypted).Current(t.Context(), listKeys(t, c.media)[0]); current {
+		t.Error("dry run re-encrypted a blob")
+	}
+
+	var calls int
+	report, err = c.RotateKeys(t.Context(), false, func(done, total int) { calls++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (KeyRotationReport{Blobs: total, Rotated: total}); *report != want {
+		t.Errorf("rotation = %+v, want %+v", *report, want)
+	}
+	if calls == 0 {
+		t.Error("no progress reported")
+	}
+
+	// Everything is under the new key alone now, with the same content
+	encryptStores(t, c, media, images, newKey)
+	for name, store := range map[string]storage.Storage{"media": c.media, "images": c.images} {
+		for _, key := range listKeys(t, store) {
+			if current, err := store.(*storage.Encrypted).Current(t.Context(), key); err != nil || !current {
+				t.Errorf("%s %s current = %v, %v", name, key, current, err)
+			}
+		}
+	}
+	if got := readAll(t, c.media); !maps.Equal(got, wantMedia) {
+		t.Errorf("media changed by the rotation")
+	}
+	if got := readAll(t, c.images); !maps.Equal(got, wantImages) {
+		t.Errorf("images changed by the rotation")
+	}
+
+	encryptStores(t, c, media, images, oldKey)
+	if err := c.media.Get(t.Context(), listKeys(t, media)[0], io.Discard); !errors.Is(err, storage.ErrUnknownKey) {
+		t.Errorf("old key still reads a rotated blob: %v", err)
+	}
+
+	// Running it again finds nothing to do
+	encryptStores(t, c, media, images, newKey, oldKey)
+	if report, err = c.RotateKeys(t.Context(), false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if want := (KeyRotationReport{Blobs: total, UpToDate: total}); *report != want {
+		t.Errorf("second rotation = %+v, want %+v", *report, want)
+	}
+}
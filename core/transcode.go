@@ -0,0 +1,250 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"sync"
+	"time"
+	"whalio/models"
+	"whalio/storage"
+	"whalio/transcode"
+)
+
+var (
+	ErrTranscodingDisabled = errors.New("transcoding is disabled")
+	ErrInvalidTranscode    = errors.New("format or bitrate not allowed")
+)
+
+// transcodeTimeout bounds a single transcode, it keeps running when the
+// request that started it goes away so the next play finds it cached
+const transcodeTimeout = 30 * time.Minute
+
+// DefaultBitrate is used when none is asked for and it is allowed
+const DefaultBitrate = 128
+
+// flight is a transcode in progress, requests for the same one wait for it
+// instead of starting their own
+type flight struct {
+	done chan struct{}
+	err  error
+
+	mu     sync.Mutex
+	stored chan struct{} // Closed whenever a part of the transcode is stored
+}
+
+func newFlight() *flight {
+	return &flight{done: make(chan struct{}), stored: make(chan struct{})}
+}
+
+// progress wakes up the requests waiting for a part of the transcode
+func (f *flight) progress() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	close(f.stored)
+	f.stored = make(chan struct{})
+}
+
+// next returns a channel closed once the next part is stored
+func (f *flight) next() <-chan struct{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.stored
+}
+
+// TranscodeOptions completes opts with the default bitrate and checks them
+// against the configured formats and bitrates
+func (c *Core) TranscodeOptions(opts transcode.Options) (transcode.Options, error) {
+	if c.transcoder == nil || len(c.cfg.TranscodeFormats) == 0 {
+		return opts, ErrTranscodingDisabled
+	}
+
+	if opts.Bitrate == 0 {
+		opts.Bitrate = c.cfg.TranscodeBitrates[0]
+		if slices.Contains(c.cfg.TranscodeBitrates, DefaultBitrate) {
+			opts.Bitrate = DefaultBitrate
+		}
+	}
+	if !slices.Contains(c.cfg.TranscodeFormats, opts.Format) || !slices.Contains(c.cfg.TranscodeBitrates, opts.Bitrate) {
+		return opts, ErrInvalidTranscode
+	}
+	return opts, nil
+}
+
+// TranscodeSong opens a song transcoded to the format and bitrate of opts.
+// Transcodes are cached in media storage, the first play of one waits for
+// the whole song to be transcoded and later ones are served like the
+// original, seeking included. The least recently played are evicted once
+// the cache grows past TranscodeCacheSize.
+func (c *Core) TranscodeSong(ctx context.Context, id uint, opts transcode.Options) (*Stream, error) {
+	opts, err := c.TranscodeOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	dbCtx, cancel := c.context()
+	defer cancel()
+
+	song, err := c.repository.GetSongByID(dbCtx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	key := models.TranscodeKey(song.StorageKey, opts.Bitrate, transcode.Ext(opts.Format))
+	return c.cachedTranscode(ctx, key, opts.Format, key, func(*flight) error {
+		return c.transcode(song, key, opts)
+	})
+}
+
+// cachedTranscode opens the transcode cached under key, running produce first
+// if it isn't cached. produce stores the transcode, or several at once such as
+// the segments of an HLS variant, and runs once for all requests sharing
+// flightKey. Its ETag changes whenever it is made again, the bytes of two
+// transcodes needn't be the same.
+func (c *Core) cachedTranscode(ctx context.Context, key, format, flightKey string, produce func(*flight) error) (*Stream, error) {
+	info, err := c.media.Stat(ctx, key)
+	if errors.Is(err, storage.ErrNotExist) {
+		if err := c.transcodeOnce(ctx, key, flightKey, produce); err != nil {
+			return nil, err
+		}
+		info, err = c.media.Stat(ctx, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	dbCtx, cancel := c.context()
+	defer cancel()
+
+	if err := c.repository.TouchArtifact(dbCtx, key); err != nil {
+		c.logger.Warn().Err(err).Str("key", key).Msg("failed record transcode use")
+	}
+
+	return &Stream{
+		ReadSeekCloser: storage.NewReadSeeker(ctx, c.media, info),
+		Name:           path.Base(key),
+		ContentType:    transcode.ContentType(format),
+		ETag:           fmt.Sprintf(`"%s-%x"`, path.Base(key), info.ModTime.UnixNano()),
+		ModTime:        info.ModTime,
+	}, nil
+}
+
+// transcodeOnce runs produce unless a transcode of flightKey is already
+// running, and waits until key is stored or the transcode is done
+func (c *Core) transcodeOnce(ctx context.Context, key, flightKey string, produce func(*flight) error) error {
+	c.flightsMu.Lock()
+	f, running := c.flights[flightKey]
+	if !running {
+		f = newFlight()
+		c.flights[flightKey] = f
+		go func() {
+			f.err = produce(f)
+			c.flightsMu.Lock()
+			delete(c.flights, flightKey)
+			c.flightsMu.Unlock()
+			close(f.done)
+		}()
+	}
+	c.flightsMu.Unlock()
+
+	for {
+		stored := f.next()
+		if _, err := c.media.Stat(ctx, key); err == nil {
+			return nil
+		}
+
+		select {
+		case <-f.done:
+			return f.err
+		case <-stored:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// transcode pipes song through the transcoder into storage, records it as
+// an artifact of the song and evicts old transcodes to make room
+func (c *Core) transcode(song *models.Song, key string, opts transcode.Options) error {
+	ctx, cancel := context.WithTimeout(context.Background(), transcodeTimeout)
+	defer cancel()
+
+	log := c.logger.With().Uint("song", song.ID).Str("key", key).Logger()
+	log.Info().Str("format", opts.Format).Int("bitrate", opts.Bitrate).Msg("transcoding song")
+	start := time.Now()
+
+	source, err := c.media.Open(ctx, song.StorageKey, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(c.transcoder.Transcode(ctx, source, writer, opts))
+	}()
+
+	size, err := c.storeTranscode(ctx, song, key, reader)
+	// Stops the transcoder if storing failed before it was done
+	reader.CloseWithError(err)
+	if err != nil {
+		log.Error().Err(err).Msg("failed transcode song")
+		return err
+	}
+
+	log.Info().Int64("size", size).Dur("took", time.Since(start)).Msg("transcoded song")
+	c.evictTranscodes(ctx)
+	return nil
+}
+
+// storeTranscode stores a transcode of song read from source under key and
+// records it as an artifact of the song. It returns its size.
+func (c *Core) storeTranscode(ctx context.Context, song *models.Song, key string, source io.Reader) (int64, error) {
+	work := c.newUnitOfWork()
+	if err := work.Put(ctx, c.media, key, source); err != nil {
+		return 0, err
+	}
+
+	staged, err := c.media.Stat(ctx, stagingKey(key))
+	if err != nil {
+		work.Rollback()
+		return 0, err
+	}
+
+	err = work.Commit(ctx, func(ctx context.Context) error {
+		return c.repository.SaveArtifacts(ctx, []models.Artifact{{
+			OwnerType:  models.OwnerSong,
+			OwnerID:    song.ID,
+			Kind:       models.ArtifactTranscode,
+			Store:      models.StoreMedia,
+			StorageKey: key,
+			Size:       staged.Size,
+			UsedAt:     time.Now(),
+		}})
+	}, func(ctx context.Context) error {
+		return c.repository.DeleteArtifact(ctx, key)
+	})
+	return staged.Size, err
+}
+
+// evictTranscodes deletes the least recently played transcodes past
+// TranscodeCacheSize, 0 keeps them all
+func (c *Core) evictTranscodes(ctx context.Context) {
+	if c.cfg.TranscodeCacheSize <= 0 {
+		return
+	}
+
+	evicted, err := c.repository.EvictArtifacts(ctx, models.ArtifactTranscode, c.cfg.TranscodeCacheSize)
+	if err != nil {
+		c.logger.Warn().Err(err).Msg("failed evict transcodes")
+		return
+	}
+	for _, artifact := range evicted {
+		if err := c.artifactStore(artifact).Delete(ctx, artifact.StorageKey); err != nil && !errors.Is(err, storage.ErrNotExist) {
+			c.logger.Warn().Err(err).Str("key", artifact.StorageKey).Msg("failed delete evicted transcode, leaving it behind")
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"whalio/models"
+	"whalio/transcode"
+)
+
+// gatedTranscoder holds every transcode until open is closed
+type gatedTranscoder struct {
+	*transcode.Fake
+	open <-chan struct{}
+}
+
+func (g *gatedTranscoder) Transcode(ctx context.Context, src io.Reader, dst io.Writer, opts transcode.Options) error {
+	select {
+	case <-g.open:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return g.Fake.Transcode(ctx, src, dst, opts)
+}
+
+// newTranscodeCore returns a core transcoding with transcoder to opus at 64
+// and 128 kbit/s
+func newTranscodeCore(t *testing.T, transcoder transcode.Transcoder) *Core {
+	t.Helper()
+
+	c := newTestCore(t, nil)
+	c.transcoder = transcoder
+	c.cfg.TranscodeFormats = []string{transcode.Opus}
+	c.cfg.TranscodeBitrates = []int{64, 128}
+	return c
+}
+
+func readTranscode(t *testing.T, c *Core, id uint, bitrate int) string {
+	t.Helper()
+
+	stream, err := c.TranscodeSong(t.Context(), id, transcode.Options{Format: transcode.Opus, Bitrate: bitrate})
+	if err != nil {
+		t.Fatalf("transcode song %d: %v", id, err)
+	}
+	defer stream.Close()
+	data, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestTranscodeOptions(t *testing.T) {
+	c := newTestCore(t, nil)
+	if _, err := c.TranscodeOptions(transcode.Options{Format: transcode.Opus}); !errors.Is(err, ErrTranscodingDisabled) {
+		t.Errorf("without a transcoder = %v, want %v", err, ErrTranscodingDisabled)
+	}
+
+	c = newTranscodeCore(t, &transcode.Fake{})
+	for _, tt := range []struct {
+		opts    transcode.Options
+		want    transcode.Options
+		wantErr error
+	}{
+		{transcode.Options{Format: transcode.Opus}, transcode.Options{Format: transcode.Opus, Bitrate: DefaultBitrate}, nil},
+		{transcode.Options{Format: transcode.Opus, Bitrate: 64}, transcode.Options{Format: transcode.Opus, Bitrate: 64}, nil},
+		{transcode.Options{Format: transcode.Opus, Bitrate: 96}, transcode.Options{}, ErrInvalidTranscode},
+		{transcode.Options{Format: transcode.MP3, Bitrate: 64}, transcode.Options{}, ErrInvalidTranscode},
+	} {
+		got, err := c.TranscodeOptions(tt.opts)
+		if !errors.Is(err, tt.wantErr) || err == nil && got != tt.want {
+			t.Errorf("TranscodeOptions(%+v) = %+v, %v, want %+v, %v", tt.opts, got, err, tt.want, tt.wantErr)
+		}
+	}
+
+	// Without the default bitrate the first configured one is used
+	c.cfg.TranscodeBitrates = []int{96, 192}
+	if got, err := c.TranscodeOptions(transcode.Options{Format: transcode.Opus}); err != nil || got.Bitrate != 96 {
+		t.Errorf("default bitrate = %d, %v, want 96", got.Bitrate, err)
+	}
+}
+
+func TestTranscodeSharesOneFlight(t *testing.T) {
+	open := make(chan struct{})
+	fake := &transcode.Fake{}
+	c := newTranscodeCore(t, &gatedTranscoder{Fake: fake, open: open})
+	song := addSong(t, c, createAlbum(t, c, "Artist", "Album", nil), 1000)
+
+	// Every request arrives while the first transcode is still running
+	results := make([]string, 8)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Go(func() { results[i] = readTranscode(t, c, song.ID, 128) })
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.flightsMu.Lock()
+		running := len(c.flights)
+		c.flightsMu.Unlock()
+		if running == 1 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(open)
+	wg.Wait()
+
+	if calls := fake.Calls(); len(calls) != 1 {
+		t.Fatalf("transcoded %d times, want once: %v", len(calls), calls)
+	}
+	for i, got := range results {
+		if !strings.HasPrefix(got, "FAKE opus 128\n") || len(got) != len("FAKE opus 128\n")+1000 {
+			t.Errorf("request %d got %d bytes: %.20q", i, len(got), got)
+		}
+	}
+
+	// Later plays are served from the cache
+	readTranscode(t, c, song.ID, 128)
+	if calls := fake.Calls(); len(calls) != 1 {
+		t.Errorf("cached transcode made again, %d calls", len(calls))
+	}
+}
+
+func TestTranscodeCacheEviction(t *testing.T) {
+	fake := &transcode.Fake{}
+	c := newTranscodeCore(t, fake)
+	album := createAlbum(t, c, "Artist", "Album", nil)
+	first, second, third := addSong(t, c, album, 1000), addSong(t, c, album, 1000), addSong(t, c, album, 1000)
+
+	// Room for two transcodes of a little over 1000 bytes
+	c.cfg.TranscodeCacheSize = 2500
+	play := func(song *models.Song) {
+		t.Helper()
+		readTranscode(t, c, song.ID, 128)
+		time.Sleep(5 * time.Millisecond)
+	}
+	play(first)
+	play(second)
+	play(first)
+	play(third)
+
+	cached := func() []string {
+		t.Helper()
+		var keys []string
+		for _, key := range listKeys(t, c.media) {
+			if strings.HasPrefix(key, models.TranscodesKeyDir+"/") {
+				keys = append(keys, key)
+			}
+		}
+		slices.Sort(keys)
+		return keys
+	}
+	key := func(song *models.Song) string {
+		return models.TranscodeKey(song.StorageKey, 128, transcode.Ext(transcode.Opus))
+	}
+
+	// The second was played least recently
+	want := []string{key(first), key(third)}
+	slices.Sort(want)
+	if got := cached(); !slices.Equal(got, want) {
+		t.Errorf("cached %v, want %v", got, want)
+	}
+	_, _, _, artifacts, err := c.repository.ListUsage(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(artifacts) != 2 {
+		t.Errorf("%d artifacts recorded, want 2", len(artifacts))
+	}
+
+	// Playing it again transcodes it again
+	calls := len(fake.Calls())
+	play(second)
+	if got := len(fake.Calls()); got != calls+1 {
+		t.Errorf("%d transcodes after playing an evicted one, want %d", got, calls+1)
+	}
+}
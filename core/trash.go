@@ -0,0 +1,217 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"time"
+	"whalio/models"
+)
+
+// trashPurgeInterval is how often the purger looks for expired rows
+const trashPurgeInterval = time.Hour
+
+const (
+	TrashArtist = "artist"
+	TrashAlbum  = "album"
+	TrashSong   = "song"
+)
+
+var ErrInvalidTrashKind = errors.New("invalid trash kind")
+
+// TrashItem is something deleted as a whole. Albums deleted with their
+// artist and songs deleted with their album are part of that item and not
+// listed on their own.
+type TrashItem struct {
+	Kind      string     `json:"kind"`
+	ID        uint       `json:"id"`
+	Name      string     `json:"name"`
+	Artist    string     `json:"artist,omitempty"`
+	Album     string     `json:"album,omitempty"`
+	Albums    int        `json:"albums"`
+	Songs     int        `json:"songs"`
+	Bytes     int64      `json:"bytes"`
+	DeletedAt time.Time  `json:"deletedAt"`
+	PurgeAt   *time.Time `json:"purgeAt,omitempty"` // nil when the trash is kept forever
+}
+
+// ListTrash returns the deleted artists, albums and songs, oldest first
+func (c *Core) ListTrash() ([]TrashItem, error) {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	artists, albums, songs, err := c.repository.ListTrash(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]TrashItem, 0, len(artists)+len(albums)+len(songs))
+	artistItems := make(map[uint]int, len(artists))
+	albumItems := make(map[uint]int, len(albums))
+
+	for _, artist := range artists {
+		artistItems[artist.ID] = len(items)
+		items = append(items, c.trashItem(TrashArtist, artist.ID, artist.Name, artist.DeletedAt.Time))
+	}
+
+	for _, album := range albums {
+		deletedAt := album.DeletedAt.Time
+		if i, ok := artistItems[album.ArtistID]; ok && items[i].DeletedAt.Equal(deletedAt) {
+			items[i].Albums++
+			albumItems[album.ID] = i
+			continue
+		}
+
+		item := c.trashItem(TrashAlbum, album.ID, album.Name, deletedAt)
+		item.Artist = album.Artist.Name
+		item.Albums = 1
+		albumItems[album.ID] = len(items)
+		items = append(items, item)
+	}
+
+	for _, song := range songs {
+		deletedAt := song.DeletedAt.Time
+		if i, ok := albumItems[song.AlbumID]; ok && items[i].DeletedAt.Equal(deletedAt) {
+			items[i].Songs++
+			items[i].Bytes += song.FileSize
+			continue
+		}
+
+		item := c.trashItem(TrashSong, song.ID, song.Name, deletedAt)
+		item.Artist = song.Album.Artist.Name
+		item.Album = song.Album.Name
+		item.Songs = 1
+		item.Bytes = song.FileSize
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+func (c *Core) trashItem(kind string, id uint, name string, deletedAt time.Time) TrashItem {
+	item := TrashItem{Kind: kind, ID: id, Name: name, DeletedAt: deletedAt}
+	if c.cfg.TrashRetention > 0 {
+		purgeAt := deletedAt.Add(c.cfg.TrashRetention)
+		item.PurgeAt = &purgeAt
+	}
+	return item
+}
+
+// RestoreFromTrash takes an item listed by ListTrash out of the trash, with
+// everything that was deleted along with it
+func (c *Core) RestoreFromTrash(kind string, id uint) error {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	switch kind {
+	case TrashArtist:
+		return c.repository.RestoreArtist(ctx, id)
+	case TrashAlbum:
+		return c.repository.RestoreAlbum(ctx, id)
+	case TrashSong:
+		return c.repository.RestoreSong(ctx, id)
+	}
+	return ErrInvalidTrashKind
+}
+
+// TrashPurgeReport summarises what PurgeTrash deleted
+type TrashPurgeReport struct {
+	Artists int
+	Albums  int
+	Songs   int
+	Files   int
+}
+
+// PurgeTrash deletes rows that went to the trash before the given time for
+// good, together with their files, images and artifacts. Rows are deleted
+// first, a file that can't be deleted afterwards is left for fsck.
+func (c *Core) PurgeTrash(ctx context.Context, before time.Time) (*TrashPurgeReport, error) {
+	artists, albums, songs, err := c.repository.ListTrash(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &TrashPurgeReport{}
+	work := c.newUnitOfWork()
+	var songIDs, albumIDs, artistIDs []uint
+
+	expired := func(deletedAt time.Time) bool { return deletedAt.Before(before) }
+
+	for _, song := range songs {
+		if expired(song.DeletedAt.Time) {
+			songIDs = append(songIDs, song.ID)
+			work.Delete(c.media, song.StorageKey)
+		}
+	}
+	for _, album := range albums {
+		if expired(album.DeletedAt.Time) {
+			albumIDs = append(albumIDs, album.ID)
+			work.Delete(c.images, album.ImagePath)
+		}
+	}
+	for _, artist := range artists {
+		if expired(artist.DeletedAt.Time) {
+			artistIDs = append(artistIDs, artist.ID)
+			work.Delete(c.images, artist.ImagePath)
+		}
+	}
+
+	for ownerType, ids := range map[string][]uint{
+		models.OwnerSong:   songIDs,
+		models.OwnerAlbum:  albumIDs,
+		models.OwnerArtist: artistIDs,
+	} {
+		artifacts, err := c.repository.ListArtifacts(ctx, ownerType, ids)
+		if err != nil {
+			return nil, err
+		}
+		for _, artifact := range artifacts {
+			work.Delete(c.artifactStore(artifact), artifact.StorageKey)
+		}
+	}
+
+	report.Songs, report.Albums, report.Artists = len(songIDs), len(albumIDs), len(artistIDs)
+	report.Files = len(work.deletes)
+	if report.Songs+report.Albums+report.Artists == 0 {
+		return report, nil
+	}
+
+	err = work.Commit(ctx, func(ctx context.Context) error {
+		return c.repository.PurgeRows(ctx, songIDs, albumIDs, artistIDs)
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// RunTrashPurger purges expired trash every trashPurgeInterval until ctx is
+// done. It does nothing when TrashRetention is 0.
+func (c *Core) RunTrashPurger(ctx context.Context) {
+	if c.cfg.TrashRetention <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		report, err := c.PurgeTrash(ctx, time.Now().Add(-c.cfg.TrashRetention))
+		if err != nil {
+			c.logger.Error().Err(err).Msg("failed purge trash")
+		} else if report.Songs+report.Albums+report.Artists > 0 {
+			c.logger.Info().
+				Int("artists", report.Artists).
+				Int("albums", report.Albums).
+				Int("songs", report.Songs).
+				Int("files", report.Files).
+				Msg("purged trash")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
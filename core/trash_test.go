@@ -0,0 +1,230 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+	"whalio/repository"
+)
+
+// trashed returns the items of the trash as "kind id" with the songs they
+// hold
+func trashed(t *testing.T, c *Core) []string {
+	t.Helper()
+
+	items, err := c.ListTrash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, item := range items {
+		got = append(got, fmt.Sprintf("%s %d: %d songs", item.Kind, item.ID, item.Songs))
+	}
+	return got
+}
+
+// liveSongs returns the ids of the songs that aren't in the trash
+func liveSongs(t *testing.T, c *Core) []uint {
+	t.Helper()
+
+	songs, err := c.repository.ListSongs(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []uint
+	for _, song := range songs {
+		ids = append(ids, song.ID)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// deleteLater waits for the clock to move on, deletions at the same instant
+// would be taken as one
+func deleteLater(t *testing.T, fn func() error) {
+	t.Helper()
+
+	time.Sleep(5 * time.Millisecond)
+	if err := fn(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestoreAlbum(t *testing.T) {
+	c := newTestCore(t, nil)
+	album := createAlbum(t, c, "Artist", "Album", nil)
+	first, second, third := addSong(t, c, album, 100), addSong(t, c, album, 100), addSong(t, c, album, 100)
+
+	// A song trashed on its own first, then the album with the others
+	deleteLater(t, func() error { return c.DeleteSong(first.ID) })
+	deleteLater(t, func() error { _, err := c.DeleteAlbum(album.ID); return err })
+
+	want := []string{fmt.Sprintf("album %d: 2 songs", album.ID), fmt.Sprintf("song %d: 1 songs", first.ID)}
+	if got := trashed(t, c); !slices.Equal(got, want) {
+		t.Fatalf("trash = %v, want %v", got, want)
+	}
+
+	if err := c.RestoreFromTrash(TrashAlbum, album.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := liveSongs(t, c), []uint{second.ID, third.ID}; !slices.Equal(got, want) {
+		t.Errorf("songs after restore = %v, want %v", got, want)
+	}
+	if got, want := trashed(t, c), want[1:]; !slices.Equal(got, want) {
+		t.Errorf("trash after restore = %v, want %v", got, want)
+	}
+
+	if err := c.RestoreFromTrash(TrashAlbum, album.ID); !errors.Is(err, repository.ErrNotInTrash) {
+		t.Errorf("restoring again = %v, want %v", err, repository.ErrNotInTrash)
+	}
+	if err := c.RestoreFromTrash("playlist", album.ID); !errors.Is(err, ErrInvalidTrashKind) {
+		t.Errorf("restoring a playlist = %v, want %v", err, ErrInvalidTrashKind)
+	}
+}
+
+func TestRestoreArtist(t *testing.T) {
+	c := newTestCore(t, nil)
+	first := createAlbum(t, c, "Artist", "First", nil)
+	second := createAlbum(t, c, "Artist", "Second", nil)
+	kept := addSong(t, c, first, 100)
+	addSong(t, c, second, 100)
+
+	artists, err := c.GetSomeArtist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	artist := artists[0]
+
+	// The second album goes first, then the artist with the first one
+	deleteLater(t, func() error { _, err := c.DeleteAlbum(second.ID); return err })
+	deleteLater(t, func() error { _, err := c.DeleteArtist(artist.ID); return err })
+
+	want := []string{fmt.Sprintf("artist %d: 1 songs", artist.ID), fmt.Sprintf("album %d: 1 songs", second.ID)}
+	if got := trashed(t, c); !slices.Equal(got, want) {
+		t.Fatalf("trash = %v, want %v", got, want)
+	}
+
+	if err := c.RestoreFromTrash(TrashArtist, artist.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := liveSongs(t, c); !slices.Equal(got, []uint{kept.ID}) {
+		t.Errorf("songs after restore = %v, want %v", got, []uint{kept.ID})
+	}
+	if got := trashed(t, c); !slices.Equal(got, want[1:]) {
+		t.Errorf("trash after restore = %v, want %v", got, want[1:])
+	}
+
+	// Restoring a song of a trashed album brings the album back without its
+	// other songs
+	other := addSong(t, c, first, 100)
+	deleteLater(t, func() error { _, err := c.DeleteArtist(artist.ID); return err })
+	if err := c.RestoreFromTrash(TrashSong, other.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := liveSongs(t, c); !slices.Equal(got, []uint{other.ID}) {
+		t.Errorf("songs after restoring one = %v, want %v", got, []uint{other.ID})
+	}
+	if _, err := c.repository.GetAlbumByID(t.Context(), first.ID); err != nil {
+		t.Errorf("album of the restored song: %v", err)
+	}
+	if _, err := c.repository.GetArtistByID(t.Context(), artist.ID); err != nil {
+		t.Errorf("artist of the restored song: %v", err)
+	}
+	if _, err := c.repository.GetAlbumByID(t.Context(), second.ID); err == nil {
+		t.Errorf("album %d restored with another album's song", second.ID)
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	c := newTestCore(t, nil)
+	gone := createAlbum(t, c, "Artist", "Gone", bytes.NewReader(testPNG(t)))
+	kept := createAlbum(t, c, "Artist", "Kept", nil)
+	addSong(t, c, gone, 100)
+	addSong(t, c, gone, 200)
+	live := addSong(t, c, kept, 300)
+	recent := addSong(t, c, kept, 400)
+
+	if _, err := c.DeleteAlbum(gone.ID); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	cutoff := time.Now()
+	deleteLater(t, func() error { return c.DeleteSong(recent.ID) })
+
+	images := len(listKeys(t, c.images))
+	if images < 2 {
+		t.Fatalf("%d images, want the cover and its thumbnails", images)
+	}
+
+	// Nothing was deleted before the start
+	report, err := c.PurgeTrash(t.Context(), gone.CreatedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *report != (TrashPurgeReport{}) {
+		t.Errorf("early purge = %+v, want nothing", *report)
+	}
+
+	report, err = c.PurgeTrash(t.Context(), cutoff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (TrashPurgeReport{Albums: 1, Songs: 2, Files: 2 + images}); *report != want {
+		t.Errorf("purge = %+v, want %+v", *report, want)
+	}
+
+	// The album is gone for good, the song deleted after the cutoff stays
+	if got, want := trashed(t, c), []string{fmt.Sprintf("song %d: 1 songs", recent.ID)}; !slices.Equal(got, want) {
+		t.Errorf("trash after purge = %v, want %v", got, want)
+	}
+	_, albums, songs, artifacts, err := c.repository.ListUsage(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(albums) != 1 || len(songs) != 2 || len(artifacts) != 0 {
+		t.Errorf("rows after purge: %d albums, %d songs, %d artifacts, want 1, 2 and 0", len(albums), len(songs), len(artifacts))
+	}
+	if got := listKeys(t, c.media); !slices.Equal(got, []string{live.StorageKey, recent.StorageKey}) &&
+		!slices.Equal(got, []string{recent.StorageKey, live.StorageKey}) {
+		t.Errorf("media after purge = %v, want the two songs of %s", got, kept.Name)
+	}
+	if got := listKeys(t, c.images); len(got) != 0 {
+		t.Errorf("images after purge = %v, want none", got)
+	}
+}
+
+func TestRunTrashPurger(t *testing.T) {
+	c := newTestCore(t, nil)
+	album := createAlbum(t, c, "Artist", "Album", nil)
+	song := addSong(t, c, album, 100)
+	if err := c.DeleteSong(song.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first pass runs right away and finds the song past the retention
+	c.cfg.TrashRetention = time.Millisecond
+	time.Sleep(5 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		c.RunTrashPurger(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(trashed(t, c)) > 0 || len(listKeys(t, c.media)) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("trash = %v, media = %v after the purger ran", trashed(t, c), listKeys(t, c.media))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
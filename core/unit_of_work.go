@@ -0,0 +1,124 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"io"
+	"whalio/storage"
+)
+
+// stagingKeyDir holds blobs written by a unit of work that isn't committed
+// yet. A staged blob is kept under its final key below this dir, so one left
+// behind by a crash can be matched to its row.
+const stagingKeyDir = "staging"
+
+func stagingKey(key string) string {
+	return stagingKeyDir + "/" + key
+}
+
+type blobRef struct {
+	store storage.Storage
+	key   string
+}
+
+// unitOfWork keeps rows and the blobs they point at consistent. Blobs are
+// written to a staging key first, the database change is committed and only
+// then are the blobs moved into place and old ones deleted:
+//
+//   - a failed write or commit deletes the staged blobs, nothing changed
+//   - a failed move after the commit undoes the database change
+//   - a failed delete after the commit leaves an unreferenced blob behind,
+//     which `whalio fsck --repair` quarantines
+//
+// So a row never points at a blob that doesn't exist, short of a crash
+// between commit and move. Fsck moves blobs stranded that way into place.
+type unitOfWork struct {
+	c       *Core
+	puts    []blobRef
+	deletes []blobRef
+}
+
+func (c *Core) newUnitOfWork() *unitOfWork {
+	return &unitOfWork{c: c}
+}
+
+// Put stages source to be stored under key on commit
+func (u *unitOfWork) Put(ctx context.Context, store storage.Storage, key string, source io.Reader) error {
+	if err := store.Put(ctx, stagingKey(key), source); err != nil {
+		u.Rollback()
+		return err
+	}
+
+	u.puts = append(u.puts, blobRef{store, key})
+	return nil
+}
+
+// Delete schedules key to be deleted once the commit succeeded. Empty keys
+// are ignored.
+func (u *unitOfWork) Delete(store storage.Storage, key string) {
+	if key != "" {
+		u.deletes = append(u.deletes, blobRef{store, key})
+	}
+}
+
+// Commit runs save, which must make the database change in a single
+// transaction, and then applies the staged blob changes. If moving a blob
+// into place fails undo is called to revert what save did.
+func (u *unitOfWork) Commit(ctx context.Context, save, undo func(context.Context) error) error {
+	if err := save(ctx); err != nil {
+		u.Rollback()
+		return err
+	}
+
+	for i, put := range u.puts {
+		err := put.store.Move(ctx, stagingKey(put.key), put.key)
+		if err == nil {
+			continue
+		}
+
+		u.c.logger.Error().Err(err).Str("key", put.key).Msg("failed move staged blob into place, reverting")
+		if undo == nil {
+			u.Rollback()
+			return err
+		}
+		if undoErr := undo(ctx); undoErr != nil {
+			u.c.logger.Error().Err(undoErr).Str("key", put.key).Msg("failed revert database change")
+			return errors.Join(err, undoErr)
+		}
+
+		for _, moved := range u.puts[:i] {
+			u.remove(moved.store, moved.key)
+		}
+		u.puts = u.puts[i:]
+		u.Rollback()
+		return err
+	}
+	u.puts = nil
+
+	for _, del := range u.deletes {
+		u.remove(del.store, del.key)
+	}
+	u.deletes = nil
+
+	return nil
+}
+
+// Rollback deletes staged blobs. It is safe to call after Commit.
+func (u *unitOfWork) Rollback() {
+	for _, put := range u.puts {
+		u.remove(put.store, stagingKey(put.key))
+	}
+	u.puts = nil
+	u.deletes = nil
+}
+
+// remove deletes a blob with a fresh context, it also runs when the caller's
+// context is what failed
+func (u *unitOfWork) remove(store storage.Storage, key string) {
+	ctx, cancel := u.c.context()
+	defer cancel()
+
+	if err := store.Delete(ctx, key); err != nil {
+		u.c.logger.Warn().Err(err).Str("key", key).Msg("failed delete blob, leaving it behind")
+	}
+}
@@ -0,0 +1,216 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"whalio/storage"
+)
+
+var errFault = errors.New("injected fault")
+
+// faultyStorage fails writes and moves to keys containing a substring
+type faultyStorage struct {
+	storage.Storage
+	failPut  string // Empty to never fail
+	failMove string // Matched against the destination key
+}
+
+func (f *faultyStorage) Put(ctx context.Context, key string, source io.Reader) error {
+	if f.failPut != "" && strings.Contains(key, f.failPut) {
+		return errFault
+	}
+	return f.Storage.Put(ctx, key, source)
+}
+
+func (f *faultyStorage) Move(ctx context.Context, src, dest string) error {
+	if f.failMove != "" && strings.Contains(dest, f.failMove) {
+		return errFault
+	}
+	return f.Storage.Move(ctx, src, dest)
+}
+
+func TestUnitOfWork(t *testing.T) {
+	errSave := errors.New("save failed")
+	errUndo := errors.New("undo failed")
+
+	tests := []struct {
+		name     string
+		failPut  string
+		failMove string
+		saveErr  error
+		undoErr  error
+		wantErr  []error
+		saved    bool     // Whether the database change is expected to stay
+		undone   bool     // Whether undo is expected to run
+		want     []string // Blobs left behind
+	}{
+		{
+			name:  "commit",
+			saved: true,
+			want:  []string{"blobs/a", "blobs/b"},
+		},
+		{
+			name:    "put fails",
+			failPut: "blobs/b",
+			wantErr: []error{errFault},
+		},
+		{
+			name:    "save fails",
+			saveErr: errSave,
+			wantErr: []error{errSave},
+		},
+		{
+			name:     "move fails",
+			failMove: "blobs/b",
+			wantErr:  []error{errFault},
+			undone:   true,
+		},
+		{
+			// The row still points at the staged blob, fsck moves it into
+			// place
+			name:     "undo fails",
+			failMove: "blobs/b",
+			undoErr:  errUndo,
+			wantErr:  []error{errFault, errUndo},
+			saved:    true,
+			undone:   true,
+			want:     []string{"blobs/a", "staging/blobs/b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCore(t, nil)
+			store := &faultyStorage{Storage: c.images, failPut: tt.failPut, failMove: tt.failMove}
+			if err := store.Put(t.Context(), "blobs/old", strings.NewReader("old")); err != nil {
+				t.Fatal(err)
+			}
+
+			work := c.newUnitOfWork()
+			work.Delete(store, "blobs/old")
+			err := work.Put(t.Context(), store, "blobs/a", strings.NewReader("a"))
+			if err == nil {
+				err = work.Put(t.Context(), store, "blobs/b", strings.NewReader("b"))
+			}
+
+			saved, undone := false, false
+			if err == nil {
+				err = work.Commit(t.Context(),
+					func(ctx context.Context) error {
+						saved = tt.saveErr == nil
+						return tt.saveErr
+					},
+					func(ctx context.Context) error {
+						undone = true
+						saved = tt.undoErr != nil
+						return tt.undoErr
+					},
+				)
+			}
+
+			for _, want := range tt.wantErr {
+				if !errors.Is(err, want) {
+					t.Errorf("err = %v, want %v", err, want)
+				}
+			}
+			if tt.wantErr == nil && err != nil {
+				t.Errorf("err = %v", err)
+			}
+			if saved != tt.saved || undone != tt.undone {
+				t.Errorf("saved %t, undone %t, want %t, %t", saved, undone, tt.saved, tt.undone)
+			}
+
+			// The old blob is only deleted once everything is in place
+			want := tt.want
+			if err != nil {
+				want = append(want, "blobs/old")
+			}
+			got := listKeys(t, store)
+			slices.Sort(got)
+			slices.Sort(want)
+			if !slices.Equal(got, want) {
+				t.Errorf("blobs = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestCreateAlbumFailedMove(t *testing.T) {
+	// Thumbnails are moved into place after the image itself
+	var store *faultyStorage
+	c := newTestCore(t, func(s storage.Storage) storage.Storage {
+		store = &faultyStorage{Storage: s, failMove: "_"}
+		return store
+	})
+	if err := c.CreateArtist("Artist", "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	err := c.CreateAlbum("Album", "", "Artist", 2020, bytes.NewReader(testPNG(t)))
+	if !errors.Is(err, errFault) {
+		t.Fatalf("err = %v, want %v", err, errFault)
+	}
+
+	_, albums, _, artifacts, err := c.repository.ListUsage(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(albums) != 0 || len(artifacts) != 0 {
+		t.Errorf("left %d albums and %d artifacts behind", len(albums), len(artifacts))
+	}
+	if keys := listKeys(t, store); len(keys) != 0 {
+		t.Errorf("left blobs behind: %v", keys)
+	}
+}
+
+func TestCreateAlbumWithImage(t *testing.T) {
+	c := newTestCore(t, nil)
+	if err := c.CreateArtist("Artist", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CreateAlbum("Album", "", "Artist", 2020, bytes.NewReader(testPNG(t))); err != nil {
+		t.Fatal(err)
+	}
+
+	_, albums, _, artifacts, err := c.repository.ListUsage(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(albums) != 1 || len(artifacts) == 0 {
+		t.Fatalf("got %d albums and %d artifacts", len(albums), len(artifacts))
+	}
+
+	keys := listKeys(t, c.images)
+	for _, artifact := range artifacts {
+		if artifact.OwnerID != albums[0].ID || !slices.Contains(keys, artifact.StorageKey) {
+			t.Errorf("artifact %s of %s %d isn't in place", artifact.StorageKey, artifact.OwnerType, artifact.OwnerID)
+		}
+	}
+	if !slices.Contains(keys, albums[0].ImagePath) {
+		t.Errorf("cover %s isn't in place", albums[0].ImagePath)
+	}
+}
+
+// testPNG returns a small PNG
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for x := range 64 {
+		for y := range 64 {
+			img.Set(x, y, color.RGBA{uint8(x * 4), uint8(y * 4), 128, 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,65 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"whalio/repository"
+)
+
+func TestUpdateSong(t *testing.T) {
+	c := newTestCore(t, nil)
+	first := createAlbum(t, c, "Artist", "First", nil)
+	second := createAlbum(t, c, "Other", "Second", nil)
+	song := addSong(t, c, first, 100)
+
+	name, track := "  Renamed ", 3
+	updated, err := c.UpdateSong(song.ID, SongUpdate{AlbumID: &second.ID, Name: &name, TrackNumber: &track})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Name != "Renamed" || updated.TrackNumber != 3 || updated.AlbumID != second.ID || updated.Album.Name != second.Name {
+		t.Errorf("updated %q, track %d, album %d %q", updated.Name, updated.TrackNumber, updated.AlbumID, updated.Album.Name)
+	}
+
+	// Moving a song only changes its row, the file stays where it is
+	saved, err := c.GetSongByID(song.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.StorageKey != song.StorageKey || saved.AlbumID != second.ID || saved.Album.Artist.Name != "Other" {
+		t.Errorf("saved key %s in album %d by %q, want %s in %d by Other",
+			saved.StorageKey, saved.AlbumID, saved.Album.Artist.Name, song.StorageKey, second.ID)
+	}
+	var content bytes.Buffer
+	if err := c.media.Get(t.Context(), saved.StorageKey, &content); err != nil || content.Len() != 100 {
+		t.Errorf("file after the move: %d bytes, %v", content.Len(), err)
+	}
+
+	// Fields left out are kept
+	if updated, err = c.UpdateSong(song.ID, SongUpdate{}); err != nil || updated.Name != "Renamed" || updated.TrackNumber != 3 {
+		t.Errorf("empty update gave %+v, %v", updated, err)
+	}
+
+	empty, negative, missing := " ", -1, uint(99)
+	for _, tt := range []struct {
+		name   string
+		id     uint
+		update SongUpdate
+		want   error
+	}{
+		{"empty name", song.ID, SongUpdate{Name: &empty}, ErrInvalidSongUpdate},
+		{"negative track number", song.ID, SongUpdate{TrackNumber: &negative}, ErrInvalidSongUpdate},
+		{"missing album", song.ID, SongUpdate{AlbumID: &missing}, repository.ErrAlbumNotFound},
+		{"missing song", missing, SongUpdate{Name: &name}, repository.ErrSongNotFound},
+	} {
+		if _, err := c.UpdateSong(tt.id, tt.update); !errors.Is(err, tt.want) {
+			t.Errorf("%s: %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	// A rejected update changes nothing
+	if saved, err = c.GetSongByID(song.ID); err != nil || saved.Name != "Renamed" || saved.TrackNumber != 3 || saved.AlbumID != second.ID {
+		t.Errorf("song after rejected updates: %+v, %v", saved, err)
+	}
+}
@@ -0,0 +1,253 @@
+package core
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"whalio/models"
+	"whalio/storage"
+)
+
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// Usage is what one song, album or artist takes up in storage. Album and
+// artist figures include everything below them.
+type Usage struct {
+	ID        uint   `json:"id,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Artist    string `json:"artist,omitempty"`
+	Album     string `json:"album,omitempty"`
+	Albums    int    `json:"albums,omitempty"`
+	Songs     int    `json:"songs,omitempty"`
+	Files     int64  `json:"files"`     // song files
+	Images    int64  `json:"images"`    // covers and artist images
+	Artifacts int64  `json:"artifacts"` // transcodes, waveforms, ...
+	Total     int64  `json:"total"`
+}
+
+func (u *Usage) add(files, images, artifacts int64) {
+	u.Files += files
+	u.Images += images
+	u.Artifacts += artifacts
+	u.Total += files + images + artifacts
+}
+
+// Quotas are the configured limits in bytes, 0 means unlimited
+type Quotas struct {
+	Total  int64 `json:"total"`
+	Artist int64 `json:"artist"`
+	Album  int64 `json:"album"`
+}
+
+// StorageUsage breaks the bytes in storage down by artist, album and song,
+// each list sorted by total, largest first. Deleted items still take up
+// space until they are purged, they count towards Trash and the library
+// total but aren't listed.
+type StorageUsage struct {
+	Library Usage   `json:"library"`
+	Trash   int64   `json:"trash"`
+	Quotas  Quotas  `json:"quotas"`
+	Artists []Usage `json:"artists,omitempty"`
+	Albums  []Usage `json:"albums,omitempty"`
+	Songs   []Usage `json:"songs,omitempty"`
+}
+
+// StorageUsage adds up the sizes of songs, images and artifacts. Image sizes
+// not recorded yet are looked up in storage once and saved.
+func (c *Core) StorageUsage() (*StorageUsage, error) {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	return c.storageUsage(ctx)
+}
+
+func (c *Core) storageUsage(ctx context.Context) (*StorageUsage, error) {
+	artists, albums, songs, artifacts, err := c.repository.ListUsage(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &StorageUsage{
+		Quotas: Quotas{
+			Total:  c.cfg.StorageQuota,
+			Artist: c.cfg.ArtistQuota,
+			Album:  c.cfg.AlbumQuota,
+		},
+		Artists: make([]Usage, 0, len(artists)),
+		Albums:  make([]Usage, 0, len(albums)),
+		Songs:   make([]Usage, 0, len(songs)),
+	}
+
+	derived := make(map[string]map[uint]int64)
+	for _, artifact := range artifacts {
+		if derived[artifact.OwnerType] == nil {
+			derived[artifact.OwnerType] = make(map[uint]int64)
+		}
+		derived[artifact.OwnerType][artifact.OwnerID] += artifact.Size
+	}
+
+	// Everything is added to the library total, deleted items to Trash
+	// and the rest to their own entry and those of their parents
+	artistUsage := make(map[uint]*Usage, len(artists))
+	albumUsage := make(map[uint]*Usage, len(albums))
+	albumArtist := make(map[uint]uint, len(albums))
+	var artistIDs, albumIDs []uint
+
+	for _, artist := range artists {
+		images := c.imageSize(ctx, models.OwnerArtist, artist.ID, artist.ImagePath, artist.ImageSize)
+		usage.Library.add(0, images, derived[models.OwnerArtist][artist.ID])
+		if artist.DeletedAt.Valid {
+			usage.Trash += images + derived[models.OwnerArtist][artist.ID]
+			continue
+		}
+		entry := &Usage{ID: artist.ID, Name: artist.Name}
+		entry.add(0, images, derived[models.OwnerArtist][artist.ID])
+		artistUsage[artist.ID] = entry
+		artistIDs = append(artistIDs, artist.ID)
+	}
+
+	for _, album := range albums {
+		images := c.imageSize(ctx, models.OwnerAlbum, album.ID, album.ImagePath, album.ImageSize)
+		artifacts := derived[models.OwnerAlbum][album.ID]
+		usage.Library.add(0, images, artifacts)
+		albumArtist[album.ID] = album.ArtistID
+		if album.DeletedAt.Valid {
+			usage.Trash += images + artifacts
+			continue
+		}
+		entry := &Usage{ID: album.ID, Name: album.Name}
+		entry.add(0, images, artifacts)
+		if artist := artistUsage[album.ArtistID]; artist != nil {
+			entry.Artist = artist.Name
+			artist.Albums++
+			artist.add(0, images, artifacts)
+		}
+		albumUsage[album.ID] = entry
+		albumIDs = append(albumIDs, album.ID)
+	}
+
+	for _, song := range songs {
+		artifacts := derived[models.OwnerSong][song.ID]
+		usage.Library.add(song.FileSize, 0, artifacts)
+		if song.DeletedAt.Valid {
+			usage.Trash += song.FileSize + artifacts
+			continue
+		}
+		usage.Library.Songs++
+		entry := Usage{ID: song.ID, Name: song.Name}
+		entry.add(song.FileSize, 0, artifacts)
+		if album := albumUsage[song.AlbumID]; album != nil {
+			entry.Album = album.Name
+			entry.Artist = album.Artist
+			album.Songs++
+			album.add(song.FileSize, 0, artifacts)
+		}
+		if artist := artistUsage[albumArtist[song.AlbumID]]; artist != nil {
+			artist.Songs++
+			artist.add(song.FileSize, 0, artifacts)
+		}
+		usage.Songs = append(usage.Songs, entry)
+	}
+
+	for _, id := range artistIDs {
+		usage.Artists = append(usage.Artists, *artistUsage[id])
+	}
+	for _, id := range albumIDs {
+		usage.Albums = append(usage.Albums, *albumUsage[id])
+	}
+	usage.Library.Albums = len(usage.Albums)
+
+	byTotal := func(a, b Usage) int { return cmp.Compare(b.Total, a.Total) }
+	slices.SortStableFunc(usage.Artists, byTotal)
+	slices.SortStableFunc(usage.Albums, byTotal)
+	slices.SortStableFunc(usage.Songs, byTotal)
+
+	return usage, nil
+}
+
+// imageSize returns the recorded size of an image, looking it up in storage
+// and recording it if it isn't known yet
+func (c *Core) imageSize(ctx context.Context, ownerType string, id uint, key string, size int64) int64 {
+	if key == "" || size > 0 {
+		return size
+	}
+
+	info, err := c.images.Stat(ctx, key)
+	if err != nil {
+		return 0
+	}
+	if err := c.repository.UpdateImage(ctx, ownerType, id, map[string]any{"image_size": info.Size}); err != nil {
+		c.logger.Warn().Err(err).Str("key", key).Msg("failed record image size")
+	}
+	return info.Size
+}
+
+// quotaLeft returns how many bytes may still be added to an album, or -1 if
+// no quota applies
+func (c *Core) quotaLeft(ctx context.Context, album *models.Album) (int64, error) {
+	if c.cfg.StorageQuota <= 0 && c.cfg.ArtistQuota <= 0 && c.cfg.AlbumQuota <= 0 {
+		return -1, nil
+	}
+
+	usage, err := c.storageUsage(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	left := int64(-1)
+	limit := func(quota, used int64) {
+		if quota > 0 && (left < 0 || quota-used < left) {
+			left = max(quota-used, 0)
+		}
+	}
+
+	limit(c.cfg.StorageQuota, usage.Library.Total)
+	if i := slices.IndexFunc(usage.Artists, func(u Usage) bool { return u.ID == album.ArtistID }); i >= 0 {
+		limit(c.cfg.ArtistQuota, usage.Artists[i].Total)
+	}
+	if i := slices.IndexFunc(usage.Albums, func(u Usage) bool { return u.ID == album.ID }); i >= 0 {
+		limit(c.cfg.AlbumQuota, usage.Albums[i].Total)
+	}
+
+	return left, nil
+}
+
+// checkQuota fails with ErrQuotaExceeded if size more bytes don't fit in
+// album. Callers hold quotaMu until the bytes are saved, so that two uploads
+// can't both fit in the same space.
+func (c *Core) checkQuota(ctx context.Context, album *models.Album, size int64) error {
+	left, err := c.quotaLeft(ctx, album)
+	if err != nil {
+		return err
+	}
+	if left >= 0 && size > left {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// quotaReader fails with ErrQuotaExceeded once more than left bytes are
+// read, so an upload of unknown size is refused as soon as it is too large
+type quotaReader struct {
+	source io.Reader
+	left   int64
+}
+
+func (r *quotaReader) Read(p []byte) (int, error) {
+	n, err := r.source.Read(p)
+	r.left -= int64(n)
+	if r.left < 0 {
+		return n, ErrQuotaExceeded
+	}
+	return n, err
+}
+
+// artifactStore returns the store an artifact is kept in
+func (c *Core) artifactStore(artifact models.Artifact) storage.Storage {
+	if artifact.Store == models.StoreImages {
+		return c.images
+	}
+	return c.media
+}
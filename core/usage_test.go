@@ -0,0 +1,222 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"maps"
+	"slices"
+	"sync"
+	"testing"
+	"whalio/models"
+)
+
+// createAlbum creates an album and its artist, if needed, and returns it
+func createAlbum(t *testing.T, c *Core, artist, name string, cover io.Reader) *models.Album {
+	t.Helper()
+
+	artists, err := c.GetSomeArtist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.ContainsFunc(artists, func(a models.Artist) bool { return a.Name == artist }) {
+		if err := c.CreateArtist(artist, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.CreateAlbum(name, "", artist, 2020, cover); err != nil {
+		t.Fatal(err)
+	}
+
+	albums, err := c.GetSomeAlbums()
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := slices.IndexFunc(albums, func(a models.Album) bool { return a.Name == name })
+	if i < 0 {
+		t.Fatalf("album %s wasn't created", name)
+	}
+	return &albums[i]
+}
+
+func addSong(t *testing.T, c *Core, album *models.Album, size int) *models.Song {
+	t.Helper()
+
+	song, _, err := c.AddSong("Song", "song.mp3", "audio/mpeg", album.ID, bytes.NewReader(make([]byte, size)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return song
+}
+
+func TestStorageUsage(t *testing.T) {
+	c := newTestCore(t, nil)
+	first := createAlbum(t, c, "Artist", "First", bytes.NewReader(testPNG(t)))
+	second := createAlbum(t, c, "Artist", "Second", nil)
+	other := createAlbum(t, c, "Other", "Other", nil)
+
+	addSong(t, c, first, 100)
+	addSong(t, c, second, 200)
+	addSong(t, c, second, 300)
+	addSong(t, c, other, 400)
+	deleted := addSong(t, c, other, 500)
+	if err := c.DeleteSong(deleted.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	usage, err := c.StorageUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The cover and its thumbnails belong to the first album and its artist
+	cover := usage.Library.Images + usage.Library.Artifacts
+	if usage.Library.Images == 0 || usage.Library.Artifacts == 0 {
+		t.Fatalf("cover counted as %d bytes of images and %d of artifacts", usage.Library.Images, usage.Library.Artifacts)
+	}
+
+	if usage.Library.Files != 1500 || usage.Library.Total != 1500+cover {
+		t.Errorf("library has %d bytes of files and %d in total, want 1500 and %d", usage.Library.Files, usage.Library.Total, 1500+cover)
+	}
+	if usage.Library.Songs != 4 || usage.Library.Albums != 3 {
+		t.Errorf("library has %d songs and %d albums, want 4 and 3", usage.Library.Songs, usage.Library.Albums)
+	}
+	if usage.Trash != 500 {
+		t.Errorf("trash = %d, want 500", usage.Trash)
+	}
+
+	totals := func(usages []Usage) map[string]int64 {
+		totals := make(map[string]int64)
+		for _, u := range usages {
+			totals[u.Name] = u.Total
+		}
+		return totals
+	}
+	if got, want := totals(usage.Artists), map[string]int64{"Artist": 600 + cover, "Other": 400}; !maps.Equal(got, want) {
+		t.Errorf("artists = %v, want %v", got, want)
+	}
+	if got, want := totals(usage.Albums), map[string]int64{"First": 100 + cover, "Second": 500, "Other": 400}; !maps.Equal(got, want) {
+		t.Errorf("albums = %v, want %v", got, want)
+	}
+	if len(usage.Songs) != 4 || usage.Songs[0].Total != 400 || usage.Songs[0].Artist != "Other" || usage.Songs[0].Album != "Other" {
+		t.Errorf("songs = %+v, want 4 led by the 400 bytes in Other", usage.Songs)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	tests := []struct {
+		name                 string
+		total, artist, album int64
+		into                 string
+		size                 int
+		wantErr              error
+	}{
+		{"no quotas", 0, 0, 0, "Full", 10000, nil},
+		{"fits", 1000, 1000, 1000, "Full", 400, nil},
+		{"fills exactly", 1000, 0, 0, "Full", 600, nil},
+		{"over total", 1000, 0, 0, "Full", 601, ErrQuotaExceeded},
+		{"over total in another album", 1000, 0, 0, "Empty", 601, ErrQuotaExceeded},
+		{"over artist", 0, 900, 0, "Full", 501, ErrQuotaExceeded},
+		{"over album", 0, 0, 700, "Full", 401, ErrQuotaExceeded},
+		{"within another album", 0, 0, 400, "Empty", 300, nil},
+		{"full album", 0, 0, 300, "Full", 1, ErrQuotaExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCore(t, nil)
+			albums := map[string]*models.Album{
+				"Full":  createAlbum(t, c, "Artist", "Full", nil),
+				"Empty": createAlbum(t, c, "Artist", "Empty", nil),
+			}
+			addSong(t, c, albums["Full"], 300)
+			addSong(t, c, albums["Empty"], 100)
+
+			c.cfg.StorageQuota, c.cfg.ArtistQuota, c.cfg.AlbumQuota = tt.total, tt.artist, tt.album
+
+			before := listKeys(t, c.media)
+			_, _, err := c.AddSong("Song", "song.mp3", "audio/mpeg", albums[tt.into].ID, bytes.NewReader(make([]byte, tt.size)))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil {
+				return
+			}
+
+			if keys := listKeys(t, c.media); !slices.Equal(keys, before) {
+				t.Errorf("refused upload left blobs behind: %v", keys)
+			}
+			usage, err := c.StorageUsage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if usage.Library.Songs != 2 {
+				t.Errorf("refused upload left a song behind, %d songs", usage.Library.Songs)
+			}
+		})
+	}
+}
+
+func TestQuotaConcurrentUploads(t *testing.T) {
+	c := newTestCore(t, nil)
+	album := createAlbum(t, c, "Artist", "Album", nil)
+	c.cfg.StorageQuota = 1000
+
+	// Every upload has checked the quota and started streaming before any
+	// is saved, so only the check when saving keeps them within it
+	const uploads, size = 10, 300
+	var streaming sync.WaitGroup
+	streaming.Add(uploads)
+	start := make(chan struct{})
+
+	errs := make(chan error, uploads)
+	for range uploads {
+		go func() {
+			source := &gatedReader{source: bytes.NewReader(make([]byte, size)), arrived: &streaming, open: start}
+			_, _, err := c.AddSong("Song", "song.mp3", "audio/mpeg", album.ID, source)
+			errs <- err
+		}()
+	}
+	streaming.Wait()
+	close(start)
+
+	added := 0
+	for range uploads {
+		switch err := <-errs; {
+		case err == nil:
+			added++
+		case !errors.Is(err, ErrQuotaExceeded):
+			t.Errorf("err = %v, want %v", err, ErrQuotaExceeded)
+		}
+	}
+	if added != 1000/size {
+		t.Errorf("added %d songs, want %d", added, 1000/size)
+	}
+
+	usage, err := c.StorageUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Library.Total > c.cfg.StorageQuota {
+		t.Errorf("library takes %d bytes, over the quota of %d", usage.Library.Total, c.cfg.StorageQuota)
+	}
+	if keys := listKeys(t, c.media); len(keys) != added {
+		t.Errorf("%d blobs stored for %d songs: %v", len(keys), added, keys)
+	}
+}
+
+// gatedReader blocks on its first read until open is closed, after telling
+// arrived it got there
+type gatedReader struct {
+	source  io.Reader
+	arrived *sync.WaitGroup
+	open    <-chan struct{}
+	once    sync.Once
+}
+
+func (r *gatedReader) Read(p []byte) (int, error) {
+	r.once.Do(func() {
+		r.arrived.Done()
+		<-r.open
+	})
+	return r.source.Read(p)
+}
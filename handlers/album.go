@@ -49,15 +49,20 @@ func (h *Handlers) GetAlbumSongs(w http.ResponseWriter, r *http.Request) {
 		AlbumID  uint   `json:"albumId"`
 		Artist   string `json:"artist"`
 		MimeType string `json:"mimeType"`
+		// The file is missing, see `whalio fsck`
+		Unavailable bool `json:"unavailable"`
 	}
 	songs := make([]songDTO, 0, len(album.Songs))
 	for _, s := range album.Songs {
-		songs = append(songs, songDTO{ID: s.ID, Name: s.Name, AlbumID: s.AlbumID, Artist: album.Artist.Name, MimeType: s.MimeType})
+		songs = append(songs, songDTO{ID: s.ID, Name: s.Name, AlbumID: s.AlbumID, Artist: album.Artist.Name, MimeType: s.MimeType, Unavailable: s.Unavailable})
 	}
 	_ = h.SendJSON(w, map[string]any{
-		"albumId": album.ID,
-		"album":   album.Name,
-		"artist":  album.Artist.Name,
-		"songs":   songs,
+		"albumId":  album.ID,
+		"album":    album.Name,
+		"artist":   album.Artist.Name,
+		"palette":  album.Colors(),
+		"tint":     album.Tint(),
+		"blurHash": album.BlurHash,
+		"songs":    songs,
 	}, http.StatusOK)
 }
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"whalio/core"
+	"whalio/imaging"
+	"whalio/repository"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Artwork serves album and artist artwork scaled to ?size= pixels, in
+// ?format=jpeg, png or webp. URLs carrying the current ?v= version are
+// cached for a year, others are revalidated on every use.
+func (h *Handlers) Artwork(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 32)
+	if err != nil {
+		h.SendError(w, r, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	size := 0
+	if value := r.URL.Query().Get("size"); value != "" {
+		if size, err = strconv.Atoi(value); err != nil || size < 0 {
+			h.SendError(w, r, "Invalid size", http.StatusBadRequest)
+			return
+		}
+	}
+
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "", imaging.JPEG, imaging.PNG, imaging.WebP:
+	case "jpg":
+		format = imaging.JPEG
+	default:
+		h.SendError(w, r, "Format must be jpeg, png or webp", http.StatusBadRequest)
+		return
+	}
+
+	art, err := h.core.Artwork(r.Context(), chi.URLParam(r, "kind"), uint(id), size, format)
+	switch {
+	case errors.Is(err, core.ErrInvalidArtworkKind),
+		errors.Is(err, repository.ErrAlbumNotFound),
+		errors.Is(err, repository.ErrArtistNotFound):
+		h.SendError(w, r, "Not found", http.StatusNotFound)
+		return
+	case err != nil:
+		h.SendError(w, r, "Failed to load artwork", http.StatusInternalServerError)
+		return
+	}
+	defer art.Close()
+
+	w.Header().Set("Content-Type", imaging.ContentType(art.Format))
+	w.Header().Set("ETag", art.ETag)
+	if art.Version != "" && r.URL.Query().Get("v") == art.Version {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "public, no-cache")
+	}
+
+	http.ServeContent(w, r, "", art.ModTime, art)
+}
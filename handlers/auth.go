@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// requireAdmin lets only requests bearing ADMIN_TOKEN through. Without a
+// token configured administration is off altogether.
+func (h *Handlers) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.cfg.AdminToken == "" {
+			h.SendError(w, r, "Administration is disabled, set ADMIN_TOKEN", http.StatusForbidden)
+			return
+		}
+		if !h.isAdmin(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="whalio"`)
+			h.SendError(w, r, "Admin token required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isAdmin reports whether r has an "Authorization: Bearer" header with
+// the admin token
+func (h *Handlers) isAdmin(r *http.Request) bool {
+	if h.cfg.AdminToken == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(h.cfg.AdminToken)) == 1
+}
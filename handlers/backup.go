@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+	"whalio/backup"
+)
+
+// DownloadBackup streams a backup archive of the whole library
+func (h *Handlers) DownloadBackup(w http.ResponseWriter, r *http.Request) {
+	// Archives of large libraries take longer than the server write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	filename := fmt.Sprintf("whalio-%s.tar.gz", time.Now().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	w.Header().Set("Cache-Control", "no-store")
+
+	if _, err := h.core.Backup(w); err != nil {
+		// The archive is already partly sent, abort the connection so the
+		// client doesn't mistake a truncated download for a complete one
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// RestoreBackup accepts a backup archive as the request body, verifies it
+// and merges it into the library in a background job. Replacing the library
+// is only possible offline with `whalio restore`.
+func (h *Handlers) RestoreBackup(w http.ResponseWriter, r *http.Request) {
+	http.NewResponseController(w).SetReadDeadline(time.Time{})
+
+	dir, manifest, err := h.core.StageBackup(r.Body)
+	if errors.Is(err, backup.ErrInvalidArchive) {
+		h.SendError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		h.SendError(w, r, "Failed to read backup", http.StatusInternalServerError)
+		return
+	}
+
+	job, err := h.core.EnqueueMergeBackup(dir)
+	if err != nil {
+		h.SendError(w, r, "Failed to start restore", http.StatusInternalServerError)
+		return
+	}
+
+	h.SendJSON(w, map[string]any{
+		"success":   true,
+		"jobId":     job.ID,
+		"createdAt": manifest.CreatedAt,
+		"files":     len(manifest.Files),
+	}, http.StatusAccepted)
+}
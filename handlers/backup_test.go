@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+	"whalio/models"
+)
+
+const testAdminToken = "admin-token"
+
+func TestAdminNeedsToken(t *testing.T) {
+	cfg := testConfig(t)
+	disabled := newTestApp(t, cfg)
+	cfg = testConfig(t)
+	cfg.AdminToken = testAdminToken
+	app := newTestApp(t, cfg)
+
+	for _, route := range []string{"GET /api/admin/backup", "POST /api/admin/restore", "GET /api/admin/fsck", "POST /api/admin/fsck"} {
+		var method, target string
+		fmt.Sscan(route, &method, &target)
+
+		if rec := disabled.do(t, method, target, nil, "Authorization: Bearer "+testAdminToken); rec.Code != http.StatusForbidden {
+			t.Errorf("%s without ADMIN_TOKEN = %d, want %d", route, rec.Code, http.StatusForbidden)
+		}
+		if rec := app.do(t, method, target, nil); rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s without token = %d, want %d", route, rec.Code, http.StatusUnauthorized)
+		}
+		if rec := app.do(t, method, target, nil, "Authorization: Bearer wrong"); rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s with wrong token = %d, want %d", route, rec.Code, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestBackupRoundTrip(t *testing.T) {
+	auth := "Authorization: Bearer " + testAdminToken
+	cfg := testConfig(t)
+	cfg.AdminToken = testAdminToken
+	src := newTestApp(t, cfg)
+
+	if err := src.core.CreateArtist("Artist", "Sings", testPNG(t)); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.core.CreateAlbum("Album", "First", "Artist", 2020, testPNG(t)); err != nil {
+		t.Fatal(err)
+	}
+	src.album = true
+	songs := map[string][]byte{
+		"One": bytes.Repeat([]byte("one "), 1000),
+		"Two": bytes.Repeat([]byte("two "), 2000),
+	}
+	for name, content := range songs {
+		src.addSong(t, name, content)
+	}
+
+	rec := src.do(t, http.MethodGet, "/api/admin/backup", nil, auth)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("backup = %d: %s", rec.Code, rec.Body)
+	}
+	archive := rec.Body.Bytes()
+
+	cfg = testConfig(t)
+	cfg.AdminToken = testAdminToken
+	dst := newTestApp(t, cfg)
+	ctx, cancel := context.WithCancel(t.Context())
+	t.Cleanup(func() {
+		cancel()
+		dst.queue.Wait()
+	})
+	if err := dst.queue.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := dst.do(t, http.MethodPost, "/api/admin/restore", bytes.NewReader([]byte("not a backup")), auth); rec.Code != http.StatusBadRequest {
+		t.Errorf("restore of garbage = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	rec = dst.do(t, http.MethodPost, "/api/admin/restore", bytes.NewReader(archive), auth)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("restore = %d: %s", rec.Code, rec.Body)
+	}
+	var accepted struct {
+		JobID uint `json:"jobId"`
+		Files int  `json:"files"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &accepted); err != nil {
+		t.Fatal(err)
+	}
+	waitForJob(t, dst, accepted.JobID)
+
+	album, err := dst.core.GetAlbum(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if album.Name != "Album" || album.Artist.Name != "Artist" || album.Description != "First" {
+		t.Errorf("restored album %q by %q, %q", album.Name, album.Artist.Name, album.Description)
+	}
+	if album.ImagePath == "" {
+		t.Error("album cover wasn't restored")
+	}
+	if len(album.Songs) != len(songs) {
+		t.Fatalf("restored %d songs, want %d", len(album.Songs), len(songs))
+	}
+	for _, song := range album.Songs {
+		rec := dst.do(t, http.MethodGet, fmt.Sprintf("/stream/%d", song.ID), nil)
+		if !bytes.Equal(rec.Body.Bytes(), songs[song.Name]) {
+			t.Errorf("song %q restored with %d bytes, want %d", song.Name, rec.Body.Len(), len(songs[song.Name]))
+		}
+	}
+
+	// Merging again adds nothing
+	rec = dst.do(t, http.MethodPost, "/api/admin/restore", bytes.NewReader(archive), auth)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("second restore = %d: %s", rec.Code, rec.Body)
+	}
+	json.Unmarshal(rec.Body.Bytes(), &accepted)
+	waitForJob(t, dst, accepted.JobID)
+	if album, err = dst.core.GetAlbum(1); err != nil || len(album.Songs) != len(songs) {
+		t.Errorf("second restore left %d songs, want %d: %v", len(album.Songs), len(songs), err)
+	}
+}
+
+// waitForJob waits until the job is done, failing the test if it failed
+func waitForJob(t *testing.T, app *testApp, id uint) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		job, err := app.core.GetJob(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch job.Status {
+		case models.JobDone:
+			return
+		case models.JobFailed:
+			t.Fatalf("job %d failed: %s", id, job.Error)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("job %d didn't finish", id)
+}
+
+// testPNG returns a small PNG
+func testPNG(t *testing.T) io.Reader {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for x := range 64 {
+		for y := range 64 {
+			img.Set(x, y, color.RGBA{uint8(x * 4), uint8(y * 4), 128, 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
@@ -1,11 +1,14 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 )
 
 func (h *Handlers) CreateAlbum(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, h.cfg.MaxImageUploadSize)
+
 	name := r.FormValue("name")
 	yearStr := r.FormValue("year")
 
@@ -18,14 +21,19 @@ func (h *Handlers) CreateAlbum(w http.ResponseWriter, r *http.Request) {
 	artist := r.FormValue("artist")
 	desc := r.FormValue("desc")
 
+	// The cover is optional, artwork is generated for albums without
 	file, _, err := r.FormFile("file")
-	if err != nil {
+	switch {
+	case errors.Is(err, http.ErrMissingFile):
+	case err != nil:
 		h.SendError(w, r, "failed get file from form", http.StatusBadRequest)
 		return
+	default:
+		defer file.Close()
 	}
 
 	if err = h.core.CreateAlbum(name, desc, artist, year, file); err != nil {
-		h.SendError(w, r, "failed create album", http.StatusInternalServerError)
+		h.sendImageError(w, r, err, "failed create album")
 		return
 	}
 }
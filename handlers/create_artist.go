@@ -1,23 +1,31 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
+	"whalio/imaging"
 )
 
 // CreateArtist handles creating a new artist
 func (h *Handlers) CreateArtist(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, h.cfg.MaxImageUploadSize)
+
 	name := r.FormValue("name")
 	desc := r.FormValue("desc")
 
+	// The image is optional, artwork is generated for artists without
 	file, _, err := r.FormFile("file")
-	if err != nil {
+	switch {
+	case errors.Is(err, http.ErrMissingFile):
+	case err != nil:
 		h.SendError(w, r, "failed get file from form", http.StatusBadRequest)
 		return
+	default:
+		defer file.Close()
 	}
-	defer file.Close()
 
 	if err := h.core.CreateArtist(name, desc, file); err != nil {
-		h.SendError(w, r, "failed create artist", http.StatusInternalServerError)
+		h.sendImageError(w, r, err, "failed create artist")
 		return
 	}
 
@@ -33,3 +41,16 @@ func (h *Handlers) CreateArtist(w http.ResponseWriter, r *http.Request) {
 		"message": "Artist created successfully",
 	}, http.StatusOK)
 }
+
+// sendImageError reports a rejected image as a client error and anything
+// else with msg
+func (h *Handlers) sendImageError(w http.ResponseWriter, r *http.Request, err error, msg string) {
+	switch {
+	case errors.Is(err, imaging.ErrInvalidImage):
+		h.SendError(w, r, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, imaging.ErrTooLarge):
+		h.SendError(w, r, err.Error(), http.StatusRequestEntityTooLarge)
+	default:
+		h.SendError(w, r, msg, http.StatusInternalServerError)
+	}
+}
@@ -1,23 +1,64 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
+	"whalio/core"
+	"whalio/repository"
 
 	"github.com/go-chi/chi/v5"
 )
 
+// DeleteAlbum moves an album with its songs to the trash, their files are
+// deleted when it's purged. With ?dry_run=true nothing is moved, the
+// response only lists what would be.
 func (h *Handlers) DeleteAlbum(w http.ResponseWriter, r *http.Request) {
-	idStr := chi.URLParam(r, "id")
+	h.deleteWithPlan(w, r, h.core.PlanAlbumDeletion, h.core.DeleteAlbum)
+}
+
+// DeleteArtist moves an artist with all of its albums and songs to the
+// trash, their files are deleted when it's purged. With ?dry_run=true nothing
+// is moved, the response only lists what would be.
+func (h *Handlers) DeleteArtist(w http.ResponseWriter, r *http.Request) {
+	h.deleteWithPlan(w, r, h.core.PlanArtistDeletion, h.core.DeleteArtist)
+}
 
-	id, err := strconv.Atoi(idStr)
+func (h *Handlers) deleteWithPlan(w http.ResponseWriter, r *http.Request, plan, remove func(uint) (*core.DeletionPlan, error)) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 32)
 	if err != nil {
-		h.SendError(w, r, "failed convert id to int", http.StatusBadRequest)
+		h.SendError(w, r, "Invalid ID", http.StatusBadRequest)
 		return
 	}
 
-	if err := h.core.DeleteAlbum(uint(id)); err != nil {
-		h.SendError(w, r, "failed delete album", http.StatusInternalServerError)
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+
+	var deleted *core.DeletionPlan
+	if dryRun {
+		deleted, err = plan(uint(id))
+	} else {
+		deleted, err = remove(uint(id))
+	}
+	switch {
+	case errors.Is(err, repository.ErrAlbumNotFound), errors.Is(err, repository.ErrArtistNotFound):
+		h.SendError(w, r, "Not found", http.StatusNotFound)
 		return
+	case err != nil:
+		h.SendError(w, r, "Failed to delete", http.StatusInternalServerError)
+		return
+	}
+
+	if !dryRun && IsHTMXRequest(r) {
+		w.Header().Set("HX-Redirect", "/library")
 	}
+
+	h.SendJSON(w, map[string]any{
+		"success": true,
+		"dryRun":  dryRun,
+		"artists": deleted.Artists,
+		"albums":  deleted.Albums,
+		"songs":   deleted.Songs,
+		"files":   deleted.Files,
+		"bytes":   deleted.Bytes,
+	}, http.StatusOK)
 }
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"whalio/core"
+)
+
+func TestDeleteAlbumDryRun(t *testing.T) {
+	app := newTestApp(t, testConfig(t))
+	app.addSong(t, "One", []byte("first song"))
+	app.addSong(t, "Two", []byte("second song"))
+
+	deleteAlbum := func(target string) (bool, core.DeletionPlan) {
+		t.Helper()
+
+		rec := app.do(t, http.MethodDelete, target, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("DELETE %s = %d: %s", target, rec.Code, rec.Body)
+		}
+		var body struct {
+			DryRun bool `json:"dryRun"`
+			core.DeletionPlan
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		return body.DryRun, body.DeletionPlan
+	}
+
+	want := core.DeletionPlan{Albums: 1, Songs: 2, Files: 2, Bytes: int64(len("first song") + len("second song"))}
+	dryRun, plan := deleteAlbum("/api/albums/1?dry_run=true")
+	if !dryRun || plan != want {
+		t.Errorf("dry run = %v, %+v, want %+v", dryRun, plan, want)
+	}
+	if _, err := app.core.GetAlbum(1); err != nil {
+		t.Fatalf("dry run deleted the album: %v", err)
+	}
+
+	dryRun, deleted := deleteAlbum("/api/albums/1")
+	if dryRun || deleted != plan {
+		t.Errorf("deleted %+v, the dry run said %+v", deleted, plan)
+	}
+	if _, err := app.core.GetAlbum(1); err == nil {
+		t.Error("album still there after delete")
+	}
+
+	trash, err := app.core.ListTrash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trash) != 1 || trash[0].Kind != core.TrashAlbum || trash[0].Songs != plan.Songs || trash[0].Bytes != plan.Bytes {
+		t.Errorf("trash = %+v, want the album with %d songs", trash, plan.Songs)
+	}
+
+	for target, want := range map[string]int{
+		"/api/albums/1":               http.StatusNotFound,
+		"/api/albums/1?dry_run=true":  http.StatusNotFound,
+		"/api/artists/9?dry_run=true": http.StatusNotFound,
+		"/api/albums/first":           http.StatusBadRequest,
+	} {
+		if rec := app.do(t, http.MethodDelete, target, nil); rec.Code != want {
+			t.Errorf("DELETE %s = %d, want %d", target, rec.Code, want)
+		}
+	}
+}
+
+func TestDeleteArtistDryRun(t *testing.T) {
+	app := newTestApp(t, testConfig(t))
+	app.addSong(t, "One", []byte("first song"))
+	if err := app.core.CreateAlbum("Second", "", "Artist", 2021, testPNG(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := app.do(t, http.MethodDelete, "/api/artists/1?dry_run=true", nil)
+	var plan core.DeletionPlan
+	if err := json.NewDecoder(rec.Body).Decode(&plan); err != nil {
+		t.Fatal(err)
+	}
+	// The size of the cover depends on the encoder, only the song's is known
+	want := core.DeletionPlan{Artists: 1, Albums: 2, Songs: 1, Files: 2, Bytes: plan.Bytes}
+	if plan != want || plan.Bytes <= int64(len("first song")) {
+		t.Errorf("dry run = %+v, want %+v with the song and the cover", plan, want)
+	}
+
+	rec = app.do(t, http.MethodDelete, "/api/artists/1", nil)
+	var deleted core.DeletionPlan
+	if err := json.NewDecoder(rec.Body).Decode(&deleted); err != nil {
+		t.Fatal(err)
+	}
+	if deleted != plan {
+		t.Errorf("deleted %+v, the dry run said %+v", deleted, plan)
+	}
+	if _, err := app.core.GetArtist(1); err == nil {
+		t.Error("artist still there after delete")
+	}
+}
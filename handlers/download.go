@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+	"whalio/core"
+	"whalio/repository"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// DownloadAlbum streams a ZIP archive of an album's songs, cover and
+// playlist
+func (h *Handlers) DownloadAlbum(w http.ResponseWriter, r *http.Request) {
+	albumID, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 32)
+	if err != nil {
+		h.SendError(w, r, "Invalid album ID", http.StatusBadRequest)
+		return
+	}
+	if !h.authorizeArchive(w, r, uint(albumID)) {
+		return
+	}
+
+	download, err := h.core.AlbumDownload(r.Context(), uint(albumID))
+	h.serveDownload(w, r, download, err)
+}
+
+// DownloadArtist streams a ZIP archive of all albums of an artist
+func (h *Handlers) DownloadArtist(w http.ResponseWriter, r *http.Request) {
+	artistID, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 32)
+	if err != nil {
+		h.SendError(w, r, "Invalid artist ID", http.StatusBadRequest)
+		return
+	}
+	if !h.authorizeArchive(w, r, 0) {
+		return
+	}
+
+	download, err := h.core.ArtistDownload(r.Context(), uint(artistID))
+	h.serveDownload(w, r, download, err)
+}
+
+// serveDownload sends an archive with its Content-Length, so browsers show
+// progress, or the error preparing it
+func (h *Handlers) serveDownload(w http.ResponseWriter, r *http.Request, download *core.Download, err error) {
+	switch {
+	case errors.Is(err, repository.ErrAlbumNotFound), errors.Is(err, repository.ErrArtistNotFound):
+		h.SendError(w, r, "Not found", http.StatusNotFound)
+		return
+	case errors.Is(err, core.ErrEmptyDownload):
+		h.SendError(w, r, "There are no songs to download", http.StatusNotFound)
+		return
+	case err != nil:
+		h.SendError(w, r, "Failed to prepare download", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Length", strconv.FormatInt(download.Size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": download.Name}))
+	w.Header().Set("Last-Modified", download.ModTime.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	// Archives take longer than the server write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	if err := download.WriteTo(r.Context(), w); err != nil {
+		// Abort rather than end the response short of its Content-Length
+		panic(http.ErrAbortHandler)
+	}
+}
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"strconv"
+	"testing"
+	"whalio/storage"
+
+	"github.com/rs/zerolog"
+)
+
+func TestDownloadAlbumWithMissingSong(t *testing.T) {
+	cfg := testConfig(t)
+	app := newTestApp(t, cfg)
+	app.addSong(t, "Kept", []byte("kept song"))
+	missing := app.addSong(t, "Missing", []byte("missing song"))
+
+	song, err := app.core.GetSongByID(missing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := zerolog.Nop()
+	media, err := storage.NewLocal(&logger, cfg.UploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := media.Delete(t.Context(), song.StorageKey); err != nil {
+		t.Fatal(err)
+	}
+
+	// The archive announced is the archive sent, without the missing song
+	rec := app.do(t, http.MethodGet, "/api/album/1/download", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("download = %d: %s", rec.Code, rec.Body)
+	}
+	if length := rec.Header().Get("Content-Length"); length != strconv.Itoa(rec.Body.Len()) {
+		t.Errorf("Content-Length %s, sent %d bytes", length, rec.Body.Len())
+	}
+	archive, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range archive.File {
+		names = append(names, file.Name)
+	}
+	if len(names) != 2 || names[0] != "01 - Kept.mp3" || names[1] != "Album.m3u8" {
+		t.Errorf("archive holds %v, want the kept song and the playlist", names)
+	}
+}
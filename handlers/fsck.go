@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+	"whalio/core"
+)
+
+// Fsck checks the library for missing and orphaned files and returns the
+// report. GET only reports, POST also repairs what the repair form value
+// selects (orphans, missing or all). hashes=true reads every song file,
+// which takes long on large libraries, `whalio fsck` is better suited then.
+func (h *Handlers) Fsck(w http.ResponseWriter, r *http.Request) {
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	var opts core.FsckOptions
+	opts.Hashes, _ = strconv.ParseBool(r.FormValue("hashes"))
+
+	if r.Method == http.MethodPost {
+		repair, err := core.ParseFsckRepair(r.FormValue("repair"))
+		if err != nil {
+			h.SendError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if repair == 0 {
+			repair = core.RepairAll
+		}
+		opts.Repair = repair
+	}
+
+	// Repairs must not be cut short by the request timeout
+	report, err := h.core.Fsck(context.WithoutCancel(r.Context()), opts, nil)
+	if errors.Is(err, core.ErrMediaMigrationPending) {
+		h.SendError(w, r, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		h.SendError(w, r, "Failed to check library", http.StatusInternalServerError)
+		return
+	}
+
+	h.SendJSON(w, report, http.StatusOK)
+}
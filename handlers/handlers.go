@@ -3,20 +3,36 @@ package handlers
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
+	"whalio/config"
 	"whalio/core"
+	"whalio/signing"
+	"whalio/streamlimit"
 
 	"github.com/go-chi/chi/v5"
 )
 
 type Handlers struct {
-	core *core.Core
+	core    *core.Core
+	cfg     *config.Config
+	signer  *signing.Signer // nil if URLs aren't signed
+	streams *streamlimit.Limiter
 }
 
-func New(core *core.Core) *Handlers {
+func New(core *core.Core, cfg *config.Config, signer *signing.Signer) *Handlers {
 	return &Handlers{
-		core: core,
+		core:   core,
+		cfg:    cfg,
+		signer: signer,
+		streams: streamlimit.New(streamlimit.Limits{
+			PerClient:  cfg.MaxStreamsPerClient,
+			StreamRate: cfg.StreamRateLimit,
+			EgressRate: cfg.EgressRateLimit,
+		}),
 	}
 }
 
@@ -24,7 +40,6 @@ func New(core *core.Core) *Handlers {
 func (h *Handlers) RegisterRoutes(r *chi.Mux) {
 	// Static files
 	r.Handle("/static/*", http.StripPrefix("/static/", http.FileServer(http.Dir("static/"))))
-	r.Handle("/images/*", http.StripPrefix("/images/", http.FileServer(http.Dir("images/"))))
 
 	// Page routes
 	r.Get("/", h.Index)
@@ -35,9 +50,24 @@ func (h *Handlers) RegisterRoutes(r *chi.Mux) {
 	r.Get("/create/album", h.CreateAlbumPage)
 	r.Get("/create/artist", h.CreateArtistPage)
 	r.Get("/upload", h.UploadSongsPage)
-
-	// Streaming routes
-	r.Get("/stream/{id}", h.StreamAudio)
+	r.Get("/trash", h.Trash)
+	r.Get("/admin/usage", h.Usage)
+
+	// Streaming routes, see IsStreamRequest
+	r.Group(func(r chi.Router) {
+		r.Use(h.limitStreams)
+		r.Get("/stream/{id}", h.StreamAudio)
+		r.Head("/stream/{id}", h.StreamAudio)
+		r.Get("/download/{id}", h.DownloadSong)
+		r.Head("/download/{id}", h.DownloadSong)
+		r.Get("/stream/{id}/hls/index.m3u8", h.HLSMasterPlaylist)
+		r.Get("/stream/{id}/hls/{bitrate}/index.m3u8", h.HLSMediaPlaylist)
+		r.Get("/stream/{id}/hls/{bitrate}/{segment}.ts", h.HLSSegment)
+		r.Get("/api/album/{id}/download", h.DownloadAlbum)
+		r.Head("/api/album/{id}/download", h.DownloadAlbum)
+		r.Get("/api/artist/{id}/download", h.DownloadArtist)
+		r.Head("/api/artist/{id}/download", h.DownloadArtist)
+	})
 
 	// API routes
 	r.Route("/api", func(r chi.Router) {
@@ -46,12 +76,30 @@ func (h *Handlers) RegisterRoutes(r *chi.Mux) {
 		r.Post("/songs/upload", h.UploadSongs)
 		r.Get("/stats", h.GetStats)
 		r.Get("/search", h.SearchContent)
-		r.Get("/delete/album/{id}", h.DeleteAlbum)
-		r.Get("/delete/artist/{id}", h.DeleteArtist)
+		r.Delete("/albums/{id}", h.DeleteAlbum)
+		r.Delete("/artists/{id}", h.DeleteArtist)
+		r.Get("/trash", h.ListTrash)
+		r.Post("/trash", h.RestoreFromTrash)
+		r.Get("/artwork/{kind}/{id}", h.Artwork)
+		r.With(h.requireAdmin).Post("/links", h.CreateLink)
 		// Player endpoints
 		r.Get("/song/{id}", h.GetSongInfo)
+		r.Patch("/songs/{id}", h.UpdateSong)
+		r.Delete("/songs/{id}", h.DeleteSong)
 		// Album endpoints
 		r.Get("/album/{id}/songs", h.GetAlbumSongs)
+		// Background jobs
+		r.Get("/jobs", h.ListJobs)
+		r.Get("/jobs/{id}", h.GetJob)
+		r.Get("/jobs/{id}/events", h.JobEvents)
+		// Administration
+		r.Route("/admin", func(r chi.Router) {
+			r.Use(h.requireAdmin)
+			r.Get("/backup", h.DownloadBackup)
+			r.Post("/restore", h.RestoreBackup)
+			r.Get("/fsck", h.Fsck)
+			r.Post("/fsck", h.Fsck)
+		})
 	})
 
 	// Health check
@@ -63,6 +111,62 @@ func IsHTMXRequest(r *http.Request) bool {
 	return r.Header.Get("HX-Request") == "true"
 }
 
+// IsStreamRequest reports whether r is for a stream or download, which
+// are limited by limitStreams instead of the global request throttle
+func IsStreamRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/stream/") || strings.HasPrefix(r.URL.Path, "/download/") ||
+		(strings.HasPrefix(r.URL.Path, "/api/") && strings.HasSuffix(r.URL.Path, "/download"))
+}
+
+// IsLongLived reports whether r is served for as long as it takes, rather
+// than within the request timeout: streams, downloads, song uploads, job
+// event streams and administration, such as backups
+func IsLongLived(r *http.Request) bool {
+	return IsStreamRequest(r) || strings.HasPrefix(r.URL.Path, "/api/admin/") ||
+		(r.Method == http.MethodPost && r.URL.Path == "/api/songs/upload") ||
+		(strings.HasPrefix(r.URL.Path, "/api/jobs/") && strings.HasSuffix(r.URL.Path, "/events"))
+}
+
+// ExceptLongLived applies middleware to all but long lived requests, to
+// keep request timeouts and the throttle off them
+func ExceptLongLived(middleware func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		wrapped := middleware(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if IsLongLived(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			wrapped.ServeHTTP(w, r)
+		})
+	}
+}
+
+// limitStreams refuses streams past the per client limit and shapes the
+// others to the stream and egress rates. Streams take as long as they
+// take at the shaped rate, so the server write timeout is lifted.
+func (h *Handlers) limitStreams(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// RealIP has replaced the address with the forwarded one if it came
+		// through a trusted proxy
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+
+		release, ok := h.streams.Acquire(client)
+		if !ok {
+			w.Header().Set("Retry-After", "5")
+			h.SendError(w, r, "Too many concurrent streams", http.StatusTooManyRequests)
+			return
+		}
+		defer release()
+
+		http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		next.ServeHTTP(h.streams.ResponseWriter(r.Context(), w), r)
+	})
+}
+
 // Utility function to get client IP
 func GetClientIP(r *http.Request) string {
 	ip := r.Header.Get("X-Real-IP")
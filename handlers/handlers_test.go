@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"whalio/config"
+	"whalio/core"
+	"whalio/jobs"
+	"whalio/repository"
+	"whalio/signing"
+	"whalio/storage"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+)
+
+// testSigningKey signs URLs in tests that turn signing on
+var testSigningKey = []byte("0123456789abcdef0123456789abcdef")
+
+// testConfig returns the defaults of config.Load, with everything stored
+// below a temporary directory
+func testConfig(t *testing.T) *config.Config {
+	t.Helper()
+
+	dir := t.TempDir()
+	return &config.Config{
+		DatabasePath:       filepath.Join(dir, "database.db"),
+		UploadDir:          filepath.Join(dir, "files"),
+		ImageDir:           filepath.Join(dir, "images"),
+		MaxUploadSize:      config.DefaultMaxUploadSize,
+		MaxImageUploadSize: config.DefaultMaxImageUploadSize,
+		SignedURLTTL:       config.DefaultSignedURLTTL,
+		HLSSegmentDuration: config.DefaultHLSSegmentDuration,
+		TrashRetention:     config.DefaultTrashRetention,
+		JobWorkers:         1,
+		JobTimeout:         time.Minute,
+		JobMaxAttempts:     1,
+	}
+}
+
+// testApp is a library served by handlers, backed by local storage and a
+// SQLite database in a temporary directory
+type testApp struct {
+	cfg     *config.Config
+	core    *core.Core
+	queue   *jobs.Queue
+	handler http.Handler
+	album   bool // Whether addSong created its album
+}
+
+func newTestApp(t *testing.T, cfg *config.Config) *testApp {
+	t.Helper()
+
+	logger := zerolog.Nop()
+	media, err := storage.NewLocal(&logger, cfg.UploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	images, err := storage.NewLocal(&logger, cfg.ImageDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, err := repository.Open(&logger, cfg.DatabasePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { repo.Close() })
+
+	queue := jobs.NewQueue(&logger, repo, jobs.Options{
+		Workers:      cfg.JobWorkers,
+		Timeout:      cfg.JobTimeout,
+		MaxAttempts:  cfg.JobMaxAttempts,
+		PollInterval: 50 * time.Millisecond,
+		RetryBackoff: time.Second,
+	})
+
+	var signer *signing.Signer
+	if cfg.Signing() {
+		if signer, err = signing.NewSigner([][]byte{testSigningKey}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := core.NewCore(&logger, repo, media, images, queue, nil, cfg, 10*time.Second)
+	r := chi.NewRouter()
+	New(c, cfg, signer).RegisterRoutes(r)
+
+	return &testApp{cfg: cfg, core: c, queue: queue, handler: r}
+}
+
+// addSong adds a song with content to a new album "Album" by "Artist",
+// creating them on first use, and returns its id
+func (a *testApp) addSong(t *testing.T, name string, content []byte) uint {
+	t.Helper()
+
+	if !a.album {
+		a.album = true
+		if err := a.core.CreateArtist("Artist", "", nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.core.CreateAlbum("Album", "", "Artist", 2020, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	song, _, err := a.core.AddSong(name, name+".mp3", "audio/mpeg", 1, bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return song.ID
+}
+
+// do serves a request, header holds "Name: value" lines
+func (a *testApp) do(t *testing.T, method, target string, body io.Reader, header ...string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(method, target, body)
+	for _, line := range header {
+		name, value, _ := strings.Cut(line, ": ")
+		req.Header.Add(name, value)
+	}
+	rec := httptest.NewRecorder()
+	a.handler.ServeHTTP(rec, req)
+	return rec
+}
@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"whalio/core"
+	"whalio/repository"
+	"whalio/signing"
+	"whalio/transcode"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// HLSMasterPlaylist serves the HLS master playlist of a song
+func (h *Handlers) HLSMasterPlaylist(w http.ResponseWriter, r *http.Request) {
+	songID, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 32)
+	if err != nil {
+		h.SendError(w, r, "Invalid song ID", http.StatusBadRequest)
+		return
+	}
+
+	if !h.authorize(w, r, signing.ActionStream, uint(songID)) {
+		return
+	}
+
+	playlist, err := h.core.HLSMasterPlaylist(uint(songID), signedQuery(r))
+	if err != nil {
+		h.sendHLSError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", transcode.HLSContentType)
+	w.Write(playlist)
+}
+
+// HLSMediaPlaylist serves the segment playlist of one bitrate of a song
+func (h *Handlers) HLSMediaPlaylist(w http.ResponseWriter, r *http.Request) {
+	songID, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 32)
+	if err != nil {
+		h.SendError(w, r, "Invalid song ID", http.StatusBadRequest)
+		return
+	}
+	bitrate, err := strconv.Atoi(chi.URLParam(r, "bitrate"))
+	if err != nil {
+		h.SendError(w, r, "Invalid bitrate", http.StatusBadRequest)
+		return
+	}
+
+	if !h.authorize(w, r, signing.ActionStream, uint(songID)) {
+		return
+	}
+
+	playlist, err := h.core.HLSMediaPlaylist(uint(songID), bitrate, signedQuery(r))
+	if err != nil {
+		h.sendHLSError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", transcode.HLSContentType)
+	w.Write(playlist)
+}
+
+// HLSSegment serves an HLS segment, transcoding it first if it isn't
+// cached yet
+func (h *Handlers) HLSSegment(w http.ResponseWriter, r *http.Request) {
+	songID, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 32)
+	if err != nil {
+		h.SendError(w, r, "Invalid song ID", http.StatusBadRequest)
+		return
+	}
+	bitrate, err := strconv.Atoi(chi.URLParam(r, "bitrate"))
+	if err != nil {
+		h.SendError(w, r, "Invalid bitrate", http.StatusBadRequest)
+		return
+	}
+	segment, err := strconv.Atoi(chi.URLParam(r, "segment"))
+	if err != nil {
+		h.SendError(w, r, "Invalid segment", http.StatusBadRequest)
+		return
+	}
+
+	if !h.authorize(w, r, signing.ActionStream, uint(songID)) {
+		return
+	}
+
+	stream, err := h.core.HLSSegment(r.Context(), uint(songID), bitrate, segment)
+	if err != nil {
+		h.sendHLSError(w, r, err)
+		return
+	}
+
+	h.serveStream(w, r, stream, "inline")
+}
+
+func (h *Handlers) sendHLSError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, core.ErrHLSDisabled):
+		h.SendError(w, r, "HLS is not available", http.StatusNotImplemented)
+	case errors.Is(err, core.ErrDurationUnknown):
+		h.SendError(w, r, "Song duration is unknown, it can't be streamed over HLS", http.StatusUnprocessableEntity)
+	case errors.Is(err, repository.ErrSongNotFound), errors.Is(err, core.ErrHLSNotFound):
+		h.SendError(w, r, "Not found", http.StatusNotFound)
+	default:
+		h.SendError(w, r, "Failed to stream song", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"whalio/jobs"
+	"whalio/models"
+	"whalio/repository"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+)
+
+// sseHeartbeat keeps idle event streams from being closed by proxies
+const sseHeartbeat = 15 * time.Second
+
+// ListJobs returns recent jobs, optionally filtered with ?status=queued,running
+func (h *Handlers) ListJobs(w http.ResponseWriter, r *http.Request) {
+	var statuses []models.JobStatus
+	if status := r.URL.Query().Get("status"); status != "" {
+		for _, s := range strings.Split(status, ",") {
+			statuses = append(statuses, models.JobStatus(strings.TrimSpace(s)))
+		}
+	}
+
+	list, err := h.core.ListJobs(50, statuses...)
+	if err != nil {
+		h.SendError(w, r, "Failed to list jobs", http.StatusInternalServerError)
+		return
+	}
+
+	events := make([]jobs.Event, 0, len(list))
+	for i := range list {
+		events = append(events, jobs.NewEvent(&list[i]))
+	}
+
+	h.SendJSON(w, map[string]any{"jobs": events}, http.StatusOK)
+}
+
+// GetJob returns the current state of a single job
+func (h *Handlers) GetJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := h.loadJob(w, r)
+	if !ok {
+		return
+	}
+
+	h.SendJSON(w, jobs.NewEvent(job), http.StatusOK)
+}
+
+// jobSubscribed runs between subscribing to a job and loading it in
+// JobEvents, tests use it to finish the job right then
+var jobSubscribed = func(id uint) {}
+
+// JobEvents streams job progress as Server-Sent Events. The current state is
+// sent first so clients that reconnect never miss the final status.
+func (h *Handlers) JobEvents(w http.ResponseWriter, r *http.Request) {
+	id, ok := h.jobID(w, r)
+	if !ok {
+		return
+	}
+
+	// Subscribe before loading the snapshot so no update falls in between
+	events, unsubscribe := h.core.SubscribeJob(id)
+	defer unsubscribe()
+	jobSubscribed(id)
+
+	job, ok := h.findJob(w, r, id)
+	if !ok {
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	// Event streams outlive the server write timeout
+	rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprint(w, "retry: 2000\n\n")
+	if err := writeJobEvent(w, rc, jobs.NewEvent(job)); err != nil || job.IsFinished() {
+		return
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case event := <-events:
+			if err := writeJobEvent(w, rc, event); err != nil {
+				return
+			}
+			if event.Status == models.JobDone || event.Status == models.JobFailed {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			rc.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeJobEvent(w http.ResponseWriter, rc *http.ResponseController, event jobs.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Status, data); err != nil {
+		return err
+	}
+
+	return rc.Flush()
+}
+
+func (h *Handlers) loadJob(w http.ResponseWriter, r *http.Request) (*models.Job, bool) {
+	id, ok := h.jobID(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	return h.findJob(w, r, id)
+}
+
+func (h *Handlers) jobID(w http.ResponseWriter, r *http.Request) (uint, bool) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 32)
+	if err != nil {
+		h.SendError(w, r, "Invalid job ID", http.StatusBadRequest)
+		return 0, false
+	}
+
+	return uint(id), true
+}
+
+func (h *Handlers) findJob(w http.ResponseWriter, r *http.Request, id uint) (*models.Job, bool) {
+	job, err := h.core.GetJob(id)
+	if err != nil {
+		if errors.Is(err, repository.ErrJobNotFound) {
+			h.SendError(w, r, "Job not found", http.StatusNotFound)
+		} else {
+			h.SendError(w, r, "Failed to get job", http.StatusInternalServerError)
+		}
+		return nil, false
+	}
+
+	return job, true
+}
@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+	"whalio/jobs"
+	"whalio/models"
+)
+
+func TestJobEventsOutliveTimeouts(t *testing.T) {
+	app := newTestApp(t, testConfig(t))
+
+	// Reports progress for a second, well past the timeouts
+	app.queue.Register("slow", func(ctx context.Context, job *models.Job, progress jobs.ProgressFunc) error {
+		for percent := 10; percent < 100; percent += 10 {
+			select {
+			case <-time.After(100 * time.Millisecond):
+				progress(percent, "")
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	})
+	ctx, cancel := context.WithCancel(t.Context())
+	t.Cleanup(func() {
+		cancel()
+		app.queue.Wait()
+	})
+	if err := app.queue.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	job, err := app.queue.Enqueue(ctx, "slow", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := serveWithTimeouts(t, app, 300*time.Millisecond)
+	resp, err := http.Get(fmt.Sprintf("%s/api/jobs/%d/events", srv.URL, job.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	start := time.Now()
+	var last string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if event, ok := strings.CutPrefix(scanner.Text(), "event: "); ok {
+			last = event
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("events cut off after %s: %v", time.Since(start), err)
+	}
+
+	if last != string(models.JobDone) {
+		t.Errorf("last event %q after %s, want %q", last, time.Since(start), models.JobDone)
+	}
+}
+
+func TestJobEventsFinishedWhileSubscribing(t *testing.T) {
+	app := newTestApp(t, testConfig(t))
+
+	finish := make(chan struct{})
+	app.queue.Register("gated", func(ctx context.Context, job *models.Job, progress jobs.ProgressFunc) error {
+		select {
+		case <-finish:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	ctx, cancel := context.WithCancel(t.Context())
+	t.Cleanup(func() {
+		cancel()
+		app.queue.Wait()
+	})
+	if err := app.queue.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	job, err := app.queue.Enqueue(ctx, "gated", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for job.Status != models.JobRunning {
+		time.Sleep(10 * time.Millisecond)
+		if job, err = app.core.GetJob(job.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The job finishes after the handler subscribed, before it loads the
+	// snapshot, so its final event has to come from one or the other
+	subscribed := jobSubscribed
+	jobSubscribed = func(id uint) {
+		close(finish)
+		waitForJob(t, app, id)
+	}
+	t.Cleanup(func() { jobSubscribed = subscribed })
+
+	srv := serveWithTimeouts(t, app, 10*time.Second)
+	reqCtx, cancelReq := context.WithTimeout(t.Context(), 3*time.Second)
+	defer cancelReq()
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, fmt.Sprintf("%s/api/jobs/%d/events", srv.URL, job.ID), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var events []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if event, ok := strings.CutPrefix(scanner.Text(), "event: "); ok {
+			events = append(events, event)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("stream didn't end after events %v: %v", events, err)
+	}
+	if len(events) == 0 || events[len(events)-1] != string(models.JobDone) {
+		t.Errorf("events = %v, want them to end with %q", events, models.JobDone)
+	}
+}
@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// serveWithTimeouts serves app like the server does, with a request timeout
+// and a server write timeout of d
+func serveWithTimeouts(t *testing.T, app *testApp, d time.Duration) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewUnstartedServer(ExceptLongLived(middleware.Timeout(d))(app.handler))
+	srv.Config.WriteTimeout = d
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestShapedStreamOutlivesTimeouts(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.StreamRateLimit = 16 << 10
+	app := newTestApp(t, cfg)
+	content := bytes.Repeat([]byte("whale song "), 4<<10) // 44 KiB, over 1.5s
+	id := app.addSong(t, "Song", content)
+
+	srv := serveWithTimeouts(t, app, 300*time.Millisecond)
+	start := time.Now()
+	resp, err := http.Get(fmt.Sprintf("%s/stream/%d", srv.URL, id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("stream cut off after %s: %v", time.Since(start), err)
+	}
+
+	if !bytes.Equal(body, content) {
+		t.Errorf("got %d bytes, want %d", len(body), len(content))
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("stream took %s, it wasn't shaped", elapsed)
+	}
+}
+
+func TestStreamsPerClient(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.MaxStreamsPerClient = 1
+	cfg.StreamRateLimit = 1 << 10
+	app := newTestApp(t, cfg)
+	id := app.addSong(t, "Song", bytes.Repeat([]byte("x"), 2<<10))
+	target := fmt.Sprintf("/stream/%d", id)
+
+	// The first stream takes a second at 1 KiB/s
+	var wg sync.WaitGroup
+	wg.Add(1)
+	started := make(chan struct{})
+	go func() {
+		defer wg.Done()
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.RemoteAddr = "203.0.113.7:5000"
+		close(started)
+		app.handler.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	<-started
+	time.Sleep(100 * time.Millisecond)
+
+	// A forwarded header from the client itself doesn't make it a new one
+	handler := RealIP(nil)(app.handler)
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.RemoteAddr = "203.0.113.7:6000"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("second stream = %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, target, nil)
+	req.RemoteAddr = "198.51.100.1:6000"
+	req.Method = http.MethodHead
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("other client = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	wg.Wait()
+}
+
+func TestIsLongLived(t *testing.T) {
+	for request, want := range map[string]bool{
+		"GET /stream/1":              true,
+		"GET /stream/1/hls/128/3.ts": true,
+		"GET /download/1":            true,
+		"GET /api/album/1/download":  true,
+		"GET /api/artist/1/download": true,
+		"POST /api/admin/backup":     true,
+		"GET /api/jobs/1/events":     true,
+		"POST /api/songs/upload":     true,
+		"GET /api/songs/upload":      false,
+		"GET /api/jobs/1":            false,
+		"GET /api/album/1/songs":     false,
+		"GET /api/song/1":            false,
+		"GET /album/1":               false,
+	} {
+		method, target, _ := strings.Cut(request, " ")
+		if got := IsLongLived(httptest.NewRequest(method, target, nil)); got != want {
+			t.Errorf("IsLongLived(%s) = %t, want %t", request, got, want)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"whalio/models"
+	"whalio/repository"
+	"whalio/signing"
+)
+
+// maxLinkTTL bounds how long a link issued by CreateLink stays valid
+const maxLinkTTL = 365 * 24 * time.Hour
+
+// authorize checks the signature of a stream or download request for a
+// song. A signed request must be valid, unexpired and scoped to include
+// the song and action; unsigned ones pass unless signed URLs are required.
+func (h *Handlers) authorize(w http.ResponseWriter, r *http.Request, action string, songID uint) bool {
+	scope, signed, ok := h.verifySignature(w, r)
+	if !ok || !signed {
+		return ok
+	}
+
+	var albumID uint
+	if scope.Kind == signing.KindAlbum {
+		song, err := h.core.GetSongByID(songID)
+		if err != nil {
+			h.SendError(w, r, "Song not found", http.StatusNotFound)
+			return false
+		}
+		albumID = song.AlbumID
+	}
+	if !scope.Allows(action, songID, albumID) {
+		h.SendError(w, r, "Link is not valid for this song", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// authorizeArchive checks the signature of a download of a whole album, or
+// of an artist if albumID is 0, which only links to the library allow
+func (h *Handlers) authorizeArchive(w http.ResponseWriter, r *http.Request, albumID uint) bool {
+	scope, signed, ok := h.verifySignature(w, r)
+	if !ok || !signed {
+		return ok
+	}
+
+	if !scope.Allows(signing.ActionDownload, 0, albumID) {
+		h.SendError(w, r, "Link is not valid for this download", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// verifySignature returns the scope of a signed request, signed is false
+// for unsigned ones that may pass. It sends the error and returns false if
+// the request may not pass.
+func (h *Handlers) verifySignature(w http.ResponseWriter, r *http.Request) (scope signing.Scope, signed, ok bool) {
+	if h.signer == nil {
+		return scope, false, true
+	}
+
+	scope, err := h.signer.Verify(r.URL.Query(), time.Now())
+	switch {
+	case errors.Is(err, signing.ErrUnsigned):
+		if !h.cfg.RequireSignedURLs {
+			return scope, false, true
+		}
+		h.SendError(w, r, "A signed URL is required", http.StatusForbidden)
+		return scope, false, false
+	case errors.Is(err, signing.ErrExpired):
+		h.SendError(w, r, "Link has expired", http.StatusForbidden)
+		return scope, false, false
+	case err != nil:
+		h.SendError(w, r, "Invalid link signature", http.StatusForbidden)
+		return scope, false, false
+	}
+	return scope, true, true
+}
+
+// signedQuery returns the signature parameters of a signed request, to be
+// carried over to the URLs it links to, "" for unsigned requests
+func signedQuery(r *http.Request) string {
+	query := signing.Query(r.URL.Query())
+	if len(query) == 0 {
+		return ""
+	}
+	return "?" + query.Encode()
+}
+
+// playerStreamURL returns the URL the player streams a song from, signed
+// for at least SignedURLTTL if signing is on. The expiry is rounded up to
+// the hour so the URL, and what browsers cache under it, stays the same
+// for a while. When signed URLs are required only admins get a new
+// signature, anyone else just that of their own request if it covers the
+// song, so song info can't be used to mint links.
+func (h *Handlers) playerStreamURL(r *http.Request, song *models.Song, path string) string {
+	if h.signer == nil {
+		return path
+	}
+	if h.cfg.RequireSignedURLs && !h.isAdmin(r) {
+		scope, err := h.signer.Verify(r.URL.Query(), time.Now())
+		if err != nil || !scope.Allows(signing.ActionStream, song.ID, song.AlbumID) {
+			return path
+		}
+		return path + signedQuery(r)
+	}
+
+	scope := signing.Scope{Kind: signing.KindSong, ID: song.ID, Action: signing.ActionStream}
+	expires := time.Now().Add(h.cfg.SignedURLTTL).Truncate(time.Hour).Add(time.Hour)
+	return path + "?" + h.signer.Sign(scope, expires).Encode()
+}
+
+type songLink struct {
+	ID       uint   `json:"id"`
+	Name     string `json:"name"`
+	Stream   string `json:"stream,omitempty"`
+	Download string `json:"download,omitempty"`
+}
+
+// CreateLink issues a signed link, to admins only. Form values: kind (song or album, the
+// whole library if empty), id, action (stream or download, both if empty)
+// and ttl (such as "1h", SIGNED_URL_TTL if empty).
+func (h *Handlers) CreateLink(w http.ResponseWriter, r *http.Request) {
+	if h.signer == nil {
+		h.SendError(w, r, "URL signing is not configured, set SIGNING_KEY", http.StatusNotImplemented)
+		return
+	}
+
+	scope := signing.Scope{Kind: r.FormValue("kind"), Action: r.FormValue("action")}
+	if scope.Kind != "" && scope.Kind != signing.KindSong && scope.Kind != signing.KindAlbum {
+		h.SendError(w, r, "Invalid kind, want song or album", http.StatusBadRequest)
+		return
+	}
+	if scope.Action != "" && scope.Action != signing.ActionStream && scope.Action != signing.ActionDownload {
+		h.SendError(w, r, "Invalid action, want stream or download", http.StatusBadRequest)
+		return
+	}
+
+	ttl := h.cfg.SignedURLTTL
+	if value := r.FormValue("ttl"); value != "" {
+		var err error
+		if ttl, err = time.ParseDuration(value); err != nil || ttl <= 0 || ttl > maxLinkTTL {
+			h.SendError(w, r, "Invalid ttl, want a duration such as 24h of at most a year", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// The songs the link is good for, none for the whole library
+	var songs []songLink
+	if scope.Kind != "" {
+		id, err := strconv.ParseUint(r.FormValue("id"), 10, 32)
+		if err != nil {
+			h.SendError(w, r, "Invalid id", http.StatusBadRequest)
+			return
+		}
+		scope.ID = uint(id)
+
+		switch scope.Kind {
+		case signing.KindSong:
+			song, err := h.core.GetSongByID(scope.ID)
+			if err != nil {
+				h.sendLinkError(w, r, err)
+				return
+			}
+			songs = append(songs, songLink{ID: song.ID, Name: song.Name})
+		case signing.KindAlbum:
+			album, err := h.core.GetAlbum(scope.ID)
+			if err != nil {
+				h.sendLinkError(w, r, err)
+				return
+			}
+			for _, song := range album.Songs {
+				songs = append(songs, songLink{ID: song.ID, Name: song.Name})
+			}
+		}
+	}
+
+	expires := time.Now().Add(ttl)
+	query := h.signer.Sign(scope, expires).Encode()
+	for i := range songs {
+		if scope.Action != signing.ActionDownload {
+			songs[i].Stream = fmt.Sprintf("/stream/%d?%s", songs[i].ID, query)
+		}
+		if scope.Action != signing.ActionStream {
+			songs[i].Download = fmt.Sprintf("/download/%d?%s", songs[i].ID, query)
+		}
+	}
+
+	response := map[string]interface{}{
+		"expires": expires.UTC().Truncate(time.Second),
+		// Appended to any stream or download URL the link is good for
+		"query": query,
+		"songs": songs,
+	}
+	// The whole album as a ZIP archive
+	if scope.Kind == signing.KindAlbum && scope.Action != signing.ActionStream {
+		response["archive"] = fmt.Sprintf("/api/album/%d/download?%s", scope.ID, query)
+	}
+	h.SendJSON(w, response, http.StatusOK)
+}
+
+func (h *Handlers) sendLinkError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, repository.ErrSongNotFound), errors.Is(err, repository.ErrAlbumNotFound):
+		h.SendError(w, r, "Not found", http.StatusNotFound)
+	default:
+		h.SendError(w, r, "Failed to create link", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	"whalio/signing"
+)
+
+// newSignedApp returns an app requiring signed URLs, with one song
+func newSignedApp(t *testing.T) (*testApp, uint) {
+	t.Helper()
+
+	cfg := testConfig(t)
+	cfg.SigningKey = string(testSigningKey)
+	cfg.RequireSignedURLs = true
+	cfg.AdminToken = "secret"
+	app := newTestApp(t, cfg)
+	return app, app.addSong(t, "Song", []byte("audio"))
+}
+
+func sign(scope signing.Scope, expires time.Time) string {
+	signer, _ := signing.NewSigner([][]byte{testSigningKey})
+	return signer.Sign(scope, expires).Encode()
+}
+
+func TestRequireSignedURLs(t *testing.T) {
+	app, id := newSignedApp(t)
+	hour := time.Now().Add(time.Hour)
+	song := signing.Scope{Kind: signing.KindSong, ID: id}
+
+	forged, _ := url.ParseQuery(sign(song, hour))
+	forged.Set("scope", "song:2")
+
+	otherKey, _ := signing.NewSigner([][]byte{[]byte("another key of thirty two bytes!")})
+
+	stream := fmt.Sprintf("/stream/%d", id)
+	download := fmt.Sprintf("/download/%d", id)
+
+	tests := []struct {
+		name   string
+		target string
+		status int
+	}{
+		{"unsigned", stream, http.StatusForbidden},
+		{"unsigned download", download, http.StatusForbidden},
+		{"unsigned album", "/api/album/1/download", http.StatusForbidden},
+		{"forged scope", stream + "?" + forged.Encode(), http.StatusForbidden},
+		{"garbage signature", stream + "?exp=9999999999&sig=AAAA", http.StatusForbidden},
+		{"other key", stream + "?" + otherKey.Sign(song, hour).Encode(), http.StatusForbidden},
+		{"expired", stream + "?" + sign(song, time.Now().Add(-time.Minute)), http.StatusForbidden},
+		{"other song", stream + "?" + sign(signing.Scope{Kind: signing.KindSong, ID: id + 1}, hour), http.StatusForbidden},
+		{"other action", download + "?" + sign(signing.Scope{Kind: signing.KindSong, ID: id, Action: signing.ActionStream}, hour), http.StatusForbidden},
+		{"song", stream + "?" + sign(song, hour), http.StatusOK},
+		{"album", download + "?" + sign(signing.Scope{Kind: signing.KindAlbum, ID: 1}, hour), http.StatusOK},
+		{"library", stream + "?" + sign(signing.Scope{}, hour), http.StatusOK},
+		{"library archive", "/api/album/1/download?" + sign(signing.Scope{}, hour), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := app.do(t, http.MethodGet, tt.target, nil); rec.Code != tt.status {
+				t.Errorf("GET %s = %d, want %d", tt.target, rec.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestCreateLinkNeedsAdmin(t *testing.T) {
+	app, _ := newSignedApp(t)
+
+	tests := []struct {
+		name   string
+		header []string
+		status int
+	}{
+		{"anonymous", nil, http.StatusUnauthorized},
+		{"wrong token", []string{"Authorization: Bearer guess"}, http.StatusUnauthorized},
+		{"not bearer", []string{"Authorization: Basic secret"}, http.StatusUnauthorized},
+		{"admin", []string{"Authorization: Bearer secret"}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := app.do(t, http.MethodPost, "/api/links", strings.NewReader("ttl=8760h"),
+				append(tt.header, "Content-Type: application/x-www-form-urlencoded")...)
+			if rec.Code != tt.status {
+				t.Errorf("POST /api/links = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+		})
+	}
+
+	app.cfg.AdminToken = ""
+	rec := app.do(t, http.MethodPost, "/api/links", nil, "Authorization: Bearer ")
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("POST /api/links without ADMIN_TOKEN = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
+
+func TestSongInfoDoesNotMintLinks(t *testing.T) {
+	app, id := newSignedApp(t)
+	signed := sign(signing.Scope{Kind: signing.KindAlbum, ID: 1, Action: signing.ActionStream}, time.Now().Add(time.Hour))
+
+	tests := []struct {
+		name   string
+		query  string
+		header []string
+		want   string // Stream URL, with any signature if signed
+		status int    // Of streaming from it
+	}{
+		{"anonymous", "", nil, "", http.StatusForbidden},
+		{"forged", "?exp=9999999999&sig=AAAA", nil, "", http.StatusForbidden},
+		{"signed", "?" + signed, nil, "?" + signed, http.StatusOK},
+		{"admin", "", []string{"Authorization: Bearer secret"}, "sig=", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := app.do(t, http.MethodGet, fmt.Sprintf("/api/song/%d%s", id, tt.query), nil, tt.header...)
+			var info struct{ Stream string }
+			if err := json.NewDecoder(rec.Body).Decode(&info); err != nil {
+				t.Fatal(err)
+			}
+
+			path, query, _ := strings.Cut(info.Stream, "?")
+			if path != fmt.Sprintf("/stream/%d", id) || (tt.want == "") != (query == "") || !strings.Contains("?"+query, tt.want) {
+				t.Errorf("stream = %q, want %q", info.Stream, tt.want)
+			}
+			if rec := app.do(t, http.MethodGet, info.Stream, nil); rec.Code != tt.status {
+				t.Errorf("GET %s = %d, want %d", info.Stream, rec.Code, tt.status)
+			}
+		})
+	}
+}
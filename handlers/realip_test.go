@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestRealIP(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("::1/128")}
+
+	tests := []struct {
+		name      string
+		peer      string
+		forwarded []string
+		realIP    string
+		want      string
+	}{
+		{"direct", "203.0.113.7:5000", nil, "", "203.0.113.7:5000"},
+		{"spoofed by client", "203.0.113.7:5000", []string{"198.51.100.1"}, "198.51.100.2", "203.0.113.7:5000"},
+		{"through proxy", "10.0.0.2:5000", []string{"198.51.100.1"}, "", "198.51.100.1"},
+		{"spoofed through proxy", "10.0.0.2:5000", []string{"1.2.3.4, 198.51.100.1"}, "", "198.51.100.1"},
+		{"proxy chain", "10.0.0.2:5000", []string{"198.51.100.1, 10.0.0.3", "10.0.0.4"}, "", "198.51.100.1"},
+		{"garbage", "10.0.0.2:5000", []string{"198.51.100.1, nonsense, 10.0.0.3"}, "", "10.0.0.3"},
+		{"real ip header", "10.0.0.2:5000", nil, "198.51.100.9", "198.51.100.9"},
+		{"ipv6 proxy", "[::1]:5000", []string{"2001:db8::1"}, "", "2001:db8::1"},
+		{"nothing forwarded", "10.0.0.2:5000", nil, "", "10.0.0.2:5000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			handler := RealIP(trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.RemoteAddr
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.peer
+			for _, value := range tt.forwarded {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+			if tt.realIP != "" {
+				req.Header.Set("X-Real-IP", tt.realIP)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if got != tt.want {
+				t.Errorf("RemoteAddr = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,6 +2,9 @@ package handlers
 
 import (
 	"net/http"
+	"whalio/core"
+	"whalio/streamlimit"
+	"whalio/templates"
 )
 
 // StatsResponse represents the statistics data
@@ -9,6 +12,10 @@ type StatsResponse struct {
 	Albums  int `json:"albums"`
 	Artists int `json:"artists"`
 	Songs   int `json:"songs"`
+	// Bytes in storage, per artist, album and song with ?usage=full
+	Storage *core.StorageUsage `json:"storage"`
+	// Streams served and how they were limited
+	Streams streamlimit.Metrics `json:"streams"`
 }
 
 // GetStats returns statistics about the music library
@@ -33,11 +40,35 @@ func (h *Handlers) GetStats(w http.ResponseWriter, r *http.Request) {
 		totalSongs += len(album.Songs)
 	}
 
+	usage, err := h.core.StorageUsage()
+	if err != nil {
+		h.SendError(w, r, "Failed to get storage usage", http.StatusInternalServerError)
+		return
+	}
+	if r.URL.Query().Get("usage") != "full" {
+		usage.Artists, usage.Albums, usage.Songs = nil, nil, nil
+	}
+
 	stats := StatsResponse{
 		Albums:  len(albums),
 		Artists: len(artists),
 		Songs:   totalSongs,
+		Storage: usage,
+		Streams: h.streams.Metrics(),
 	}
 
 	h.SendJSON(w, stats, http.StatusOK)
 }
+
+// Usage renders the storage usage page
+func (h *Handlers) Usage(w http.ResponseWriter, r *http.Request) {
+	usage, err := h.core.StorageUsage()
+	if err != nil {
+		h.SendError(w, r, "failed load storage usage", http.StatusInternalServerError)
+		return
+	}
+
+	if err := templates.Usage(usage).Render(r.Context(), w); err != nil {
+		h.SendError(w, r, "failed render", http.StatusInternalServerError)
+	}
+}
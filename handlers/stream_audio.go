@@ -1,16 +1,23 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
-	"io"
+	"mime"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
+	"whalio/core"
+	"whalio/repository"
+	"whalio/signing"
+	"whalio/transcode"
 
 	"github.com/go-chi/chi/v5"
 )
 
-// StreamAudio handles streaming audio files with range request support
+// StreamAudio streams a song file, or a transcode of it when a format is
+// asked for, see serveStream for range and conditional requests
 func (h *Handlers) StreamAudio(w http.ResponseWriter, r *http.Request) {
 	// Get song ID from URL parameter
 	songIDStr := chi.URLParam(r, "id")
@@ -19,110 +26,100 @@ func (h *Handlers) StreamAudio(w http.ResponseWriter, r *http.Request) {
 		h.SendError(w, r, "Invalid song ID", http.StatusBadRequest)
 		return
 	}
-
-	// Get song file from core
-	file, fileInfo, err := h.core.PlaySong(uint(songID))
-	if err != nil {
-		h.SendError(w, r, "Song not found", http.StatusNotFound)
+	if !h.authorize(w, r, signing.ActionStream, uint(songID)) {
 		return
 	}
-	// Close file if it supports Close()
-	if closer, ok := file.(interface{ Close() error }); ok {
-		defer closer.Close()
-	}
 
-	// Set content type and length
-	w.Header().Set("Content-Type", "audio/mpeg") // Default to MP3, could be improved to detect actual type
-	w.Header().Set("Accept-Ranges", "bytes")
-	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"%s\"", fileInfo.Name()))
-
-	fileSize := fileInfo.Size()
-
-	// Handle range requests for audio streaming
-	rangeHeader := r.Header.Get("Range")
-	if rangeHeader != "" {
-		h.handleRangeRequest(w, r, file, fileSize, rangeHeader)
+	// Transcoded on request
+	if format := r.URL.Query().Get("format"); format != "" {
+		h.streamTranscoded(w, r, uint(songID), format)
 		return
 	}
 
-	// No range request, serve full file
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", fileSize))
-	w.WriteHeader(http.StatusOK)
-
-	if _, err := io.Copy(w, file); err != nil {
-		// Don't send error response as we've already started writing
+	// Get song file from core
+	stream, err := h.core.PlaySong(r.Context(), uint(songID))
+	if err != nil {
+		h.SendError(w, r, "Song not found", http.StatusNotFound)
 		return
 	}
+
+	h.serveStream(w, r, stream, "inline")
 }
 
-// handleRangeRequest handles HTTP range requests for partial content delivery
-func (h *Handlers) handleRangeRequest(w http.ResponseWriter, r *http.Request, file io.ReadSeeker, fileSize int64, rangeHeader string) {
-	// Parse range header (format: "bytes=start-end")
-	if !strings.HasPrefix(rangeHeader, "bytes=") {
-		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+// DownloadSong serves a song file as an attachment under its original name
+func (h *Handlers) DownloadSong(w http.ResponseWriter, r *http.Request) {
+	songID, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 32)
+	if err != nil {
+		h.SendError(w, r, "Invalid song ID", http.StatusBadRequest)
 		return
 	}
-
-	rangeValue := rangeHeader[6:] // Remove "bytes=" prefix
-	ranges := strings.Split(rangeValue, ",")
-
-	// Handle only the first range for simplicity
-	if len(ranges) == 0 {
-		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+	if !h.authorize(w, r, signing.ActionDownload, uint(songID)) {
 		return
 	}
 
-	rangeParts := strings.Split(ranges[0], "-")
-	if len(rangeParts) != 2 {
-		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+	stream, err := h.core.PlaySong(r.Context(), uint(songID))
+	if err != nil {
+		h.SendError(w, r, "Song not found", http.StatusNotFound)
 		return
 	}
 
-	var start, end int64
-	var err error
+	h.serveStream(w, r, stream, "attachment")
+}
 
-	// Parse start
-	if rangeParts[0] != "" {
-		start, err = strconv.ParseInt(rangeParts[0], 10, 64)
-		if err != nil || start < 0 {
-			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+// streamTranscoded serves a song transcoded to format at the bitrate given
+// in kbit/s by the bitrate parameter, or the default one
+func (h *Handlers) streamTranscoded(w http.ResponseWriter, r *http.Request, songID uint, format string) {
+	opts := transcode.Options{Format: format}
+	if bitrate := r.URL.Query().Get("bitrate"); bitrate != "" {
+		var err error
+		if opts.Bitrate, err = strconv.Atoi(bitrate); err != nil || opts.Bitrate <= 0 {
+			h.SendError(w, r, "Invalid bitrate", http.StatusBadRequest)
 			return
 		}
 	}
 
-	// Parse end
-	if rangeParts[1] != "" {
-		end, err = strconv.ParseInt(rangeParts[1], 10, 64)
-		if err != nil || end >= fileSize {
-			end = fileSize - 1
-		}
-	} else {
-		end = fileSize - 1
-	}
-
-	// Validate range
-	if start > end || start >= fileSize {
-		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+	stream, err := h.core.TranscodeSong(r.Context(), songID, opts)
+	switch {
+	case errors.Is(err, core.ErrTranscodingDisabled):
+		h.SendError(w, r, "Transcoding is not available", http.StatusNotImplemented)
 		return
-	}
-
-	// Seek to start position
-	if _, err := file.Seek(start, io.SeekStart); err != nil {
-		http.Error(w, "Failed to seek file", http.StatusInternalServerError)
+	case errors.Is(err, core.ErrInvalidTranscode):
+		h.SendError(w, r, fmt.Sprintf("Format or bitrate not allowed (formats: %s, bitrates: %v)",
+			strings.Join(h.cfg.TranscodeFormats, ", "), h.cfg.TranscodeBitrates), http.StatusBadRequest)
+		return
+	case errors.Is(err, repository.ErrSongNotFound):
+		h.SendError(w, r, "Song not found", http.StatusNotFound)
+		return
+	case err != nil:
+		h.SendError(w, r, "Failed to transcode song", http.StatusInternalServerError)
 		return
 	}
 
-	// Set headers for partial content
-	contentLength := end - start + 1
-	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, fileSize))
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", contentLength))
-	w.WriteHeader(http.StatusPartialContent)
+	h.serveStream(w, r, stream, "inline")
+}
 
-	// Copy the requested range
-	if _, err := io.CopyN(w, file, contentLength); err != nil {
-		// Don't send error response as we've already started writing
-		return
+// serveStream serves a stream with http.ServeContent, which implements the
+// range and conditional requests of RFC 9110: single, suffix and multiple
+// ranges (as multipart/byteranges), If-Range, and If-Match, If-None-Match,
+// If-Modified-Since and If-Unmodified-Since with their 304 and 412
+// responses. Clients revalidate instead of caching blindly, so a replaced
+// file is never served stale. Disposition is "inline" or "attachment".
+// Long streams outlast the server write timeout, so it is lifted.
+func (h *Handlers) serveStream(w http.ResponseWriter, r *http.Request, stream *core.Stream, disposition string) {
+	defer stream.Close()
+
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	if stream.ContentType != "" {
+		w.Header().Set("Content-Type", stream.ContentType)
 	}
+	if stream.ETag != "" {
+		w.Header().Set("ETag", stream.ETag)
+	}
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": stream.Name}))
+
+	http.ServeContent(w, r, stream.Name, stream.ModTime, stream)
 }
 
 // GetSongInfo returns information about a song for the player
@@ -148,10 +145,17 @@ func (h *Handlers) GetSongInfo(w http.ResponseWriter, r *http.Request) {
 		"mimeType": song.MimeType,
 		"fileSize": song.FileSize,
 		"duration": song.Duration,
+		// The file is missing, see `whalio fsck`
+		"unavailable": song.Unavailable,
 		"album": map[string]interface{}{
 			"id":   song.Album.ID,
 			"name": song.Album.Name,
 			"year": song.Album.Year,
+			// Dominant colors of the cover and the one to tint with
+			"palette": song.Album.Colors(),
+			"tint":    song.Album.Tint(),
+			// Shown while the cover loads
+			"blurHash": song.Album.BlurHash,
 			"artist": map[string]interface{}{
 				"id":   song.Album.Artist.ID,
 				"name": song.Album.Artist.Name,
@@ -159,5 +163,12 @@ func (h *Handlers) GetSongInfo(w http.ResponseWriter, r *http.Request) {
 		},
 	}
 
+	// Where to stream from, signed if signing is on
+	songInfo["stream"] = h.playerStreamURL(r, song, fmt.Sprintf("/stream/%d", song.ID))
+	// Adaptive streaming for clients that prefer it over /stream/{id}
+	if h.core.HLSEnabled() && song.Duration > 0 {
+		songInfo["hls"] = h.playerStreamURL(r, song, fmt.Sprintf("/stream/%d/hls/%s", song.ID, transcode.HLSPlaylist))
+	}
+
 	h.SendJSON(w, songInfo, http.StatusOK)
 }
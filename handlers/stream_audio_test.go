@@ -0,0 +1,222 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamRanges(t *testing.T) {
+	app := newTestApp(t, testConfig(t))
+	content := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	id := app.addSong(t, "Song", content)
+	target := fmt.Sprintf("/stream/%d", id)
+
+	first := app.do(t, http.MethodGet, target, nil)
+	etag := first.Header().Get("ETag")
+	modified := first.Header().Get("Last-Modified")
+	if etag == "" || modified == "" {
+		t.Fatalf("missing validators: ETag %q, Last-Modified %q", etag, modified)
+	}
+	past := time.Now().Add(-24 * time.Hour).UTC().Format(http.TimeFormat)
+
+	tests := []struct {
+		name    string
+		method  string
+		header  []string
+		status  int
+		body    string            // Expected body, unless parts are
+		parts   map[string]string // Content-Range to body of multipart responses
+		headers map[string]string
+	}{
+		{
+			name:    "full",
+			status:  http.StatusOK,
+			body:    string(content),
+			headers: map[string]string{"Accept-Ranges": "bytes", "Content-Length": "36"},
+		},
+		{
+			name:    "range",
+			header:  []string{"Range: bytes=2-5"},
+			status:  http.StatusPartialContent,
+			body:    "2345",
+			headers: map[string]string{"Content-Range": "bytes 2-5/36", "Content-Length": "4"},
+		},
+		{
+			name:    "open range",
+			header:  []string{"Range: bytes=30-"},
+			status:  http.StatusPartialContent,
+			body:    "uvwxyz",
+			headers: map[string]string{"Content-Range": "bytes 30-35/36"},
+		},
+		{
+			name:    "suffix range",
+			header:  []string{"Range: bytes=-4"},
+			status:  http.StatusPartialContent,
+			body:    "wxyz",
+			headers: map[string]string{"Content-Range": "bytes 32-35/36"},
+		},
+		{
+			name:    "suffix longer than file",
+			header:  []string{"Range: bytes=-100"},
+			status:  http.StatusPartialContent,
+			body:    string(content),
+			headers: map[string]string{"Content-Range": "bytes 0-35/36"},
+		},
+		{
+			name:   "multiple ranges",
+			header: []string{"Range: bytes=0-1,10-12,-2"},
+			status: http.StatusPartialContent,
+			parts: map[string]string{
+				"bytes 0-1/36":   "01",
+				"bytes 10-12/36": "abc",
+				"bytes 34-35/36": "yz",
+			},
+		},
+		{
+			name:    "unsatisfiable",
+			header:  []string{"Range: bytes=100-200"},
+			status:  http.StatusRequestedRangeNotSatisfiable,
+			headers: map[string]string{"Content-Range": "bytes */36"},
+		},
+		{
+			name:   "malformed range",
+			header: []string{"Range: bytes=5-2"},
+			status: http.StatusRequestedRangeNotSatisfiable,
+		},
+		{
+			name:   "if-range current etag",
+			header: []string{"Range: bytes=0-3", "If-Range: " + etag},
+			status: http.StatusPartialContent,
+			body:   "0123",
+		},
+		{
+			name:   "if-range stale etag",
+			header: []string{"Range: bytes=0-3", `If-Range: "stale"`},
+			status: http.StatusOK,
+			body:   string(content),
+		},
+		{
+			name:   "if-range stale date",
+			header: []string{"Range: bytes=0-3", "If-Range: " + past},
+			status: http.StatusOK,
+			body:   string(content),
+		},
+		{
+			name:    "if-none-match",
+			header:  []string{"If-None-Match: " + etag},
+			status:  http.StatusNotModified,
+			headers: map[string]string{"ETag": etag},
+		},
+		{
+			name:   "if-none-match any",
+			header: []string{"If-None-Match: *"},
+			status: http.StatusNotModified,
+		},
+		{
+			name:   "if-none-match other",
+			header: []string{`If-None-Match: "other"`},
+			status: http.StatusOK,
+			body:   string(content),
+		},
+		{
+			name:   "if-modified-since",
+			header: []string{"If-Modified-Since: " + modified},
+			status: http.StatusNotModified,
+		},
+		{
+			name:   "if-match",
+			header: []string{"If-Match: " + etag, "Range: bytes=0-0"},
+			status: http.StatusPartialContent,
+			body:   "0",
+		},
+		{
+			name:   "if-match other",
+			header: []string{`If-Match: "other"`},
+			status: http.StatusPreconditionFailed,
+		},
+		{
+			name:   "if-unmodified-since",
+			header: []string{"If-Unmodified-Since: " + past},
+			status: http.StatusPreconditionFailed,
+		},
+		{
+			name:    "head",
+			method:  http.MethodHead,
+			status:  http.StatusOK,
+			headers: map[string]string{"Content-Length": "36", "ETag": etag, "Accept-Ranges": "bytes"},
+		},
+		{
+			name:    "head range",
+			method:  http.MethodHead,
+			header:  []string{"Range: bytes=-4"},
+			status:  http.StatusPartialContent,
+			headers: map[string]string{"Content-Range": "bytes 32-35/36", "Content-Length": "4"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			rec := app.do(t, method, target, nil, tt.header...)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.status)
+			}
+			for name, want := range tt.headers {
+				if got := rec.Header().Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+
+			if tt.parts != nil {
+				checkParts(t, rec.Header().Get("Content-Type"), rec.Body.String(), tt.parts)
+				return
+			}
+			if rec.Code == http.StatusOK || rec.Code == http.StatusPartialContent {
+				if got := rec.Body.String(); got != tt.body {
+					t.Errorf("body = %q, want %q", got, tt.body)
+				}
+			}
+		})
+	}
+}
+
+func checkParts(t *testing.T, contentType, body string, want map[string]string) {
+	t.Helper()
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("Content-Type = %q, want multipart/byteranges", contentType)
+	}
+
+	got := make(map[string]string)
+	reader := multipart.NewReader(strings.NewReader(body), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			break
+		}
+		data, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[part.Header.Get("Content-Range")] = string(data)
+	}
+
+	if len(got) != len(want) {
+		t.Errorf("got %d parts, want %d: %v", len(got), len(want), got)
+	}
+	for contentRange, body := range want {
+		if got[contentRange] != body {
+			t.Errorf("part %s = %q, want %q", contentRange, got[contentRange], body)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"whalio/core"
+	"whalio/repository"
+	"whalio/templates"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Trash renders the trash page
+func (h *Handlers) Trash(w http.ResponseWriter, r *http.Request) {
+	items, err := h.core.ListTrash()
+	if err != nil {
+		h.SendError(w, r, "failed load trash", http.StatusInternalServerError)
+		return
+	}
+
+	if err := templates.Trash(items).Render(r.Context(), w); err != nil {
+		h.SendError(w, r, "failed render", http.StatusInternalServerError)
+	}
+}
+
+// ListTrash returns the deleted artists, albums and songs
+func (h *Handlers) ListTrash(w http.ResponseWriter, r *http.Request) {
+	items, err := h.core.ListTrash()
+	if err != nil {
+		h.SendError(w, r, "Failed to list trash", http.StatusInternalServerError)
+		return
+	}
+
+	h.SendJSON(w, map[string]any{"items": items}, http.StatusOK)
+}
+
+// RestoreFromTrash restores the item given by the kind (artist, album or
+// song) and id form values. HTMX requests get an empty body so the row of
+// the restored item disappears.
+func (h *Handlers) RestoreFromTrash(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxFieldSize)
+
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 32)
+	if err != nil {
+		h.SendError(w, r, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	err = h.core.RestoreFromTrash(r.FormValue("kind"), uint(id))
+	switch {
+	case errors.Is(err, core.ErrInvalidTrashKind):
+		h.SendError(w, r, "Kind must be artist, album or song", http.StatusBadRequest)
+		return
+	case errors.Is(err, repository.ErrNotInTrash):
+		h.SendError(w, r, "Not in trash", http.StatusNotFound)
+		return
+	case err != nil:
+		h.SendError(w, r, "Failed to restore", http.StatusInternalServerError)
+		return
+	}
+
+	if IsHTMXRequest(r) {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	h.SendJSON(w, map[string]any{"success": true}, http.StatusOK)
+}
+
+// DeleteSong moves a song to the trash
+func (h *Handlers) DeleteSong(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 32)
+	if err != nil {
+		h.SendError(w, r, "Invalid song ID", http.StatusBadRequest)
+		return
+	}
+
+	err = h.core.DeleteSong(uint(id))
+	switch {
+	case errors.Is(err, repository.ErrSongNotFound):
+		h.SendError(w, r, "Song not found", http.StatusNotFound)
+		return
+	case err != nil:
+		h.SendError(w, r, "Failed to delete song", http.StatusInternalServerError)
+		return
+	}
+
+	h.SendJSON(w, map[string]any{"success": true}, http.StatusOK)
+}
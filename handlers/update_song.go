@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"whalio/core"
+	"whalio/repository"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// UpdateSong changes album, title or track number of a song. Fields missing
+// from the form are left as they are.
+func (h *Handlers) UpdateSong(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxFieldSize)
+
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 32)
+	if err != nil {
+		h.SendError(w, r, "Invalid song ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		h.SendError(w, r, "Failed to parse form data", http.StatusBadRequest)
+		return
+	}
+
+	var update core.SongUpdate
+
+	if r.PostForm.Has("album_id") {
+		albumID, err := strconv.ParseUint(r.PostForm.Get("album_id"), 10, 32)
+		if err != nil {
+			h.SendError(w, r, "Invalid album ID", http.StatusBadRequest)
+			return
+		}
+		id := uint(albumID)
+		update.AlbumID = &id
+	}
+
+	if r.PostForm.Has("title") {
+		title := r.PostForm.Get("title")
+		update.Name = &title
+	}
+
+	if r.PostForm.Has("track_number") {
+		track, err := strconv.Atoi(r.PostForm.Get("track_number"))
+		if err != nil {
+			h.SendError(w, r, "Invalid track number", http.StatusBadRequest)
+			return
+		}
+		update.TrackNumber = &track
+	}
+
+	song, err := h.core.UpdateSong(uint(id), update)
+	switch {
+	case errors.Is(err, repository.ErrSongNotFound):
+		h.SendError(w, r, "Song not found", http.StatusNotFound)
+		return
+	case errors.Is(err, repository.ErrAlbumNotFound):
+		h.SendError(w, r, "Album not found", http.StatusNotFound)
+		return
+	case errors.Is(err, core.ErrInvalidSongUpdate):
+		h.SendError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		h.SendError(w, r, "Failed to update song", http.StatusInternalServerError)
+		return
+	}
+
+	h.SendJSON(w, map[string]interface{}{
+		"success":     true,
+		"id":          song.ID,
+		"name":        song.Name,
+		"trackNumber": song.TrackNumber,
+		"album": map[string]interface{}{
+			"id":   song.Album.ID,
+			"name": song.Album.Name,
+		},
+	}, http.StatusOK)
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestUpdateSong(t *testing.T) {
+	app := newTestApp(t, testConfig(t))
+	id := app.addSong(t, "Song", []byte("song"))
+	if err := app.core.CreateAlbum("Second", "", "Artist", 2021, nil); err != nil {
+		t.Fatal(err)
+	}
+	song, err := app.core.GetSongByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patch := func(target string, form url.Values) *http.Response {
+		t.Helper()
+		return app.do(t, http.MethodPatch, target, strings.NewReader(form.Encode()),
+			"Content-Type: application/x-www-form-urlencoded").Result()
+	}
+
+	for _, tt := range []struct {
+		name   string
+		target string
+		form   url.Values
+		want   int
+	}{
+		{"empty title", "/api/songs/1", url.Values{"title": {" "}}, http.StatusBadRequest},
+		{"negative track number", "/api/songs/1", url.Values{"track_number": {"-1"}}, http.StatusBadRequest},
+		{"bad track number", "/api/songs/1", url.Values{"track_number": {"one"}}, http.StatusBadRequest},
+		{"bad album id", "/api/songs/1", url.Values{"album_id": {"second"}}, http.StatusBadRequest},
+		{"missing album", "/api/songs/1", url.Values{"album_id": {"99"}}, http.StatusNotFound},
+		{"missing song", "/api/songs/99", url.Values{"title": {"Title"}}, http.StatusNotFound},
+		{"bad song id", "/api/songs/one", url.Values{"title": {"Title"}}, http.StatusBadRequest},
+	} {
+		if resp := patch(tt.target, tt.form); resp.StatusCode != tt.want {
+			t.Errorf("%s: %d, want %d", tt.name, resp.StatusCode, tt.want)
+		}
+	}
+
+	resp := patch("/api/songs/1", url.Values{"album_id": {"2"}, "title": {"Moved"}, "track_number": {"4"}})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("move = %d", resp.StatusCode)
+	}
+	var body struct {
+		Name        string `json:"name"`
+		TrackNumber int    `json:"trackNumber"`
+		Album       struct {
+			ID   uint   `json:"id"`
+			Name string `json:"name"`
+		} `json:"album"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Name != "Moved" || body.TrackNumber != 4 || body.Album.ID != 2 || body.Album.Name != "Second" {
+		t.Errorf("response %+v", body)
+	}
+
+	moved, err := app.core.GetSongByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.AlbumID != 2 || moved.StorageKey != song.StorageKey {
+		t.Errorf("moved to album %d with key %s, want album 2 and key %s", moved.AlbumID, moved.StorageKey, song.StorageKey)
+	}
+
+	// The file is still served after the move
+	if rec := app.do(t, http.MethodGet, "/stream/1", nil); rec.Code != http.StatusOK || rec.Body.String() != "song" {
+		t.Errorf("stream after move = %d %q", rec.Code, rec.Body)
+	}
+}
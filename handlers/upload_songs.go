@@ -1,93 +1,176 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
-	"mime/multipart"
+	"io"
 	"net/http"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
+	"whalio/core"
+	"whalio/models"
 )
 
-// UploadSongs handles song file uploads
+// maxFieldSize caps the plain form values that accompany an upload
+const maxFieldSize = 4 << 10
+
+// UploadSongs handles song file uploads. The multipart body is read part by
+// part so the audio is streamed straight into storage instead of being
+// spooled to temporary files first. Form values must precede the file part.
 func (h *Handlers) UploadSongs(w http.ResponseWriter, r *http.Request) {
-	// Parse multipart form (max 32MB)
-	if err := r.ParseMultipartForm(32 << 20); err != nil {
+	// Large files take longer to upload than the server timeouts
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+
+	r.Body = http.MaxBytesReader(w, r.Body, h.cfg.MaxUploadSize)
+
+	reader, err := r.MultipartReader()
+	if err != nil {
 		h.SendError(w, r, "Failed to parse form data: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Get form values
-	albumIDStr := r.FormValue("album_id")
-	songTitle := strings.TrimSpace(r.FormValue("song_title"))
+	var (
+		albumIDStr string
+		songTitle  string
+		uploaded   bool
+		song       *models.Song
+		job        *models.Job
+	)
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			h.sendUploadError(w, r, err)
+			return
+		}
+
+		switch part.FormName() {
+		case "album_id":
+			albumIDStr, err = readFormField(part)
+		case "song_title":
+			songTitle, err = readFormField(part)
+		case "audio_file":
+			if uploaded {
+				err = fmt.Errorf("only one audio file per request is supported")
+				break
+			}
+			song, job, err = h.uploadSong(albumIDStr, songTitle, part.FileName(), part)
+			uploaded = true
+		}
+		part.Close()
+
+		if err != nil {
+			h.sendUploadError(w, r, err)
+			return
+		}
+	}
 
-	// Validate album ID
-	albumID, err := strconv.ParseUint(albumIDStr, 10, 32)
-	if err != nil {
-		h.SendError(w, r, "Invalid album ID", http.StatusBadRequest)
+	if !uploaded {
+		h.SendError(w, r, "No audio file provided", http.StatusBadRequest)
 		return
 	}
 
-	// Get uploaded file
-	file, fileHeader, err := r.FormFile("audio_file")
+	if IsHTMXRequest(r) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<div class="alert alert-success"><span>✓ Song uploaded successfully</span></div>`)
+	} else {
+		resp := map[string]interface{}{
+			"success": true,
+			"message": "Song uploaded successfully",
+			"songId":  song.ID,
+		}
+		// Clients can follow tag parsing and scanning via /api/jobs/{id}/events
+		if job != nil {
+			resp["jobId"] = job.ID
+		}
+		h.SendJSON(w, resp, http.StatusOK)
+	}
+}
+
+// uploadError is returned for problems with the request itself, as opposed
+// to failures while storing the song.
+type uploadError struct {
+	msg string
+}
+
+func (e *uploadError) Error() string {
+	return e.msg
+}
+
+func (h *Handlers) uploadSong(albumIDStr, songTitle, filename string, source io.Reader) (*models.Song, *models.Job, error) {
+	// Validate album ID
+	albumID, err := strconv.ParseUint(albumIDStr, 10, 32)
 	if err != nil {
-		h.SendError(w, r, "No audio file provided", http.StatusBadRequest)
-		return
+		return nil, nil, &uploadError{"Invalid album ID (album_id must be sent before audio_file)"}
 	}
-	defer file.Close()
 
 	// Validate file
-	if err := h.validateAudioFile(fileHeader); err != nil {
-		h.SendError(w, r, err.Error(), http.StatusBadRequest)
-		return
+	if err := h.validateAudioFile(filename); err != nil {
+		return nil, nil, &uploadError{err.Error()}
 	}
 
 	// Use filename as title if no title provided
 	if songTitle == "" {
-		songTitle = strings.TrimSuffix(fileHeader.Filename, filepath.Ext(fileHeader.Filename))
+		songTitle = strings.TrimSuffix(filename, filepath.Ext(filename))
 	}
 
-	// Detect MIME type
-	mimeType := h.detectMimeType(fileHeader.Filename)
+	// Detect MIME type, the core refines it from the file contents
+	mimeType := h.detectMimeType(filename)
 
 	// Add song to database and save file
-	if err := h.core.AddSong(songTitle, fileHeader.Filename, mimeType, fileHeader.Size, uint(albumID), file); err != nil {
-		h.SendError(w, r, "Failed to upload song: "+err.Error(), http.StatusInternalServerError)
-		return
+	song, job, err := h.core.AddSong(songTitle, filename, mimeType, uint(albumID), source)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to upload song: %w", err)
 	}
 
-	if IsHTMXRequest(r) {
-		w.Header().Set("Content-Type", "text/html")
-		fmt.Fprint(w, `<div class="alert alert-success"><span>✓ Song uploaded successfully</span></div>`)
-	} else {
-		h.SendJSON(w, map[string]interface{}{
-			"success": true,
-			"message": "Song uploaded successfully",
-		}, http.StatusOK)
-	}
+	return song, job, nil
 }
 
-// validateAudioFile checks if the uploaded file is a valid audio file
-func (h *Handlers) validateAudioFile(fileHeader *multipart.FileHeader) error {
-	const maxFileSize = 100 << 20 // 100MB
+func (h *Handlers) sendUploadError(w http.ResponseWriter, r *http.Request, err error) {
+	var tooLarge *http.MaxBytesError
+	var badRequest *uploadError
+
+	switch {
+	case errors.As(err, &tooLarge):
+		h.SendError(w, r, fmt.Sprintf("Upload too large (max %d bytes)", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+	case errors.As(err, &badRequest):
+		h.SendError(w, r, badRequest.msg, http.StatusBadRequest)
+	case errors.Is(err, core.ErrQuotaExceeded):
+		h.SendError(w, r, "Storage quota exceeded", http.StatusInsufficientStorage)
+	default:
+		h.SendError(w, r, err.Error(), http.StatusInternalServerError)
+	}
+}
 
-	// Check file size
-	if fileHeader.Size > maxFileSize {
-		return fmt.Errorf("file too large (max 100MB)")
+// readFormField reads a small, non-file form value
+func readFormField(r io.Reader) (string, error) {
+	value, err := io.ReadAll(io.LimitReader(r, maxFieldSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(value) > maxFieldSize {
+		return "", &uploadError{"form field too large"}
 	}
 
-	// Check file extension
-	ext := strings.ToLower(filepath.Ext(fileHeader.Filename))
-	validExts := map[string]bool{
-		".mp3":  true,
-		".wav":  true,
-		".flac": true,
-		".ogg":  true,
-		".m4a":  true,
-		".aac":  true,
+	return strings.TrimSpace(string(value)), nil
+}
+
+// validateAudioFile checks if the uploaded file is a valid audio file
+func (h *Handlers) validateAudioFile(filename string) error {
+	if filename == "" {
+		return fmt.Errorf("No audio file provided")
 	}
 
-	if !validExts[ext] {
+	// Check file extension
+	ext := strings.ToLower(filepath.Ext(filename))
+	if models.MimeTypeFromExtension(ext) == "" {
 		return fmt.Errorf("unsupported file format: %s", ext)
 	}
 
@@ -96,18 +179,7 @@ func (h *Handlers) validateAudioFile(fileHeader *multipart.FileHeader) error {
 
 // detectMimeType returns the MIME type based on file extension
 func (h *Handlers) detectMimeType(filename string) string {
-	ext := strings.ToLower(filepath.Ext(filename))
-
-	mimeTypes := map[string]string{
-		".mp3":  "audio/mpeg",
-		".wav":  "audio/wav",
-		".flac": "audio/flac",
-		".ogg":  "audio/ogg",
-		".m4a":  "audio/m4a",
-		".aac":  "audio/aac",
-	}
-
-	if mimeType, exists := mimeTypes[ext]; exists {
+	if mimeType := models.MimeTypeFromExtension(filepath.Ext(filename)); mimeType != "" {
 		return mimeType
 	}
 
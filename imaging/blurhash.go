@@ -0,0 +1,119 @@
+package imaging
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"strings"
+)
+
+// BlurHash components, the 4x3 the reference implementations default to
+const (
+	blurHashX = 4
+	blurHashY = 3
+)
+
+const base83 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// BlurHash encodes img as a BlurHash (https://blurha.sh), a short string
+// clients decode into a blurred preview while the image loads. It is
+// computed from a small thumbnail, the result is blurry anyway.
+func BlurHash(img image.Image) string {
+	small := Thumbnail(img, paletteSample)
+	bounds := small.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	// Linear RGB of every pixel, transparent ones count as black
+	linear := make([][3]float64, 0, w*h)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(small.At(x, y)).(color.NRGBA)
+			alpha := float64(c.A) / 255
+			linear = append(linear, [3]float64{
+				srgbToLinear(c.R) * alpha,
+				srgbToLinear(c.G) * alpha,
+				srgbToLinear(c.B) * alpha,
+			})
+		}
+	}
+
+	factors := make([][3]float64, 0, blurHashX*blurHashY)
+	for j := range blurHashY {
+		for i := range blurHashX {
+			normalization := 2.0
+			if i == 0 && j == 0 {
+				normalization = 1
+			}
+
+			var factor [3]float64
+			for y := range h {
+				for x := range w {
+					basis := math.Cos(math.Pi*float64(i)*float64(x)/float64(w)) *
+						math.Cos(math.Pi*float64(j)*float64(y)/float64(h))
+					pixel := linear[y*w+x]
+					for c := range 3 {
+						factor[c] += basis * pixel[c]
+					}
+				}
+			}
+
+			scale := normalization / float64(w*h)
+			factors = append(factors, [3]float64{factor[0] * scale, factor[1] * scale, factor[2] * scale})
+		}
+	}
+
+	var hash strings.Builder
+	encode83(&hash, (blurHashX-1)+(blurHashY-1)*9, 1)
+
+	dc, ac := factors[0], factors[1:]
+	maximum := 1.0
+	if len(ac) > 0 {
+		actual := 0.0
+		for _, f := range ac {
+			actual = max(actual, math.Abs(f[0]), math.Abs(f[1]), math.Abs(f[2]))
+		}
+		quantised := int(max(0, min(82, math.Floor(actual*166-0.5))))
+		maximum = float64(quantised+1) / 166
+		encode83(&hash, quantised, 1)
+	} else {
+		encode83(&hash, 0, 1)
+	}
+
+	encode83(&hash, linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4)
+
+	for _, f := range ac {
+		quantise := func(v float64) int {
+			return int(max(0, min(18, math.Floor(signPow(v/maximum, 0.5)*9+9.5))))
+		}
+		encode83(&hash, quantise(f[0])*19*19+quantise(f[1])*19+quantise(f[2]), 2)
+	}
+
+	return hash.String()
+}
+
+func encode83(b *strings.Builder, value, length int) {
+	for i := 1; i <= length; i++ {
+		digit := value / int(math.Pow(83, float64(length-i))) % 83
+		b.WriteByte(base83[digit])
+	}
+}
+
+func srgbToLinear(v uint8) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	v = max(0, min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
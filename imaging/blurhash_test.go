@@ -0,0 +1,39 @@
+package imaging
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestBlurHash(t *testing.T) {
+	red, blue := color.NRGBA{255, 0, 0, 255}, color.NRGBA{0, 0, 255, 255}
+
+	// Hashes of the reference algorithm, which samples the cosines at x/w,
+	// so even a solid image has a little detail
+	tests := []struct {
+		name string
+		img  image.Image
+		want string
+	}{
+		{"red", fill(32, 32, red), "L9TI:j|cfQ|c|co1fQo1fQfQfQfQ"},
+		{"white", fill(32, 32, color.NRGBA{255, 255, 255, 255}), "L9TSUA~qfQ~q~qoffQoffQfQfQfQ"},
+		{"black", fill(32, 32, color.NRGBA{0, 0, 0, 255}), "L00000fQfQfQfQfQfQfQfQfQfQfQ"},
+		{"transparent counts as black", fill(32, 32, color.NRGBA{255, 0, 0, 0}), "L00000fQfQfQfQfQfQfQfQfQfQfQ"},
+		{"red and blue halves", paint(fill(64, 64, red), image.Rect(32, 0, 64, 64), blue), "L~LjfL|Tn~FOo3jsfQa}fQfQfQfQ"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := BlurHash(tt.img); got != tt.want {
+				t.Errorf("BlurHash = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBlurHashScalesDown(t *testing.T) {
+	img := paint(fill(640, 480, color.NRGBA{255, 0, 0, 255}), image.Rect(320, 0, 640, 480), color.NRGBA{0, 0, 255, 255})
+	if got, want := BlurHash(img), BlurHash(Thumbnail(img, paletteSample)); got != want {
+		t.Errorf("BlurHash = %q, want the hash of the thumbnail %q", got, want)
+	}
+}
@@ -0,0 +1,154 @@
+package imaging
+
+import (
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strings"
+	"sync"
+	"unicode"
+
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// MosaicTiles is the number of covers an artist needs for a mosaic
+const MosaicTiles = 4
+
+var initialsFont = sync.OnceValues(func() (*opentype.Font, error) {
+	return opentype.Parse(gobold.TTF)
+})
+
+// Initials renders the default artwork of something without image: up to
+// two initials of its name in white on a color derived from the name, so
+// the same name always looks the same
+func Initials(name string, size int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), image.NewUniform(NameColor(name)), image.Point{}, draw.Src)
+
+	text := initials(name)
+	f, err := initialsFont()
+	if text == "" || err != nil {
+		return img
+	}
+
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: float64(size) * 0.4, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return img
+	}
+	defer face.Close()
+
+	// Characters the font lacks would show up as boxes, the color alone is
+	// better than that
+	for _, r := range text {
+		if _, ok := face.GlyphAdvance(r); !ok {
+			return img
+		}
+	}
+
+	drawer := &font.Drawer{Dst: img, Src: image.White, Face: face}
+	bounds, advance := drawer.BoundString(text)
+	height := bounds.Max.Y - bounds.Min.Y
+	drawer.Dot = fixed.Point26_6{
+		X: (fixed.I(size) - advance) / 2,
+		Y: (fixed.I(size)-height)/2 - bounds.Min.Y,
+	}
+	drawer.DrawString(text)
+
+	return img
+}
+
+// NameColor derives a color from a hash of name: any hue, with saturation
+// and lightness chosen so white text stays readable
+func NameColor(name string) color.RGBA {
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToLower(name)))
+	return hslToRGB(float64(h.Sum32()%360), 0.55, 0.42)
+}
+
+// initials returns the uppercased first letters of the first two words of
+// name
+func initials(name string) string {
+	var letters []rune
+	for _, word := range strings.Fields(name) {
+		for _, r := range word {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				letters = append(letters, unicode.ToUpper(r))
+				break
+			}
+		}
+		if len(letters) == 2 {
+			break
+		}
+	}
+	return string(letters)
+}
+
+// Mosaic renders the first MosaicTiles tiles as a 2x2 grid, each cropped
+// and scaled to fill its quarter. With fewer tiles the first one fills the
+// whole square.
+func Mosaic(tiles []image.Image, size int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	if len(tiles) < MosaicTiles {
+		if len(tiles) > 0 {
+			xdraw.CatmullRom.Scale(img, img.Bounds(), tiles[0], squareCrop(tiles[0].Bounds()), draw.Src, nil)
+		}
+		return img
+	}
+
+	half := size / 2
+	for i, tile := range tiles[:min(len(tiles), MosaicTiles)] {
+		x, y := i%2*half, i/2*half
+		cell := image.Rect(x, y, x+half, y+half)
+		if i%2 == 1 {
+			cell.Max.X = size
+		}
+		if i/2 == 1 {
+			cell.Max.Y = size
+		}
+		xdraw.CatmullRom.Scale(img, cell, tile, squareCrop(tile.Bounds()), draw.Src, nil)
+	}
+	return img
+}
+
+// squareCrop returns the largest centered square of r
+func squareCrop(r image.Rectangle) image.Rectangle {
+	side := min(r.Dx(), r.Dy())
+	x := r.Min.X + (r.Dx()-side)/2
+	y := r.Min.Y + (r.Dy()-side)/2
+	return image.Rect(x, y, x+side, y+side)
+}
+
+func hslToRGB(h, s, l float64) color.RGBA {
+	c := (1 - math.Abs(2*l-1)) * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := l - c/2
+
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g, b = c, x, 0
+	case h < 120:
+		r, g, b = x, c, 0
+	case h < 180:
+		r, g, b = 0, c, x
+	case h < 240:
+		r, g, b = 0, x, c
+	case h < 300:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+
+	return color.RGBA{
+		R: uint8(math.Round((r + m) * 255)),
+		G: uint8(math.Round((g + m) * 255)),
+		B: uint8(math.Round((b + m) * 255)),
+		A: 0xff,
+	}
+}
@@ -0,0 +1,159 @@
+// Package imaging decodes uploaded artwork and renders thumbnails of it.
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strings"
+
+	"github.com/HugoSmits86/nativewebp"
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// MaxPixels bounds the decoded size of an image, a small file can still
+// decompress into gigabytes
+const MaxPixels = 50_000_000
+
+var (
+	ErrInvalidImage = errors.New("not a JPEG, PNG, GIF or WebP image")
+	ErrTooLarge     = errors.New("image too large")
+)
+
+// Formats as reported by image.Decode
+const (
+	JPEG = "jpeg"
+	PNG  = "png"
+	GIF  = "gif"
+	WebP = "webp"
+)
+
+// Image is a decoded upload together with the bytes it was decoded from
+type Image struct {
+	image.Image
+	Format string
+	Data   []byte
+}
+
+// Decode reads at most maxBytes from r and decodes them. The dimensions are
+// checked before any pixels are decoded.
+func Decode(r io.Reader, maxBytes int64) (*Image, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, fmt.Errorf("%w: more than %d bytes", ErrTooLarge, maxBytes)
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+	if Ext(format) == "" {
+		return nil, ErrInvalidImage
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return nil, ErrInvalidImage
+	}
+	if int64(config.Width)*int64(config.Height) > MaxPixels {
+		return nil, fmt.Errorf("%w: %dx%d pixels", ErrTooLarge, config.Width, config.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidImage, err)
+	}
+
+	return &Image{Image: img, Format: format, Data: data}, nil
+}
+
+// Ext returns the file extension for a format, "" for unsupported ones
+func Ext(format string) string {
+	switch format {
+	case JPEG:
+		return ".jpg"
+	case PNG:
+		return ".png"
+	case GIF:
+		return ".gif"
+	case WebP:
+		return ".webp"
+	}
+	return ""
+}
+
+// Format returns the format of a file extension, "" for unsupported ones
+func Format(ext string) string {
+	for _, format := range []string{JPEG, PNG, GIF, WebP} {
+		if strings.EqualFold(ext, Ext(format)) {
+			return format
+		}
+	}
+	if strings.EqualFold(ext, ".jpeg") {
+		return JPEG
+	}
+	return ""
+}
+
+// ContentType returns the media type of a format
+func ContentType(format string) string {
+	return "image/" + format
+}
+
+// Thumbnail scales img down to fit a size x size square, keeping its aspect
+// ratio. Images that already fit are returned as they are.
+func Thumbnail(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+
+	if w >= h {
+		w, h = size, max(h*size/w, 1)
+	} else {
+		w, h = max(w*size/h, 1), size
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+	return dst
+}
+
+// Opaque reports whether img has no transparent pixels
+func Opaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
+
+// ThumbnailFormat is the format thumbnails of img are encoded in: JPEG
+// unless transparency has to be kept
+func ThumbnailFormat(img image.Image) string {
+	if Opaque(img) {
+		return JPEG
+	}
+	return PNG
+}
+
+// Encode writes img as JPEG, PNG or lossless WebP
+func Encode(w io.Writer, img image.Image, format string) error {
+	switch format {
+	case JPEG:
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: 85})
+	case PNG:
+		return png.Encode(w, img)
+	case WebP:
+		return nativewebp.Encode(w, img, nil)
+	}
+	return fmt.Errorf("can't encode %s", format)
+}
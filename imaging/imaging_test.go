@@ -0,0 +1,144 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"strings"
+	"testing"
+)
+
+// testImage returns a w x h image with a gradient, opaque or half
+// transparent
+func testImage(w, h int, opaque bool) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	alpha := uint8(255)
+	if !opaque {
+		alpha = 128
+	}
+	for x := range w {
+		for y := range h {
+			img.Set(x, y, color.NRGBA{uint8(x), uint8(y), 128, alpha})
+		}
+	}
+	return img
+}
+
+func encode(t *testing.T, img image.Image, format string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if format == GIF {
+		if err := gif.Encode(&buf, img, nil); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	if err := Encode(&buf, img, format); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestThumbnail(t *testing.T) {
+	tests := []struct {
+		name       string
+		w, h, size int
+		wantW      int
+		wantH      int
+	}{
+		{"landscape", 400, 200, 100, 100, 50},
+		{"portrait", 200, 400, 100, 50, 100},
+		{"square", 300, 300, 100, 100, 100},
+		{"odd ratio", 333, 100, 100, 100, 30},
+		{"thin strip", 1000, 2, 100, 100, 1},
+		{"already fits", 80, 60, 100, 80, 60},
+		{"exactly fits", 100, 40, 100, 100, 40},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := testImage(tt.w, tt.h, true)
+			thumb := Thumbnail(src, tt.size)
+			if got := thumb.Bounds(); got.Dx() != tt.wantW || got.Dy() != tt.wantH {
+				t.Errorf("thumbnail is %dx%d, want %dx%d", got.Dx(), got.Dy(), tt.wantW, tt.wantH)
+			}
+			if tt.w <= tt.size && tt.h <= tt.size && thumb != image.Image(src) {
+				t.Error("an image that fits was scaled")
+			}
+		})
+	}
+}
+
+func TestDecode(t *testing.T) {
+	src := testImage(40, 30, true)
+	for _, format := range []string{JPEG, PNG, GIF, WebP} {
+		t.Run(format, func(t *testing.T) {
+			data := encode(t, src, format)
+			img, err := Decode(bytes.NewReader(data), int64(len(data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if img.Format != format || !bytes.Equal(img.Data, data) {
+				t.Errorf("decoded %s with %d bytes, want %s with %d", img.Format, len(img.Data), format, len(data))
+			}
+			if got := img.Bounds(); got.Dx() != 40 || got.Dy() != 30 {
+				t.Errorf("decoded %dx%d, want 40x30", got.Dx(), got.Dy())
+			}
+		})
+	}
+}
+
+func TestDecodeRejects(t *testing.T) {
+	png := encode(t, testImage(40, 30, true), PNG)
+
+	// A GIF claiming to be 65535 pixels square, its header is all that is
+	// read
+	huge := encode(t, testImage(1, 1, true), GIF)
+	huge[6], huge[7], huge[8], huge[9] = 0xff, 0xff, 0xff, 0xff
+
+	tests := []struct {
+		name string
+		data []byte
+		max  int64
+		want error
+	}{
+		{"text", []byte("not an image at all"), 1 << 20, ErrInvalidImage},
+		{"empty", nil, 1 << 20, ErrInvalidImage},
+		{"svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg"/>`), 1 << 20, ErrInvalidImage},
+		{"truncated", png[:len(png)/2], 1 << 20, ErrInvalidImage},
+		{"over the byte limit", png, int64(len(png)) - 1, ErrTooLarge},
+		{"too many pixels", huge, 1 << 20, ErrTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if img, err := Decode(bytes.NewReader(tt.data), tt.max); !errors.Is(err, tt.want) {
+				t.Errorf("Decode = %v, %v, want %v", img, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormats(t *testing.T) {
+	for ext, want := range map[string]string{
+		".jpg": JPEG, ".JPEG": JPEG, ".png": PNG, ".gif": GIF, ".WebP": WebP, ".bmp": "", "": "",
+	} {
+		if got := Format(ext); got != want {
+			t.Errorf("Format(%q) = %q, want %q", ext, got, want)
+		}
+	}
+	if got := Ext("bmp"); got != "" {
+		t.Errorf("Ext(bmp) = %q, want none", got)
+	}
+
+	if got := ThumbnailFormat(testImage(2, 2, true)); got != JPEG {
+		t.Errorf("opaque thumbnails are %s, want %s", got, JPEG)
+	}
+	if got := ThumbnailFormat(testImage(2, 2, false)); got != PNG {
+		t.Errorf("transparent thumbnails are %s, want %s", got, PNG)
+	}
+	if err := Encode(&strings.Builder{}, testImage(2, 2, true), GIF); err == nil {
+		t.Error("encoded a GIF")
+	}
+}
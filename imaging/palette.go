@@ -0,0 +1,102 @@
+package imaging
+
+import (
+	"cmp"
+	"fmt"
+	"image"
+	"slices"
+)
+
+// PaletteSize is the number of dominant colors Palette finds
+const PaletteSize = 5
+
+// paletteSample is the size images are scaled down to before their colors
+// are counted, which is plenty to find the dominant ones
+const paletteSample = 64
+
+type rgb [3]uint8
+
+// colorBox is a set of pixels median cut splits further
+type colorBox []rgb
+
+// Palette returns up to PaletteSize dominant colors of img as "#rrggbb",
+// the most common first. It uses median cut: the pixels are repeatedly
+// split at the median of the channel they vary most in, and each of the
+// final boxes contributes its average color. Mostly transparent pixels are
+// ignored; an image with nothing else has no palette.
+func Palette(img image.Image) []string {
+	small := Thumbnail(img, paletteSample)
+	bounds := small.Bounds()
+
+	pixels := make(colorBox, 0, bounds.Dx()*bounds.Dy())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := small.At(x, y).RGBA()
+			if a < 0x8000 {
+				continue
+			}
+			// Undo the alpha premultiplication
+			pixels = append(pixels, rgb{uint8(r * 0xff / a), uint8(g * 0xff / a), uint8(b * 0xff / a)})
+		}
+	}
+	if len(pixels) == 0 {
+		return nil
+	}
+
+	boxes := []colorBox{pixels}
+	for len(boxes) < PaletteSize {
+		// Split the box with the widest range, as long as any has one
+		widest, channel, span := -1, 0, 0
+		for i, box := range boxes {
+			if c, s := box.widestChannel(); s > span {
+				widest, channel, span = i, c, s
+			}
+		}
+		if widest < 0 {
+			break
+		}
+
+		box := boxes[widest]
+		slices.SortFunc(box, func(a, b rgb) int { return cmp.Compare(a[channel], b[channel]) })
+		median := len(box) / 2
+		boxes[widest] = box[:median]
+		boxes = append(boxes, box[median:])
+	}
+
+	slices.SortStableFunc(boxes, func(a, b colorBox) int { return cmp.Compare(len(b), len(a)) })
+
+	palette := make([]string, 0, len(boxes))
+	for _, box := range boxes {
+		color := box.average()
+		hex := fmt.Sprintf("#%02x%02x%02x", color[0], color[1], color[2])
+		if !slices.Contains(palette, hex) {
+			palette = append(palette, hex)
+		}
+	}
+	return palette
+}
+
+// widestChannel returns the channel the colors in b vary most in and by how
+// much
+func (b colorBox) widestChannel() (channel, span int) {
+	for c := range 3 {
+		lo, hi := uint8(255), uint8(0)
+		for _, p := range b {
+			lo, hi = min(lo, p[c]), max(hi, p[c])
+		}
+		if int(hi)-int(lo) > span && len(b) > 1 {
+			channel, span = c, int(hi)-int(lo)
+		}
+	}
+	return channel, span
+}
+
+func (b colorBox) average() rgb {
+	var sum [3]int
+	for _, p := range b {
+		for c := range 3 {
+			sum[c] += int(p[c])
+		}
+	}
+	return rgb{uint8(sum[0] / len(b)), uint8(sum[1] / len(b)), uint8(sum[2] / len(b))}
+}
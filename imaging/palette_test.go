@@ -0,0 +1,69 @@
+package imaging
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"slices"
+	"testing"
+)
+
+// fill returns a w x h image of c
+func fill(w, h int, c color.Color) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	return img
+}
+
+// paint fills r of img with c
+func paint(img *image.NRGBA, r image.Rectangle, c color.Color) *image.NRGBA {
+	draw.Draw(img, r, image.NewUniform(c), image.Point{}, draw.Src)
+	return img
+}
+
+func TestPalette(t *testing.T) {
+	red := color.NRGBA{255, 0, 0, 255}
+	blue := color.NRGBA{0, 0, 255, 255}
+	clear := color.NRGBA{0, 255, 0, 0}
+
+	tests := []struct {
+		name string
+		img  image.Image
+		want []string
+	}{
+		{"solid", fill(32, 32, red), []string{"#ff0000"}},
+		// The median split mixes both colors in a box before separating them
+		// on the next one, no purple is left
+		{"three quarters red", paint(fill(64, 64, red), image.Rect(48, 0, 64, 64), blue), []string{"#ff0000", "#0000ff"}},
+		{"mostly blue", paint(fill(64, 64, blue), image.Rect(0, 0, 64, 8), red), []string{"#0000ff", "#ff0000"}},
+		{"transparent pixels ignored", paint(fill(64, 64, clear), image.Rect(0, 0, 16, 16), blue), []string{"#0000ff"}},
+		{"fully transparent", fill(64, 64, clear), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Palette(tt.img); !slices.Equal(got, tt.want) {
+				t.Errorf("Palette = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPaletteSize(t *testing.T) {
+	// A gradient has more colors than the palette holds
+	img := image.NewNRGBA(image.Rect(0, 0, 256, 16))
+	for x := range 256 {
+		for y := range 16 {
+			img.Set(x, y, color.NRGBA{uint8(x), 0, uint8(255 - x), 255})
+		}
+	}
+
+	palette := Palette(img)
+	if len(palette) != PaletteSize {
+		t.Fatalf("Palette = %v, want %d colors", palette, PaletteSize)
+	}
+	for _, hex := range palette {
+		if len(hex) != 7 || hex[0] != '#' {
+			t.Errorf("%q isn't #rrggbb", hex)
+		}
+	}
+}
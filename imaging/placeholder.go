@@ -0,0 +1,33 @@
+package imaging
+
+import (
+	"image"
+	"image/color"
+)
+
+var (
+	placeholderBackground = color.RGBA{0x2a, 0x30, 0x3c, 0xff}
+	placeholderDisc       = color.RGBA{0x3d, 0x45, 0x54, 0xff}
+)
+
+// Placeholder renders the artwork shown where there is none: a record on a
+// dark square, size pixels wide
+func Placeholder(size int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	center := float64(size) / 2
+	outer, inner := center*0.7, center*0.12
+
+	for y := range size {
+		for x := range size {
+			dx, dy := float64(x)+0.5-center, float64(y)+0.5-center
+			d := dx*dx + dy*dy
+			c := placeholderBackground
+			if d <= outer*outer && d > inner*inner {
+				c = placeholderDisc
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+
+	return img
+}
@@ -0,0 +1,183 @@
+// Package itunes reads the XML library export produced by iTunes and the
+// macOS Music app (File > Library > Export Library).
+package itunes
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Track is the subset of an exported track that Whalio cares about.
+type Track struct {
+	ID          int64
+	Name        string
+	Artist      string
+	AlbumArtist string
+	Album       string
+	Year        int
+	TrackNumber int
+	PlayCount   int
+	Rating      int // 0-100, 20 per star
+	DateAdded   time.Time
+	PlayDate    time.Time
+	Location    string // Local path decoded from the file:// URL
+	Podcast     bool
+	Video       bool
+}
+
+// Stars converts the 0-100 iTunes rating to 0-5 stars.
+func (t *Track) Stars() int {
+	return min(max((t.Rating+10)/20, 0), 5)
+}
+
+// Playlist is a user playlist with its tracks in order.
+type Playlist struct {
+	ID       int64
+	Name     string
+	TrackIDs []int64
+}
+
+type Library struct {
+	MusicFolder string // Local path of the iTunes media folder
+	Tracks      map[int64]*Track
+	Playlists   []Playlist
+}
+
+// Parse reads a Library.xml export.
+func Parse(r io.Reader) (*Library, error) {
+	root, err := decodePlist(r)
+	if err != nil {
+		return nil, err
+	}
+
+	dict, ok := root.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("itunes: library root is not a dict")
+	}
+
+	lib := &Library{
+		Tracks: make(map[int64]*Track),
+	}
+
+	if folder := str(dict, "Music Folder"); folder != "" {
+		lib.MusicFolder = locationPath(folder)
+	}
+
+	tracks, _ := dict["Tracks"].(map[string]any)
+	for _, v := range tracks {
+		t, ok := v.(map[string]any)
+		if !ok {
+			continue
+		}
+
+		track := &Track{
+			ID:          integer(t, "Track ID"),
+			Name:        str(t, "Name"),
+			Artist:      str(t, "Artist"),
+			AlbumArtist: str(t, "Album Artist"),
+			Album:       str(t, "Album"),
+			Year:        int(integer(t, "Year")),
+			TrackNumber: int(integer(t, "Track Number")),
+			PlayCount:   int(integer(t, "Play Count")),
+			Rating:      int(integer(t, "Rating")),
+			DateAdded:   date(t, "Date Added"),
+			PlayDate:    date(t, "Play Date UTC"),
+			Podcast:     boolean(t, "Podcast"),
+			Video:       boolean(t, "Has Video") || boolean(t, "Movie") || boolean(t, "TV Show"),
+		}
+		if loc := str(t, "Location"); loc != "" {
+			track.Location = locationPath(loc)
+		}
+		// Computed ratings are guesses derived from album ratings
+		if boolean(t, "Rating Computed") {
+			track.Rating = 0
+		}
+
+		lib.Tracks[track.ID] = track
+	}
+
+	playlists, _ := dict["Playlists"].([]any)
+	for _, v := range playlists {
+		p, ok := v.(map[string]any)
+		if !ok {
+			continue
+		}
+
+		// Skip the whole-library playlist, built-in lists such as "Music"
+		// or "Podcasts", and folders which only group other playlists
+		if boolean(p, "Master") || boolean(p, "Folder") || p["Distinguished Kind"] != nil {
+			continue
+		}
+
+		playlist := Playlist{
+			ID:   integer(p, "Playlist ID"),
+			Name: str(p, "Name"),
+		}
+		items, _ := p["Playlist Items"].([]any)
+		for _, item := range items {
+			if entry, ok := item.(map[string]any); ok {
+				playlist.TrackIDs = append(playlist.TrackIDs, integer(entry, "Track ID"))
+			}
+		}
+
+		lib.Playlists = append(lib.Playlists, playlist)
+	}
+
+	return lib, nil
+}
+
+// Resolve maps a track location from the exporting machine onto musicRoot.
+// Locations inside the library's music folder keep their relative layout;
+// anything else is returned unchanged.
+func (l *Library) Resolve(location, musicRoot string) string {
+	if location == "" || musicRoot == "" || l.MusicFolder == "" {
+		return location
+	}
+
+	rel, err := filepath.Rel(l.MusicFolder, location)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return location
+	}
+
+	return filepath.Join(musicRoot, rel)
+}
+
+// locationPath turns a file://localhost/... URL into a local path.
+func locationPath(location string) string {
+	u, err := url.Parse(location)
+	if err != nil || u.Scheme != "file" {
+		return location
+	}
+
+	path := u.Path
+	// Windows exports look like file://localhost/C:/Users/...
+	if len(path) > 2 && path[0] == '/' && path[2] == ':' {
+		path = path[1:]
+	}
+
+	return filepath.FromSlash(path)
+}
+
+func str(d map[string]any, key string) string {
+	s, _ := d[key].(string)
+	return strings.TrimSpace(s)
+}
+
+func integer(d map[string]any, key string) int64 {
+	i, _ := d[key].(int64)
+	return i
+}
+
+func boolean(d map[string]any, key string) bool {
+	b, _ := d[key].(bool)
+	return b
+}
+
+func date(d map[string]any, key string) time.Time {
+	t, _ := d[key].(time.Time)
+	return t
+}
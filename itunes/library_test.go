@@ -0,0 +1,148 @@
+package itunes
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	file, err := os.Open(filepath.Join("testdata", "Library.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	lib, err := Parse(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := filepath.FromSlash("/Users/me/Music/Music/Media.localized/"); lib.MusicFolder != want {
+		t.Errorf("MusicFolder = %q, want %q", lib.MusicFolder, want)
+	}
+
+	want := map[int64]*Track{
+		101: {
+			ID:          101,
+			Name:        "Blue Monday",
+			Artist:      "New Order",
+			AlbumArtist: "New Order",
+			Album:       "Power, Corruption & Lies",
+			Year:        1983,
+			TrackNumber: 1,
+			PlayCount:   42,
+			Rating:      80,
+			DateAdded:   time.Date(2010, 5, 4, 10, 0, 0, 0, time.UTC),
+			PlayDate:    time.Date(2024, 2, 29, 22, 15, 0, 0, time.UTC),
+			Location:    filepath.FromSlash("/Users/me/Music/Music/Media.localized/Music/New Order/Power, Corruption & Lies/01 Blue Monday.mp3"),
+		},
+		// A computed rating is dropped
+		102: {
+			ID:       102,
+			Name:     "Café",
+			Artist:   "Björk",
+			Album:    "Début",
+			Location: filepath.FromSlash("/Users/me/Music/Music/Media.localized/Music/Björk/Début/Café.m4a"),
+		},
+		103: {ID: 103, Name: "Episode 1", Podcast: true, Location: filepath.FromSlash("/Users/me/Music/Podcasts/episode1.mp3")},
+		104: {ID: 104, Name: "Video", Video: true},
+		105: {ID: 105, Name: "Elsewhere", Location: filepath.FromSlash("/Volumes/Backup/elsewhere.flac")},
+	}
+	if !reflect.DeepEqual(lib.Tracks, want) {
+		for id, track := range lib.Tracks {
+			if !reflect.DeepEqual(track, want[id]) {
+				t.Errorf("track %d = %+v, want %+v", id, track, want[id])
+			}
+		}
+		if len(lib.Tracks) != len(want) {
+			t.Errorf("got %d tracks, want %d", len(lib.Tracks), len(want))
+		}
+	}
+
+	// The library, built-in lists and folders are skipped
+	wantPlaylists := []Playlist{
+		{ID: 4, Name: "Favourites", TrackIDs: []int64{102, 101}},
+		{ID: 5, Name: "Empty"},
+	}
+	if !reflect.DeepEqual(lib.Playlists, wantPlaylists) {
+		t.Errorf("playlists = %+v, want %+v", lib.Playlists, wantPlaylists)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for name, xml := range map[string]string{
+		"not a plist": `hello`,
+		"array root":  `<plist><array/></plist>`,
+		"broken":      `<plist><dict><key>Tracks</key><dict>`,
+	} {
+		if lib, err := Parse(strings.NewReader(xml)); err == nil {
+			t.Errorf("%s: parsed %+v, want an error", name, lib)
+		}
+	}
+}
+
+func TestLocationPath(t *testing.T) {
+	tests := []struct {
+		location, want string
+	}{
+		{"file://localhost/Users/me/Music/song.mp3", "/Users/me/Music/song.mp3"},
+		{"file:///Users/me/Music/song.mp3", "/Users/me/Music/song.mp3"},
+		{"file://localhost/Users/me/My%20Music/01%20Song.mp3", "/Users/me/My Music/01 Song.mp3"},
+		{"file://localhost/Users/me/Bj%C3%B6rk/Caf%C3%A9.m4a", "/Users/me/Björk/Café.m4a"},
+		{"file://localhost/Users/me/100%25/a%23b%3F.mp3", "/Users/me/100%/a#b?.mp3"},
+		{"file://localhost/C:/Users/me/Music/song.mp3", "C:/Users/me/Music/song.mp3"},
+		{"file://localhost/Users/me/Music/", "/Users/me/Music/"},
+		// Anything else is kept as it is
+		{"/Users/me/song.mp3", "/Users/me/song.mp3"},
+		{"http://example.com/song.mp3", "http://example.com/song.mp3"},
+		{"file://localhost/bad%zzescape.mp3", "file://localhost/bad%zzescape.mp3"},
+	}
+	for _, tt := range tests {
+		if got, want := locationPath(tt.location), filepath.FromSlash(tt.want); got != want {
+			t.Errorf("locationPath(%q) = %q, want %q", tt.location, got, want)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	lib := &Library{MusicFolder: filepath.FromSlash("/Users/me/Music/Media")}
+	tests := []struct {
+		name                      string
+		location, musicRoot, want string
+	}{
+		{"inside", "/Users/me/Music/Media/Music/A/B/song.mp3", "/mnt/music", "/mnt/music/Music/A/B/song.mp3"},
+		{"folder itself", "/Users/me/Music/Media", "/mnt/music", "/mnt/music"},
+		{"sibling with the same prefix", "/Users/me/Music/Media2/song.mp3", "/mnt/music", "/Users/me/Music/Media2/song.mp3"},
+		{"outside", "/Volumes/Backup/song.mp3", "/mnt/music", "/Volumes/Backup/song.mp3"},
+		{"parent", "/Users/me/Music/song.mp3", "/mnt/music", "/Users/me/Music/song.mp3"},
+		{"no root", "/Users/me/Music/Media/song.mp3", "", "/Users/me/Music/Media/song.mp3"},
+		{"no location", "", "/mnt/music", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := lib.Resolve(filepath.FromSlash(tt.location), filepath.FromSlash(tt.musicRoot))
+			if want := filepath.FromSlash(tt.want); got != want {
+				t.Errorf("Resolve = %q, want %q", got, want)
+			}
+		})
+	}
+
+	if got := (&Library{}).Resolve("/a/song.mp3", "/mnt/music"); got != "/a/song.mp3" {
+		t.Errorf("Resolve without a music folder = %q, want the location", got)
+	}
+}
+
+func TestStars(t *testing.T) {
+	for rating, want := range map[int]int{
+		0: 0, 9: 0, 10: 1, 20: 1, 40: 2, 50: 3, 60: 3, 80: 4, 100: 5, 120: 5, -20: 0,
+	} {
+		track := Track{Rating: rating}
+		if got := track.Stars(); got != want {
+			t.Errorf("Stars of rating %d = %d, want %d", rating, got, want)
+		}
+	}
+}
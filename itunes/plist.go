@@ -0,0 +1,117 @@
+package itunes
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// decodePlist reads an XML property list into plain Go values: dicts become
+// map[string]any, arrays []any, and scalars string, int64, float64, bool,
+// time.Time or []byte.
+func decodePlist(r io.Reader) (any, error) {
+	dec := xml.NewDecoder(r)
+	// Library exports declare UTF-8, but be lenient with other labels
+	dec.CharsetReader = func(_ string, input io.Reader) (io.Reader, error) { return input, nil }
+
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, fmt.Errorf("plist: %w", err)
+		}
+
+		if start, ok := tok.(xml.StartElement); ok {
+			if start.Name.Local == "plist" {
+				continue
+			}
+			return decodeValue(dec, start)
+		}
+	}
+}
+
+func decodeValue(dec *xml.Decoder, start xml.StartElement) (any, error) {
+	switch start.Name.Local {
+	case "dict":
+		return decodeDict(dec)
+	case "array":
+		return decodeArray(dec)
+	case "true", "false":
+		if err := dec.Skip(); err != nil {
+			return nil, err
+		}
+		return start.Name.Local == "true", nil
+	}
+
+	var text string
+	if err := dec.DecodeElement(&text, &start); err != nil {
+		return nil, err
+	}
+
+	switch start.Name.Local {
+	case "string", "key":
+		return text, nil
+	case "integer":
+		return strconv.ParseInt(strings.TrimSpace(text), 10, 64)
+	case "real":
+		return strconv.ParseFloat(strings.TrimSpace(text), 64)
+	case "date":
+		return time.Parse(time.RFC3339, strings.TrimSpace(text))
+	case "data":
+		return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(text), ""))
+	}
+
+	return nil, fmt.Errorf("plist: unknown element <%s>", start.Name.Local)
+}
+
+func decodeDict(dec *xml.Decoder) (map[string]any, error) {
+	dict := make(map[string]any)
+	var key string
+
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			value, err := decodeValue(dec, t)
+			if err != nil {
+				return nil, err
+			}
+			if t.Name.Local == "key" {
+				key = value.(string)
+				continue
+			}
+			dict[key] = value
+		case xml.EndElement:
+			return dict, nil
+		}
+	}
+}
+
+func decodeArray(dec *xml.Decoder) ([]any, error) {
+	var array []any
+
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			value, err := decodeValue(dec, t)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		case xml.EndElement:
+			return array, nil
+		}
+	}
+}
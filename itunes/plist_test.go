@@ -0,0 +1,68 @@
+package itunes
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodePlist(t *testing.T) {
+	tests := []struct {
+		name string
+		xml  string
+		want any
+	}{
+		{"string", `<string>Blue Monday</string>`, "Blue Monday"},
+		{"empty string", `<string/>`, ""},
+		{"entities", `<string>Power, Corruption &amp; Lies</string>`, "Power, Corruption & Lies"},
+		{"integer", `<integer> -42 </integer>`, int64(-42)},
+		{"real", `<real>1.5</real>`, 1.5},
+		{"true", `<true/>`, true},
+		{"false", `<false/>`, false},
+		{"date", `<date>2024-02-29T22:15:00Z</date>`, time.Date(2024, 2, 29, 22, 15, 0, 0, time.UTC)},
+		{"data", "<data>\n\tAAEC\n\tAw==\n</data>", []byte{0, 1, 2, 3}},
+		{"empty dict", `<dict/>`, map[string]any{}},
+		{"empty array", `<array></array>`, []any(nil)},
+		{"dict", `<dict><key>Name</key><string>x</string><key>Count</key><integer>3</integer><key>On</key><true/></dict>`,
+			map[string]any{"Name": "x", "Count": int64(3), "On": true}},
+		{"array", `<array><integer>1</integer><string>two</string><false/></array>`, []any{int64(1), "two", false}},
+		{"nested", `<dict><key>Items</key><array><dict><key>Track ID</key><integer>7</integer></dict></array></dict>`,
+			map[string]any{"Items": []any{map[string]any{"Track ID": int64(7)}}}},
+		{"plist element", `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple Computer//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0"><dict><key>A</key><string>b</string></dict></plist>`, map[string]any{"A": "b"}},
+		{"other charset", `<?xml version="1.0" encoding="MacRoman"?><plist><string>x</string></plist>`, "x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodePlist(strings.NewReader(tt.xml))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodePlistInvalid(t *testing.T) {
+	for name, xml := range map[string]string{
+		"empty":           ``,
+		"only plist":      `<plist></plist>`,
+		"unknown element": `<dict><key>A</key><uid>1</uid></dict>`,
+		"bad integer":     `<integer>one</integer>`,
+		"bad real":        `<real>1,5</real>`,
+		"bad date":        `<date>yesterday</date>`,
+		"bad data":        `<data>!!!</data>`,
+		"unclosed dict":   `<dict><key>A</key><string>b</string>`,
+		"unclosed array":  `<array><string>b</string>`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if got, err := decodePlist(strings.NewReader(xml)); err == nil {
+				t.Errorf("decoded %#v, want an error", got)
+			}
+		})
+	}
+}
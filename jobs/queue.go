@@ -0,0 +1,311 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+	"whalio/models"
+	"whalio/repository"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// Handler runs a single job. Progress reports are forwarded to subscribers
+// and periodically persisted. Returning an error schedules a retry until the
+// job runs out of attempts.
+type Handler func(ctx context.Context, job *models.Job, progress ProgressFunc) error
+
+// ProgressFunc reports completion as a percentage with an optional message.
+type ProgressFunc func(percent int, message string)
+
+// Event is what subscribers receive whenever a job changes.
+type Event struct {
+	ID       uint             `json:"id"`
+	Kind     string           `json:"kind"`
+	Status   models.JobStatus `json:"status"`
+	Progress int              `json:"progress"`
+	Message  string           `json:"message,omitempty"`
+	Error    string           `json:"error,omitempty"`
+	Attempts int              `json:"attempts"`
+}
+
+func NewEvent(job *models.Job) Event {
+	return Event{
+		ID:       job.ID,
+		Kind:     job.Kind,
+		Status:   job.Status,
+		Progress: job.Progress,
+		Message:  job.Message,
+		Error:    job.Error,
+		Attempts: job.Attempts,
+	}
+}
+
+type Options struct {
+	Workers      int
+	Timeout      time.Duration // Per attempt
+	MaxAttempts  int
+	PollInterval time.Duration
+	RetryBackoff time.Duration // Multiplied by attempts squared
+}
+
+// Queue is a persistent job queue backed by the jobs table. A single
+// dispatcher claims jobs and hands them to a fixed pool of workers.
+type Queue struct {
+	logger     *zerolog.Logger
+	repository *repository.Repository
+	opts       Options
+
+	handlers map[string]Handler
+	wake     chan struct{}
+
+	mu          sync.Mutex
+	subscribers map[uint]map[chan Event]struct{}
+
+	wg sync.WaitGroup
+}
+
+func NewQueue(logger *zerolog.Logger, repository *repository.Repository, opts Options) *Queue {
+	return &Queue{
+		logger:      logger,
+		repository:  repository,
+		opts:        opts,
+		handlers:    make(map[string]Handler),
+		wake:        make(chan struct{}, 1),
+		subscribers: make(map[uint]map[chan Event]struct{}),
+	}
+}
+
+// Register installs the handler for a job kind. It must be called before Start.
+func (q *Queue) Register(kind string, handler Handler) {
+	q.handlers[kind] = handler
+}
+
+// Enqueue persists a new job and wakes the dispatcher.
+func (q *Queue) Enqueue(ctx context.Context, kind string, payload any) (*models.Job, error) {
+	if _, ok := q.handlers[kind]; !ok {
+		return nil, fmt.Errorf("no handler registered for job kind %q", kind)
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode job payload")
+	}
+
+	job := models.NewJob(kind, string(data), q.opts.MaxAttempts)
+	if err := q.repository.CreateJob(ctx, job); err != nil {
+		return nil, err
+	}
+
+	q.publish(job)
+	q.notify()
+
+	return job, nil
+}
+
+// Get returns the current state of a job
+func (q *Queue) Get(ctx context.Context, id uint) (*models.Job, error) {
+	return q.repository.GetJobByID(ctx, id)
+}
+
+// List returns recent jobs, optionally filtered by status
+func (q *Queue) List(ctx context.Context, limit int, statuses ...models.JobStatus) ([]models.Job, error) {
+	return q.repository.ListJobs(ctx, limit, statuses...)
+}
+
+// Subscribe returns a channel receiving events for job id. Slow receivers
+// miss intermediate events rather than blocking workers. The returned func
+// must be called to release the subscription.
+func (q *Queue) Subscribe(id uint) (<-chan Event, func()) {
+	ch := make(chan Event, 16)
+
+	q.mu.Lock()
+	if q.subscribers[id] == nil {
+		q.subscribers[id] = make(map[chan Event]struct{})
+	}
+	q.subscribers[id][ch] = struct{}{}
+	q.mu.Unlock()
+
+	return ch, func() {
+		q.mu.Lock()
+		delete(q.subscribers[id], ch)
+		if len(q.subscribers[id]) == 0 {
+			delete(q.subscribers, id)
+		}
+		q.mu.Unlock()
+	}
+}
+
+func (q *Queue) publish(job *models.Job) {
+	event := NewEvent(job)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for ch := range q.subscribers[job.ID] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+func (q *Queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start requeues jobs interrupted by a previous shutdown and runs the
+// dispatcher until ctx is cancelled. Wait blocks until in-flight jobs finish.
+func (q *Queue) Start(ctx context.Context) error {
+	if _, err := q.repository.RequeueRunningJobs(ctx); err != nil {
+		return err
+	}
+
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		q.dispatch(ctx)
+	}()
+
+	return nil
+}
+
+func (q *Queue) Wait() {
+	q.wg.Wait()
+}
+
+func (q *Queue) dispatch(ctx context.Context) {
+	slots := make(chan struct{}, max(q.opts.Workers, 1))
+
+	for {
+		// Wait for a free worker before claiming, so claimed jobs never sit idle
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+
+		job, err := q.repository.ClaimJob(ctx)
+		if err != nil {
+			<-slots
+			if !errors.Is(err, repository.ErrNoJobsReady) {
+				q.logger.Error().Err(err).Msg("failed claim job")
+			}
+
+			select {
+			case <-q.wake:
+			case <-time.After(q.pollDelay(ctx)):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			defer func() { <-slots }()
+			q.run(ctx, job)
+		}()
+	}
+}
+
+// pollDelay sleeps until the next scheduled retry, capped at the poll interval
+func (q *Queue) pollDelay(ctx context.Context) time.Duration {
+	next, err := q.repository.NextJobRunAt(ctx)
+	if err != nil {
+		return q.opts.PollInterval
+	}
+
+	return min(max(time.Until(next), 0), q.opts.PollInterval)
+}
+
+func (q *Queue) run(ctx context.Context, job *models.Job) {
+	log := q.logger.With().Uint("job_id", job.ID).Str("kind", job.Kind).Int("attempt", job.Attempts).Logger()
+	log.Info().Msg("Running job")
+
+	q.publish(job)
+
+	runCtx, cancel := context.WithTimeout(ctx, q.opts.Timeout)
+	defer cancel()
+
+	var lastSave time.Time
+	progress := func(percent int, message string) {
+		job.Progress = min(max(percent, 0), 100)
+		job.Message = message
+		q.publish(job)
+
+		// Persist at most once a second, subscribers get every update
+		if time.Since(lastSave) >= time.Second {
+			lastSave = time.Now()
+			if err := q.repository.UpdateJob(runCtx, job); err != nil {
+				log.Warn().Err(err).Msg("failed save job progress")
+			}
+		}
+	}
+
+	err := q.execute(runCtx, job, progress)
+
+	// Record the outcome even if the queue is shutting down
+	saveCtx, saveCancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer saveCancel()
+
+	now := time.Now()
+	switch {
+	case err == nil:
+		job.Status = models.JobDone
+		job.Progress = 100
+		job.FinishedAt = &now
+		log.Info().Msg("Job finished")
+	case ctx.Err() != nil:
+		// Interrupted by shutdown, run it again on next start without
+		// counting the attempt
+		job.Status = models.JobQueued
+		job.Attempts--
+		log.Warn().Msg("Job interrupted by shutdown")
+	case job.Attempts < job.MaxAttempts:
+		job.Status = models.JobQueued
+		job.Error = err.Error()
+		job.RunAt = now.Add(q.opts.RetryBackoff * time.Duration(job.Attempts*job.Attempts))
+		log.Warn().Err(err).Time("retry_at", job.RunAt).Msg("Job failed, will retry")
+	default:
+		job.Status = models.JobFailed
+		job.Error = err.Error()
+		job.FinishedAt = &now
+		log.Error().Err(err).Msg("Job failed")
+	}
+
+	if err := q.repository.UpdateJob(saveCtx, job); err != nil {
+		log.Error().Err(err).Msg("failed save job result")
+	}
+	q.publish(job)
+}
+
+func (q *Queue) execute(ctx context.Context, job *models.Job, progress ProgressFunc) (err error) {
+	handler, ok := q.handlers[job.Kind]
+	if !ok {
+		return fmt.Errorf("no handler registered for job kind %q", job.Kind)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+
+	return handler(ctx, job, progress)
+}
+
+// DecodePayload unmarshals the job payload into v
+func DecodePayload(job *models.Job, v any) error {
+	if err := json.Unmarshal([]byte(job.Payload), v); err != nil {
+		return errors.Wrap(err, "failed to decode job payload")
+	}
+	return nil
+}
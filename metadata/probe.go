@@ -0,0 +1,269 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+)
+
+// probeWindow is how many bytes are captured at the start of the stream and
+// again at the start of the audio payload (after an ID3v2 tag, if any).
+const probeWindow = 4096
+
+// Result describes what a Probe learned about an audio stream.
+type Result struct {
+	MimeType string
+	Duration time.Duration
+	Size     int64
+}
+
+// Probe is an io.Writer that inspects audio bytes as they stream past, so it
+// can be placed behind an io.TeeReader while the file is being stored.
+type Probe struct {
+	head    []byte
+	frame   []byte
+	skip    int64
+	skipSet bool
+	size    int64
+}
+
+func NewProbe() *Probe {
+	return &Probe{
+		head: make([]byte, 0, probeWindow),
+	}
+}
+
+func (p *Probe) Write(b []byte) (int, error) {
+	offset := p.size
+	p.size += int64(len(b))
+
+	if n := cap(p.head) - len(p.head); n > 0 {
+		p.head = append(p.head, b[:min(n, len(b))]...)
+	}
+
+	if !p.skipSet && len(p.head) >= 10 {
+		p.skip = id3v2Size(p.head)
+		p.skipSet = true
+		if p.skip < int64(len(p.head)) {
+			p.frame = append(make([]byte, 0, probeWindow), p.head[p.skip:]...)
+		}
+	}
+
+	if p.skipSet && len(p.frame) < probeWindow {
+		start := max(p.skip+int64(len(p.frame)), offset)
+		if start < p.size {
+			chunk := b[start-offset:]
+			p.frame = append(p.frame, chunk[:min(probeWindow-len(p.frame), len(chunk))]...)
+		}
+	}
+
+	return len(b), nil
+}
+
+// Size returns the number of bytes written to the probe so far.
+func (p *Probe) Size() int64 {
+	return p.size
+}
+
+// Result returns the detected MIME type and duration. Fields that could not
+// be determined are left empty.
+func (p *Probe) Result() Result {
+	res := Result{
+		MimeType: sniffMimeType(p.head, p.frame),
+		Size:     p.size,
+	}
+
+	switch res.MimeType {
+	case "audio/mpeg":
+		res.Duration = mp3Duration(p.frame, p.size-p.skip)
+	case "audio/flac":
+		res.Duration = flacDuration(p.head)
+	case "audio/wav":
+		res.Duration = wavDuration(p.head, p.size)
+	}
+
+	return res
+}
+
+func sniffMimeType(head, frame []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("fLaC")):
+		return "audio/flac"
+	case bytes.HasPrefix(head, []byte("OggS")):
+		return "audio/ogg"
+	case len(head) >= 12 && bytes.Equal(head[0:4], []byte("RIFF")) && bytes.Equal(head[8:12], []byte("WAVE")):
+		return "audio/wav"
+	case len(head) >= 8 && bytes.Equal(head[4:8], []byte("ftyp")):
+		return "audio/m4a"
+	case len(frame) >= 2 && frame[0] == 0xFF && frame[1]&0xF6 == 0xF0:
+		return "audio/aac"
+	case bytes.HasPrefix(head, []byte("ID3")), len(frame) >= 2 && frame[0] == 0xFF && frame[1]&0xE0 == 0xE0:
+		return "audio/mpeg"
+	}
+
+	return ""
+}
+
+// id3v2Size returns the total size of a leading ID3v2 tag, or 0 if there is none.
+func id3v2Size(head []byte) int64 {
+	if len(head) < 10 || !bytes.HasPrefix(head, []byte("ID3")) {
+		return 0
+	}
+
+	size := int64(head[6]&0x7F)<<21 | int64(head[7]&0x7F)<<14 | int64(head[8]&0x7F)<<7 | int64(head[9]&0x7F)
+	size += 10
+	if head[5]&0x10 != 0 {
+		size += 10 // footer present
+	}
+
+	return size
+}
+
+var (
+	mp3Bitrates = [2][3][16]int{
+		{ // MPEG-1
+			{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448, 0},
+			{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 0},
+			{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+		},
+		{ // MPEG-2 and 2.5
+			{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256, 0},
+			{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+			{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+		},
+	}
+	mp3SampleRates = [4][3]int{
+		{11025, 12000, 8000},  // MPEG-2.5
+		{0, 0, 0},             // reserved
+		{22050, 24000, 16000}, // MPEG-2
+		{44100, 48000, 32000}, // MPEG-1
+	}
+)
+
+// mp3Header is a decoded MPEG audio frame header.
+type mp3Header struct {
+	bitrate         int // bits per second
+	sampleRate      int
+	samplesPerFrame int
+	length          int // frame length in bytes, including the header
+}
+
+func parseMP3Header(h []byte) (mp3Header, bool) {
+	if len(h) < 4 || h[0] != 0xFF || h[1]&0xE0 != 0xE0 {
+		return mp3Header{}, false
+	}
+
+	version := (h[1] >> 3) & 0x03
+	layer := (h[1] >> 1) & 0x03
+	bitrateIdx := h[2] >> 4
+	rateIdx := (h[2] >> 2) & 0x03
+	padding := int(h[2]>>1) & 0x01
+	if version == 1 || layer == 0 || rateIdx == 3 || bitrateIdx == 0x0F {
+		return mp3Header{}, false
+	}
+
+	table := 0
+	if version != 3 {
+		table = 1
+	}
+
+	hdr := mp3Header{
+		bitrate:         mp3Bitrates[table][3-layer][bitrateIdx] * 1000,
+		sampleRate:      mp3SampleRates[version][rateIdx],
+		samplesPerFrame: 1152,
+	}
+	switch {
+	case layer == 3:
+		hdr.samplesPerFrame = 384
+	case layer == 1 && version != 3:
+		hdr.samplesPerFrame = 576
+	}
+
+	if hdr.bitrate > 0 {
+		if layer == 3 {
+			hdr.length = (12*hdr.bitrate/hdr.sampleRate + padding) * 4
+		} else {
+			hdr.length = hdr.samplesPerFrame/8*hdr.bitrate/hdr.sampleRate + padding
+		}
+	}
+
+	return hdr, true
+}
+
+// mp3Duration estimates duration from the first MPEG frame. VBR files are
+// handled through their Xing/Info header; everything else is treated as CBR.
+func mp3Duration(frame []byte, payload int64) time.Duration {
+	i := 0
+	for ; i+4 <= len(frame); i++ {
+		if frame[i] == 0xFF && frame[i+1]&0xE0 == 0xE0 {
+			break
+		}
+	}
+
+	h := frame[min(i, len(frame)):]
+	hdr, ok := parseMP3Header(h)
+	if !ok {
+		return 0
+	}
+
+	for _, tag := range [][]byte{[]byte("Xing"), []byte("Info")} {
+		if j := bytes.Index(h[:min(len(h), 64)], tag); j >= 0 && j+12 <= len(h) {
+			if binary.BigEndian.Uint32(h[j+4:])&0x01 != 0 {
+				frames := int64(binary.BigEndian.Uint32(h[j+8:]))
+				return time.Duration(frames*int64(hdr.samplesPerFrame)) * time.Second / time.Duration(hdr.sampleRate)
+			}
+		}
+	}
+
+	if hdr.bitrate == 0 || payload <= 0 {
+		return 0
+	}
+
+	return time.Duration(payload*8) * time.Second / time.Duration(hdr.bitrate)
+}
+
+// flacDuration reads the mandatory STREAMINFO block that follows the marker.
+func flacDuration(head []byte) time.Duration {
+	if len(head) < 8+34 || head[4]&0x7F != 0 {
+		return 0
+	}
+
+	info := head[8:]
+	sampleRate := int64(info[10])<<12 | int64(info[11])<<4 | int64(info[12])>>4
+	samples := int64(info[13]&0x0F)<<32 | int64(binary.BigEndian.Uint32(info[14:18]))
+	if sampleRate == 0 {
+		return 0
+	}
+
+	return time.Duration(samples) * time.Second / time.Duration(sampleRate)
+}
+
+// wavDuration walks the RIFF chunks for the byte rate and data length.
+func wavDuration(head []byte, size int64) time.Duration {
+	var byteRate, dataSize int64
+
+	for off := 12; off+8 <= len(head); {
+		id := string(head[off : off+4])
+		n := int64(binary.LittleEndian.Uint32(head[off+4:]))
+
+		switch id {
+		case "fmt ":
+			if off+20 <= len(head) {
+				byteRate = int64(binary.LittleEndian.Uint32(head[off+16:]))
+			}
+		case "data":
+			dataSize = min(n, size-int64(off+8))
+		}
+		if dataSize > 0 {
+			break
+		}
+
+		off += 8 + int(n) + int(n&1)
+	}
+
+	if byteRate == 0 || dataSize <= 0 {
+		return 0
+	}
+
+	return time.Duration(dataSize) * time.Second / time.Duration(byteRate)
+}
@@ -0,0 +1,117 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func wavHeader(byteRate uint32, chunks ...[]byte) []byte {
+	var b bytes.Buffer
+	b.WriteString("RIFF")
+	binary.Write(&b, binary.LittleEndian, uint32(0))
+	b.WriteString("WAVE")
+	b.WriteString("fmt ")
+	binary.Write(&b, binary.LittleEndian, uint32(16))
+	binary.Write(&b, binary.LittleEndian, []uint16{1, 1})               // PCM, mono
+	binary.Write(&b, binary.LittleEndian, []uint32{byteRate, byteRate}) // Sample and byte rate
+	binary.Write(&b, binary.LittleEndian, []uint16{1, 8})               // Block align, bits per sample
+	for _, chunk := range chunks {
+		b.Write(chunk)
+	}
+	return b.Bytes()
+}
+
+func riffChunk(id string, size uint32, data []byte) []byte {
+	b := append([]byte(id), binary.LittleEndian.AppendUint32(nil, size)...)
+	return append(b, data...)
+}
+
+// mp3Frame is the header of an MPEG-1 Layer III frame at 128 kbit/s and
+// 44.1 kHz
+var mp3Frame = []byte{0xFF, 0xFB, 0x90, 0x00}
+
+func id3Tag(size int) []byte {
+	tag := []byte{'I', 'D', '3', 4, 0, 0, byte(size >> 21 & 0x7F), byte(size >> 14 & 0x7F), byte(size >> 7 & 0x7F), byte(size & 0x7F)}
+	return append(tag, make([]byte, size)...)
+}
+
+func xingFrame(frames uint32) []byte {
+	frame := append(bytes.Clone(mp3Frame), make([]byte, 32)...)
+	frame = append(frame, "Xing"...)
+	frame = binary.BigEndian.AppendUint32(frame, 1) // Frame count present
+	return binary.BigEndian.AppendUint32(frame, frames)
+}
+
+func flacHeader(blockType byte, sampleRate int, samples int64) []byte {
+	info := make([]byte, 34)
+	info[10] = byte(sampleRate >> 12)
+	info[11] = byte(sampleRate >> 4)
+	info[12] = byte(sampleRate<<4) | 0x02 // Stereo
+	info[13] = 0xF0 | byte(samples>>32&0x0F)
+	binary.BigEndian.PutUint32(info[14:18], uint32(samples))
+	return append([]byte{'f', 'L', 'a', 'C', 0x80 | blockType, 0, 0, 34}, info...)
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestProbe(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		mimeType string
+		duration time.Duration
+	}{
+		{"empty", nil, "", 0},
+		{"too short", []byte("RI"), "", 0},
+
+		{"wav", wavHeader(8000, riffChunk("data", 8000, make([]byte, 8000))), "audio/wav", time.Second},
+		{"wav odd chunk", wavHeader(8000, riffChunk("LIST", 3, []byte("abc\x00")), riffChunk("data", 4000, make([]byte, 4000))), "audio/wav", time.Second / 2},
+		{"wav data past end", wavHeader(8000, riffChunk("data", 80000, make([]byte, 800))), "audio/wav", time.Second / 10},
+		{"wav truncated fmt", wavHeader(8000)[:30], "audio/wav", 0},
+		{"wav truncated fmt header", wavHeader(8000)[:18], "audio/wav", 0},
+		{"wav no fmt", join([]byte("RIFF\x00\x00\x00\x00WAVE"), riffChunk("data", 100, make([]byte, 100))), "audio/wav", 0},
+		{"wav no data", wavHeader(8000), "audio/wav", 0},
+		{"wav huge chunk", wavHeader(8000, riffChunk("junk", 0xFFFFFFFF, nil), riffChunk("data", 10, nil)), "audio/wav", 0},
+		{"wav zero byte rate", wavHeader(0, riffChunk("data", 100, make([]byte, 100))), "audio/wav", 0},
+
+		{"mp3", join(mp3Frame, make([]byte, 16000-4)), "audio/mpeg", time.Second},
+		{"mp3 after id3", join(id3Tag(100), mp3Frame, make([]byte, 16000-4)), "audio/mpeg", time.Second},
+		{"mp3 garbage before frame", join([]byte{0, 1, 2}, mp3Frame, make([]byte, 16000-7)), "", 0},
+		{"mp3 xing", join(xingFrame(441), make([]byte, 1000)), "audio/mpeg", 441 * 1152 * time.Second / 44100},
+		{"mp3 xing truncated", join(mp3Frame, make([]byte, 32), []byte("Xing\x00\x00")), "audio/mpeg", 42 * 8 * time.Second / 128000},
+		{"mp3 truncated header", []byte{0xFF, 0xFB}, "", 0},
+		{"mp3 reserved version", join([]byte{0xFF, 0xEB, 0x90, 0x00}, make([]byte, 100)), "audio/mpeg", 0},
+		{"mp3 free bitrate", join([]byte{0xFF, 0xFB, 0x00, 0x00}, make([]byte, 100)), "audio/mpeg", 0},
+		{"mp3 bad bitrate", join([]byte{0xFF, 0xFB, 0xF0, 0x00}, make([]byte, 100)), "audio/mpeg", 0},
+		{"id3 without audio", id3Tag(20), "audio/mpeg", 0},
+		{"id3 past end", id3Tag(200)[:50], "audio/mpeg", 0},
+
+		{"flac", flacHeader(0, 44100, 441000), "audio/flac", 10 * time.Second},
+		{"flac long", flacHeader(0, 48000, 1<<33), "audio/flac", (1 << 33) * time.Second / 48000},
+		{"flac truncated", flacHeader(0, 44100, 441000)[:30], "audio/flac", 0},
+		{"flac marker only", []byte("fLaC"), "audio/flac", 0},
+		{"flac other block first", flacHeader(4, 44100, 441000), "audio/flac", 0},
+		{"flac zero sample rate", flacHeader(0, 0, 441000), "audio/flac", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Whole and byte by byte, as a reader may hand over any amount
+			for _, chunk := range []int{len(tt.data) + 1, 1} {
+				probe := NewProbe()
+				for data := tt.data; len(data) > 0; data = data[min(chunk, len(data)):] {
+					probe.Write(data[:min(chunk, len(data))])
+				}
+
+				res := probe.Result()
+				if res.MimeType != tt.mimeType || res.Duration != tt.duration || res.Size != int64(len(tt.data)) {
+					t.Errorf("writes of %d: got %s, %s, %d bytes, want %s, %s, %d bytes", chunk,
+						res.MimeType, res.Duration, res.Size, tt.mimeType, tt.duration, len(tt.data))
+				}
+			}
+		})
+	}
+}
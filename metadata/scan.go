@@ -0,0 +1,113 @@
+package metadata
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"time"
+)
+
+// Scan reads an entire audio stream, parsing its tags and measuring its
+// duration more precisely than Probe can. For MP3 every frame is walked, so
+// VBR files without a Xing header still get an accurate duration. progress
+// is called with the number of bytes consumed so far.
+func Scan(r io.Reader, progress func(read int64)) (Result, Tags, error) {
+	probe := NewProbe()
+	counted := &progressReader{r: r, progress: progress}
+	br := bufio.NewReaderSize(io.TeeReader(counted, probe), 64<<10)
+
+	var tags Tags
+	var duration time.Duration
+
+	id3, _, err := readID3v2(br)
+	if err != nil {
+		return Result{}, tags, err
+	}
+	tags.merge(id3)
+
+	flac, _, err := readFLACComments(br)
+	if err != nil {
+		return Result{}, tags, err
+	}
+	tags.merge(flac)
+
+	head, _ := br.Peek(4)
+	if _, ok := parseMP3Header(head); ok {
+		var tail []byte
+		duration, tail, err = countMP3Frames(br)
+		if err != nil {
+			return Result{}, tags, err
+		}
+		tags.merge(readID3v1(tail))
+	}
+
+	if _, err := io.Copy(io.Discard, br); err != nil {
+		return Result{}, tags, err
+	}
+
+	res := probe.Result()
+	if duration > 0 {
+		res.Duration = duration
+	}
+
+	return res, tags, nil
+}
+
+// countMP3Frames walks MPEG frames until the audio ends. It returns the total
+// duration and the last 128 bytes after the audio, which may hold an ID3v1 tag.
+func countMP3Frames(r *bufio.Reader) (time.Duration, []byte, error) {
+	var samples, sampleRate int64
+
+	for {
+		h, err := r.Peek(4)
+		if err != nil {
+			break
+		}
+
+		hdr, ok := parseMP3Header(h)
+		if !ok || hdr.length < 4 {
+			// Lost sync: either trailing tags or garbage. Stop at known
+			// trailers, otherwise skip a byte and try again.
+			if bytes.HasPrefix(h, []byte("TAG")) || bytes.HasPrefix(h, []byte("APET")) || bytes.HasPrefix(h, []byte("LYRI")) {
+				break
+			}
+			r.Discard(1)
+			continue
+		}
+
+		if _, err := r.Discard(hdr.length); err != nil {
+			break
+		}
+		samples += int64(hdr.samplesPerFrame)
+		sampleRate = int64(hdr.sampleRate)
+	}
+
+	tail, err := io.ReadAll(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(tail) > 128 {
+		tail = tail[len(tail)-128:]
+	}
+
+	if sampleRate == 0 {
+		return 0, tail, nil
+	}
+
+	return time.Duration(samples) * time.Second / time.Duration(sampleRate), tail, nil
+}
+
+type progressReader struct {
+	r        io.Reader
+	read     int64
+	progress func(int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	if p.progress != nil && n > 0 {
+		p.progress(p.read)
+	}
+	return n, err
+}
@@ -0,0 +1,279 @@
+package metadata
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// Tags holds the descriptive fields read from ID3 or Vorbis comment tags.
+type Tags struct {
+	Title  string
+	Artist string
+	Album  string
+	Year   int
+	Track  int
+}
+
+// merge fills the empty fields of t from other.
+func (t *Tags) merge(other Tags) {
+	if t.Title == "" {
+		t.Title = other.Title
+	}
+	if t.Artist == "" {
+		t.Artist = other.Artist
+	}
+	if t.Album == "" {
+		t.Album = other.Album
+	}
+	if t.Year == 0 {
+		t.Year = other.Year
+	}
+	if t.Track == 0 {
+		t.Track = other.Track
+	}
+}
+
+// readID3v2 parses an ID3v2.2-2.4 tag from the start of r. It consumes
+// exactly the tag and returns the number of bytes read.
+func readID3v2(r *bufio.Reader) (Tags, int64, error) {
+	var tags Tags
+
+	header, err := r.Peek(10)
+	if err != nil || !bytes.HasPrefix(header, []byte("ID3")) {
+		return tags, 0, nil
+	}
+
+	size := id3v2Size(header)
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return tags, 0, err
+	}
+
+	major := body[3]
+	flags := body[5]
+	frames := body[10:]
+
+	if flags&0x40 != 0 && len(frames) >= 4 {
+		// Skip the extended header
+		ext := int(binary.BigEndian.Uint32(frames))
+		if major == 4 {
+			ext = int(syncsafe(frames))
+		} else {
+			ext += 4
+		}
+		frames = frames[min(ext, len(frames)):]
+	}
+
+	idLen, hdrLen := 4, 10
+	if major == 2 {
+		idLen, hdrLen = 3, 6
+	}
+
+	for len(frames) >= hdrLen && frames[0] != 0 {
+		id := string(frames[:idLen])
+
+		var n int
+		switch major {
+		case 2:
+			n = int(frames[3])<<16 | int(frames[4])<<8 | int(frames[5])
+		case 4:
+			n = int(syncsafe(frames[4:]))
+		default:
+			n = int(binary.BigEndian.Uint32(frames[4:]))
+		}
+		if n < 0 || hdrLen+n > len(frames) {
+			break
+		}
+
+		value := decodeID3Text(frames[hdrLen : hdrLen+n])
+		switch id {
+		case "TIT2", "TT2":
+			tags.Title = value
+		case "TPE1", "TP1":
+			tags.Artist = value
+		case "TALB", "TAL":
+			tags.Album = value
+		case "TRCK", "TRK":
+			tags.Track = leadingInt(value)
+		case "TYER", "TDRC", "TYE":
+			tags.Year = leadingInt(value)
+		}
+
+		frames = frames[hdrLen+n:]
+	}
+
+	return tags, size, nil
+}
+
+func syncsafe(b []byte) uint32 {
+	return uint32(b[0]&0x7F)<<21 | uint32(b[1]&0x7F)<<14 | uint32(b[2]&0x7F)<<7 | uint32(b[3]&0x7F)
+}
+
+// decodeID3Text decodes a text information frame body.
+func decodeID3Text(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+
+	var s string
+	switch enc, data := b[0], b[1:]; enc {
+	case 0: // ISO-8859-1
+		runes := make([]rune, len(data))
+		for i, c := range data {
+			runes[i] = rune(c)
+		}
+		s = string(runes)
+	case 1, 2: // UTF-16 with BOM, UTF-16BE
+		order := binary.ByteOrder(binary.BigEndian)
+		if enc == 1 && len(data) >= 2 {
+			if data[0] == 0xFF && data[1] == 0xFE {
+				order = binary.LittleEndian
+			}
+			data = data[2:]
+		}
+		units := make([]uint16, len(data)/2)
+		for i := range units {
+			units[i] = order.Uint16(data[i*2:])
+		}
+		s = string(utf16.Decode(units))
+	default: // UTF-8
+		s = string(data)
+	}
+
+	// v2.4 allows several NUL separated values, keep the first one
+	if i := strings.IndexRune(s, 0); i >= 0 {
+		s = s[:i]
+	}
+
+	return strings.TrimSpace(s)
+}
+
+// readID3v1 parses the fixed 128 byte tag found at the end of some MP3s.
+func readID3v1(b []byte) Tags {
+	var tags Tags
+	if len(b) != 128 || !bytes.HasPrefix(b, []byte("TAG")) {
+		return tags
+	}
+
+	field := func(f []byte) string {
+		if i := bytes.IndexByte(f, 0); i >= 0 {
+			f = f[:i]
+		}
+		return strings.TrimSpace(string(f))
+	}
+
+	tags.Title = field(b[3:33])
+	tags.Artist = field(b[33:63])
+	tags.Album = field(b[63:93])
+	tags.Year = leadingInt(field(b[93:97]))
+	if b[125] == 0 {
+		tags.Track = int(b[126])
+	}
+
+	return tags
+}
+
+// readFLACComments walks the FLAC metadata blocks and parses the Vorbis
+// comment block, if any. It consumes all metadata blocks.
+func readFLACComments(r *bufio.Reader) (Tags, int64, error) {
+	var tags Tags
+
+	marker, err := r.Peek(4)
+	if err != nil || !bytes.Equal(marker, []byte("fLaC")) {
+		return tags, 0, nil
+	}
+	r.Discard(4)
+	read := int64(4)
+
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return tags, read, err
+		}
+		n := int(hdr[1])<<16 | int(hdr[2])<<8 | int(hdr[3])
+		read += 4 + int64(n)
+
+		if hdr[0]&0x7F == 4 {
+			block := make([]byte, n)
+			if _, err := io.ReadFull(r, block); err != nil {
+				return tags, read, err
+			}
+			tags = parseVorbisComments(block)
+		} else if _, err := r.Discard(n); err != nil {
+			return tags, read, err
+		}
+
+		if hdr[0]&0x80 != 0 {
+			return tags, read, nil
+		}
+	}
+}
+
+func parseVorbisComments(b []byte) Tags {
+	var tags Tags
+
+	next := func() (string, bool) {
+		if len(b) < 4 {
+			return "", false
+		}
+		n := int(binary.LittleEndian.Uint32(b))
+		if n < 0 || 4+n > len(b) {
+			return "", false
+		}
+		s := string(b[4 : 4+n])
+		b = b[4+n:]
+		return s, true
+	}
+
+	if _, ok := next(); !ok { // vendor string
+		return tags
+	}
+	if len(b) < 4 {
+		return tags
+	}
+	count := int(binary.LittleEndian.Uint32(b))
+	b = b[4:]
+
+	for range count {
+		comment, ok := next()
+		if !ok {
+			break
+		}
+		key, value, found := strings.Cut(comment, "=")
+		if !found {
+			continue
+		}
+
+		value = strings.TrimSpace(value)
+		switch strings.ToUpper(key) {
+		case "TITLE":
+			tags.Title = value
+		case "ARTIST":
+			tags.Artist = value
+		case "ALBUM":
+			tags.Album = value
+		case "TRACKNUMBER":
+			tags.Track = leadingInt(value)
+		case "DATE", "YEAR":
+			tags.Year = leadingInt(value)
+		}
+	}
+
+	return tags
+}
+
+// leadingInt parses the number at the start of values like "3/12" or "2004-05-01".
+func leadingInt(s string) int {
+	end := 0
+	for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+		end++
+	}
+
+	n, _ := strconv.Atoi(s[:end])
+	return n
+}
@@ -6,7 +6,9 @@ import (
 	"gorm.io/gorm"
 )
 
-const ImageFilepathKey = "%s:%d.png"
+// LegacyImageKeyString is the name based cover layout used before storage
+// keys: name:artistID.png
+const LegacyImageKeyString = "%s:%d.png"
 
 type Album struct {
 	gorm.Model
@@ -14,7 +16,7 @@ type Album struct {
 	Description string
 	ArtistID    uint
 	Year        int
-	ImagePath   string
+	Image              // The cover
 	Artist      Artist `gorm:"foreignKey:ArtistID"`
 	Songs       []Song `gorm:"foreignKey:AlbumID"`
 }
@@ -28,6 +30,22 @@ func NewAlbum(name string, desc string, year int, artistID uint) *Album {
 	}
 }
 
-func (a *Album) ImageFilepath() string {
-	return fmt.Sprintf(ImageFilepathKey, a.Name, a.ArtistID)
+// LegacyImageKey returns where the cover was stored before storage keys
+func (a *Album) LegacyImageKey() string {
+	return fmt.Sprintf(LegacyImageKeyString, a.Name, a.ArtistID)
+}
+
+// ImageURL returns the artwork URL of the cover for display at size pixels,
+// generated artwork if there is no cover
+func (a *Album) ImageURL(size int) string {
+	return imageURL(OwnerAlbum, a.ID, a.ArtworkVersion(), size)
+}
+
+// ArtworkVersion identifies the artwork of the album: its cover, or the
+// name its artwork is generated from
+func (a *Album) ArtworkVersion() string {
+	if a.ImagePath == "" {
+		return ArtworkVersion("initials:" + a.Name)
+	}
+	return ArtworkVersion(a.ImagePath)
 }
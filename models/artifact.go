@@ -0,0 +1,34 @@
+package models
+
+import "time"
+
+// Artifact owners
+const (
+	OwnerSong   = "song"
+	OwnerAlbum  = "album"
+	OwnerArtist = "artist"
+)
+
+// Artifact stores
+const (
+	StoreMedia  = "media"
+	StoreImages = "images"
+)
+
+// ArtifactTranscode is a song converted to another format or bitrate
+const ArtifactTranscode = "transcode"
+
+// Artifact is a blob derived from a song, album or artist, such as a
+// transcode, a waveform or a resized image. It is recorded so its bytes
+// count towards its owner and it is deleted with it.
+type Artifact struct {
+	ID         uint `gorm:"primarykey"`
+	CreatedAt  time.Time
+	OwnerType  string `gorm:"index:idx_artifact_owner"`
+	OwnerID    uint   `gorm:"index:idx_artifact_owner"`
+	Kind       string // e.g. "transcode" or "waveform"
+	Store      string // StoreMedia or StoreImages
+	StorageKey string `gorm:"uniqueIndex"`
+	Size       int64
+	UsedAt     time.Time // Last served, for artifacts evicted when unused such as transcodes
+}
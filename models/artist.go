@@ -2,19 +2,20 @@ package models
 
 import (
 	"fmt"
-	"path/filepath"
 
 	"gorm.io/gorm"
 )
 
-const ArtistImageTemplate = "%s.png"
+// LegacyImageKeyTemplate is the name based image layout used before
+// storage keys: name.png
+const LegacyImageKeyTemplate = "%s.png"
 
 type Artist struct {
 	gorm.Model
-	Name      string
-	ImagePath string
-	Desc      string
-	Albums    []Album `gorm:"foreignKey:ArtistID"`
+	Name string
+	Image
+	Desc   string
+	Albums []Album `gorm:"foreignKey:ArtistID"`
 }
 
 func NewArtist(name string, desc string) *Artist {
@@ -24,6 +25,22 @@ func NewArtist(name string, desc string) *Artist {
 	}
 }
 
-func (a *Artist) GetImageFilepath(imageDir string) string {
-	return filepath.Join(imageDir, fmt.Sprintf(ArtistImageTemplate, a.Name))
+// LegacyImageKey returns where the image was stored before storage keys
+func (a *Artist) LegacyImageKey() string {
+	return fmt.Sprintf(LegacyImageKeyTemplate, a.Name)
+}
+
+// ImageURL returns the artwork URL of the image for display at size pixels,
+// generated artwork if there is no image
+func (a *Artist) ImageURL(size int) string {
+	return imageURL(OwnerArtist, a.ID, a.ArtworkVersion(), size)
+}
+
+// ArtworkVersion identifies the image of the artist. It is empty without
+// image: the generated artwork depends on the covers of its albums.
+func (a *Artist) ArtworkVersion() string {
+	if a.ImagePath == "" {
+		return ""
+	}
+	return ArtworkVersion(a.ImagePath)
 }
@@ -0,0 +1,120 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Image is what is stored about the image of an album or artist, embedded
+// in both so its fields are columns of their tables
+type Image struct {
+	ImagePath string // Key of the image in image storage
+	ImageSize int64  // Size of the image in bytes, 0 if not known yet
+	ThumbExt  string // Extension of the image's thumbnails, empty if there are none
+	Palette   string // Dominant colors of the image as "#rrggbb,…", most common first
+	BlurHash  string // BlurHash of the image, shown while it loads
+}
+
+// Colors returns the dominant colors of the image, most common first
+func (i *Image) Colors() []string {
+	return paletteColors(i.Palette)
+}
+
+// Tint returns the color pages and the player are tinted with, empty
+// without palette
+func (i *Image) Tint() string {
+	return paletteTint(i.Palette)
+}
+
+// ThumbnailSizes are the bounding squares, in pixels, thumbnails of album
+// and artist images are generated for
+var ThumbnailSizes = []int{64, 256, 1024}
+
+// ArtworkSizes are the sizes the artwork endpoint renders, requests for
+// other sizes get the next larger one so the cache stays bounded
+var ArtworkSizes = []int{32, 64, 128, 256, 512, 1024, 2048}
+
+// Artifact kinds of images derived from album and artist images
+const (
+	ArtifactThumbnail = "thumbnail"
+	ArtifactArtwork   = "artwork"
+)
+
+// ThumbnailKey returns the key of the thumbnail of an image for one of
+// ThumbnailSizes, next to the image: "covers/3f/3f9c….jpg" has
+// "covers/3f/3f9c…_256.jpg"
+func ThumbnailKey(key string, size int, ext string) string {
+	return fmt.Sprintf("%s_%d%s", strings.TrimSuffix(key, path.Ext(key)), size, ext)
+}
+
+// ArtworkKey returns the key artwork rendered from an image is cached
+// under, size 0 meaning full size. Thumbnails are reused: they have the
+// same key as artwork of their size and format.
+func ArtworkKey(key string, size int, ext string) string {
+	if size == 0 {
+		return strings.TrimSuffix(key, path.Ext(key)) + "_full" + ext
+	}
+	return ThumbnailKey(key, size, ext)
+}
+
+// ArtworkSize returns the size of ArtworkSizes requests for size pixels
+// are served at, 0 stays full size
+func ArtworkSize(size int) int {
+	if size <= 0 {
+		return 0
+	}
+	for _, s := range ArtworkSizes {
+		if s >= size {
+			return s
+		}
+	}
+	return ArtworkSizes[len(ArtworkSizes)-1]
+}
+
+// ArtworkVersion identifies an image. Image keys never change their
+// content, so URLs carrying the version can be cached for good.
+func ArtworkVersion(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:4])
+}
+
+// imageURL returns the URL of the artwork of an album or artist at size
+// pixels, with its version if it has one
+func imageURL(kind string, id uint, version string, size int) string {
+	url := fmt.Sprintf("/api/artwork/%s/%d?size=%d", kind, id, ArtworkSize(size))
+	if version != "" {
+		url += "&v=" + version
+	}
+	return url
+}
+
+// paletteColors splits a palette as stored
+func paletteColors(palette string) []string {
+	if palette == "" {
+		return []string{}
+	}
+	return strings.Split(palette, ",")
+}
+
+// paletteTint picks the most colorful color of a palette, so a cover that
+// is mostly black or white still tints with its accent. Palettes of greys
+// tint with their most common color.
+func paletteTint(palette string) string {
+	tint, best := "", -1
+	for _, color := range paletteColors(palette) {
+		hex := strings.TrimPrefix(color, "#")
+		value, err := strconv.ParseUint(hex, 16, 32)
+		if err != nil || len(hex) != 6 {
+			continue
+		}
+		r, g, b := int(value>>16&0xff), int(value>>8&0xff), int(value&0xff)
+		if chroma := max(r, g, b) - min(r, g, b); chroma > best {
+			tint, best = color, chroma
+		}
+	}
+	return tint
+}
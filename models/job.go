@@ -0,0 +1,47 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type JobStatus string
+
+const (
+	JobQueued  JobStatus = "queued"
+	JobRunning JobStatus = "running"
+	JobDone    JobStatus = "done"
+	JobFailed  JobStatus = "failed"
+)
+
+// Job is a unit of background work persisted in the jobs table so it
+// survives restarts.
+type Job struct {
+	gorm.Model
+	Kind        string    `gorm:"index"`
+	Payload     string    // JSON encoded, interpreted by the handler for Kind
+	Status      JobStatus `gorm:"index"`
+	Progress    int       // 0-100
+	Message     string    // Human readable progress note
+	Error       string    // Last failure, kept across retries
+	Attempts    int
+	MaxAttempts int
+	RunAt       time.Time `gorm:"index"` // Not picked up before this time
+	FinishedAt  *time.Time
+}
+
+func NewJob(kind, payload string, maxAttempts int) *Job {
+	return &Job{
+		Kind:        kind,
+		Payload:     payload,
+		Status:      JobQueued,
+		MaxAttempts: maxAttempts,
+		RunAt:       time.Now(),
+	}
+}
+
+// IsFinished reports whether the job has reached a terminal status
+func (j *Job) IsFinished() bool {
+	return j.Status == JobDone || j.Status == JobFailed
+}
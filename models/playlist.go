@@ -0,0 +1,25 @@
+package models
+
+import "gorm.io/gorm"
+
+type Playlist struct {
+	gorm.Model
+	Name    string          `gorm:"index"`
+	Entries []PlaylistEntry `gorm:"foreignKey:PlaylistID"`
+}
+
+// PlaylistEntry places a song in a playlist. The same song may appear
+// several times at different positions.
+type PlaylistEntry struct {
+	ID         uint `gorm:"primarykey"`
+	PlaylistID uint `gorm:"index"`
+	SongID     uint
+	Position   int
+	Song       Song `gorm:"foreignKey:SongID"`
+}
+
+func NewPlaylist(name string) *Playlist {
+	return &Playlist{
+		Name: name,
+	}
+}
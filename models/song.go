@@ -3,36 +3,50 @@ package models
 import (
 	"fmt"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"gorm.io/gorm"
 )
 
-const PathKeyString = "%s-%s-%s%s" // filename format: song-album-artist.ext
+// LegacyKeyString is the name based layout used before storage keys:
+// song-album-artist.ext
+const LegacyKeyString = "%s-%s-%s%s"
 
 type Song struct {
 	gorm.Model
-	Name     string
-	Filename string // Original filename with extension
-	MimeType string // e.g., "audio/mpeg", "audio/wav"
-	FileSize int64  // Size in bytes
-	Duration int    // Duration in seconds
-	AlbumID  uint
-	Album    Album `gorm:"foreignKey:AlbumID"`
+	Name        string
+	Filename    string // Original filename with extension
+	MimeType    string // e.g., "audio/mpeg", "audio/wav"
+	FileSize    int64  // Size in bytes
+	Duration    int    // Duration in seconds
+	Hash        string // Hex-encoded SHA-256 of the file contents
+	StorageKey  string `gorm:"index"` // Key of the file in media storage
+	Unavailable bool   // Set by fsck when the file is missing
+	TrackNumber int
+	PlayCount   int
+	Rating      int // 0-5 stars, 0 means unrated
+	LastPlayed  *time.Time
+	AlbumID     uint
+	Album       Album `gorm:"foreignKey:AlbumID"`
 }
 
-func NewSong(name, filename, mimeType string, fileSize int64, albumID uint) *Song {
+func NewSong(name, filename, mimeType string, albumID uint) *Song {
 	return &Song{
 		Name:     name,
 		Filename: filename,
 		MimeType: mimeType,
-		FileSize: fileSize,
 		AlbumID:  albumID,
+		// The file keeps this key for life, whatever is renamed
+		StorageKey: NewStorageKey(SongsKeyDir, filepath.Ext(filename)),
 	}
 }
 
-func (s *Song) Filepath(uploadDir string) string {
+// LegacyKey returns where the file was stored before storage keys, it needs
+// album and artist preloaded
+func (s *Song) LegacyKey() string {
 	ext := filepath.Ext(s.Filename)
-	return filepath.Join(uploadDir, fmt.Sprintf(PathKeyString, s.Name, s.Album.Name, s.Album.Artist.Name, ext))
+	return fmt.Sprintf(LegacyKeyString, s.Name, s.Album.Name, s.Album.Artist.Name, ext)
 }
 
 // GetFileExtension returns the file extension from filename
@@ -52,3 +66,18 @@ func (s *Song) IsAudioFile() bool {
 	}
 	return validMimeTypes[s.MimeType]
 }
+
+// MimeTypeFromExtension returns the MIME type for a supported audio file
+// extension, or "" if the extension is not supported.
+func MimeTypeFromExtension(ext string) string {
+	mimeTypes := map[string]string{
+		".mp3":  "audio/mpeg",
+		".wav":  "audio/wav",
+		".flac": "audio/flac",
+		".ogg":  "audio/ogg",
+		".m4a":  "audio/m4a",
+		".aac":  "audio/aac",
+	}
+
+	return mimeTypes[strings.ToLower(ext)]
+}
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Storage key directories
+const (
+	SongsKeyDir   = "songs"
+	CoversKeyDir  = "covers"
+	ArtistsKeyDir = "artists"
+
+	TranscodesKeyDir = "transcodes"
+)
+
+// NewStorageKey returns a new random key below dir, such as
+// "songs/3f/3f9c0a...e1.mp3". Keys are assigned once and never derived from
+// names, so renaming anything doesn't touch storage. The first byte of the
+// ID shards keys over subdirectories.
+func NewStorageKey(dir, ext string) string {
+	var b [16]byte
+	rand.Read(b[:])
+	id := hex.EncodeToString(b[:])
+
+	return path.Join(dir, id[:2], id+cleanExt(ext))
+}
+
+// TranscodeKey returns the key a song transcoded to bitrate kbit/s is
+// cached under: "songs/3f/3f9c….flac" has "transcodes/3f/3f9c…_128k.opus"
+func TranscodeKey(key string, bitrate int, ext string) string {
+	name := strings.TrimSuffix(strings.TrimPrefix(key, SongsKeyDir+"/"), path.Ext(key))
+	return fmt.Sprintf("%s/%s_%dk%s", TranscodesKeyDir, name, bitrate, ext)
+}
+
+// HLSSegmentKey returns the key HLS segment n of a song transcoded to
+// bitrate kbit/s is cached under: "songs/3f/3f9c….flac" has
+// "transcodes/3f/3f9c…_128k_hls/00012.ts"
+func HLSSegmentKey(key string, bitrate int, name string) string {
+	return TranscodeKey(key, bitrate, "_hls") + "/" + name
+}
+
+// cleanExt keeps short alphanumeric extensions and drops anything else
+func cleanExt(ext string) string {
+	ext = strings.ToLower(ext)
+	if len(ext) < 2 || len(ext) > 8 || ext[0] != '.' {
+		return ""
+	}
+	for _, r := range ext[1:] {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			return ""
+		}
+	}
+	return ext
+}
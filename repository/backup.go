@@ -0,0 +1,108 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"whalio/models"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	gormsqlite "gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// Open opens the SQLite database at path and migrates it to the current
+// schema. It is used for databases other than the live one, e.g. a
+// snapshot extracted from a backup archive.
+func Open(logger *zerolog.Logger, path string) (*Repository, error) {
+	db, err := gorm.Open(gormsqlite.Open(path))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open database")
+	}
+
+	r := NewRepository(logger, db)
+	if err := r.Migrate(); err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Migrate creates or updates the tables for all models
+func (r *Repository) Migrate() error {
+	err := r.db.AutoMigrate(
+		&models.Song{},
+		&models.Artist{},
+		&models.Album{},
+		&models.Job{},
+		&models.Playlist{},
+		&models.PlaylistEntry{},
+		&models.Artifact{},
+	)
+	return errors.Wrap(err, "failed to migrate database")
+}
+
+func (r *Repository) Close() error {
+	sqlDB, err := r.db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
+
+// Snapshot writes a consistent copy of the database to path using the
+// SQLite online backup API. Writers are blocked only while pages are copied,
+// so it is safe to call while the server is running.
+func (r *Repository) Snapshot(ctx context.Context, path string) error {
+	log := r.logger.With().Str("method", "Snapshot").Str("path", path).Logger()
+	log.Info().Msg("Snapshotting database")
+
+	src, err := r.db.DB()
+	if err != nil {
+		return errors.Wrap(err, "failed to get database handle")
+	}
+
+	dest, err := sql.Open(gormsqlite.DriverName, path)
+	if err != nil {
+		return errors.Wrap(err, "failed to open snapshot")
+	}
+	defer dest.Close()
+
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to get database connection")
+	}
+	defer srcConn.Close()
+
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to get snapshot connection")
+	}
+	defer destConn.Close()
+
+	err = destConn.Raw(func(destDriver any) error {
+		return srcConn.Raw(func(srcDriver any) error {
+			backup, err := destDriver.(*sqlite3.SQLiteConn).Backup("main", srcDriver.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+
+			// Copy all pages in one step so the snapshot is a single
+			// point in time
+			if _, err := backup.Step(-1); err != nil {
+				backup.Finish()
+				return err
+			}
+			return backup.Finish()
+		})
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to snapshot database")
+		return errors.Wrap(err, "failed to snapshot database")
+	}
+
+	log.Debug().Msg("Database snapshot written")
+	return nil
+}
@@ -0,0 +1,141 @@
+package repository
+
+import (
+	"context"
+	"time"
+	"whalio/models"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrJobNotFound = errors.New("job not found")
+	ErrNoJobsReady = errors.New("no jobs ready")
+)
+
+func (r *Repository) CreateJob(ctx context.Context, job *models.Job) error {
+	log := r.logger.With().Str("method", "CreateJob").Str("kind", job.Kind).Logger()
+	log.Info().Msg("Creating new job")
+
+	if err := r.db.WithContext(ctx).Create(job).Error; err != nil {
+		log.Error().Err(err).Msg("Failed to create job")
+		return errors.Wrap(err, "failed to create job")
+	}
+	log.Debug().Uint("id", job.ID).Msg("Job created successfully")
+	return nil
+}
+
+func (r *Repository) GetJobByID(ctx context.Context, id uint) (*models.Job, error) {
+	log := r.logger.With().Str("method", "GetJobByID").Uint("id", id).Logger()
+	log.Debug().Msg("Fetching job")
+
+	var job models.Job
+	if err := r.db.WithContext(ctx).First(&job, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Warn().Msg("Job not found")
+			return nil, ErrJobNotFound
+		}
+		log.Error().Stack().Err(err).Msg("Failed to get job")
+		return nil, errors.Wrap(err, "failed to get job")
+	}
+	return &job, nil
+}
+
+// ListJobs returns jobs in any of the given statuses, newest first. No
+// statuses means all jobs.
+func (r *Repository) ListJobs(ctx context.Context, limit int, statuses ...models.JobStatus) ([]models.Job, error) {
+	log := r.logger.With().Str("method", "ListJobs").Logger()
+	log.Debug().Msg("Fetching jobs")
+
+	query := r.db.WithContext(ctx).Order("id desc").Limit(limit)
+	if len(statuses) > 0 {
+		query = query.Where("status IN ?", statuses)
+	}
+
+	var jobs []models.Job
+	if err := query.Find(&jobs).Error; err != nil {
+		log.Error().Stack().Err(err).Msg("Failed to fetch jobs")
+		return nil, errors.Wrap(err, "failed to fetch jobs")
+	}
+	return jobs, nil
+}
+
+// ClaimJob atomically moves the oldest runnable queued job to running and
+// returns it. ErrNoJobsReady is returned when there is nothing to do.
+func (r *Repository) ClaimJob(ctx context.Context) (*models.Job, error) {
+	log := r.logger.With().Str("method", "ClaimJob").Logger()
+
+	next := r.db.Model(&models.Job{}).
+		Select("id").
+		Where("status = ? AND run_at <= ?", models.JobQueued, time.Now()).
+		Order("run_at, id").
+		Limit(1)
+
+	var jobs []models.Job
+	err := r.db.WithContext(ctx).
+		Model(&jobs).
+		Clauses(clause.Returning{}).
+		Where("id = (?)", next).
+		Updates(map[string]any{
+			"status":   models.JobRunning,
+			"attempts": gorm.Expr("attempts + 1"),
+		}).Error
+	if err != nil {
+		log.Error().Stack().Err(err).Msg("Failed to claim job")
+		return nil, errors.Wrap(err, "failed to claim job")
+	}
+	if len(jobs) == 0 {
+		return nil, ErrNoJobsReady
+	}
+
+	log.Debug().Uint("id", jobs[0].ID).Str("kind", jobs[0].Kind).Msg("Job claimed")
+	return &jobs[0], nil
+}
+
+// NextJobRunAt returns when the earliest queued job becomes runnable.
+func (r *Repository) NextJobRunAt(ctx context.Context) (time.Time, error) {
+	var jobs []models.Job
+	err := r.db.WithContext(ctx).
+		Where("status = ?", models.JobQueued).
+		Order("run_at").
+		Limit(1).
+		Find(&jobs).Error
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "failed to get next job")
+	}
+	if len(jobs) == 0 {
+		return time.Time{}, ErrNoJobsReady
+	}
+	return jobs[0].RunAt, nil
+}
+
+func (r *Repository) UpdateJob(ctx context.Context, job *models.Job) error {
+	log := r.logger.With().Str("method", "UpdateJob").Uint("id", job.ID).Logger()
+
+	if err := r.db.WithContext(ctx).Save(job).Error; err != nil {
+		log.Error().Stack().Err(err).Msg("Failed to update job")
+		return errors.Wrap(err, "failed to update job")
+	}
+	return nil
+}
+
+// RequeueRunningJobs puts jobs left running by a previous process back in
+// the queue. It must only be called before any worker starts.
+func (r *Repository) RequeueRunningJobs(ctx context.Context) (int64, error) {
+	log := r.logger.With().Str("method", "RequeueRunningJobs").Logger()
+
+	res := r.db.WithContext(ctx).
+		Model(&models.Job{}).
+		Where("status = ?", models.JobRunning).
+		Update("status", models.JobQueued)
+	if res.Error != nil {
+		log.Error().Stack().Err(res.Error).Msg("Failed to requeue jobs")
+		return 0, errors.Wrap(res.Error, "failed to requeue jobs")
+	}
+	if res.RowsAffected > 0 {
+		log.Info().Int64("count", res.RowsAffected).Msg("Requeued interrupted jobs")
+	}
+	return res.RowsAffected, nil
+}
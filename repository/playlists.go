@@ -0,0 +1,84 @@
+package repository
+
+import (
+	"context"
+	"whalio/models"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+var ErrPlaylistNotFound = errors.New("playlist not found")
+
+func (r *Repository) GetPlaylistByName(ctx context.Context, name string) (*models.Playlist, error) {
+	log := r.logger.With().Str("method", "GetPlaylistByName").Str("name", name).Logger()
+	log.Info().Msg("Fetching playlist")
+
+	var playlists []models.Playlist
+	err := r.db.WithContext(ctx).
+		Preload("Entries", func(db *gorm.DB) *gorm.DB { return db.Order("position") }).
+		Where("name = ?", name).
+		Limit(1).
+		Find(&playlists).Error
+	if err != nil {
+		log.Error().Stack().Err(err).Msg("Failed to get playlist")
+		return nil, errors.Wrap(err, "failed to get playlist")
+	}
+	if len(playlists) == 0 {
+		return nil, ErrPlaylistNotFound
+	}
+	return &playlists[0], nil
+}
+
+// SavePlaylist creates or updates the playlist and replaces its entries
+// with songIDs, in order.
+func (r *Repository) SavePlaylist(ctx context.Context, playlist *models.Playlist, songIDs []uint) error {
+	log := r.logger.With().Str("method", "SavePlaylist").Str("name", playlist.Name).Logger()
+	log.Info().Int("songs", len(songIDs)).Msg("Saving playlist")
+
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Entries").Save(playlist).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("playlist_id = ?", playlist.ID).Delete(&models.PlaylistEntry{}).Error; err != nil {
+			return err
+		}
+
+		entries := make([]models.PlaylistEntry, len(songIDs))
+		for i, id := range songIDs {
+			entries[i] = models.PlaylistEntry{PlaylistID: playlist.ID, SongID: id, Position: i}
+		}
+		if len(entries) > 0 {
+			if err := tx.CreateInBatches(entries, 500).Error; err != nil {
+				return err
+			}
+		}
+		playlist.Entries = entries
+		return nil
+	})
+	if err != nil {
+		log.Error().Stack().Err(err).Msg("Failed to save playlist")
+		return errors.Wrap(err, "failed to save playlist")
+	}
+	log.Debug().Uint("id", playlist.ID).Msg("Playlist saved successfully")
+	return nil
+}
+
+// ListPlaylists returns all playlists with their entries in order
+func (r *Repository) ListPlaylists(ctx context.Context) ([]models.Playlist, error) {
+	log := r.logger.With().Str("method", "ListPlaylists").Logger()
+	log.Info().Msg("Fetching playlists")
+
+	var playlists []models.Playlist
+	err := r.db.WithContext(ctx).
+		Preload("Entries", func(db *gorm.DB) *gorm.DB { return db.Order("position") }).
+		Order("id").
+		Find(&playlists).Error
+	if err != nil {
+		log.Error().Stack().Err(err).Msg("Failed to fetch playlists")
+		return nil, errors.Wrap(err, "failed to fetch playlists")
+	}
+
+	log.Debug().Int("count", len(playlists)).Msg("Playlists fetched successfully")
+	return playlists, nil
+}
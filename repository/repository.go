@@ -2,11 +2,13 @@ package repository
 
 import (
 	"context"
+	"time"
 	"whalio/models"
 
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 var (
@@ -27,7 +29,9 @@ func NewRepository(logger *zerolog.Logger, db *gorm.DB) *Repository {
 	}
 }
 
-func (r *Repository) CreateArtist(ctx context.Context, artist *models.Artist) error {
+// CreateArtist creates the artist and records the artifacts derived from
+// its image, in one transaction
+func (r *Repository) CreateArtist(ctx context.Context, artist *models.Artist, artifacts ...models.Artifact) error {
 	log := r.logger.With().Str("method", "CreateArtist").Logger()
 	log.Info().Str("name", artist.Name).Msg("Creating new artist")
 
@@ -37,6 +41,11 @@ func (r *Repository) CreateArtist(ctx context.Context, artist *models.Artist) er
 		log.Error().Err(err).Msg("Failed to create artist")
 		return errors.Wrap(err, "failed to create artist")
 	}
+	if err := saveArtifacts(tx, ownedBy(artifacts, models.OwnerArtist, artist.ID)); err != nil {
+		tx.Rollback()
+		log.Error().Err(err).Msg("Failed to save artist artifacts")
+		return err
+	}
 	if err := tx.Commit().Error; err != nil {
 		log.Error().Err(err).Msg("Failed to commit transaction")
 		return errors.Wrap(err, "failed to commit artist creation")
@@ -106,7 +115,9 @@ func (r *Repository) ListArtists(ctx context.Context) ([]models.Artist, error) {
 	return albums, nil
 }
 
-func (r *Repository) UpdateArtist(ctx context.Context, artist *models.Artist) error {
+// UpdateArtist saves the artist and records the artifacts derived from its
+// image, in one transaction
+func (r *Repository) UpdateArtist(ctx context.Context, artist *models.Artist, artifacts ...models.Artifact) error {
 	log := r.logger.With().Str("method", "UpdateArtist").Uint("id", artist.ID).Logger()
 	log.Info().Msg("Updating artist")
 
@@ -116,6 +127,11 @@ func (r *Repository) UpdateArtist(ctx context.Context, artist *models.Artist) er
 		log.Error().Stack().Err(err).Msg("Failed to update artist")
 		return errors.Wrap(err, "failed to update artist")
 	}
+	if err := saveArtifacts(tx, ownedBy(artifacts, models.OwnerArtist, artist.ID)); err != nil {
+		tx.Rollback()
+		log.Error().Err(err).Msg("Failed to save artist artifacts")
+		return err
+	}
 	if err := tx.Commit().Error; err != nil {
 		log.Error().Err(err).Msg("Failed to commit transaction")
 		return errors.Wrap(err, "failed to commit artist update")
@@ -124,12 +140,28 @@ func (r *Repository) UpdateArtist(ctx context.Context, artist *models.Artist) er
 	return nil
 }
 
+// DeleteArtist soft deletes the artist together with its albums and their
+// songs, in one transaction. They all get the same DeletedAt, which is how
+// RestoreArtist finds them again.
 func (r *Repository) DeleteArtist(ctx context.Context, id uint) error {
 	log := r.logger.With().Str("method", "DeleteArtist").Uint("id", id).Logger()
 	log.Info().Msg("Deleting artist")
 
+	now := time.Now()
 	tx := r.db.WithContext(ctx).Begin()
-	if err := tx.Delete(&models.Artist{}, id).Error; err != nil {
+
+	var albumIDs []uint
+	if err := tx.Model(&models.Album{}).Where("artist_id = ?", id).Pluck("id", &albumIDs).Error; err != nil {
+		tx.Rollback()
+		log.Error().Stack().Err(err).Msg("Failed to find albums of artist")
+		return errors.Wrap(err, "failed to find albums of artist")
+	}
+	if err := deleteAlbums(tx, albumIDs, now); err != nil {
+		tx.Rollback()
+		log.Error().Stack().Err(err).Msg("Failed to delete albums of artist")
+		return err
+	}
+	if err := tx.Model(&models.Artist{}).Where("id = ?", id).Update("deleted_at", now).Error; err != nil {
 		tx.Rollback()
 		log.Error().Stack().Err(err).Msg("Failed to delete artist")
 		return errors.Wrap(err, "failed to delete artist")
@@ -138,11 +170,29 @@ func (r *Repository) DeleteArtist(ctx context.Context, id uint) error {
 		log.Error().Err(err).Msg("Failed to commit transaction")
 		return errors.Wrap(err, "failed to commit artist deletion")
 	}
-	log.Debug().Msg("Artist deleted successfully")
+	log.Debug().Int("albums", len(albumIDs)).Msg("Artist deleted successfully")
 	return nil
 }
 
-func (r *Repository) CreateAlbum(ctx context.Context, album *models.Album) error {
+// deleteAlbums soft deletes albums and their songs within tx, setting
+// DeletedAt to now. Songs already in the trash keep their own DeletedAt.
+func deleteAlbums(tx *gorm.DB, albumIDs []uint, now time.Time) error {
+	if len(albumIDs) == 0 {
+		return nil
+	}
+
+	if err := tx.Model(&models.Song{}).Where("album_id IN ?", albumIDs).Update("deleted_at", now).Error; err != nil {
+		return errors.Wrap(err, "failed to delete songs")
+	}
+	if err := tx.Model(&models.Album{}).Where("id IN ?", albumIDs).Update("deleted_at", now).Error; err != nil {
+		return errors.Wrap(err, "failed to delete albums")
+	}
+	return nil
+}
+
+// CreateAlbum creates the album and records the artifacts derived from its
+// cover, in one transaction
+func (r *Repository) CreateAlbum(ctx context.Context, album *models.Album, artifacts ...models.Artifact) error {
 	log := r.logger.With().Str("method", "CreateAlbum").Str("name", album.Name).
 		Uint("artist_id", album.ArtistID).
 		Str("image_path", album.ImagePath).
@@ -161,6 +211,11 @@ func (r *Repository) CreateAlbum(ctx context.Context, album *models.Album) error
 		log.Error().Stack().Err(err).Msg("Failed to create album")
 		return errors.Wrap(err, "failed to create album")
 	}
+	if err := saveArtifacts(tx, ownedBy(artifacts, models.OwnerAlbum, album.ID)); err != nil {
+		tx.Rollback()
+		log.Error().Err(err).Msg("Failed to save album artifacts")
+		return err
+	}
 	if err := tx.Commit().Error; err != nil {
 		log.Error().Err(err).Msg("Failed to commit transaction")
 		return errors.Wrap(err, "failed to commit album creation")
@@ -212,7 +267,10 @@ func (r *Repository) ListAlbums(ctx context.Context) ([]models.Album, error) {
 	log.Debug().Int("count", len(albums)).Msg("Albums fetched successfully")
 	return albums, nil
 }
-func (r *Repository) UpdateAlbum(ctx context.Context, album *models.Album) error {
+
+// UpdateAlbum saves the album and records the artifacts derived from its
+// cover, in one transaction
+func (r *Repository) UpdateAlbum(ctx context.Context, album *models.Album, artifacts ...models.Artifact) error {
 	log := r.logger.With().Str("method", "UpdateAlbum").Uint("id", album.ID).Logger()
 	log.Info().Msg("Updating album")
 
@@ -222,6 +280,11 @@ func (r *Repository) UpdateAlbum(ctx context.Context, album *models.Album) error
 		log.Error().Stack().Err(err).Msg("Failed to update album")
 		return errors.Wrap(err, "failed to update album")
 	}
+	if err := saveArtifacts(tx, ownedBy(artifacts, models.OwnerAlbum, album.ID)); err != nil {
+		tx.Rollback()
+		log.Error().Err(err).Msg("Failed to save album artifacts")
+		return err
+	}
 	if err := tx.Commit().Error; err != nil {
 		log.Error().Err(err).Msg("Failed to commit transaction")
 		return errors.Wrap(err, "failed to commit album update")
@@ -230,12 +293,14 @@ func (r *Repository) UpdateAlbum(ctx context.Context, album *models.Album) error
 	return nil
 }
 
+// DeleteAlbum soft deletes the album together with its songs, in one
+// transaction
 func (r *Repository) DeleteAlbum(ctx context.Context, id uint) error {
 	log := r.logger.With().Str("method", "DeleteAlbum").Uint("id", id).Logger()
 	log.Info().Msg("Deleting album")
 
 	tx := r.db.WithContext(ctx).Begin()
-	if err := tx.Delete(&models.Album{}, id).Error; err != nil {
+	if err := deleteAlbums(tx, []uint{id}, time.Now()); err != nil {
 		tx.Rollback()
 		log.Error().Stack().Err(err).Msg("Failed to delete album")
 		return errors.Wrap(err, "failed to delete album")
@@ -296,8 +361,10 @@ func (r *Repository) UpdateSong(ctx context.Context, song *models.Song) error {
 	log := r.logger.With().Str("method", "UpdateSong").Uint("id", song.ID).Logger()
 	log.Info().Msg("Updating song")
 
+	// Without Omit gorm saves the preloaded album too and takes AlbumID
+	// from it, undoing a move to another album
 	tx := r.db.WithContext(ctx).Begin()
-	if err := tx.Save(song).Error; err != nil {
+	if err := tx.Omit(clause.Associations).Save(song).Error; err != nil {
 		tx.Rollback()
 		log.Error().Stack().Err(err).Msg("Failed to update song")
 		return errors.Wrap(err, "failed to update song")
@@ -341,3 +408,191 @@ func (r *Repository) AddSongToAlbum(ctx context.Context, albumID uint, song *mod
 	song.AlbumID = albumID
 	return r.CreateSong(ctx, song)
 }
+
+func (r *Repository) GetAlbumByName(ctx context.Context, artistID uint, name string) (*models.Album, error) {
+	log := r.logger.With().Str("method", "GetAlbumByName").Uint("artist_id", artistID).Str("name", name).Logger()
+	log.Info().Msg("Fetching album")
+
+	var albums []models.Album
+	err := r.db.WithContext(ctx).
+		Preload("Artist").
+		Where("artist_id = ? AND LOWER(name) = LOWER(?)", artistID, name).
+		Limit(1).
+		Find(&albums).Error
+	if err != nil {
+		log.Error().Stack().Err(err).Msg("Failed to get album")
+		return nil, errors.Wrap(err, "failed to get album")
+	}
+	if len(albums) == 0 {
+		return nil, ErrAlbumNotFound
+	}
+	return &albums[0], nil
+}
+
+// FindSongByHash returns a song whose file has the given content hash
+func (r *Repository) FindSongByHash(ctx context.Context, hash string) (*models.Song, error) {
+	log := r.logger.With().Str("method", "FindSongByHash").Str("hash", hash).Logger()
+	log.Debug().Msg("Fetching song")
+
+	var songs []models.Song
+	err := r.db.WithContext(ctx).
+		Preload("Album.Artist").
+		Where("hash = ?", hash).
+		Limit(1).
+		Find(&songs).Error
+	if err != nil {
+		log.Error().Stack().Err(err).Msg("Failed to get song")
+		return nil, errors.Wrap(err, "failed to get song")
+	}
+	if len(songs) == 0 {
+		return nil, ErrSongNotFound
+	}
+	return &songs[0], nil
+}
+
+// FindSongInAlbum returns the song with the given name, ignoring case
+func (r *Repository) FindSongInAlbum(ctx context.Context, albumID uint, name string) (*models.Song, error) {
+	log := r.logger.With().Str("method", "FindSongInAlbum").Uint("album_id", albumID).Str("name", name).Logger()
+	log.Debug().Msg("Fetching song")
+
+	var songs []models.Song
+	err := r.db.WithContext(ctx).
+		Preload("Album.Artist").
+		Where("album_id = ? AND LOWER(name) = LOWER(?)", albumID, name).
+		Limit(1).
+		Find(&songs).Error
+	if err != nil {
+		log.Error().Stack().Err(err).Msg("Failed to get song")
+		return nil, errors.Wrap(err, "failed to get song")
+	}
+	if len(songs) == 0 {
+		return nil, ErrSongNotFound
+	}
+	return &songs[0], nil
+}
+
+// ListSongs returns all songs with album and artist preloaded
+func (r *Repository) ListSongs(ctx context.Context) ([]models.Song, error) {
+	log := r.logger.With().Str("method", "ListSongs").Logger()
+	log.Info().Msg("Fetching songs")
+
+	var songs []models.Song
+	err := r.db.WithContext(ctx).
+		Preload("Album.Artist").
+		Order("id").
+		Find(&songs).Error
+	if err != nil {
+		log.Error().Stack().Err(err).Msg("Failed to fetch songs")
+		return nil, errors.Wrap(err, "failed to fetch songs")
+	}
+
+	log.Debug().Int("count", len(songs)).Msg("Songs fetched successfully")
+	return songs, nil
+}
+
+func (r *Repository) CountSongs(ctx context.Context) (int64, error) {
+	var count int64
+	if err := r.db.WithContext(ctx).Model(&models.Song{}).Count(&count).Error; err != nil {
+		r.logger.Error().Str("method", "CountSongs").Err(err).Msg("Failed to count songs")
+		return 0, errors.Wrap(err, "failed to count songs")
+	}
+	return count, nil
+}
+
+// CountSongsWithoutStorageKey counts songs still stored under the name based
+// layout
+func (r *Repository) CountSongsWithoutStorageKey(ctx context.Context) (int64, error) {
+	var count int64
+	err := r.db.WithContext(ctx).Model(&models.Song{}).Where("storage_key = '' OR storage_key IS NULL").Count(&count).Error
+	if err != nil {
+		r.logger.Error().Str("method", "CountSongsWithoutStorageKey").Err(err).Msg("Failed to count songs")
+		return 0, errors.Wrap(err, "failed to count songs")
+	}
+	return count, nil
+}
+
+// ListStorageKeys returns the keys of all song files and of all images,
+// including those of soft deleted rows, plus the keys of artifacts in either
+// store. Empty keys are left out.
+func (r *Repository) ListStorageKeys(ctx context.Context) (media, images []string, err error) {
+	log := r.logger.With().Str("method", "ListStorageKeys").Logger()
+	log.Info().Msg("Fetching storage keys")
+
+	db := r.db.WithContext(ctx).Unscoped().Session(&gorm.Session{})
+	if err := db.Model(&models.Song{}).Where("storage_key <> ''").Pluck("storage_key", &media).Error; err != nil {
+		log.Error().Stack().Err(err).Msg("Failed to fetch song keys")
+		return nil, nil, errors.Wrap(err, "failed to fetch song keys")
+	}
+
+	var covers, artistImages []string
+	if err := db.Model(&models.Album{}).Where("image_path <> ''").Pluck("image_path", &covers).Error; err != nil {
+		log.Error().Stack().Err(err).Msg("Failed to fetch cover keys")
+		return nil, nil, errors.Wrap(err, "failed to fetch cover keys")
+	}
+	if err := db.Model(&models.Artist{}).Where("image_path <> ''").Pluck("image_path", &artistImages).Error; err != nil {
+		log.Error().Stack().Err(err).Msg("Failed to fetch artist image keys")
+		return nil, nil, errors.Wrap(err, "failed to fetch artist image keys")
+	}
+
+	var artifacts []models.Artifact
+	if err := db.Select("store", "storage_key").Find(&artifacts).Error; err != nil {
+		log.Error().Stack().Err(err).Msg("Failed to fetch artifact keys")
+		return nil, nil, errors.Wrap(err, "failed to fetch artifact keys")
+	}
+
+	images = append(covers, artistImages...)
+	for _, artifact := range artifacts {
+		if artifact.Store == models.StoreImages {
+			images = append(images, artifact.StorageKey)
+		} else {
+			media = append(media, artifact.StorageKey)
+		}
+	}
+
+	return media, images, nil
+}
+
+// SetSongUnavailable flags a song whose file is missing, or clears the flag
+func (r *Repository) SetSongUnavailable(ctx context.Context, id uint, unavailable bool) error {
+	log := r.logger.With().Str("method", "SetSongUnavailable").Uint("id", id).Logger()
+	log.Info().Bool("unavailable", unavailable).Msg("Updating song availability")
+
+	err := r.db.WithContext(ctx).
+		Model(&models.Song{}).
+		Where("id = ?", id).
+		Update("unavailable", unavailable).Error
+	if err != nil {
+		log.Error().Stack().Err(err).Msg("Failed to update song availability")
+		return errors.Wrap(err, "failed to update song availability")
+	}
+	return nil
+}
+
+// UpdateSongScan saves what a scan found out about a song's file. Only those
+// columns are written, so edits made while the scan ran are kept, and the
+// track number only if none is set yet.
+func (r *Repository) UpdateSongScan(ctx context.Context, id uint, duration, trackNumber int) error {
+	log := r.logger.With().Str("method", "UpdateSongScan").Uint("id", id).Logger()
+	log.Info().Int("duration", duration).Int("track_number", trackNumber).Msg("Updating scanned song")
+
+	updates := map[string]any{}
+	if duration > 0 {
+		updates["duration"] = duration
+	}
+	if trackNumber > 0 {
+		updates["track_number"] = gorm.Expr("CASE WHEN track_number = 0 THEN ? ELSE track_number END", trackNumber)
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+
+	err := r.db.WithContext(ctx).
+		Model(&models.Song{}).
+		Where("id = ?", id).
+		Updates(updates).Error
+	if err != nil {
+		log.Error().Stack().Err(err).Msg("Failed to update scanned song")
+		return errors.Wrap(err, "failed to update scanned song")
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+package repository
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+	"whalio/models"
+
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+)
+
+var errFault = errors.New("injected fault")
+
+func newTestRepository(t *testing.T) *Repository {
+	t.Helper()
+
+	logger := zerolog.Nop()
+	r, err := Open(&logger, filepath.Join(t.TempDir(), "database.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+// failArtifacts makes every following insert of artifacts fail
+func failArtifacts(t *testing.T, r *Repository) {
+	t.Helper()
+
+	err := r.db.Callback().Create().Before("gorm:create").Register("test:fail_artifacts", func(db *gorm.DB) {
+		if db.Statement.Table == "artifacts" {
+			db.AddError(errFault)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func thumbnails(keys ...string) []models.Artifact {
+	var artifacts []models.Artifact
+	for _, key := range keys {
+		artifacts = append(artifacts, models.Artifact{Kind: models.ArtifactThumbnail, Store: models.StoreImages, StorageKey: key, Size: 1})
+	}
+	return artifacts
+}
+
+func TestCreateWithArtifacts(t *testing.T) {
+	r := newTestRepository(t)
+	ctx := t.Context()
+
+	artist := models.NewArtist("Artist", "")
+	if err := r.CreateArtist(ctx, artist, thumbnails("artists/a_64.webp")...); err != nil {
+		t.Fatal(err)
+	}
+	album := models.NewAlbum("Album", "", 2020, artist.ID)
+	if err := r.CreateAlbum(ctx, album, thumbnails("covers/a_64.webp", "covers/a_256.webp")...); err != nil {
+		t.Fatal(err)
+	}
+
+	for ownerType, want := range map[string]struct {
+		id    uint
+		count int
+	}{
+		models.OwnerArtist: {artist.ID, 1},
+		models.OwnerAlbum:  {album.ID, 2},
+	} {
+		artifacts, err := r.ListArtifacts(ctx, ownerType, []uint{want.id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(artifacts) != want.count {
+			t.Errorf("%s has %d artifacts, want %d", ownerType, len(artifacts), want.count)
+		}
+	}
+}
+
+func TestCreateWithArtifactsIsAtomic(t *testing.T) {
+	r := newTestRepository(t)
+	ctx := t.Context()
+
+	artist := models.NewArtist("Artist", "")
+	if err := r.CreateArtist(ctx, artist); err != nil {
+		t.Fatal(err)
+	}
+	failArtifacts(t, r)
+
+	if err := r.CreateArtist(ctx, models.NewArtist("Other", ""), thumbnails("artists/b_64.webp")...); !errors.Is(err, errFault) {
+		t.Errorf("CreateArtist = %v, want %v", err, errFault)
+	}
+	if err := r.CreateAlbum(ctx, models.NewAlbum("Album", "", 2020, artist.ID), thumbnails("covers/a_64.webp")...); !errors.Is(err, errFault) {
+		t.Errorf("CreateAlbum = %v, want %v", err, errFault)
+	}
+	artist.Desc = "Changed"
+	if err := r.UpdateArtist(ctx, artist, thumbnails("artists/a_64.webp")...); !errors.Is(err, errFault) {
+		t.Errorf("UpdateArtist = %v, want %v", err, errFault)
+	}
+
+	artists, albums, _, artifacts, err := r.ListUsage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(artists) != 1 || len(albums) != 0 || len(artifacts) != 0 {
+		t.Errorf("got %d artists, %d albums and %d artifacts, want only the first artist", len(artists), len(albums), len(artifacts))
+	}
+	if got, err := r.GetArtistByID(ctx, artist.ID); err != nil || got.Desc != "" {
+		t.Errorf("artist update wasn't rolled back: %+v, %v", got, err)
+	}
+}
+
+func TestUpdateSongScan(t *testing.T) {
+	tests := []struct {
+		name                    string
+		track                   int // Before the scan
+		duration, tagTrack      int
+		wantDuration, wantTrack int
+	}{
+		{"fills both", 0, 180, 3, 180, 3},
+		{"keeps track set by hand", 7, 180, 3, 180, 7},
+		{"no tag", 0, 180, 0, 180, 0},
+		{"no duration", 7, 0, 0, 42, 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRepository(t)
+			ctx := t.Context()
+
+			artist := models.NewArtist("Artist", "")
+			if err := r.CreateArtist(ctx, artist); err != nil {
+				t.Fatal(err)
+			}
+			album := models.NewAlbum("Album", "", 2020, artist.ID)
+			other := models.NewAlbum("Other", "", 2020, artist.ID)
+			for _, a := range []*models.Album{album, other} {
+				if err := r.CreateAlbum(ctx, a); err != nil {
+					t.Fatal(err)
+				}
+			}
+			song := models.NewSong("Song", "song.mp3", "audio/mpeg", album.ID)
+			song.Duration = 42
+			song.TrackNumber = tt.track
+			if err := r.CreateSong(ctx, song); err != nil {
+				t.Fatal(err)
+			}
+
+			// Renamed and moved while the scan ran
+			edited := *song
+			edited.Name = "Renamed"
+			edited.AlbumID = other.ID
+			if err := r.UpdateSong(ctx, &edited); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := r.UpdateSongScan(ctx, song.ID, tt.duration, tt.tagTrack); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := r.GetSongByID(ctx, song.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Name != "Renamed" || got.AlbumID != other.ID {
+				t.Errorf("scan undid the edit: %q in album %d", got.Name, got.AlbumID)
+			}
+			if got.Duration != tt.wantDuration || got.TrackNumber != tt.wantTrack {
+				t.Errorf("duration %d, track %d, want %d and %d", got.Duration, got.TrackNumber, tt.wantDuration, tt.wantTrack)
+			}
+		})
+	}
+}
+
+func TestEvictArtifacts(t *testing.T) {
+	r := newTestRepository(t)
+	ctx := t.Context()
+	now := time.Now()
+
+	transcode := func(key string, size int64, age time.Duration) models.Artifact {
+		return models.Artifact{Kind: models.ArtifactTranscode, Store: models.StoreMedia, StorageKey: key, Size: size, UsedAt: now.Add(-age)}
+	}
+	thumbnail := thumbnails("thumbnail")[0]
+	thumbnail.Size = 1000
+	err := r.SaveArtifacts(ctx, []models.Artifact{
+		transcode("newest", 40, time.Minute),
+		transcode("older", 40, time.Hour),
+		transcode("oldest", 40, 24*time.Hour),
+		thumbnail,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	evictedKeys := func(maxBytes int64) []string {
+		t.Helper()
+		evicted, err := r.EvictArtifacts(ctx, models.ArtifactTranscode, maxBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for _, artifact := range evicted {
+			keys = append(keys, artifact.StorageKey)
+		}
+		return keys
+	}
+
+	if got := evictedKeys(120); len(got) != 0 {
+		t.Errorf("evicted %v with everything fitting", got)
+	}
+	if got := evictedKeys(100); !slices.Equal(got, []string{"oldest"}) {
+		t.Errorf("evicted %v, want the least recently used", got)
+	}
+
+	// Playing the older one again makes it the most recent, and the most
+	// recent is kept even when it alone is over the limit
+	if err := r.TouchArtifact(ctx, "older"); err != nil {
+		t.Fatal(err)
+	}
+	if got := evictedKeys(10); !slices.Equal(got, []string{"newest"}) {
+		t.Errorf("evicted %v, want all but the one just played", got)
+	}
+
+	// Other kinds are left alone, evicted ones are forgotten
+	_, _, _, artifacts, err := r.ListUsage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	for _, artifact := range artifacts {
+		left = append(left, artifact.StorageKey)
+	}
+	slices.Sort(left)
+	if want := []string{"older", "thumbnail"}; !slices.Equal(left, want) {
+		t.Errorf("artifacts left = %v, want %v", left, want)
+	}
+}
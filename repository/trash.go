@@ -0,0 +1,244 @@
+package repository
+
+import (
+	"context"
+	"whalio/models"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+)
+
+var ErrNotInTrash = errors.New("not in trash")
+
+func unscoped(db *gorm.DB) *gorm.DB {
+	return db.Unscoped()
+}
+
+// ListTrash returns soft deleted artists, albums and songs, oldest first.
+// Albums come with their artist and songs with album and artist, deleted or
+// not.
+func (r *Repository) ListTrash(ctx context.Context) ([]models.Artist, []models.Album, []models.Song, error) {
+	log := r.logger.With().Str("method", "ListTrash").Logger()
+	log.Info().Msg("Fetching trash")
+
+	db := r.db.WithContext(ctx).Unscoped().Session(&gorm.Session{})
+
+	var artists []models.Artist
+	if err := db.Where("deleted_at IS NOT NULL").Order("deleted_at").Find(&artists).Error; err != nil {
+		log.Error().Stack().Err(err).Msg("Failed to fetch deleted artists")
+		return nil, nil, nil, errors.Wrap(err, "failed to fetch deleted artists")
+	}
+
+	var albums []models.Album
+	err := db.Where("deleted_at IS NOT NULL").
+		Preload("Artist", unscoped).
+		Order("deleted_at").
+		Find(&albums).Error
+	if err != nil {
+		log.Error().Stack().Err(err).Msg("Failed to fetch deleted albums")
+		return nil, nil, nil, errors.Wrap(err, "failed to fetch deleted albums")
+	}
+
+	var songs []models.Song
+	err = db.Where("deleted_at IS NOT NULL").
+		Preload("Album", unscoped).
+		Preload("Album.Artist", unscoped).
+		Order("deleted_at").
+		Find(&songs).Error
+	if err != nil {
+		log.Error().Stack().Err(err).Msg("Failed to fetch deleted songs")
+		return nil, nil, nil, errors.Wrap(err, "failed to fetch deleted songs")
+	}
+
+	return artists, albums, songs, nil
+}
+
+// RestoreArtist takes an artist out of the trash together with the albums
+// and songs that were deleted with it
+func (r *Repository) RestoreArtist(ctx context.Context, id uint) error {
+	log := r.logger.With().Str("method", "RestoreArtist").Uint("id", id).Logger()
+	log.Info().Msg("Restoring artist")
+
+	return r.restore(ctx, log, func(tx *gorm.DB) error {
+		var artist models.Artist
+		if err := findDeleted(tx, &artist, id); err != nil {
+			return err
+		}
+
+		var albums []models.Album
+		if err := tx.Where("artist_id = ? AND deleted_at IS NOT NULL", id).Find(&albums).Error; err != nil {
+			return errors.Wrap(err, "failed to find albums of artist")
+		}
+
+		var albumIDs []uint
+		for _, album := range albums {
+			if album.DeletedAt.Time.Equal(artist.DeletedAt.Time) {
+				albumIDs = append(albumIDs, album.ID)
+			}
+		}
+		if err := restoreAlbumSongs(tx, albumIDs, artist.DeletedAt); err != nil {
+			return err
+		}
+		if err := undelete(tx, &models.Album{}, albumIDs); err != nil {
+			return err
+		}
+		return undelete(tx, &models.Artist{}, []uint{id})
+	})
+}
+
+// RestoreAlbum takes an album out of the trash together with the songs that
+// were deleted with it. A deleted artist is restored too, without its other
+// albums.
+func (r *Repository) RestoreAlbum(ctx context.Context, id uint) error {
+	log := r.logger.With().Str("method", "RestoreAlbum").Uint("id", id).Logger()
+	log.Info().Msg("Restoring album")
+
+	return r.restore(ctx, log, func(tx *gorm.DB) error {
+		var album models.Album
+		if err := findDeleted(tx, &album, id); err != nil {
+			return err
+		}
+
+		if err := restoreAlbumSongs(tx, []uint{id}, album.DeletedAt); err != nil {
+			return err
+		}
+		if err := undelete(tx, &models.Album{}, []uint{id}); err != nil {
+			return err
+		}
+		return undelete(tx, &models.Artist{}, []uint{album.ArtistID})
+	})
+}
+
+// RestoreSong takes a song out of the trash. A deleted album or artist is
+// restored too, without their other songs or albums.
+func (r *Repository) RestoreSong(ctx context.Context, id uint) error {
+	log := r.logger.With().Str("method", "RestoreSong").Uint("id", id).Logger()
+	log.Info().Msg("Restoring song")
+
+	return r.restore(ctx, log, func(tx *gorm.DB) error {
+		var song models.Song
+		if err := findDeleted(tx, &song, id); err != nil {
+			return err
+		}
+
+		var album models.Album
+		if err := tx.First(&album, song.AlbumID).Error; err != nil {
+			return errors.Wrap(err, "failed to find album of song")
+		}
+
+		if err := undelete(tx, &models.Song{}, []uint{id}); err != nil {
+			return err
+		}
+		if err := undelete(tx, &models.Album{}, []uint{album.ID}); err != nil {
+			return err
+		}
+		return undelete(tx, &models.Artist{}, []uint{album.ArtistID})
+	})
+}
+
+func (r *Repository) restore(ctx context.Context, log zerolog.Logger, fn func(tx *gorm.DB) error) error {
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return fn(tx.Unscoped().Session(&gorm.Session{}))
+	})
+	if errors.Is(err, ErrNotInTrash) {
+		log.Warn().Msg("Not in trash")
+		return err
+	}
+	if err != nil {
+		log.Error().Stack().Err(err).Msg("Failed to restore")
+		return errors.Wrap(err, "failed to restore")
+	}
+	log.Debug().Msg("Restored successfully")
+	return nil
+}
+
+// findDeleted loads a soft deleted row, ErrNotInTrash if there is none
+func findDeleted(tx *gorm.DB, dest any, id uint) error {
+	err := tx.Where("deleted_at IS NOT NULL").First(dest, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrNotInTrash
+	}
+	return err
+}
+
+// restoreAlbumSongs undeletes the songs of albums that were deleted at the
+// same time as deletedAt. Times are compared in Go, their text form in the
+// database depends on the time zone they were written in.
+func restoreAlbumSongs(tx *gorm.DB, albumIDs []uint, deletedAt gorm.DeletedAt) error {
+	if len(albumIDs) == 0 {
+		return nil
+	}
+
+	var songs []models.Song
+	if err := tx.Where("album_id IN ? AND deleted_at IS NOT NULL", albumIDs).Find(&songs).Error; err != nil {
+		return errors.Wrap(err, "failed to find songs of albums")
+	}
+
+	var ids []uint
+	for _, song := range songs {
+		if song.DeletedAt.Time.Equal(deletedAt.Time) {
+			ids = append(ids, song.ID)
+		}
+	}
+
+	return undelete(tx, &models.Song{}, ids)
+}
+
+func undelete(tx *gorm.DB, model any, ids []uint) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if err := tx.Model(model).Where("id IN ?", ids).Update("deleted_at", nil).Error; err != nil {
+		return errors.Wrap(err, "failed to restore rows")
+	}
+	return nil
+}
+
+// PurgeRows deletes rows for good, whether they are in the trash or not.
+// Playlist entries of the songs and the records of artifacts go with them.
+func (r *Repository) PurgeRows(ctx context.Context, songIDs, albumIDs, artistIDs []uint) error {
+	log := r.logger.With().Str("method", "PurgeRows").Logger()
+	log.Info().Int("songs", len(songIDs)).Int("albums", len(albumIDs)).Int("artists", len(artistIDs)).Msg("Purging rows")
+
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		tx = tx.Unscoped().Session(&gorm.Session{})
+		for ownerType, ids := range map[string][]uint{
+			models.OwnerSong:   songIDs,
+			models.OwnerAlbum:  albumIDs,
+			models.OwnerArtist: artistIDs,
+		} {
+			if len(ids) == 0 {
+				continue
+			}
+			if err := tx.Where("owner_type = ? AND owner_id IN ?", ownerType, ids).Delete(&models.Artifact{}).Error; err != nil {
+				return errors.Wrap(err, "failed to delete artifacts")
+			}
+		}
+		if len(songIDs) > 0 {
+			if err := tx.Where("song_id IN ?", songIDs).Delete(&models.PlaylistEntry{}).Error; err != nil {
+				return errors.Wrap(err, "failed to delete playlist entries")
+			}
+			if err := tx.Delete(&models.Song{}, songIDs).Error; err != nil {
+				return errors.Wrap(err, "failed to delete songs")
+			}
+		}
+		if len(albumIDs) > 0 {
+			if err := tx.Delete(&models.Album{}, albumIDs).Error; err != nil {
+				return errors.Wrap(err, "failed to delete albums")
+			}
+		}
+		if len(artistIDs) > 0 {
+			if err := tx.Delete(&models.Artist{}, artistIDs).Error; err != nil {
+				return errors.Wrap(err, "failed to delete artists")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error().Stack().Err(err).Msg("Failed to purge rows")
+		return err
+	}
+	log.Debug().Msg("Rows purged successfully")
+	return nil
+}
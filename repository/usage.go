@@ -0,0 +1,215 @@
+package repository
+
+import (
+	"context"
+	"time"
+	"whalio/models"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ListUsage returns what storage accounting needs of every artist, album,
+// song and artifact, including those in the trash. Only ids, names, owners,
+// sizes and deletion times are loaded.
+func (r *Repository) ListUsage(ctx context.Context) ([]models.Artist, []models.Album, []models.Song, []models.Artifact, error) {
+	log := r.logger.With().Str("method", "ListUsage").Logger()
+	log.Info().Msg("Fetching storage usage")
+
+	db := r.db.WithContext(ctx).Unscoped().Session(&gorm.Session{})
+
+	var artists []models.Artist
+	if err := db.Select("id", "name", "image_path", "image_size", "deleted_at").Find(&artists).Error; err != nil {
+		log.Error().Stack().Err(err).Msg("Failed to fetch artists")
+		return nil, nil, nil, nil, errors.Wrap(err, "failed to fetch artists")
+	}
+
+	var albums []models.Album
+	if err := db.Select("id", "name", "artist_id", "image_path", "image_size", "deleted_at").Find(&albums).Error; err != nil {
+		log.Error().Stack().Err(err).Msg("Failed to fetch albums")
+		return nil, nil, nil, nil, errors.Wrap(err, "failed to fetch albums")
+	}
+
+	var songs []models.Song
+	if err := db.Select("id", "name", "album_id", "file_size", "deleted_at").Find(&songs).Error; err != nil {
+		log.Error().Stack().Err(err).Msg("Failed to fetch songs")
+		return nil, nil, nil, nil, errors.Wrap(err, "failed to fetch songs")
+	}
+
+	var artifacts []models.Artifact
+	if err := db.Find(&artifacts).Error; err != nil {
+		log.Error().Stack().Err(err).Msg("Failed to fetch artifacts")
+		return nil, nil, nil, nil, errors.Wrap(err, "failed to fetch artifacts")
+	}
+
+	return artists, albums, songs, artifacts, nil
+}
+
+// UpdateImage sets columns describing an album's or artist's image, such
+// as image_size or thumb_ext, and records artifacts derived from it, in one
+// transaction
+func (r *Repository) UpdateImage(ctx context.Context, ownerType string, id uint, updates map[string]any, artifacts ...models.Artifact) error {
+	log := r.logger.With().Str("method", "UpdateImage").Str("owner", ownerType).Uint("id", id).Logger()
+
+	var model any
+	switch ownerType {
+	case models.OwnerAlbum:
+		model = &models.Album{}
+	case models.OwnerArtist:
+		model = &models.Artist{}
+	default:
+		return errors.Errorf("no image for %s", ownerType)
+	}
+
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Model(model).Where("id = ?", id).Updates(updates).Error; err != nil {
+			return errors.Wrap(err, "failed to update image")
+		}
+		return saveArtifacts(tx, artifacts)
+	})
+	if err != nil {
+		log.Error().Stack().Err(err).Msg("Failed to update image")
+		return err
+	}
+	return nil
+}
+
+// ListPendingArtwork returns albums and artists with an image that has no
+// thumbnails, palette or BlurHash yet
+func (r *Repository) ListPendingArtwork(ctx context.Context) ([]models.Album, []models.Artist, error) {
+	log := r.logger.With().Str("method", "ListPendingArtwork").Logger()
+
+	db := r.db.WithContext(ctx).Session(&gorm.Session{})
+	pending := "image_path <> '' AND (thumb_ext = '' OR palette = '' OR blur_hash = '')"
+
+	var albums []models.Album
+	if err := db.Where(pending).Find(&albums).Error; err != nil {
+		log.Error().Stack().Err(err).Msg("Failed to fetch albums")
+		return nil, nil, errors.Wrap(err, "failed to fetch albums")
+	}
+
+	var artists []models.Artist
+	if err := db.Where(pending).Find(&artists).Error; err != nil {
+		log.Error().Stack().Err(err).Msg("Failed to fetch artists")
+		return nil, nil, errors.Wrap(err, "failed to fetch artists")
+	}
+
+	return albums, artists, nil
+}
+
+// SaveArtifacts records derived blobs in one transaction, replacing the
+// records of artifacts with the same key
+func (r *Repository) SaveArtifacts(ctx context.Context, artifacts []models.Artifact) error {
+	log := r.logger.With().Str("method", "SaveArtifacts").Int("count", len(artifacts)).Logger()
+	log.Debug().Msg("Saving artifacts")
+
+	if err := saveArtifacts(r.db.WithContext(ctx), artifacts); err != nil {
+		log.Error().Stack().Err(err).Msg("Failed to save artifacts")
+		return err
+	}
+	return nil
+}
+
+func saveArtifacts(tx *gorm.DB, artifacts []models.Artifact) error {
+	if len(artifacts) == 0 {
+		return nil
+	}
+
+	err := tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "storage_key"}},
+		UpdateAll: true,
+	}).Create(&artifacts).Error
+	return errors.Wrap(err, "failed to save artifacts")
+}
+
+// ownedBy sets the owner of artifacts whose owner was only just created
+func ownedBy(artifacts []models.Artifact, ownerType string, id uint) []models.Artifact {
+	for i := range artifacts {
+		artifacts[i].OwnerType = ownerType
+		artifacts[i].OwnerID = id
+	}
+	return artifacts
+}
+
+// DeleteArtifact forgets a derived blob, the blob itself is left alone
+func (r *Repository) DeleteArtifact(ctx context.Context, key string) error {
+	log := r.logger.With().Str("method", "DeleteArtifact").Str("key", key).Logger()
+	log.Debug().Msg("Deleting artifact")
+
+	if err := r.db.WithContext(ctx).Where("storage_key = ?", key).Delete(&models.Artifact{}).Error; err != nil {
+		log.Error().Stack().Err(err).Msg("Failed to delete artifact")
+		return errors.Wrap(err, "failed to delete artifact")
+	}
+	return nil
+}
+
+// ListArtifacts returns the artifacts of the given owners
+func (r *Repository) ListArtifacts(ctx context.Context, ownerType string, ids []uint) ([]models.Artifact, error) {
+	log := r.logger.With().Str("method", "ListArtifacts").Str("owner", ownerType).Logger()
+
+	var artifacts []models.Artifact
+	if len(ids) == 0 {
+		return artifacts, nil
+	}
+
+	err := r.db.WithContext(ctx).Where("owner_type = ? AND owner_id IN ?", ownerType, ids).Find(&artifacts).Error
+	if err != nil {
+		log.Error().Stack().Err(err).Msg("Failed to fetch artifacts")
+		return nil, errors.Wrap(err, "failed to fetch artifacts")
+	}
+	return artifacts, nil
+}
+
+// TouchArtifact records that an artifact was just served
+func (r *Repository) TouchArtifact(ctx context.Context, key string) error {
+	log := r.logger.With().Str("method", "TouchArtifact").Str("key", key).Logger()
+
+	err := r.db.WithContext(ctx).Model(&models.Artifact{}).Where("storage_key = ?", key).Update("used_at", time.Now()).Error
+	if err != nil {
+		log.Error().Stack().Err(err).Msg("Failed to touch artifact")
+		return errors.Wrap(err, "failed to touch artifact")
+	}
+	return nil
+}
+
+// EvictArtifacts forgets the least recently used artifacts of a kind until
+// the rest take up at most maxBytes, and returns them so their blobs can be
+// deleted. The most recently used one is always kept.
+func (r *Repository) EvictArtifacts(ctx context.Context, kind string, maxBytes int64) ([]models.Artifact, error) {
+	log := r.logger.With().Str("method", "EvictArtifacts").Str("kind", kind).Logger()
+
+	var evicted []models.Artifact
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var artifacts []models.Artifact
+		err := tx.Select("id", "storage_key", "store", "size", "used_at").
+			Where("kind = ?", kind).Order("used_at DESC, id DESC").Find(&artifacts).Error
+		if err != nil {
+			return errors.Wrap(err, "failed to fetch artifacts")
+		}
+
+		var total int64
+		var ids []uint
+		for i, artifact := range artifacts {
+			total += artifact.Size
+			if i > 0 && total > maxBytes {
+				evicted = append(evicted, artifact)
+				ids = append(ids, artifact.ID)
+			}
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+
+		return errors.Wrap(tx.Delete(&models.Artifact{}, ids).Error, "failed to delete artifacts")
+	})
+	if err != nil {
+		log.Error().Stack().Err(err).Msg("Failed to evict artifacts")
+		return nil, err
+	}
+
+	if len(evicted) > 0 {
+		log.Info().Int("count", len(evicted)).Msg("Evicted artifacts")
+	}
+	return evicted, nil
+}
@@ -10,6 +10,9 @@ document.addEventListener('DOMContentLoaded', function() {
     
     // Initialize utility functions
     initUtils();
+
+    // Blurred previews for artwork still loading
+    showBlurHashes(document);
 });
 
 // Theme management
@@ -47,6 +50,10 @@ function initThemeSystem() {
 
 // HTMX event handlers
 function initHTMXHandlers() {
+    document.addEventListener('htmx:afterSwap', function(evt) {
+        showBlurHashes(evt.detail.target);
+    });
+
     // Loading indicators
     document.addEventListener('htmx:beforeRequest', function(evt) {
         const target = evt.target;
@@ -379,13 +386,122 @@ function throttle(func, limit) {
     }
 }
 
+// Follow a background job over Server-Sent Events. onEvent receives every
+// update; the stream is closed once the job is done or failed.
+function watchJob(id, onEvent) {
+    const source = new EventSource(`/api/jobs/${id}/events`);
+    const handle = (e) => {
+        let job;
+        try {
+            job = JSON.parse(e.data);
+        } catch {
+            return;
+        }
+        onEvent(job);
+        if (job.status === 'done' || job.status === 'failed') {
+            source.close();
+        }
+    };
+    ['queued', 'running', 'done', 'failed'].forEach(type => source.addEventListener(type, handle));
+    return source;
+}
+
+// ---- BlurHash placeholders ----
+// Images with a data-blurhash get the decoded hash as background until they
+// have loaded. See https://blurha.sh for the format.
+const BLURHASH_CHARS = '0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~';
+
+function showBlurHashes(root) {
+    root.querySelectorAll('img[data-blurhash]').forEach(img => {
+        const hash = img.getAttribute('data-blurhash');
+        if (!hash || img.complete) return;
+        try {
+            const url = blurHashToDataURL(hash, 32, 32);
+            img.style.backgroundImage = `url(${url})`;
+            img.style.backgroundSize = 'cover';
+            img.addEventListener('load', () => { img.style.backgroundImage = ''; }, { once: true });
+        } catch (e) {
+            console.warn('Invalid BlurHash', hash, e);
+        }
+    });
+}
+
+function decode83(str) {
+    let value = 0;
+    for (const c of str) {
+        const digit = BLURHASH_CHARS.indexOf(c);
+        if (digit < 0) throw new Error(`invalid character ${c}`);
+        value = value * 83 + digit;
+    }
+    return value;
+}
+
+function blurHashToDataURL(hash, width, height) {
+    const sizeFlag = decode83(hash[0]);
+    const numX = (sizeFlag % 9) + 1;
+    const numY = Math.floor(sizeFlag / 9) + 1;
+    if (hash.length !== 4 + 2 * numX * numY) throw new Error('invalid length');
+
+    const srgbToLinear = v => {
+        v /= 255;
+        return v <= 0.04045 ? v / 12.92 : Math.pow((v + 0.055) / 1.055, 2.4);
+    };
+    const linearToSrgb = v => {
+        v = Math.max(0, Math.min(1, v));
+        return v <= 0.0031308 ? Math.round(v * 12.92 * 255) : Math.round((1.055 * Math.pow(v, 1 / 2.4) - 0.055) * 255);
+    };
+    const signPow = (v, exp) => Math.sign(v) * Math.pow(Math.abs(v), exp);
+
+    const maximum = (decode83(hash[1]) + 1) / 166;
+    const colors = [];
+    const dc = decode83(hash.substring(2, 6));
+    colors.push([srgbToLinear(dc >> 16), srgbToLinear((dc >> 8) & 255), srgbToLinear(dc & 255)]);
+    for (let i = 1; i < numX * numY; i++) {
+        const ac = decode83(hash.substring(4 + i * 2, 6 + i * 2));
+        colors.push([
+            signPow((Math.floor(ac / 361) - 9) / 9, 2) * maximum,
+            signPow((Math.floor(ac / 19) % 19 - 9) / 9, 2) * maximum,
+            signPow((ac % 19 - 9) / 9, 2) * maximum,
+        ]);
+    }
+
+    const canvas = document.createElement('canvas');
+    canvas.width = width;
+    canvas.height = height;
+    const ctx = canvas.getContext('2d');
+    const pixels = ctx.createImageData(width, height);
+    for (let y = 0; y < height; y++) {
+        for (let x = 0; x < width; x++) {
+            let r = 0, g = 0, b = 0;
+            for (let j = 0; j < numY; j++) {
+                for (let i = 0; i < numX; i++) {
+                    const basis = Math.cos(Math.PI * x * i / width) * Math.cos(Math.PI * y * j / height);
+                    const color = colors[i + j * numX];
+                    r += color[0] * basis;
+                    g += color[1] * basis;
+                    b += color[2] * basis;
+                }
+            }
+            const offset = 4 * (x + y * width);
+            pixels.data[offset] = linearToSrgb(r);
+            pixels.data[offset + 1] = linearToSrgb(g);
+            pixels.data[offset + 2] = linearToSrgb(b);
+            pixels.data[offset + 3] = 255;
+        }
+    }
+    ctx.putImageData(pixels, 0, 0);
+    return canvas.toDataURL();
+}
+
 // Export utilities
 window.whalio = {
     ...window.whalio,
     showProgressBar,
     updateProgress,
     debounce,
-    throttle
+    throttle,
+    watchJob,
+    showBlurHashes
 };
 
 // ---- Audio Player Module ----
@@ -472,8 +588,10 @@ window.whalio = {
         const artistName = data?.album?.artist?.name || "Unknown artist";
         const albumName = data?.album?.name ? ` • ${data.album.name}` : "";
         this.els.artist.textContent = `${artistName}${albumName}`;
+        this.setTint(data?.album?.tint);
 
-        const src = `/stream/${id}`;
+        // Signed for this song when the server signs stream URLs
+        const src = data.stream || `/stream/${id}`;
         if (this.audio.getAttribute("src") !== src) {
           this.audio.setAttribute("src", src);
         }
@@ -489,6 +607,16 @@ window.whalio = {
       }
     },
 
+    // Tint the bar with the dominant color of the cover, see .cover-tint
+    setTint(color) {
+      if (!this.els.bar) return;
+      if (color) {
+        this.els.bar.style.setProperty("--cover-tint", color);
+      } else {
+        this.els.bar.style.removeProperty("--cover-tint");
+      }
+    },
+
     setNowPlaying(id) {
       this.state.nowPlayingId = id;
       // Highlight rows if present on page
@@ -545,7 +673,7 @@ window.whalio = {
         const res = await fetch(`/api/album/${albumId}/songs`);
         if (!res.ok) throw new Error(`Failed to fetch album songs: ${res.status}`);
         const data = await res.json();
-        const ids = (data?.songs || []).map(s => s.id);
+        const ids = (data?.songs || []).filter(s => !s.unavailable).map(s => s.id);
         if (!ids.length) {
           wh.showToast && wh.showToast("Album has no songs", "warning");
           return;
@@ -604,6 +732,17 @@ window.whalio = {
         return;
       }
     }
+    const deleteBtn = e.target.closest('[data-delete-url]');
+    if (deleteBtn) {
+      e.preventDefault();
+      confirmDelete(deleteBtn.getAttribute('data-delete-url'), deleteBtn.getAttribute('data-delete-name'));
+      return;
+    }
+    const sortHeader = e.target.closest('table[data-sortable] th[data-sort]');
+    if (sortHeader) {
+      sortTable(sortHeader);
+      return;
+    }
     const albumBtn = e.target.closest('[data-play-album]');
     if (albumBtn) {
       const albumId = Number(albumBtn.getAttribute('data-album-id'));
@@ -615,5 +754,71 @@ window.whalio = {
     }
   }
   document.addEventListener('click', onClick);
+
+  // Sorts the rows of a table by the column of the clicked header, by each
+  // cell's data-value if it has one. Clicking again reverses the order.
+  function sortTable(th) {
+    const table = th.closest('table');
+    const tbody = table.tBodies[0];
+    const column = Array.from(th.parentNode.children).indexOf(th);
+    const numeric = th.getAttribute('data-sort') === 'number';
+    // Numbers start largest first, text alphabetically
+    const current = th.getAttribute('aria-sort');
+    const descending = current ? current === 'ascending' : numeric;
+
+    table.querySelectorAll('th[aria-sort]').forEach(h => h.removeAttribute('aria-sort'));
+    th.setAttribute('aria-sort', descending ? 'descending' : 'ascending');
+
+    const value = row => {
+      const cell = row.children[column];
+      const raw = cell.getAttribute('data-value') ?? cell.textContent.trim();
+      return numeric ? Number(raw) : raw.toLowerCase();
+    };
+    const rows = Array.from(tbody.rows);
+    rows.sort((a, b) => {
+      const x = value(a), y = value(b);
+      const order = x < y ? -1 : x > y ? 1 : 0;
+      return descending ? -order : order;
+    });
+    tbody.append(...rows);
+  }
+
+  function formatBytes(bytes) {
+    const units = ["B", "KB", "MB", "GB", "TB"];
+    let i = 0;
+    while (bytes >= 1024 && i < units.length - 1) {
+      bytes /= 1024;
+      i++;
+    }
+    return `${bytes.toFixed(i ? 1 : 0)} ${units[i]}`;
+  }
+
+  function plural(n, word) {
+    return `${n} ${word}${n === 1 ? "" : "s"}`;
+  }
+
+  // Shows what a delete would remove and only deletes once confirmed
+  async function confirmDelete(url, name) {
+    try {
+      const preview = await fetch(`${url}?dry_run=true`, { method: "DELETE" });
+      if (!preview.ok) throw new Error(`Failed to preview delete: ${preview.status}`);
+      const plan = await preview.json();
+
+      const parts = [];
+      if (plan.artists) parts.push(plural(plan.artists, "artist"));
+      if (plan.albums) parts.push(plural(plan.albums, "album"));
+      parts.push(plural(plan.songs, "song"));
+      const message = `Move ${name} to the trash? This includes ${parts.join(", ")} and ` +
+        `${plural(plan.files, "file")} (${formatBytes(plan.bytes)}), which can be restored until the trash is purged.`;
+      if (!window.confirm(message)) return;
+
+      const res = await fetch(url, { method: "DELETE" });
+      if (!res.ok) throw new Error(`Failed to delete: ${res.status}`);
+      window.location.href = "/library";
+    } catch (e) {
+      console.error(e);
+      wh.showToast && wh.showToast("Unable to delete", "error");
+    }
+  }
 })();
 
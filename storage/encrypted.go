@@ -0,0 +1,441 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+// Encrypted blobs start with a header followed by chunks of at most
+// chunkSize bytes, each sealed with AES-256-GCM on its own:
+//
+//	magic     8 bytes  "WHALIOE1"
+//	key id    8 bytes  identifies the key, see keyID
+//	nonce     8 bytes  random prefix, the chunk index makes up the rest
+//	chunk     4 bytes  plaintext chunk size, big endian
+//	reserved  4 bytes
+//
+// A chunk's nonce is the prefix followed by its index, its additional data
+// is the header and a flag marking the last chunk, so chunks can't be
+// reordered, swapped between blobs or cut off. Since chunks have a fixed
+// size, a range of the plaintext maps onto a range of chunks and reading
+// from an offset only fetches and decrypts the chunks it needs.
+const (
+	encMagic       = "WHALIOE1"
+	encHeaderSize  = 32
+	encChunkSize   = 64 << 10
+	encMaxChunk    = 16 << 20
+	encKeySize     = 32
+	encKeyIDSize   = 8
+	encNoncePrefix = 8
+)
+
+var (
+	// ErrUnknownKey is returned for blobs encrypted with a key that isn't
+	// configured
+	ErrUnknownKey = errors.New("storage: blob encrypted with unknown key")
+	// ErrCorrupt is returned when a chunk fails to authenticate
+	ErrCorrupt = errors.New("storage: encrypted blob is corrupt")
+)
+
+// ParseKeys parses base64 encoded 256 bit keys separated by commas or
+// newlines. Blank lines and lines starting with # are skipped.
+func ParseKeys(s string) ([][]byte, error) {
+	var keys [][]byte
+	for line := range strings.Lines(s) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		for field := range strings.SplitSeq(line, ",") {
+			field = strings.TrimSpace(field)
+			if field == "" {
+				continue
+			}
+
+			key, err := base64.StdEncoding.DecodeString(field)
+			if err != nil || len(key) != encKeySize {
+				return nil, fmt.Errorf("invalid encryption key #%d: want %d bytes, base64 encoded", len(keys)+1, encKeySize)
+			}
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// keyID derives the id stored in the header, so a blob can be matched to
+// its key without trying each one
+func keyID(key []byte) [encKeyIDSize]byte {
+	sum := sha256.Sum256(append([]byte("whalio key id\x00"), key...))
+	return [encKeyIDSize]byte(sum[:encKeyIDSize])
+}
+
+// Encrypted encrypts blobs of another store at rest. New blobs are
+// encrypted with the first key, the others can still be read, so keys can
+// be rotated. Blobs without an encryption header are read as plaintext,
+// which keeps a library written before encryption was turned on working
+// until it has been rotated.
+type Encrypted struct {
+	logger  *zerolog.Logger
+	store   Storage
+	current [encKeyIDSize]byte
+	keys    map[[encKeyIDSize]byte]cipher.AEAD
+}
+
+func NewEncrypted(logger *zerolog.Logger, store Storage, keys [][]byte) (*Encrypted, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("storage: no encryption key")
+	}
+
+	e := &Encrypted{
+		logger:  logger,
+		store:   store,
+		current: keyID(keys[0]),
+		keys:    make(map[[encKeyIDSize]byte]cipher.AEAD, len(keys)),
+	}
+
+	for _, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		e.keys[keyID(key)] = aead
+	}
+
+	return e, nil
+}
+
+// header is the parsed header of an encrypted blob
+type header struct {
+	raw       []byte
+	keyID     [encKeyIDSize]byte
+	nonce     [encNoncePrefix]byte
+	chunkSize int64
+}
+
+func (h *header) sealedSize() int64 {
+	return h.chunkSize + 16
+}
+
+// chunks returns the number of chunks of a blob with the given stored size
+func (h *header) chunks(size int64) int64 {
+	body := size - encHeaderSize
+	return (body + h.sealedSize() - 1) / h.sealedSize()
+}
+
+// plainSize returns the plaintext size of a blob with the given stored size
+func (h *header) plainSize(size int64) int64 {
+	return size - encHeaderSize - h.chunks(size)*16
+}
+
+func (h *header) chunkNonce(index int64) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, h.nonce[:])
+	binary.BigEndian.PutUint32(nonce[encNoncePrefix:], uint32(index))
+	return nonce
+}
+
+func (h *header) additionalData(last bool) []byte {
+	data := append(bytes.Clone(h.raw), 0)
+	if last {
+		data[len(data)-1] = 1
+	}
+	return data
+}
+
+// readHeader returns the header of key and its stored size. The header is
+// nil for plaintext blobs.
+func (e *Encrypted) readHeader(ctx context.Context, key string) (*header, Info, error) {
+	info, err := e.store.Stat(ctx, key)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	if info.Size < encHeaderSize+16 {
+		return nil, info, nil
+	}
+
+	source, err := e.store.Open(ctx, key, 0, encHeaderSize)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	defer source.Close()
+
+	raw := make([]byte, encHeaderSize)
+	if _, err := io.ReadFull(source, raw); err != nil {
+		return nil, Info{}, err
+	}
+	if string(raw[:len(encMagic)]) != encMagic {
+		return nil, info, nil
+	}
+
+	h := &header{raw: raw, chunkSize: int64(binary.BigEndian.Uint32(raw[24:28]))}
+	copy(h.keyID[:], raw[8:16])
+	copy(h.nonce[:], raw[16:24])
+
+	if h.chunkSize <= 0 || h.chunkSize > encMaxChunk {
+		return nil, Info{}, ErrCorrupt
+	}
+	if _, ok := e.keys[h.keyID]; !ok {
+		return nil, Info{}, ErrUnknownKey
+	}
+
+	return h, info, nil
+}
+
+// Current reports whether key is encrypted with the first key. Rotation
+// rewrites every blob for which it is false.
+func (e *Encrypted) Current(ctx context.Context, key string) (bool, error) {
+	h, _, err := e.readHeader(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	return h != nil && h.keyID == e.current, nil
+}
+
+func (e *Encrypted) Put(ctx context.Context, key string, source io.Reader) error {
+	raw := make([]byte, encHeaderSize)
+	copy(raw, encMagic)
+	copy(raw[8:16], e.current[:])
+	if _, err := rand.Read(raw[16:24]); err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(raw[24:28], encChunkSize)
+
+	h := &header{raw: raw, keyID: e.current, chunkSize: encChunkSize}
+	copy(h.nonce[:], raw[16:24])
+
+	return e.store.Put(ctx, key, &encryptReader{
+		aead:   e.keys[e.current],
+		header: h,
+		source: bufio.NewReaderSize(source, encChunkSize),
+		plain:  make([]byte, encChunkSize),
+		out:    bytes.Clone(raw),
+	})
+}
+
+func (e *Encrypted) Get(ctx context.Context, key string, dest io.Writer) error {
+	source, err := e.Open(ctx, key, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	_, err = io.Copy(dest, source)
+	return err
+}
+
+func (e *Encrypted) Open(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	h, info, err := e.readHeader(ctx, key)
+	if err != nil {
+		e.logger.Error().Msgf("failed open encrypted %s: %v", key, err)
+		return nil, err
+	}
+	if h == nil {
+		return e.store.Open(ctx, key, offset, length)
+	}
+
+	size := h.plainSize(info.Size)
+	end := size
+	if length >= 0 && offset+length < size {
+		end = offset + length
+	}
+	if offset >= end {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+
+	first := offset / h.chunkSize
+	last := (end - 1) / h.chunkSize
+	body, err := e.store.Open(ctx, key, encHeaderSize+first*h.sealedSize(), (last-first+1)*h.sealedSize())
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptReader{
+		aead:      e.keys[h.keyID],
+		header:    h,
+		body:      body,
+		index:     first,
+		lastChunk: h.chunks(info.Size) - 1,
+		sealed:    make([]byte, h.sealedSize()),
+		skip:      offset - first*h.chunkSize,
+		remaining: end - offset,
+	}, nil
+}
+
+func (e *Encrypted) Delete(ctx context.Context, key string) error {
+	return e.store.Delete(ctx, key)
+}
+
+// Move doesn't touch the content, chunks aren't bound to their key
+func (e *Encrypted) Move(ctx context.Context, src, dest string) error {
+	return e.store.Move(ctx, src, dest)
+}
+
+// Stat returns the plaintext size of the blob
+func (e *Encrypted) Stat(ctx context.Context, key string) (Info, error) {
+	h, info, err := e.readHeader(ctx, key)
+	if err != nil {
+		return Info{}, err
+	}
+	if h != nil {
+		info.Size = h.plainSize(info.Size)
+	}
+	return info, nil
+}
+
+// List returns plaintext sizes, which means reading the header of every
+// blob
+func (e *Encrypted) List(ctx context.Context, prefix string) ([]Info, error) {
+	infos, err := e.store.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range infos {
+		h, info, err := e.readHeader(ctx, infos[i].Key)
+		if errors.Is(err, ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed read header of %s: %w", infos[i].Key, err)
+		}
+		if h != nil {
+			infos[i].Size = h.plainSize(info.Size)
+		}
+	}
+
+	return infos, nil
+}
+
+// encryptReader reads plaintext from source and returns the encrypted
+// blob, header first
+type encryptReader struct {
+	aead   cipher.AEAD
+	header *header
+	source *bufio.Reader
+	plain  []byte
+	out    []byte
+	index  int64
+	done   bool
+}
+
+func (r *encryptReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.seal(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// seal encrypts the next chunk. A chunk is the last one if the source ends
+// within or right after it, an empty blob is a single empty chunk.
+func (r *encryptReader) seal() error {
+	n, err := io.ReadFull(r.source, r.plain)
+	last := false
+	switch {
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		last = true
+	case err != nil:
+		return err
+	default:
+		if _, err := r.source.Peek(1); errors.Is(err, io.EOF) {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if r.index > int64(^uint32(0)) {
+		return errors.New("storage: blob too large to encrypt")
+	}
+
+	r.out = r.aead.Seal(r.out[:0], r.header.chunkNonce(r.index), r.plain[:n], r.header.additionalData(last))
+	r.index++
+	r.done = last
+	return nil
+}
+
+// decryptReader decrypts chunks read from body, starting with chunk index,
+// and returns remaining bytes of plaintext after skipping skip
+type decryptReader struct {
+	aead      cipher.AEAD
+	header    *header
+	body      io.ReadCloser
+	index     int64
+	lastChunk int64
+	sealed    []byte
+	plain     []byte
+	skip      int64
+	remaining int64
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, io.EOF
+	}
+
+	for len(r.plain) == 0 {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	r.remaining -= int64(n)
+	return n, nil
+}
+
+// open reads and decrypts the next chunk
+func (r *decryptReader) open() error {
+	if r.index > r.lastChunk {
+		return io.ErrUnexpectedEOF
+	}
+
+	n, err := io.ReadFull(r.body, r.sealed)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+
+	plain, err := r.aead.Open(r.sealed[:0], r.header.chunkNonce(r.index), r.sealed[:n], r.header.additionalData(r.index == r.lastChunk))
+	if err != nil {
+		return ErrCorrupt
+	}
+	r.index++
+
+	skip := min(r.skip, int64(len(plain)))
+	r.plain = plain[skip:]
+	r.skip -= skip
+	return nil
+}
+
+func (r *decryptReader) Close() error {
+	return r.body.Close()
+}
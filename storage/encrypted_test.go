@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, encKeySize)
+}
+
+func newEncrypted(t *testing.T, store Storage, keys ...[]byte) *Encrypted {
+	t.Helper()
+
+	logger := zerolog.Nop()
+	e, err := NewEncrypted(&logger, store, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestEncryptedTampering(t *testing.T) {
+	// Two full chunks and a short last one
+	content := make([]byte, 2*encChunkSize+1000)
+	for i := range content {
+		content[i] = byte(i * 7 / 3)
+	}
+	sealed := encChunkSize + 16
+	lastChunk := encHeaderSize + 2*sealed
+
+	tests := []struct {
+		name   string
+		tamper func(blob []byte) []byte
+	}{
+		{"flipped ciphertext byte", func(blob []byte) []byte {
+			blob[encHeaderSize+100] ^= 1
+			return blob
+		}},
+		{"flipped tag byte", func(blob []byte) []byte {
+			blob[encHeaderSize+sealed-1] ^= 1
+			return blob
+		}},
+		{"flipped nonce byte", func(blob []byte) []byte {
+			blob[16] ^= 1
+			return blob
+		}},
+		{"flipped reserved byte", func(blob []byte) []byte {
+			blob[30] ^= 1
+			return blob
+		}},
+		{"truncated last chunk", func(blob []byte) []byte {
+			return blob[:len(blob)-10]
+		}},
+		{"dropped last chunk", func(blob []byte) []byte {
+			return blob[:lastChunk]
+		}},
+		{"swapped chunks", func(blob []byte) []byte {
+			first := bytes.Clone(blob[encHeaderSize : encHeaderSize+sealed])
+			copy(blob[encHeaderSize:], blob[encHeaderSize+sealed:encHeaderSize+2*sealed])
+			copy(blob[encHeaderSize+sealed:], first)
+			return blob
+		}},
+		{"extra chunk", func(blob []byte) []byte {
+			return append(blob, blob[encHeaderSize:encHeaderSize+sealed]...)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := NewMemory()
+			store := newEncrypted(t, raw, testKey(1))
+			ctx := t.Context()
+
+			if err := store.Put(ctx, "blob", bytes.NewReader(content)); err != nil {
+				t.Fatal(err)
+			}
+			var blob bytes.Buffer
+			if err := raw.Get(ctx, "blob", &blob); err != nil {
+				t.Fatal(err)
+			}
+			if err := raw.Put(ctx, "blob", bytes.NewReader(tt.tamper(blob.Bytes()))); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := store.Get(ctx, "blob", io.Discard); !errors.Is(err, ErrCorrupt) {
+				t.Errorf("Get = %v, want %v", err, ErrCorrupt)
+			}
+		})
+	}
+}
+
+func TestEncryptedRangeSkipsCorruptChunks(t *testing.T) {
+	raw := NewMemory()
+	store := newEncrypted(t, raw, testKey(1))
+	ctx := t.Context()
+
+	content := bytes.Repeat([]byte("whalio"), encChunkSize)
+	if err := store.Put(ctx, "blob", bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	var blob bytes.Buffer
+	if err := raw.Get(ctx, "blob", &blob); err != nil {
+		t.Fatal(err)
+	}
+	tampered := blob.Bytes()
+	tampered[len(tampered)-1] ^= 1
+	if err := raw.Put(ctx, "blob", bytes.NewReader(tampered)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the chunks a range covers are read and authenticated
+	read := func(offset, length int64) error {
+		body, err := store.Open(ctx, "blob", offset, length)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		got, err := io.ReadAll(body)
+		if err == nil && !bytes.Equal(got, content[offset:offset+length]) {
+			t.Errorf("range %d+%d has the wrong content", offset, length)
+		}
+		return err
+	}
+	if err := read(10, 1000); err != nil {
+		t.Errorf("range in an intact chunk: %v", err)
+	}
+	if err := read(int64(len(content))-1000, 1000); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("range in the corrupt chunk = %v, want %v", err, ErrCorrupt)
+	}
+}
+
+func TestEncryptedUnknownKey(t *testing.T) {
+	raw := NewMemory()
+	ctx := t.Context()
+	if err := newEncrypted(t, raw, testKey(1)).Put(ctx, "blob", bytes.NewReader([]byte("secret"))); err != nil {
+		t.Fatal(err)
+	}
+
+	other := newEncrypted(t, raw, testKey(2))
+	if err := other.Get(ctx, "blob", io.Discard); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Get = %v, want %v", err, ErrUnknownKey)
+	}
+	if _, err := other.Stat(ctx, "blob"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Stat = %v, want %v", err, ErrUnknownKey)
+	}
+	if _, err := other.Current(ctx, "blob"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Current = %v, want %v", err, ErrUnknownKey)
+	}
+}
+
+func TestEncryptedKeyRotation(t *testing.T) {
+	raw := NewMemory()
+	ctx := t.Context()
+	oldKey, newKey := testKey(1), testKey(2)
+
+	if err := newEncrypted(t, raw, oldKey).Put(ctx, "old", bytes.NewReader([]byte("old"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := raw.Put(ctx, "plain", bytes.NewReader([]byte("plain"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// The old key is kept to read what it encrypted, new blobs get the new one
+	store := newEncrypted(t, raw, newKey, oldKey)
+	if err := store.Put(ctx, "new", bytes.NewReader([]byte("new"))); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[string]bool{"old": false, "plain": false, "new": true} {
+		var buf bytes.Buffer
+		if err := store.Get(ctx, key, &buf); err != nil || buf.String() != key {
+			t.Errorf("Get %s = %q, %v", key, buf.String(), err)
+		}
+		if current, err := store.Current(ctx, key); err != nil || current != want {
+			t.Errorf("Current %s = %v, %v, want %v", key, current, err, want)
+		}
+	}
+
+	if err := newEncrypted(t, raw, oldKey).Get(ctx, "new", io.Discard); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("old key reads a blob of the new one: %v", err)
+	}
+}
+
+func TestEncryptedWrongKeyRejected(t *testing.T) {
+	// A header naming a configured key, sealed with another one
+	raw := NewMemory()
+	ctx := t.Context()
+	if err := newEncrypted(t, raw, testKey(1)).Put(ctx, "blob", bytes.NewReader([]byte("secret"))); err != nil {
+		t.Fatal(err)
+	}
+	var blob bytes.Buffer
+	if err := raw.Get(ctx, "blob", &blob); err != nil {
+		t.Fatal(err)
+	}
+	forged := blob.Bytes()
+	id := keyID(testKey(2))
+	copy(forged[8:16], id[:])
+	if err := raw.Put(ctx, "blob", bytes.NewReader(forged)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := newEncrypted(t, raw, testKey(2), testKey(1)).Get(ctx, "blob", io.Discard); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Get = %v, want %v", err, ErrCorrupt)
+	}
+}
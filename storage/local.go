@@ -0,0 +1,236 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+// tempPrefix marks in-progress Puts, they are hidden from List
+const tempPrefix = ".tmp-"
+
+// Local stores blobs as files below a root directory. Every access goes
+// through an os.Root, so neither a crafted key nor a symlink placed in the
+// directory can reach a file outside of it.
+type Local struct {
+	logger *zerolog.Logger
+	root   string
+	dir    *os.Root
+}
+
+func NewLocal(logger *zerolog.Logger, root string) (*Local, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+
+	dir, err := os.OpenRoot(root)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Local{
+		logger: logger,
+		root:   root,
+		dir:    dir,
+	}, nil
+}
+
+// Root returns the directory blobs are stored in
+func (l *Local) Root() string {
+	return l.root
+}
+
+// path converts a key into a path relative to the root
+func (l *Local) path(key string) (string, error) {
+	key, err := CleanKey(key)
+	if err != nil {
+		l.logger.Warn().Msgf("rejected key: %v", err)
+		return "", err
+	}
+
+	return filepath.FromSlash(key), nil
+}
+
+func (l *Local) Put(ctx context.Context, key string, source io.Reader) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	name, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := l.dir.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		l.logger.Error().Msgf("failed create dir for %s: %v", key, err)
+		return err
+	}
+
+	// Write to a temp file and rename it into place, readers never see a
+	// half written blob and a failed upload leaves nothing behind
+	temp := filepath.Join(filepath.Dir(name), tempPrefix+strconv.FormatUint(rand.Uint64(), 36))
+	dest, err := l.dir.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		l.logger.Error().Msgf("failed create dest for %s: %v", key, err)
+		return err
+	}
+	defer l.dir.Remove(temp)
+
+	if _, err = io.Copy(dest, source); err != nil {
+		dest.Close()
+		l.logger.Error().Msgf("failed copy %s: %v", key, err)
+		return err
+	}
+	if err := dest.Close(); err != nil {
+		l.logger.Error().Msgf("failed close %s: %v", key, err)
+		return err
+	}
+
+	if err := l.dir.Rename(temp, name); err != nil {
+		l.logger.Error().Msgf("failed rename %s: %v", key, err)
+		return err
+	}
+
+	return nil
+}
+
+func (l *Local) Get(ctx context.Context, key string, dest io.Writer) error {
+	source, err := l.Open(ctx, key, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	if _, err = io.Copy(dest, source); err != nil {
+		l.logger.Error().Msgf("failed copy %s: %v", key, err)
+		return err
+	}
+
+	return nil
+}
+
+func (l *Local) Open(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	name, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := l.dir.Open(name)
+	if err != nil {
+		l.logger.Error().Msgf("failed open: %s: %v", key, err)
+		return nil, err
+	}
+
+	if offset > 0 {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	// Hand out the file itself when possible so io.Copy can use sendfile
+	if length < 0 {
+		return file, nil
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(file, length), file}, nil
+}
+
+func (l *Local) Delete(ctx context.Context, key string) error {
+	name, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = l.dir.Remove(name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		l.logger.Error().Msgf("failed remove %s: %v", key, err)
+		return err
+	}
+
+	return nil
+}
+
+// Move is a single rename: readers see the blob under either key, never
+// both or neither. Both keys must be on the same file system, which they are
+// below one root unless it has mount points inside.
+func (l *Local) Move(ctx context.Context, src, dest string) error {
+	srcPath, err := l.path(src)
+	if err != nil {
+		return err
+	}
+	destPath, err := l.path(dest)
+	if err != nil {
+		return err
+	}
+
+	if err := l.dir.MkdirAll(filepath.Dir(destPath), 0o755); err != nil {
+		l.logger.Error().Msgf("failed create dir for %s: %v", dest, err)
+		return err
+	}
+
+	if err := l.dir.Rename(srcPath, destPath); err != nil {
+		l.logger.Error().Msgf("failed move %s to %s: %v", src, dest, err)
+		return err
+	}
+
+	return nil
+}
+
+func (l *Local) Stat(ctx context.Context, key string) (Info, error) {
+	name, err := l.path(key)
+	if err != nil {
+		return Info{}, err
+	}
+
+	stat, err := l.dir.Stat(name)
+	if err != nil {
+		return Info{}, err
+	}
+	if !stat.Mode().IsRegular() {
+		return Info{}, ErrNotExist
+	}
+
+	return Info{Key: key, Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+func (l *Local) List(ctx context.Context, prefix string) ([]Info, error) {
+	var infos []Info
+
+	err := fs.WalkDir(l.dir.FS(), ".", func(key string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || strings.HasPrefix(d.Name(), tempPrefix) {
+			return nil
+		}
+
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		stat, err := d.Info()
+		if err != nil {
+			return err
+		}
+		infos = append(infos, Info{Key: key, Size: stat.Size(), ModTime: stat.ModTime()})
+
+		return ctx.Err()
+	})
+	if err != nil {
+		l.logger.Error().Msgf("failed list %s: %v", l.root, err)
+		return nil, err
+	}
+
+	return infos, nil
+}
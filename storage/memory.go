@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory keeps blobs in memory, for tests. Keys are checked like in the
+// other stores, so it accepts and refuses the same keys.
+type Memory struct {
+	mu    sync.RWMutex
+	blobs map[string]memoryBlob
+}
+
+type memoryBlob struct {
+	data    []byte
+	modTime time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{blobs: make(map[string]memoryBlob)}
+}
+
+func (m *Memory) Put(ctx context.Context, key string, source io.Reader) error {
+	key, err := CleanKey(key)
+	if err != nil {
+		return err
+	}
+
+	// Read everything before storing anything, a failed Put leaves the old
+	// blob or none
+	data, err := io.ReadAll(source)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.blobs[key] = memoryBlob{data: data, modTime: time.Now()}
+	return nil
+}
+
+func (m *Memory) Get(ctx context.Context, key string, dest io.Writer) error {
+	source, err := m.Open(ctx, key, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	_, err = io.Copy(dest, source)
+	return err
+}
+
+func (m *Memory) Open(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	blob, err := m.blob(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data := blob.data[min(offset, int64(len(blob.data))):]
+	if length >= 0 {
+		data = data[:min(length, int64(len(data)))]
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m *Memory) Delete(ctx context.Context, key string) error {
+	key, err := CleanKey(key)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.blobs, key)
+	return nil
+}
+
+func (m *Memory) Move(ctx context.Context, src, dest string) error {
+	src, err := CleanKey(src)
+	if err != nil {
+		return err
+	}
+	if dest, err = CleanKey(dest); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	blob, ok := m.blobs[src]
+	if !ok {
+		return ErrNotExist
+	}
+	delete(m.blobs, src)
+	m.blobs[dest] = blob
+	return nil
+}
+
+func (m *Memory) Stat(ctx context.Context, key string) (Info, error) {
+	blob, err := m.blob(key)
+	if err != nil {
+		return Info{}, err
+	}
+
+	return Info{Key: key, Size: int64(len(blob.data)), ModTime: blob.modTime}, nil
+}
+
+func (m *Memory) List(ctx context.Context, prefix string) ([]Info, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var infos []Info
+	for key, blob := range m.blobs {
+		if strings.HasPrefix(key, prefix) {
+			infos = append(infos, Info{Key: key, Size: int64(len(blob.data)), ModTime: blob.modTime})
+		}
+	}
+	slices.SortFunc(infos, func(a, b Info) int { return strings.Compare(a.Key, b.Key) })
+	return infos, nil
+}
+
+func (m *Memory) blob(key string) (memoryBlob, error) {
+	key, err := CleanKey(key)
+	if err != nil {
+		return memoryBlob{}, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	blob, ok := m.blobs[key]
+	if !ok {
+		return memoryBlob{}, ErrNotExist
+	}
+	return blob, nil
+}
@@ -0,0 +1,41 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// ErrInvalidKey is returned for keys that could escape the store, such as
+// absolute paths or keys with ".." elements
+var ErrInvalidKey = errors.New("invalid storage key")
+
+// CleanKey checks that key is safe to use as a path below a store root and
+// returns it. Keys are slash separated and must already be canonical: no
+// leading or trailing slash, no empty, "." or ".." elements, no backslashes
+// or control characters, and no element that is reserved for temp files or
+// by the operating system. Nothing is escaped, a key that isn't safe as is
+// gets rejected, so one blob can never be reached under two keys.
+func CleanKey(key string) (string, error) {
+	if !fs.ValidPath(key) || key == "." {
+		return "", fmt.Errorf("%w: %q", ErrInvalidKey, key)
+	}
+	if strings.ContainsFunc(key, func(r rune) bool { return r == '\\' || unicode.IsControl(r) }) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidKey, key)
+	}
+	// Catches reserved names like NUL or COM1 on Windows
+	if !filepath.IsLocal(filepath.FromSlash(key)) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidKey, key)
+	}
+
+	for element := range strings.SplitSeq(key, "/") {
+		if strings.HasPrefix(element, tempPrefix) {
+			return "", fmt.Errorf("%w: %q", ErrInvalidKey, key)
+		}
+	}
+
+	return key, nil
+}
@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCleanKey(t *testing.T) {
+	tests := []struct {
+		key   string
+		valid bool
+	}{
+		{"songs/3f/3f9c0a.mp3", true},
+		{"covers/a.png", true},
+		{"Sigur Rós/Ágætis byrjun.flac", true},
+		{"a/.tmp", true},
+		{"a/tmp-.tmp-", true},
+		{"...", true},
+		{"a..b/c", true},
+		// Encoded dot-dot is a literal name, keys are never unescaped
+		{"%2e%2e/etc/passwd", true},
+		{"..%2fetc", true},
+		{"%2E%2E%5Cetc", true},
+
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"../etc/passwd", false},
+		{"a/../../b", false},
+		{"a/../b", false},
+		{"a/..", false},
+		{"./a", false},
+		{"a/./b", false},
+		{"/etc/passwd", false},
+		{"//server/share", false},
+		{"a/", false},
+		{"a//b", false},
+		{`a\b`, false},
+		{`..\etc`, false},
+		{`\\server\share`, false},
+		{`C:\Windows`, false},
+		{"a\x00b", false},
+		{"a\nb", false},
+		{"a\rb", false},
+		{"a\tb", false},
+		{"a\x1bb", false},
+		{"a\x7fb", false},
+		{"a\u0085b", false},
+		{"a\xffb", false}, // Not UTF-8
+		{".tmp-upload", false},
+		{"songs/.tmp-123", false},
+		{".tmp-dir/a.mp3", false},
+	}
+	for _, tt := range tests {
+		got, err := CleanKey(tt.key)
+		switch {
+		case tt.valid && (err != nil || got != tt.key):
+			t.Errorf("CleanKey(%q) = %q, %v, want it unchanged", tt.key, got, err)
+		case !tt.valid && !errors.Is(err, ErrInvalidKey):
+			t.Errorf("CleanKey(%q) = %q, %v, want %v", tt.key, got, err, ErrInvalidKey)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/rs/zerolog"
+)
+
+// s3PartSize bounds memory use of uploads with unknown size, each part is
+// buffered before it is sent
+const s3PartSize = 16 << 20
+
+type S3Config struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	UseSSL    bool
+	// Prefix is prepended to every key, so several stores can share a bucket
+	Prefix string
+}
+
+// S3 stores blobs in a bucket of an S3 compatible object store such as
+// MinIO, Garage or AWS S3
+type S3 struct {
+	logger *zerolog.Logger
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func NewS3(logger *zerolog.Logger, cfg S3Config) (*S3, error) {
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.UseSSL,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed create s3 client: %w", err)
+	}
+
+	return &S3{
+		logger: logger,
+		client: client,
+		bucket: cfg.Bucket,
+		prefix: cfg.Prefix,
+	}, nil
+}
+
+// object returns the object name of key. Object stores have no directories
+// to escape, keys are still checked so the same key is valid or invalid
+// regardless of backend.
+func (s *S3) object(key string) (string, error) {
+	key, err := CleanKey(key)
+	if err != nil {
+		s.logger.Warn().Msgf("rejected key: %v", err)
+		return "", err
+	}
+
+	return s.prefix + key, nil
+}
+
+// mapError translates missing objects into ErrNotExist
+func mapError(err error) error {
+	switch minio.ToErrorResponse(err).Code {
+	case minio.NoSuchKey, "NotFound":
+		return fmt.Errorf("%w: %v", ErrNotExist, err)
+	}
+	return err
+}
+
+func (s *S3) Put(ctx context.Context, key string, source io.Reader) error {
+	object, err := s.object(key)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.PutObject(ctx, s.bucket, object, source, -1, minio.PutObjectOptions{
+		PartSize: s3PartSize,
+	})
+	if err != nil {
+		s.logger.Error().Msgf("failed put %s: %v", key, err)
+		return err
+	}
+
+	return nil
+}
+
+func (s *S3) Get(ctx context.Context, key string, dest io.Writer) error {
+	source, err := s.Open(ctx, key, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	if _, err = io.Copy(dest, source); err != nil {
+		s.logger.Error().Msgf("failed copy %s: %v", key, err)
+		return err
+	}
+
+	return nil
+}
+
+func (s *S3) Open(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	name, err := s.object(key)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := minio.GetObjectOptions{}
+	switch {
+	case length == 0:
+		return io.NopCloser(strings.NewReader("")), nil
+	case length > 0:
+		err = opts.SetRange(offset, offset+length-1)
+	case offset > 0:
+		err = opts.SetRange(offset, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	object, err := s.client.GetObject(ctx, s.bucket, name, opts)
+	if err != nil {
+		s.logger.Error().Msgf("failed open: %s: %v", key, err)
+		return nil, mapError(err)
+	}
+
+	// GetObject is lazy, Stat sends the request so a missing key fails here
+	// rather than on the first Read
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+		s.logger.Error().Msgf("failed open: %s: %v", key, err)
+		return nil, mapError(err)
+	}
+
+	return object, nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	object, err := s.object(key)
+	if err != nil {
+		return err
+	}
+
+	if err := s.client.RemoveObject(ctx, s.bucket, object, minio.RemoveObjectOptions{}); err != nil {
+		s.logger.Error().Msgf("failed remove %s: %v", key, err)
+		return err
+	}
+
+	return nil
+}
+
+// Move copies the object server side and removes the source. Object stores
+// have no rename, so a crash in between leaves both copies.
+func (s *S3) Move(ctx context.Context, src, dest string) error {
+	srcObject, err := s.object(src)
+	if err != nil {
+		return err
+	}
+	destObject, err := s.object(dest)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.CopyObject(ctx,
+		minio.CopyDestOptions{Bucket: s.bucket, Object: destObject},
+		minio.CopySrcOptions{Bucket: s.bucket, Object: srcObject},
+	)
+	if err != nil {
+		s.logger.Error().Msgf("failed copy %s to %s: %v", src, dest, err)
+		return mapError(err)
+	}
+
+	return s.Delete(ctx, src)
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (Info, error) {
+	object, err := s.object(key)
+	if err != nil {
+		return Info{}, err
+	}
+
+	stat, err := s.client.StatObject(ctx, s.bucket, object, minio.StatObjectOptions{})
+	if err != nil {
+		return Info{}, mapError(err)
+	}
+
+	return Info{Key: key, Size: stat.Size, ModTime: stat.LastModified}, nil
+}
+
+func (s *S3) List(ctx context.Context, prefix string) ([]Info, error) {
+	var infos []Info
+
+	objects := s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{
+		Prefix:    s.prefix + prefix,
+		Recursive: true,
+	})
+	for object := range objects {
+		if object.Err != nil {
+			s.logger.Error().Msgf("failed list %s: %v", prefix, object.Err)
+			return nil, object.Err
+		}
+		infos = append(infos, Info{
+			Key:     strings.TrimPrefix(object.Key, s.prefix),
+			Size:    object.Size,
+			ModTime: object.LastModified,
+		})
+	}
+
+	return infos, nil
+}
@@ -1,124 +1,101 @@
 package storage
 
 import (
+	"context"
+	"errors"
 	"io"
-	"os"
-
-	"github.com/rs/zerolog"
+	"io/fs"
+	"time"
 )
 
-type Storage struct {
-	logger *zerolog.Logger
-}
-
-func NewStorage(logger *zerolog.Logger) *Storage {
-	return &Storage{
-		logger: logger,
-	}
+// ErrNotExist is returned for keys that don't exist. It matches
+// fs.ErrNotExist, so os.IsNotExist style checks keep working.
+var ErrNotExist = fs.ErrNotExist
+
+// Storage stores blobs under slash separated keys such as "covers/1.png".
+// Implementations must be safe for concurrent use.
+type Storage interface {
+	// Put stores everything read from source under key, replacing any
+	// existing blob. A failed Put leaves no partial blob behind.
+	Put(ctx context.Context, key string, source io.Reader) error
+	// Get copies the blob to dest
+	Get(ctx context.Context, key string, dest io.Writer) error
+	// Open returns length bytes starting at offset, or everything from
+	// offset on if length is negative
+	Open(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+	// Delete removes the blob. Deleting a missing key is not an error.
+	Delete(ctx context.Context, key string) error
+	// Move renames a blob, replacing any blob at dest
+	Move(ctx context.Context, src, dest string) error
+	Stat(ctx context.Context, key string) (Info, error)
+	// List returns all blobs whose key starts with prefix
+	List(ctx context.Context, prefix string) ([]Info, error)
 }
 
-func (s *Storage) SaveFile(source io.Reader, name string) error {
-	dest, err := os.Create(name)
-	if err != nil {
-		s.logger.Error().Msgf("failed create dest for %s: %v", name, err)
-
-		return err
-	}
-	defer dest.Close()
-
-	if _, err = io.Copy(dest, source); err != nil {
-		s.logger.Error().Msgf("failed copy %s: %v", name, err)
-
-		return err
-	}
-
-	return nil
+type Info struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
 }
 
-func (s *Storage) DeleteFile(name string) error {
-	err := os.Remove(name)
-	if err != nil {
-		s.logger.Error().Msgf("failed remove %s: %v", name, err)
-
-		return err
-	}
-
-	return nil
+// readSeeker adapts ranged Opens to io.ReadSeeker. The underlying blob is
+// only opened on the first Read after a Seek, so seeking is free.
+type readSeeker struct {
+	ctx     context.Context
+	storage Storage
+	key     string
+	size    int64
+	offset  int64
+	body    io.ReadCloser
 }
 
-func (s *Storage) ListFiles(dir string) ([]string, error) {
-	files, err := os.ReadDir(dir)
-	if err != nil {
-		s.logger.Error().Msgf("failed read dir %s: %v", dir, err)
-
-		return nil, err
-	}
-
-	names := make([]string, len(files))
-
-	for i, file := range files {
-		names[i] = file.Name()
-	}
-
-	return names, nil
+// NewReadSeeker returns a seekable reader for a blob of the given size,
+// e.g. for http.ServeContent.
+func NewReadSeeker(ctx context.Context, storage Storage, info Info) io.ReadSeekCloser {
+	return &readSeeker{ctx: ctx, storage: storage, key: info.Key, size: info.Size}
 }
 
-func (s *Storage) RenameFile(destPath string, srcPath string) error {
-	dest, err := os.Open(destPath)
-	if err != nil {
-		s.logger.Error().Msgf("failed open dest: %s: %v", destPath, err)
-		return err
-	}
-
-	src, err := os.Open(srcPath)
-	if err != nil {
-		s.logger.Error().Msgf("failed open source: %s: %v", srcPath, err)
-		return err
+func (r *readSeeker) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
 	}
 
-	if _, err = io.Copy(dest, src); err != nil {
-		s.logger.Error().Msgf("failed copy: %v", err)
-		return err
+	if r.body == nil {
+		body, err := r.storage.Open(r.ctx, r.key, r.offset, -1)
+		if err != nil {
+			return 0, err
+		}
+		r.body = body
 	}
 
-	return nil
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	return n, err
 }
 
-func (s *Storage) GetFile(dest io.Writer, name string) error {
-	if _, err := os.Stat(name); os.IsNotExist(err) {
-		s.logger.Error().Msgf("failed get stat of %s: %v", name, err)
-		return err
+func (r *readSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
 	}
-
-	source, err := os.Open(name)
-	if err != nil {
-		s.logger.Error().Msgf("failed open: %s: %v", name, err)
-
-		return err
+	if offset < 0 {
+		return 0, errors.New("storage: negative position")
 	}
 
-	if _, err = io.Copy(dest, source); err != nil {
-		s.logger.Error().Msgf("failed copy %s: %v", name, err)
-
-		return err
+	if offset != r.offset && r.body != nil {
+		r.body.Close()
+		r.body = nil
 	}
+	r.offset = offset
 
-	return nil
+	return offset, nil
 }
 
-func (s *Storage) OpenFile(name string) (io.ReadSeeker, os.FileInfo, error) {
-	stat, err := os.Stat(name)
-	if os.IsNotExist(err) {
-		s.logger.Error().Msgf("failed get stat of %s: %v", name, err)
-		return nil, nil, err
+func (r *readSeeker) Close() error {
+	if r.body == nil {
+		return nil
 	}
-
-	source, err := os.Open(name)
-	if err != nil {
-		s.logger.Error().Msgf("failed open: %s: %v", name, err)
-
-		return nil, nil, err
-	}
-
-	return source, stat, nil
+	return r.body.Close()
 }
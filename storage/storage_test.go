@@ -0,0 +1,303 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestLocal(t *testing.T) {
+	testStorage(t, func(t *testing.T) Storage {
+		logger := zerolog.Nop()
+		store, err := NewLocal(&logger, t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	})
+}
+
+func TestMemory(t *testing.T) {
+	testStorage(t, func(t *testing.T) Storage { return NewMemory() })
+}
+
+func TestEncrypted(t *testing.T) {
+	testStorage(t, func(t *testing.T) Storage {
+		logger := zerolog.Nop()
+		store, err := NewEncrypted(&logger, NewMemory(), [][]byte{bytes.Repeat([]byte{7}, encKeySize)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	})
+}
+
+// TestS3 runs against an S3 compatible store such as MinIO, if
+// WHALIO_TEST_S3_ENDPOINT and WHALIO_TEST_S3_BUCKET name one. Every test
+// works below its own random prefix, which is emptied afterwards.
+func TestS3(t *testing.T) {
+	cfg := S3Config{
+		Endpoint:  os.Getenv("WHALIO_TEST_S3_ENDPOINT"),
+		Region:    os.Getenv("WHALIO_TEST_S3_REGION"),
+		Bucket:    os.Getenv("WHALIO_TEST_S3_BUCKET"),
+		AccessKey: os.Getenv("WHALIO_TEST_S3_ACCESS_KEY"),
+		SecretKey: os.Getenv("WHALIO_TEST_S3_SECRET_KEY"),
+		UseSSL:    os.Getenv("WHALIO_TEST_S3_USE_SSL") == "true",
+	}
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		t.Skip("set WHALIO_TEST_S3_ENDPOINT and WHALIO_TEST_S3_BUCKET to test against S3")
+	}
+
+	testStorage(t, func(t *testing.T) Storage {
+		cfg := cfg
+		cfg.Prefix = fmt.Sprintf("whalio-test-%x/", rand.Uint64())
+		logger := zerolog.Nop()
+		store, err := NewS3(&logger, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			infos, _ := store.List(context.Background(), "")
+			for _, info := range infos {
+				store.Delete(context.Background(), info.Key)
+			}
+		})
+		return store
+	})
+}
+
+// testStorage checks that a store behaves as the Storage interface says,
+// with newStore returning an empty store
+func testStorage(t *testing.T, newStore func(t *testing.T) Storage) {
+	// Spans several chunks of encrypted stores
+	content := make([]byte, 150<<10)
+	for i := range content {
+		content[i] = byte(i * 7 / 3)
+	}
+
+	put := func(t *testing.T, store Storage, key string, data []byte) {
+		t.Helper()
+		if err := store.Put(t.Context(), key, bytes.NewReader(data)); err != nil {
+			t.Fatalf("Put %s: %v", key, err)
+		}
+	}
+	get := func(t *testing.T, store Storage, key string) []byte {
+		t.Helper()
+		var buf bytes.Buffer
+		if err := store.Get(t.Context(), key, &buf); err != nil {
+			t.Fatalf("Get %s: %v", key, err)
+		}
+		return buf.Bytes()
+	}
+
+	t.Run("put and get", func(t *testing.T) {
+		store := newStore(t)
+		put(t, store, "songs/ab/song.mp3", content)
+		if got := get(t, store, "songs/ab/song.mp3"); !bytes.Equal(got, content) {
+			t.Errorf("got %d bytes, want %d", len(got), len(content))
+		}
+
+		put(t, store, "songs/ab/song.mp3", []byte("replaced"))
+		if got := get(t, store, "songs/ab/song.mp3"); string(got) != "replaced" {
+			t.Errorf("got %q after replacing", got)
+		}
+
+		put(t, store, "empty", nil)
+		if got := get(t, store, "empty"); len(got) != 0 {
+			t.Errorf("empty blob has %d bytes", len(got))
+		}
+	})
+
+	t.Run("failed put", func(t *testing.T) {
+		store := newStore(t)
+		failing := io.MultiReader(bytes.NewReader(content[:1000]), errReader{})
+		if err := store.Put(t.Context(), "partial", failing); err == nil {
+			t.Fatal("Put of a failing reader succeeded")
+		}
+		if _, err := store.Stat(t.Context(), "partial"); !errors.Is(err, ErrNotExist) {
+			t.Errorf("Stat of a failed Put = %v, want %v", err, ErrNotExist)
+		}
+		if infos, _ := store.List(t.Context(), ""); len(infos) != 0 {
+			t.Errorf("List shows a failed Put: %v", infos)
+		}
+	})
+
+	t.Run("open", func(t *testing.T) {
+		store := newStore(t)
+		put(t, store, "blob", content)
+		size := int64(len(content))
+
+		tests := []struct {
+			name           string
+			offset, length int64
+			want           []byte
+		}{
+			{"all", 0, -1, content},
+			{"from offset", 100, -1, content[100:]},
+			{"range", 10, 20, content[10:30]},
+			{"across chunks", 65<<10 - 5, 70 << 10, content[65<<10-5 : 135<<10-5]},
+			{"last byte", size - 1, 1, content[size-1:]},
+			{"past end", size - 10, 100, content[size-10:]},
+			{"exact length", 0, size, content},
+			{"nothing", 5, 0, nil},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				body, err := store.Open(t.Context(), "blob", tt.offset, tt.length)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer body.Close()
+				got, err := io.ReadAll(body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, tt.want) {
+					t.Errorf("got %d bytes, want %d", len(got), len(tt.want))
+				}
+			})
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		store := newStore(t)
+		ctx := t.Context()
+
+		if err := store.Get(ctx, "missing", io.Discard); !errors.Is(err, ErrNotExist) {
+			t.Errorf("Get = %v, want %v", err, ErrNotExist)
+		}
+		if _, err := store.Open(ctx, "missing", 0, -1); !errors.Is(err, ErrNotExist) {
+			t.Errorf("Open = %v, want %v", err, ErrNotExist)
+		}
+		if _, err := store.Open(ctx, "missing", 10, 10); !errors.Is(err, ErrNotExist) {
+			t.Errorf("Open of a range = %v, want %v", err, ErrNotExist)
+		}
+		if _, err := store.Stat(ctx, "missing"); !errors.Is(err, ErrNotExist) {
+			t.Errorf("Stat = %v, want %v", err, ErrNotExist)
+		}
+		if err := store.Move(ctx, "missing", "dest"); !errors.Is(err, ErrNotExist) {
+			t.Errorf("Move = %v, want %v", err, ErrNotExist)
+		}
+		if err := store.Delete(ctx, "missing"); err != nil {
+			t.Errorf("Delete = %v, want nil", err)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		store := newStore(t)
+		put(t, store, "a/blob", content[:10])
+		if err := store.Delete(t.Context(), "a/blob"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Stat(t.Context(), "a/blob"); !errors.Is(err, ErrNotExist) {
+			t.Errorf("Stat after Delete = %v, want %v", err, ErrNotExist)
+		}
+	})
+
+	t.Run("move", func(t *testing.T) {
+		store := newStore(t)
+		put(t, store, "staging/covers/a.png", content)
+		put(t, store, "covers/b.png", []byte("old"))
+
+		if err := store.Move(t.Context(), "staging/covers/a.png", "covers/new/a.png"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Stat(t.Context(), "staging/covers/a.png"); !errors.Is(err, ErrNotExist) {
+			t.Errorf("source still there: %v", err)
+		}
+		if got := get(t, store, "covers/new/a.png"); !bytes.Equal(got, content) {
+			t.Errorf("moved blob has %d bytes, want %d", len(got), len(content))
+		}
+
+		// Replaces the destination
+		if err := store.Move(t.Context(), "covers/new/a.png", "covers/b.png"); err != nil {
+			t.Fatal(err)
+		}
+		if got := get(t, store, "covers/b.png"); !bytes.Equal(got, content) {
+			t.Errorf("replaced blob has %d bytes, want %d", len(got), len(content))
+		}
+	})
+
+	t.Run("stat", func(t *testing.T) {
+		store := newStore(t)
+		put(t, store, "covers/a.png", content)
+
+		info, err := store.Stat(t.Context(), "covers/a.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Key != "covers/a.png" || info.Size != int64(len(content)) || info.ModTime.IsZero() {
+			t.Errorf("Stat = %+v, want covers/a.png of %d bytes", info, len(content))
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		store := newStore(t)
+		for _, key := range []string{"songs/ab/1.mp3", "songs/cd/2.mp3", "songs.txt", "covers/ab/1.png"} {
+			put(t, store, key, []byte(key))
+		}
+
+		for prefix, want := range map[string][]string{
+			"":         {"covers/ab/1.png", "songs.txt", "songs/ab/1.mp3", "songs/cd/2.mp3"},
+			"songs/":   {"songs/ab/1.mp3", "songs/cd/2.mp3"},
+			"songs":    {"songs.txt", "songs/ab/1.mp3", "songs/cd/2.mp3"},
+			"songs/ab": {"songs/ab/1.mp3"},
+			"missing/": nil,
+		} {
+			infos, err := store.List(t.Context(), prefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, info := range infos {
+				got = append(got, info.Key)
+				if info.Size != int64(len(info.Key)) {
+					t.Errorf("%s listed with %d bytes, want %d", info.Key, info.Size, len(info.Key))
+				}
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, want) {
+				t.Errorf("List(%q) = %v, want %v", prefix, got, want)
+			}
+		}
+	})
+
+	t.Run("invalid keys", func(t *testing.T) {
+		store := newStore(t)
+		ctx := t.Context()
+		put(t, store, "valid", content[:10])
+
+		for _, key := range []string{"../escape", "/absolute", "a/../../b", "a\\b", ".tmp-upload", ""} {
+			if err := store.Put(ctx, key, strings.NewReader("x")); !errors.Is(err, ErrInvalidKey) {
+				t.Errorf("Put %q = %v, want %v", key, err, ErrInvalidKey)
+			}
+			if _, err := store.Open(ctx, key, 0, -1); !errors.Is(err, ErrInvalidKey) {
+				t.Errorf("Open %q = %v, want %v", key, err, ErrInvalidKey)
+			}
+			if _, err := store.Stat(ctx, key); !errors.Is(err, ErrInvalidKey) {
+				t.Errorf("Stat %q = %v, want %v", key, err, ErrInvalidKey)
+			}
+			if err := store.Delete(ctx, key); !errors.Is(err, ErrInvalidKey) {
+				t.Errorf("Delete %q = %v, want %v", key, err, ErrInvalidKey)
+			}
+			if err := store.Move(ctx, "valid", key); !errors.Is(err, ErrInvalidKey) {
+				t.Errorf("Move to %q = %v, want %v", key, err, ErrInvalidKey)
+			}
+		}
+	})
+}
+
+type errReader struct{}
+
+func (errReader) Read(p []byte) (int, error) {
+	return 0, errors.New("read failed")
+}
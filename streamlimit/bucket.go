@@ -0,0 +1,69 @@
+package streamlimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket of bytes. It fills at rate bytes per second up
+// to a second's worth, and takers reserve tokens ahead of time, waiting
+// until the bucket has caught up, so concurrent takers are served in turn.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time // time.Now, tests replace it
+}
+
+// NewBucket returns a full bucket of rate bytes per second
+func NewBucket(rate int64) *Bucket {
+	return &Bucket{
+		rate:   float64(rate),
+		burst:  float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+		now:    time.Now,
+	}
+}
+
+// Burst is the most that can be taken at once without waiting
+func (b *Bucket) Burst() int {
+	return int(b.burst)
+}
+
+// reserve takes n tokens, going into debt if there aren't enough, and
+// returns how long to wait until the debt is paid off
+func (b *Bucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// wait sleeps for d unless ctx is done first
+func wait(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,78 @@
+package streamlimit
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock that only moves when told to
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// newFakeBucket returns a full bucket of rate bytes per second on a fake
+// clock
+func newFakeBucket(rate int64) (*Bucket, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	b := NewBucket(rate)
+	b.now, b.last = clock.Now, clock.now
+	return b, clock
+}
+
+func TestBucketBurst(t *testing.T) {
+	b, _ := newFakeBucket(1000)
+	if got := b.Burst(); got != 1000 {
+		t.Errorf("Burst = %d, want a second's worth", got)
+	}
+
+	// A full bucket gives a second's worth at once, anything more waits
+	if d := b.reserve(600); d != 0 {
+		t.Errorf("first 600 waited %s", d)
+	}
+	if d := b.reserve(400); d != 0 {
+		t.Errorf("next 400 waited %s", d)
+	}
+	if d := b.reserve(100); d != 100*time.Millisecond {
+		t.Errorf("100 over the burst waits %s, want 100ms", d)
+	}
+}
+
+func TestBucketRefill(t *testing.T) {
+	b, clock := newFakeBucket(1000)
+	b.reserve(1000)
+
+	// Tokens come back at the rate
+	clock.Advance(250 * time.Millisecond)
+	if d := b.reserve(250); d != 0 {
+		t.Errorf("250 after 250ms waited %s", d)
+	}
+	if d := b.reserve(500); d != 500*time.Millisecond {
+		t.Errorf("500 on an empty bucket waits %s, want 500ms", d)
+	}
+
+	// Takers queue up behind the debt
+	if d := b.reserve(500); d != time.Second {
+		t.Errorf("next 500 waits %s, want 1s", d)
+	}
+	clock.Advance(time.Second)
+	if d := b.reserve(0); d != 0 {
+		t.Errorf("debt not paid off after 1s, %s left", d)
+	}
+
+	// An idle bucket fills up to the burst and no further
+	clock.Advance(time.Hour)
+	if d := b.reserve(1000); d != 0 {
+		t.Errorf("a full bucket made 1000 wait %s", d)
+	}
+	if d := b.reserve(1); d != time.Millisecond {
+		t.Errorf("idle time saved up past the burst, 1 more waits %s", d)
+	}
+}
@@ -0,0 +1,164 @@
+// Package streamlimit keeps streaming from swamping the server: it caps
+// concurrent streams per client, shapes every stream to a bandwidth and all
+// of them together to a server-wide egress budget, and counts what it did.
+package streamlimit
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxChunk bounds a single shaped write, so a large write doesn't empty
+// the buckets in one go
+const maxChunk = 32 << 10
+
+// Limits configure a Limiter, zero means unlimited
+type Limits struct {
+	PerClient  int   `json:"perClient"`  // Concurrent streams per client
+	StreamRate int64 `json:"streamRate"` // Bytes per second of each stream
+	EgressRate int64 `json:"egressRate"` // Bytes per second of all streams
+}
+
+// Metrics are counted since the server started
+type Metrics struct {
+	Limits    Limits  `json:"limits"`
+	Active    int64   `json:"active"`    // Streams being served
+	Clients   int     `json:"clients"`   // Clients with at least one stream
+	Served    int64   `json:"served"`    // Streams started
+	Rejected  int64   `json:"rejected"`  // Streams refused for PerClient
+	BytesSent int64   `json:"bytesSent"` // Bytes written to streams
+	Throttled float64 `json:"throttled"` // Seconds writes waited for bandwidth
+}
+
+type Limiter struct {
+	limits Limits
+	egress *Bucket // nil if unlimited
+
+	mu      sync.Mutex
+	clients map[string]int
+
+	active, served, rejected, sent, throttled atomic.Int64
+}
+
+func New(limits Limits) *Limiter {
+	l := &Limiter{limits: limits, clients: make(map[string]int)}
+	if limits.EgressRate > 0 {
+		l.egress = NewBucket(limits.EgressRate)
+	}
+	return l
+}
+
+// Acquire counts a stream of client. It returns false if the client
+// already has as many as it may; otherwise release must be called once the
+// stream is done.
+func (l *Limiter) Acquire(client string) (release func(), ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.limits.PerClient > 0 && l.clients[client] >= l.limits.PerClient {
+		l.rejected.Add(1)
+		return nil, false
+	}
+
+	l.clients[client]++
+	l.active.Add(1)
+	l.served.Add(1)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+
+			if l.clients[client]--; l.clients[client] <= 0 {
+				delete(l.clients, client)
+			}
+			l.active.Add(-1)
+		})
+	}, true
+}
+
+// ResponseWriter wraps w to shape what is written to it to the stream and
+// egress rates, giving up once ctx is done. It deliberately doesn't
+// implement io.ReaderFrom, which would let copies bypass the shaping.
+func (l *Limiter) ResponseWriter(ctx context.Context, w http.ResponseWriter) http.ResponseWriter {
+	shaped := &responseWriter{ResponseWriter: w, ctx: ctx, limiter: l}
+	if l.limits.StreamRate > 0 {
+		shaped.stream = NewBucket(l.limits.StreamRate)
+	}
+	return shaped
+}
+
+// Metrics returns the current figures
+func (l *Limiter) Metrics() Metrics {
+	l.mu.Lock()
+	clients := len(l.clients)
+	l.mu.Unlock()
+
+	return Metrics{
+		Limits:    l.limits,
+		Active:    l.active.Load(),
+		Clients:   clients,
+		Served:    l.served.Load(),
+		Rejected:  l.rejected.Load(),
+		BytesSent: l.sent.Load(),
+		Throttled: time.Duration(l.throttled.Load()).Seconds(),
+	}
+}
+
+type responseWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	limiter *Limiter
+	stream  *Bucket // nil if unlimited
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if w.stream == nil && w.limiter.egress == nil {
+		n, err := w.ResponseWriter.Write(p)
+		w.limiter.sent.Add(int64(n))
+		return n, err
+	}
+
+	chunk := maxChunk
+	for _, bucket := range []*Bucket{w.stream, w.limiter.egress} {
+		if bucket != nil {
+			chunk = max(min(chunk, bucket.Burst()), 1)
+		}
+	}
+
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), chunk)
+
+		var delay time.Duration
+		for _, bucket := range []*Bucket{w.stream, w.limiter.egress} {
+			if bucket != nil {
+				delay = max(delay, bucket.reserve(n))
+			}
+		}
+		if delay > 0 {
+			w.limiter.throttled.Add(int64(delay))
+			if err := wait(w.ctx, delay); err != nil {
+				return written, err
+			}
+		}
+
+		m, err := w.ResponseWriter.Write(p[:n])
+		written += m
+		w.limiter.sent.Add(int64(m))
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,100 @@
+package streamlimit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAcquire(t *testing.T) {
+	l := New(Limits{PerClient: 2})
+
+	first, ok := l.Acquire("a")
+	if !ok {
+		t.Fatal("first stream refused")
+	}
+	if _, ok := l.Acquire("a"); !ok {
+		t.Fatal("second stream refused")
+	}
+	if _, ok := l.Acquire("a"); ok {
+		t.Error("third stream of a client accepted")
+	}
+	if _, ok := l.Acquire("b"); !ok {
+		t.Error("another client refused")
+	}
+
+	// Releasing twice frees one slot
+	first()
+	first()
+	if _, ok := l.Acquire("a"); !ok {
+		t.Error("released slot not reused")
+	}
+	if _, ok := l.Acquire("a"); ok {
+		t.Error("a release counted twice")
+	}
+
+	want := Metrics{Limits: Limits{PerClient: 2}, Active: 3, Clients: 2, Served: 4, Rejected: 2}
+	if got := l.Metrics(); got != want {
+		t.Errorf("Metrics = %+v, want %+v", got, want)
+	}
+}
+
+func TestResponseWriterShapes(t *testing.T) {
+	content := bytes.Repeat([]byte("whale"), 6000) // 30000 bytes
+
+	tests := []struct {
+		name     string
+		limits   Limits
+		throttle bool
+	}{
+		{"unlimited", Limits{}, false},
+		{"stream rate", Limits{StreamRate: 20000}, true},
+		{"egress rate", Limits{EgressRate: 20000}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := New(tt.limits)
+			rec := httptest.NewRecorder()
+			w := l.ResponseWriter(t.Context(), rec)
+
+			// A full bucket sends 20000 at once, the rest waits half a second
+			start := time.Now()
+			if n, err := w.Write(content); n != len(content) || err != nil {
+				t.Fatalf("Write = %d, %v", n, err)
+			}
+			elapsed := time.Since(start)
+
+			if !bytes.Equal(rec.Body.Bytes(), content) {
+				t.Errorf("wrote %d bytes, want %d", rec.Body.Len(), len(content))
+			}
+			metrics := l.Metrics()
+			if metrics.BytesSent != int64(len(content)) {
+				t.Errorf("BytesSent = %d, want %d", metrics.BytesSent, len(content))
+			}
+			if tt.throttle && (elapsed < 400*time.Millisecond || metrics.Throttled < 0.4) {
+				t.Errorf("took %s, throttled %.2fs, want about 0.5s", elapsed, metrics.Throttled)
+			}
+			if !tt.throttle && metrics.Throttled != 0 {
+				t.Errorf("throttled %.2fs without limits", metrics.Throttled)
+			}
+		})
+	}
+}
+
+func TestResponseWriterGivesUp(t *testing.T) {
+	l := New(Limits{StreamRate: 1000})
+	ctx, cancel := context.WithTimeout(t.Context(), 100*time.Millisecond)
+	defer cancel()
+
+	rec := httptest.NewRecorder()
+	n, err := l.ResponseWriter(ctx, rec).Write(make([]byte, 5000))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Write = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if n != 1000 || rec.Body.Len() != 1000 {
+		t.Errorf("wrote %d bytes, %d reached the client, want the burst of 1000", n, rec.Body.Len())
+	}
+}
@@ -0,0 +1,74 @@
+package transcode
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Fake is a Transcoder for tests. It writes a header naming the options
+// followed by the unchanged source, and counts its calls. Segments are cut
+// every SegmentSize bytes of the source, 1 KiB if it is 0.
+type Fake struct {
+	SegmentSize int
+
+	mu    sync.Mutex
+	calls []Options
+}
+
+func (f *Fake) Transcode(ctx context.Context, src io.Reader, dst io.Writer, opts Options) error {
+	if !Supported(opts.Format) {
+		return ErrUnsupported
+	}
+	f.record(opts)
+
+	if _, err := fmt.Fprintf(dst, "FAKE %s %d\n", opts.Format, opts.Bitrate); err != nil {
+		return err
+	}
+	_, err := io.Copy(dst, src)
+	return err
+}
+
+func (f *Fake) Segment(ctx context.Context, src io.Reader, opts Options, length time.Duration, segment func(n int, r io.Reader) error) error {
+	if opts.Format != AAC && opts.Format != MP3 {
+		return ErrUnsupported
+	}
+	f.record(opts)
+
+	size := f.SegmentSize
+	if size <= 0 {
+		size = 1 << 10
+	}
+	buf := make([]byte, size)
+	for n := 0; ; n++ {
+		read, err := io.ReadFull(src, buf)
+		if read > 0 {
+			header := fmt.Sprintf("FAKE %s %d %s %d\n", opts.Format, opts.Bitrate, length, n)
+			if err := segment(n, io.MultiReader(bytes.NewReader([]byte(header)), bytes.NewReader(buf[:read]))); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (f *Fake) record(opts Options) {
+	f.mu.Lock()
+	f.calls = append(f.calls, opts)
+	f.mu.Unlock()
+}
+
+// Calls returns the options of every transcode so far
+func (f *Fake) Calls() []Options {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Options(nil), f.calls...)
+}
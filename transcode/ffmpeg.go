@@ -0,0 +1,162 @@
+package transcode
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// codecs maps formats to the ffmpeg encoder and container producing them
+var codecs = map[string][2]string{
+	Opus: {"libopus", "ogg"},
+	MP3:  {"libmp3lame", "mp3"},
+	AAC:  {"aac", "adts"},
+}
+
+// FFmpeg transcodes by running an ffmpeg binary, piping the source into it
+// and its output out of it. Cover art and tags are dropped.
+type FFmpeg struct {
+	logger *zerolog.Logger
+	path   string
+}
+
+// NewFFmpeg looks up the ffmpeg binary at path, a file name is searched in
+// $PATH
+func NewFFmpeg(logger *zerolog.Logger, path string) (*FFmpeg, error) {
+	resolved, err := exec.LookPath(path)
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg not found: %w", err)
+	}
+	return &FFmpeg{logger: logger, path: resolved}, nil
+}
+
+func (f *FFmpeg) Transcode(ctx context.Context, src io.Reader, dst io.Writer, opts Options) error {
+	codec, ok := codecs[opts.Format]
+	if !ok {
+		return ErrUnsupported
+	}
+
+	args := append(encodeArgs(codec, opts), "-f", codec[1], "pipe:1")
+	cmd := exec.CommandContext(ctx, f.path, args...)
+	var stderr bytes.Buffer
+	cmd.Stdin = src
+	cmd.Stdout = dst
+	cmd.Stderr = &stderr
+
+	f.logger.Debug().Str("format", opts.Format).Int("bitrate", opts.Bitrate).Msg("Running ffmpeg")
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("ffmpeg: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// Segment runs ffmpeg's segment muxer, which writes the segments to a
+// temporary directory and lists each on stdout as it moves on to the next.
+// A listed segment is only handed on once the one after it is listed or
+// ffmpeg exited, by then its file is surely closed.
+func (f *FFmpeg) Segment(ctx context.Context, src io.Reader, opts Options, length time.Duration, segment func(n int, r io.Reader) error) error {
+	codec, ok := codecs[opts.Format]
+	if !ok || (opts.Format != AAC && opts.Format != MP3) {
+		return ErrUnsupported
+	}
+
+	dir, err := os.MkdirTemp("", "whalio-hls-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	args := append(encodeArgs(codec, opts),
+		"-f", "segment", "-segment_format", "mpegts", "-segment_time", seconds(length), "-muxdelay", "0",
+		"-segment_list", "pipe:1", "-segment_list_type", "flat",
+		filepath.Join(dir, "%05d.ts"),
+	)
+	cmd := exec.CommandContext(ctx, f.path, args...)
+	var stderr bytes.Buffer
+	cmd.Stdin = src
+	cmd.Stderr = &stderr
+	list, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	f.logger.Debug().Str("format", opts.Format).Int("bitrate", opts.Bitrate).Dur("length", length).Msg("Running ffmpeg segmenter")
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	n := 0
+	pending := ""
+	send := func() error {
+		if pending == "" {
+			return nil
+		}
+		file, err := os.Open(filepath.Join(dir, filepath.Base(pending)))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		defer os.Remove(file.Name())
+
+		if err := segment(n, file); err != nil {
+			return err
+		}
+		n++
+		return nil
+	}
+
+	var sendErr error
+	scanner := bufio.NewScanner(list)
+	for scanner.Scan() {
+		if sendErr = send(); sendErr != nil {
+			// Stops ffmpeg, the rest is of no use
+			cancel()
+			break
+		}
+		pending = strings.TrimSpace(scanner.Text())
+	}
+	io.Copy(io.Discard, list)
+
+	if err := cmd.Wait(); sendErr == nil && err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("ffmpeg: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if sendErr != nil {
+		return sendErr
+	}
+	return send()
+}
+
+// encodeArgs returns the arguments reading audio from stdin and encoding it
+// with codec
+func encodeArgs(codec [2]string, opts Options) []string {
+	return []string{
+		"-hide_banner", "-nostdin", "-loglevel", "error",
+		"-i", "pipe:0",
+		"-map", "0:a:0", "-map_metadata", "-1",
+		"-c:a", codec[0], "-b:a", fmt.Sprintf("%dk", opts.Bitrate),
+	}
+}
+
+// seconds formats d for ffmpeg's time options
+func seconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
@@ -0,0 +1,56 @@
+package transcode
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"time"
+)
+
+// HLS playlists link their variants and segments relative to themselves:
+// the master playlist at ".../index.m3u8" lists "128/index.m3u8", which
+// lists "00000.ts", "00001.ts", ...
+const (
+	HLSContentType     = "application/vnd.apple.mpegurl"
+	HLSSegmentType     = "video/mp2t"
+	HLSPlaylist        = "index.m3u8"
+	HLSSegmentFormat   = AAC
+	hlsSegmentOverhead = 1.2 // MPEG-TS packaging on top of the audio bitrate
+)
+
+// HLSSegments returns how many segments of segment length a song of
+// duration is split into
+func HLSSegments(duration, segment time.Duration) int {
+	return int((duration + segment - 1) / segment)
+}
+
+// HLSSegmentName returns the file name of segment n
+func HLSSegmentName(n int) string {
+	return fmt.Sprintf("%05d.ts", n)
+}
+
+// MasterPlaylist lists a variant playlist for each bitrate, query is
+// appended to their URIs so a signed playlist links to signed variants
+func MasterPlaylist(bitrates []int, query string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-INDEPENDENT-SEGMENTS\n")
+	for _, bitrate := range bitrates {
+		fmt.Fprintf(&buf, "#EXT-X-STREAM-INF:BANDWIDTH=%d,CODECS=\"mp4a.40.2\"\n%d/%s%s\n",
+			int(float64(bitrate*1000)*hlsSegmentOverhead), bitrate, HLSPlaylist, query)
+	}
+	return buf.Bytes()
+}
+
+// MediaPlaylist lists the segments of a song of duration, all but the last
+// segment long, with query appended to their URIs
+func MediaPlaylist(duration, segment time.Duration, query string) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n",
+		int(math.Ceil(segment.Seconds())))
+	for n := range HLSSegments(duration, segment) {
+		length := min(segment, duration-time.Duration(n)*segment)
+		fmt.Fprintf(&buf, "#EXTINF:%.3f,\n%s%s\n", length.Seconds(), HLSSegmentName(n), query)
+	}
+	buf.WriteString("#EXT-X-ENDLIST\n")
+	return buf.Bytes()
+}
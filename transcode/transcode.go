@@ -0,0 +1,83 @@
+// Package transcode converts songs to other formats and bitrates for
+// streaming over slow or metered connections.
+package transcode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+)
+
+var ErrUnsupported = errors.New("unsupported transcoding format")
+
+// Formats songs can be transcoded to
+const (
+	Opus = "opus"
+	MP3  = "mp3"
+	AAC  = "aac"
+)
+
+// Formats lists every format a Transcoder has to support
+var Formats = []string{Opus, MP3, AAC}
+
+// Options select the output of a transcode
+type Options struct {
+	Format  string // One of Formats
+	Bitrate int    // In kbit/s
+}
+
+// Transcoder converts audio read from src to the format and bitrate of
+// opts, writing it to dst as it goes
+type Transcoder interface {
+	Transcode(ctx context.Context, src io.Reader, dst io.Writer, opts Options) error
+	// Segment transcodes src into HLS segments of length in one pass and
+	// calls segment with each, in order, once it is complete. Segments are
+	// MPEG-TS cut from one encode, so they play back to back without gaps.
+	// Only AAC and MP3 can be segmented.
+	Segment(ctx context.Context, src io.Reader, opts Options, length time.Duration, segment func(n int, r io.Reader) error) error
+}
+
+// Supported reports whether format is one of Formats
+func Supported(format string) bool {
+	return slices.Contains(Formats, format)
+}
+
+// CheckFormats returns an error naming the first of formats that isn't one of
+// Formats
+func CheckFormats(formats []string) error {
+	for _, format := range formats {
+		if !Supported(format) {
+			return fmt.Errorf("%w: %s (valid: %v)", ErrUnsupported, format, Formats)
+		}
+	}
+	return nil
+}
+
+// Ext returns the file extension of a format
+func Ext(format string) string {
+	switch format {
+	case Opus:
+		return ".opus"
+	case MP3:
+		return ".mp3"
+	case AAC:
+		return ".aac"
+	}
+	return ""
+}
+
+// ContentType returns the media type of a format
+func ContentType(format string) string {
+	switch format {
+	case Opus:
+		return "audio/ogg; codecs=opus"
+	case MP3:
+		return "audio/mpeg"
+	case AAC:
+		return "audio/aac"
+	}
+	return "application/octet-stream"
+}
@@ -0,0 +1,19 @@
+package transcode
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckFormats(t *testing.T) {
+	for _, formats := range [][]string{nil, {Opus}, Formats} {
+		if err := CheckFormats(formats); err != nil {
+			t.Errorf("CheckFormats(%v) = %v", formats, err)
+		}
+	}
+	for _, formats := range [][]string{{"flac"}, {Opus, "OPUS"}, {""}} {
+		if err := CheckFormats(formats); !errors.Is(err, ErrUnsupported) {
+			t.Errorf("CheckFormats(%v) = %v, want %v", formats, err, ErrUnsupported)
+		}
+	}
+}
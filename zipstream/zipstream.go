@@ -0,0 +1,126 @@
+// Package zipstream writes uncompressed ZIP archives straight from their
+// sources, without temporary files, and tells their exact size before a
+// byte is written so it can be sent as the Content-Length.
+package zipstream
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ErrSizeMismatch is returned by Write when an entry isn't as long as it
+// said, which would break the size the archive was announced with
+var ErrSizeMismatch = errors.New("zipstream: entry size changed")
+
+// Entry is a file in an archive
+type Entry struct {
+	Name     string // Path in the archive, with forward slashes
+	Size     int64
+	Modified time.Time
+	// Open returns the content, exactly Size bytes long
+	Open func(ctx context.Context) (io.ReadCloser, error)
+}
+
+// Lengths of the records archive/zip writes for stored entries
+const (
+	fileHeaderLen       = 30 // + name + extra
+	directoryHeaderLen  = 46 // + name + extra
+	directoryEndLen     = 22
+	dataDescriptorLen   = 16
+	dataDescriptor64Len = 24
+	directory64Len      = 56 + 20 // End record and locator
+	extTimeLen          = 9       // Extra field of the modification time
+	zip64ExtraLen       = 4       // + 8 per field that doesn't fit 32 bits
+
+	uint16max = 1<<16 - 1
+	uint32max = 1<<32 - 1
+)
+
+// Size returns the length of the archive Write produces for entries,
+// adding up the records archive/zip lays out around the content.
+func Size(entries []Entry) (int64, error) {
+	var offset, directory int64
+	zip64 := false
+	for _, entry := range entries {
+		if len(entry.Name) > uint16max || entry.Size < 0 {
+			return 0, fmt.Errorf("zipstream: invalid entry %.64s", entry.Name)
+		}
+
+		extra := int64(0)
+		if !entry.Modified.IsZero() {
+			extra = extTimeLen
+		}
+
+		// Local header, content and data descriptor
+		header := offset
+		offset += fileHeaderLen + int64(len(entry.Name)) + extra + entry.Size
+		if entry.Size > uint32max {
+			offset += dataDescriptor64Len
+		} else {
+			offset += dataDescriptorLen
+		}
+
+		// Central directory header, with both sizes and the header offset
+		// moved to a zip64 extra field when they reach 32 bits
+		directory += directoryHeaderLen + int64(len(entry.Name)) + extra
+		fields := int64(0)
+		if entry.Size >= uint32max {
+			fields += 2
+		}
+		if header >= uint32max {
+			fields++
+		}
+		if fields > 0 {
+			directory += zip64ExtraLen + 8*fields
+			zip64 = true
+		}
+	}
+
+	size := offset + directory + directoryEndLen
+	if zip64 || len(entries) >= uint16max || directory >= uint32max || offset >= uint32max {
+		size += directory64Len
+	}
+	return size, nil
+}
+
+// Write writes an archive of entries to w, reading one entry at a time.
+// Entries are stored rather than compressed: audio and images don't
+// compress, and it keeps the size known up front.
+func Write(ctx context.Context, w io.Writer, entries []Entry) error {
+	zw := zip.NewWriter(w)
+	for _, entry := range entries {
+		fw, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     entry.Name,
+			Method:   zip.Store,
+			Modified: entry.Modified,
+		})
+		if err != nil {
+			return err
+		}
+		if err := copyEntry(ctx, fw, entry); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func copyEntry(ctx context.Context, w io.Writer, entry Entry) error {
+	content, err := entry.Open(ctx)
+	if err != nil {
+		return fmt.Errorf("zipstream: open %s: %w", entry.Name, err)
+	}
+	defer content.Close()
+
+	_, err = io.CopyN(w, content, entry.Size)
+	if errors.Is(err, io.EOF) {
+		return fmt.Errorf("%w: %s is shorter than %d bytes", ErrSizeMismatch, entry.Name, entry.Size)
+	}
+	if err != nil {
+		return fmt.Errorf("zipstream: read %s: %w", entry.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package zipstream
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func entry(name, content string, modified time.Time) Entry {
+	return Entry{
+		Name:     name,
+		Size:     int64(len(content)),
+		Modified: modified,
+		Open: func(ctx context.Context) (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader(content)), nil
+		},
+	}
+}
+
+// zeroEntry is size zero bytes, without holding them in memory
+func zeroEntry(name string, size int64) Entry {
+	return Entry{
+		Name: name,
+		Size: size,
+		Open: func(ctx context.Context) (io.ReadCloser, error) {
+			return io.NopCloser(io.LimitReader(zeros{}, size)), nil
+		},
+	}
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+type countWriter struct {
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+func TestWrite(t *testing.T) {
+	modified := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	many := make([]Entry, 70000) // More than fit the 16 bit entry count
+	for i := range many {
+		many[i] = entry(fmt.Sprintf("%d.txt", i), "", time.Time{})
+	}
+
+	tests := []struct {
+		name    string
+		entries []Entry
+	}{
+		{"empty", nil},
+		{"one", []Entry{entry("song.mp3", "whale song", modified)}},
+		{"without time", []Entry{entry("song.mp3", "whale song", time.Time{})}},
+		{"empty file", []Entry{entry("empty", "", modified)}},
+		{"folders", []Entry{
+			entry("2020 - Album/01 - Song.mp3", strings.Repeat("a", 1000), modified),
+			entry("2020 - Album/cover.jpg", strings.Repeat("b", 100), modified),
+			entry("2021 - Album/01 - Song.flac", strings.Repeat("c", 10), modified),
+		}},
+		{"unicode", []Entry{entry("Sigur Rós/Ágætis byrjun/01 - Intro.mp3", "x", modified)}},
+		{"many", many},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			size, err := Size(tt.entries)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			if err := Write(t.Context(), &buf, tt.entries); err != nil {
+				t.Fatal(err)
+			}
+			if int64(buf.Len()) != size {
+				t.Fatalf("wrote %d bytes, Size said %d", buf.Len(), size)
+			}
+
+			zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(zr.File) != len(tt.entries) {
+				t.Fatalf("archive has %d files, want %d", len(zr.File), len(tt.entries))
+			}
+			for i, file := range zr.File {
+				want := tt.entries[i]
+				if file.Name != want.Name || file.Method != zip.Store {
+					t.Errorf("file %d is %s, method %d, want stored %s", i, file.Name, file.Method, want.Name)
+				}
+				if !want.Modified.IsZero() && !file.Modified.Equal(want.Modified) {
+					t.Errorf("%s modified %s, want %s", file.Name, file.Modified, want.Modified)
+				}
+
+				content, err := file.Open()
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := io.ReadAll(content) // Checks the CRC too
+				if err != nil {
+					t.Fatalf("%s: %v", file.Name, err)
+				}
+				source, _ := want.Open(t.Context())
+				expected, _ := io.ReadAll(source)
+				if !bytes.Equal(got, expected) {
+					t.Errorf("%s = %q, want %q", file.Name, got, expected)
+				}
+			}
+		})
+	}
+}
+
+// TestSizeZip64 checks the sizes around 4 GiB, where archive/zip switches
+// to zip64 records
+func TestSizeZip64(t *testing.T) {
+	if testing.Short() {
+		t.Skip("writes archives of over 4 GiB")
+	}
+
+	tests := []struct {
+		name    string
+		entries []Entry
+	}{
+		{"just below", []Entry{zeroEntry("a", 1<<32-2)}},
+		{"reaching 32 bits", []Entry{zeroEntry("a", 1<<32-1)}},
+		{"past 32 bits", []Entry{zeroEntry("a", 1<<32)}},
+		{"offset past 32 bits", []Entry{zeroEntry("a", 1<<31), zeroEntry("b", 1<<31), zeroEntry("c", 1)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			size, err := Size(tt.entries)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var counter countWriter
+			if err := Write(t.Context(), &counter, tt.entries); err != nil {
+				t.Fatal(err)
+			}
+			if counter.n != size {
+				t.Errorf("wrote %d bytes, Size said %d", counter.n, size)
+			}
+		})
+	}
+}
+
+func TestWriteShortEntry(t *testing.T) {
+	short := entry("song.mp3", "whale", time.Time{})
+	short.Size = 100
+
+	err := Write(t.Context(), io.Discard, []Entry{short})
+	if !errors.Is(err, ErrSizeMismatch) {
+		t.Errorf("err = %v, want %v", err, ErrSizeMismatch)
+	}
+}
+
+func TestSizeInvalid(t *testing.T) {
+	for _, e := range []Entry{
+		zeroEntry("negative", -1),
+		zeroEntry(strings.Repeat("a", 1<<16), 0),
+	} {
+		if _, err := Size([]Entry{e}); err == nil {
+			t.Errorf("Size accepted %.16s of %d bytes", e.Name, e.Size)
+		}
+	}
+}